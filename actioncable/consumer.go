@@ -0,0 +1,466 @@
+// Package actioncable is a client for Rails Action Cable with the actioncable-v1-json subprotocol on top of the plugin
+package actioncable
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// Subprotocol is the websocket subprotocol of Action Cable
+const Subprotocol = "actioncable-v1-json"
+
+// message types sent by the server
+const (
+    TypeWelcome    = "welcome"
+    TypePing       = "ping"
+    TypeConfirm    = "confirm_subscription"
+    TypeReject     = "reject_subscription"
+    TypeDisconnect = "disconnect"
+)
+
+// commands sent by the consumer
+const (
+    CommandSubscribe   = "subscribe"
+    CommandUnsubscribe = "unsubscribe"
+    CommandMessage     = "message"
+)
+
+var (
+    // ErrStale is the error of a consumer that did not receive a ping for too long
+    ErrStale = errors.New("actioncable: connection is stale")
+
+    // ErrConsumerClosed is returned after Close
+    ErrConsumerClosed = errors.New("actioncable: consumer closed")
+
+    // ErrRejected is returned when the server rejects a subscription
+    ErrRejected = errors.New("actioncable: subscription rejected")
+
+    // ErrTimeout is returned when a subscription was not confirmed in time
+    ErrTimeout = errors.New("actioncable: subscription not confirmed in time")
+)
+
+// DisconnectError is a disconnect message of the server
+type DisconnectError struct {
+    Reason    string
+    Reconnect bool
+}
+
+func (e *DisconnectError) Error() string {
+    return fmt.Sprintf("actioncable: disconnected by the server: %s", e.Reason)
+}
+
+// message is a message sent by the server
+type message struct {
+    Type       string          `json:"type,omitempty"`
+    Identifier string          `json:"identifier,omitempty"`
+    Message    json.RawMessage `json:"message,omitempty"`
+    Reason     string          `json:"reason,omitempty"`
+    Reconnect  *bool           `json:"reconnect,omitempty"`
+}
+
+// command is a command sent by the consumer, the data of a message is a json encoded string
+type command struct {
+    Command    string `json:"command"`
+    Identifier string `json:"identifier"`
+    Data       string `json:"data,omitempty"`
+}
+
+// Config of a Consumer
+type Config struct {
+    // StaleAfter is how long the consumer waits for a ping before it drops the connection, 0 waits 6 seconds
+    StaleAfter time.Duration
+
+    // Timeout is how long Subscribe waits for the confirmation, 0 waits 10 seconds
+    Timeout time.Duration
+
+    // ConnectTimeout is the time to wait for the welcome message, 0 uses the default of the init exchange
+    ConnectTimeout time.Duration
+
+    // OnError is called for messages that can not be decoded and rejected resubscriptions, it must not block
+    OnError func(err error)
+
+    // Clock is used for the stale check and timeouts, the system clock is used when it is nil
+    Clock plugin.Clock
+}
+
+// Consumer holds the subscriptions of a Ws, they are subscribed again whenever the Ws makes a new connection
+type Consumer struct {
+    w     *plugin.Ws
+    cfg   Config
+    clock plugin.Clock
+
+    // writeLock makes sure there is only one writer
+    writeLock sync.Mutex
+
+    lock       sync.Mutex
+    subs       map[string]*Subscription
+    err        error
+    running    bool
+    closed     bool
+    stop       chan struct{}
+    gen        uint64
+    pinged     bool
+    timedOut   bool
+    disconnect *DisconnectError
+}
+
+// Subscription is a subscription to a channel
+type Subscription struct {
+    // Identifier is the json encoded identifier of the subscription
+    Identifier string
+
+    consumer  *Consumer
+    handler   func(message json.RawMessage)
+    confirmed bool
+
+    // confirm is set while Subscribe waits for the confirmation
+    confirm chan error
+}
+
+// NewConsumer create a consumer for w, the url of w must point at the cable path,
+// the OnConnect hook of w is wrapped to subscribe again
+func NewConsumer(w *plugin.Ws, cfg Config) *Consumer {
+    if cfg.StaleAfter <= 0 {
+        cfg.StaleAfter = 6 * time.Second
+    }
+    if cfg.Timeout <= 0 {
+        cfg.Timeout = 10 * time.Second
+    }
+    if cfg.Clock == nil {
+        cfg.Clock = plugin.SystemClock
+    }
+    c := &Consumer{
+        w:     w,
+        cfg:   cfg,
+        clock: cfg.Clock,
+        subs:  map[string]*Subscription{},
+        stop:  make(chan struct{}),
+    }
+    w.SetSubprotocols(Subprotocol)
+    w.SetInitExchange(plugin.InitExchange{Accept: c.accept, Timeout: cfg.ConnectTimeout})
+    hooks := w.Hooks()
+    next := hooks.OnConnect
+    hooks.OnConnect = func(w *plugin.Ws, info plugin.ConnectInfo) error {
+        c.restore()
+        if next != nil {
+            return next(w, info)
+        }
+        return nil
+    }
+    w.SetHooks(hooks)
+    return c
+}
+
+// accept wait for the welcome message, a disconnect message rejects the connection
+func (c *Consumer) accept(_ int, data []byte) (bool, error) {
+    var m message
+    if err := json.Unmarshal(data, &m); err != nil {
+        return false, err
+    }
+    switch m.Type {
+    case TypeWelcome:
+        return true, nil
+    case TypeDisconnect:
+        return false, disconnectError(m)
+    }
+    return false, nil
+}
+
+func disconnectError(m message) *DisconnectError {
+    return &DisconnectError{Reason: m.Reason, Reconnect: m.Reconnect == nil || *m.Reconnect}
+}
+
+// Connect make the connection, wait for the welcome message and start reading messages
+func (c *Consumer) Connect(ctx context.Context) error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return ErrConsumerClosed
+    }
+    c.lock.Unlock()
+    if err := c.w.ConnectContext(ctx); err != nil {
+        return err
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.err = nil
+    if !c.running {
+        c.running = true
+        go c.readLoop()
+    }
+    return nil
+}
+
+// Err return why the consumer stopped reading, it is nil while it runs
+func (c *Consumer) Err() error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.err
+}
+
+// Close the connection, the subscriptions are not made again
+func (c *Consumer) Close() error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil
+    }
+    c.closed = true
+    close(c.stop)
+    c.lock.Unlock()
+    return c.w.Close()
+}
+
+// Subscribe to a channel and wait for the confirmation, identifier must contain the channel name,
+// handler is called on the goroutine that reads messages for every message of the subscription
+func (c *Consumer) Subscribe(ctx context.Context, identifier interface{}, handler func(message json.RawMessage)) (*Subscription, error) {
+    id, err := json.Marshal(identifier)
+    if err != nil {
+        return nil, err
+    }
+    confirm := make(chan error, 1)
+    s := &Subscription{Identifier: string(id), consumer: c, handler: handler, confirm: confirm}
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil, ErrConsumerClosed
+    }
+    if _, ok := c.subs[s.Identifier]; ok {
+        c.lock.Unlock()
+        return nil, fmt.Errorf("actioncable: already subscribed to %s", s.Identifier)
+    }
+    c.subs[s.Identifier] = s
+    c.lock.Unlock()
+    if err := c.write(command{Command: CommandSubscribe, Identifier: s.Identifier}); err != nil {
+        c.remove(s)
+        return nil, err
+    }
+    timer := c.clock.NewTimer(c.cfg.Timeout)
+    defer timer.Stop()
+    select {
+    case err := <-confirm:
+        if err != nil {
+            c.remove(s)
+            return nil, err
+        }
+        return s, nil
+    case <-timer.C():
+        err = ErrTimeout
+    case <-ctx.Done():
+        err = ctx.Err()
+    }
+    c.remove(s)
+    _ = c.write(command{Command: CommandUnsubscribe, Identifier: s.Identifier})
+    return nil, err
+}
+
+// Confirmed return true while the subscription is confirmed by the server
+func (s *Subscription) Confirmed() bool {
+    s.consumer.lock.Lock()
+    defer s.consumer.lock.Unlock()
+    return s.confirmed
+}
+
+// Send data to the subscription, it is received by the receive method of the channel
+func (s *Subscription) Send(data interface{}) error {
+    d, err := json.Marshal(data)
+    if err != nil {
+        return err
+    }
+    return s.consumer.write(command{Command: CommandMessage, Identifier: s.Identifier, Data: string(d)})
+}
+
+// Perform call an action of the channel with data as its arguments
+func (s *Subscription) Perform(action string, data map[string]interface{}) error {
+    args := map[string]interface{}{}
+    for k, v := range data {
+        args[k] = v
+    }
+    args["action"] = action
+    return s.Send(args)
+}
+
+// Unsubscribe remove the subscription
+func (s *Subscription) Unsubscribe() error {
+    s.consumer.remove(s)
+    return s.consumer.write(command{Command: CommandUnsubscribe, Identifier: s.Identifier})
+}
+
+// remove a subscription
+func (c *Consumer) remove(s *Subscription) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.subs[s.Identifier] == s {
+        delete(c.subs, s.Identifier)
+    }
+    s.confirmed = false
+    s.confirm = nil
+}
+
+// write a command
+func (c *Consumer) write(cmd command) error {
+    c.writeLock.Lock()
+    defer c.writeLock.Unlock()
+    return c.w.WriteJSON(cmd)
+}
+
+// restore subscribe again after a new connection and start the stale check,
+// the subscribes are written on another goroutine because a write that reconnected still holds the write lock
+func (c *Consumer) restore() {
+    c.lock.Lock()
+    c.gen++
+    gen := c.gen
+    c.timedOut = false
+    c.pinged = true
+    var ids []string
+    for id, s := range c.subs {
+        if s.confirmed {
+            s.confirmed = false
+            ids = append(ids, id)
+        }
+    }
+    c.lock.Unlock()
+    sort.Strings(ids)
+    if len(ids) > 0 {
+        go func() {
+            for _, id := range ids {
+                _ = c.write(command{Command: CommandSubscribe, Identifier: id})
+            }
+        }()
+    }
+    go c.watchPings(gen)
+}
+
+// readLoop read messages until the connection fails and is not made again
+func (c *Consumer) readLoop() {
+    for {
+        conn := c.w.ConnID()
+        _, d, err := c.w.Read()
+        if err != nil {
+            c.lock.Lock()
+            stopped := c.closed || c.timedOut || c.disconnect != nil
+            c.lock.Unlock()
+            if !stopped && c.w.Reconnected(conn) {
+                // the plugin reconnected while reading
+                continue
+            }
+            c.fail(err)
+            return
+        }
+        var m message
+        if err := json.Unmarshal(d, &m); err != nil {
+            c.report(err)
+            continue
+        }
+        c.dispatch(m)
+    }
+}
+
+// dispatch a message received from the server
+func (c *Consumer) dispatch(m message) {
+    c.lock.Lock()
+    switch m.Type {
+    case TypeWelcome, TypePing:
+        c.pinged = true
+        c.lock.Unlock()
+        return
+    case TypeDisconnect:
+        err := disconnectError(m)
+        if !err.Reconnect {
+            c.disconnect = err
+        }
+        c.lock.Unlock()
+        if !err.Reconnect {
+            _ = c.w.Close()
+        }
+        return
+    }
+    s := c.subs[m.Identifier]
+    if s == nil {
+        c.lock.Unlock()
+        return
+    }
+    switch m.Type {
+    case TypeConfirm:
+        s.confirmed = true
+        if s.confirm != nil {
+            s.confirm <- nil
+            s.confirm = nil
+        }
+        c.lock.Unlock()
+        return
+    case TypeReject:
+        delete(c.subs, m.Identifier)
+        confirm := s.confirm
+        s.confirm = nil
+        c.lock.Unlock()
+        err := fmt.Errorf("%w: %s", ErrRejected, m.Identifier)
+        if confirm != nil {
+            confirm <- err
+        } else {
+            // a resubscription was rejected
+            c.report(err)
+        }
+        return
+    }
+    c.lock.Unlock()
+    if m.Message != nil && s.handler != nil {
+        s.handler(m.Message)
+    }
+}
+
+// report an error to OnError
+func (c *Consumer) report(err error) {
+    if c.cfg.OnError != nil {
+        c.cfg.OnError(err)
+    }
+}
+
+// fail stop reading
+func (c *Consumer) fail(err error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.timedOut {
+        err = ErrStale
+    } else if c.disconnect != nil {
+        err = c.disconnect
+    } else if c.closed {
+        err = ErrConsumerClosed
+    }
+    c.err = err
+    c.running = false
+    c.gen++
+}
+
+// watchPings drop the connection when no ping arrived during a whole StaleAfter
+func (c *Consumer) watchPings(gen uint64) {
+    for {
+        timer := c.clock.NewTimer(c.cfg.StaleAfter)
+        select {
+        case <-timer.C():
+        case <-c.stop:
+            timer.Stop()
+            return
+        }
+        c.lock.Lock()
+        if c.gen != gen {
+            c.lock.Unlock()
+            return
+        }
+        stale := !c.pinged
+        c.pinged = false
+        c.timedOut = stale
+        c.lock.Unlock()
+        if stale {
+            _ = c.w.Close()
+            return
+        }
+    }
+}
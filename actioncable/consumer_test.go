@@ -0,0 +1,269 @@
+package actioncable
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+// server is a small Action Cable server for the tests, the channel Secret is rejected,
+// the action speak is broadcast to the subscription, ping sends a ping and kick sends a disconnect
+type server struct {
+    srv    *wstest.Server
+    reject bool
+
+    lock sync.Mutex
+    log  []string
+}
+
+func newServer(t *testing.T) *server {
+    s := &server{}
+    s.srv = wstest.NewServer(s.serve)
+    s.srv.Upgrader.Subprotocols = []string{Subprotocol}
+    t.Cleanup(s.srv.Close)
+    return s
+}
+
+func (s *server) record(c *wstest.Conn, format string, args ...interface{}) {
+    s.lock.Lock()
+    s.log = append(s.log, fmt.Sprintf("%d ", c.Index)+fmt.Sprintf(format, args...))
+    s.lock.Unlock()
+}
+
+// waitFor wait until the server logged an entry
+func (s *server) waitFor(t *testing.T, entry string) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        s.lock.Lock()
+        for _, e := range s.log {
+            if e == entry {
+                s.lock.Unlock()
+                return
+            }
+        }
+        s.lock.Unlock()
+        time.Sleep(time.Millisecond)
+    }
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    t.Fatalf("server got %q, want %q", s.log, entry)
+}
+
+func (s *server) serve(c *wstest.Conn) {
+    if s.reject {
+        _ = c.WriteJSON(map[string]interface{}{"type": TypeDisconnect, "reason": "unauthorized", "reconnect": false})
+        return
+    }
+    _ = c.WriteJSON(message{Type: TypeWelcome})
+    for {
+        _, d, err := c.Receive()
+        if err != nil {
+            return
+        }
+        var cmd command
+        if err := json.Unmarshal(d, &cmd); err != nil {
+            return
+        }
+        var id struct{ Channel string }
+        _ = json.Unmarshal([]byte(cmd.Identifier), &id)
+        switch cmd.Command {
+        case CommandSubscribe:
+            s.record(c, "subscribe %s", cmd.Identifier)
+            if id.Channel == "Secret" {
+                _ = c.WriteJSON(message{Type: TypeReject, Identifier: cmd.Identifier})
+                continue
+            }
+            _ = c.WriteJSON(message{Type: TypeConfirm, Identifier: cmd.Identifier})
+        case CommandUnsubscribe:
+            s.record(c, "unsubscribe %s", cmd.Identifier)
+        case CommandMessage:
+            s.record(c, "message %s", cmd.Data)
+            var data struct {
+                Action string
+                Body   string
+            }
+            _ = json.Unmarshal([]byte(cmd.Data), &data)
+            switch data.Action {
+            case "speak":
+                msg, _ := json.Marshal(map[string]interface{}{"conn": c.Index, "body": data.Body})
+                _ = c.WriteJSON(message{Identifier: cmd.Identifier, Message: msg})
+            case "ping":
+                _ = c.WriteJSON(map[string]interface{}{"type": TypePing, "message": time.Now().Unix()})
+            case "kick":
+                _ = c.WriteJSON(map[string]interface{}{"type": TypeDisconnect, "reason": "remote", "reconnect": false})
+            }
+        }
+    }
+}
+
+// newTestConsumer connect a consumer to the server
+func newTestConsumer(t *testing.T, s *server, cfg Config, setup func(w *plugin.Ws)) *Consumer {
+    w := &plugin.Ws{}
+    w.SetUrl("ws", s.srv.Host, "/cable")
+    if setup != nil {
+        setup(w)
+    }
+    c := NewConsumer(w, cfg)
+    if err := c.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { c.Close() })
+    return c
+}
+
+// receive wait for a message of a subscription
+func receive(t *testing.T, ch <-chan json.RawMessage) string {
+    t.Helper()
+    select {
+    case m := <-ch:
+        return string(m)
+    case <-time.After(5 * time.Second):
+        t.Fatal("no message received")
+        return ""
+    }
+}
+
+// waitErr wait until the consumer stopped
+func waitErr(c *Consumer) error {
+    deadline := time.Now().Add(5 * time.Second)
+    for c.Err() == nil && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    return c.Err()
+}
+
+func TestConsumer_Connect_rejected(t *testing.T) {
+    s := newServer(t)
+    s.reject = true
+    w := &plugin.Ws{}
+    w.SetUrl("ws", s.srv.Host, "/cable")
+    err := NewConsumer(w, Config{}).Connect(context.Background())
+    if !errors.Is(err, plugin.ErrInitRejected) {
+        t.Errorf("Connect() error = %v, want %v", err, plugin.ErrInitRejected)
+    }
+}
+
+func TestConsumer_Subscribe(t *testing.T) {
+    s := newServer(t)
+    c := newTestConsumer(t, s, Config{}, nil)
+    got := make(chan json.RawMessage, 1)
+    sub, err := c.Subscribe(context.Background(), map[string]string{"channel": "ChatChannel", "room": "1"}, func(m json.RawMessage) { got <- m })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if sub.Identifier != `{"channel":"ChatChannel","room":"1"}` || !sub.Confirmed() {
+        t.Errorf("Identifier, Confirmed() = %s, %v", sub.Identifier, sub.Confirmed())
+    }
+    if err := sub.Perform("speak", map[string]interface{}{"body": "hi"}); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, `1 message {"action":"speak","body":"hi"}`)
+    if m := receive(t, got); m != `{"body":"hi","conn":1}` {
+        t.Errorf("message = %s", m)
+    }
+    if _, err := c.Subscribe(context.Background(), map[string]string{"channel": "ChatChannel", "room": "1"}, nil); err == nil {
+        t.Error("Subscribe() accepted the same identifier twice")
+    }
+}
+
+func TestConsumer_Subscribe_rejected(t *testing.T) {
+    s := newServer(t)
+    c := newTestConsumer(t, s, Config{}, nil)
+    if _, err := c.Subscribe(context.Background(), map[string]string{"channel": "Secret"}, nil); !errors.Is(err, ErrRejected) {
+        t.Errorf("Subscribe() error = %v, want %v", err, ErrRejected)
+    }
+}
+
+func TestSubscription_Unsubscribe(t *testing.T) {
+    s := newServer(t)
+    c := newTestConsumer(t, s, Config{}, nil)
+    sub, err := c.Subscribe(context.Background(), map[string]string{"channel": "ChatChannel"}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := sub.Unsubscribe(); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, `1 unsubscribe {"channel":"ChatChannel"}`)
+    if sub.Confirmed() {
+        t.Error("Confirmed() = true after Unsubscribe()")
+    }
+}
+
+func TestConsumer_disconnect(t *testing.T) {
+    s := newServer(t)
+    c := newTestConsumer(t, s, Config{}, func(w *plugin.Ws) { w.Reconnect(true) })
+    sub, err := c.Subscribe(context.Background(), map[string]string{"channel": "ChatChannel"}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := sub.Perform("kick", nil); err != nil {
+        t.Fatal(err)
+    }
+    var de *DisconnectError
+    if err := waitErr(c); !errors.As(err, &de) || de.Reason != "remote" || de.Reconnect {
+        t.Errorf("Err() = %v, want the disconnect", err)
+    }
+}
+
+func TestConsumer_stale(t *testing.T) {
+    s := newServer(t)
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    c := newTestConsumer(t, s, Config{StaleAfter: 6 * time.Second, Clock: clock}, func(w *plugin.Ws) { w.Reconnect(true) })
+    sub, err := c.Subscribe(context.Background(), map[string]string{"channel": "ChatChannel"}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the welcome counts as a ping
+    clock.BlockUntil(1)
+    clock.Advance(6 * time.Second)
+    if err := sub.Perform("ping", nil); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, `1 message {"action":"ping"}`)
+    // wait until the ping is read
+    if err := sub.Perform("speak", nil); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, `1 message {"action":"speak"}`)
+    clock.BlockUntil(1)
+    clock.Advance(6 * time.Second)
+    if c.Err() != nil {
+        t.Fatalf("Err() = %v after a ping", c.Err())
+    }
+    clock.BlockUntil(1)
+    clock.Advance(6 * time.Second)
+    if err := waitErr(c); !errors.Is(err, ErrStale) {
+        t.Errorf("Err() = %v, want %v", err, ErrStale)
+    }
+}
+
+func TestConsumer_resubscribe(t *testing.T) {
+    s := newServer(t)
+    c := newTestConsumer(t, s, Config{}, func(w *plugin.Ws) { w.Reconnect(true) })
+    got := make(chan json.RawMessage, 1)
+    sub, err := c.Subscribe(context.Background(), map[string]string{"channel": "ChatChannel"}, func(m json.RawMessage) { got <- m })
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.srv.CloseConnections()
+    s.waitFor(t, `2 subscribe {"channel":"ChatChannel"}`)
+    deadline := time.Now().Add(5 * time.Second)
+    for !sub.Confirmed() && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if err := sub.Perform("speak", map[string]interface{}{"body": "again"}); err != nil {
+        t.Fatal(err)
+    }
+    if m := receive(t, got); m != `{"body":"again","conn":2}` {
+        t.Errorf("message = %s after the reconnect", m)
+    }
+}
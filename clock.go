@@ -0,0 +1,266 @@
+package websocket
+
+import (
+    "context"
+    "net"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Clock is the source of time for sleeps, timers and timeouts, it can be replaced to test timing without waiting
+type Clock interface {
+    Now() time.Time
+    Sleep(d time.Duration)
+    After(d time.Duration) <-chan time.Time
+    NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer made by a Clock
+type Timer interface {
+    C() <-chan time.Time
+    Stop() bool
+    Reset(d time.Duration) bool
+}
+
+// SystemClock is the wall clock, it is used when no clock is set
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) NewTimer(d time.Duration) Timer         { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct {
+    t *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time        { return t.t.C }
+func (t systemTimer) Stop() bool                 { return t.t.Stop() }
+func (t systemTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+// SetClock set the clock used for reconnect delays, queue retries, handshake and init timeouts and the scheduler
+func (w *Ws) SetClock(c Clock) {
+    w.clock = c
+}
+
+// Clock return the clock that is set or the system clock, layers on top of the plugin use it for their timers
+func (w *Ws) Clock() Clock {
+    return w.getClock()
+}
+
+// now return the current time of the clock
+func (w *Ws) now() time.Time {
+    return w.getClock().Now()
+}
+
+// getClock return the clock that is set or the system clock
+func (w *Ws) getClock() Clock {
+    if w.clock == nil {
+        return SystemClock
+    }
+    return w.clock
+}
+
+// expiry ends the network operations on a connection that take longer than a timeout on the clock,
+// the deadline of the connection is moved into the past when the timer fires
+type expiry struct {
+    lock    sync.Mutex
+    timer   Timer
+    cancel  context.CancelFunc
+    stopped chan struct{}
+    conn    net.Conn
+    fired   bool
+    done    bool
+}
+
+// newExpiry start a timer of d on the clock, cancel is called when it fires and may be nil
+func newExpiry(c Clock, d time.Duration, cancel context.CancelFunc) *expiry {
+    e := &expiry{timer: c.NewTimer(d), cancel: cancel, stopped: make(chan struct{})}
+    go func() {
+        select {
+        case <-e.timer.C():
+            e.expire()
+        case <-e.stopped:
+        }
+    }()
+    return e
+}
+
+// startHandshakeTimer start an expiry for a dial and handshake, the returned context and dial function must be used
+func startHandshakeTimer(ctx context.Context, c Clock, d time.Duration,
+    dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) (context.Context, func(ctx context.Context, network, addr string) (net.Conn, error), *expiry) {
+    if dial == nil {
+        dial = (&net.Dialer{}).DialContext
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    e := newExpiry(c, d, cancel)
+    wrapped := func(ctx context.Context, network, addr string) (net.Conn, error) {
+        nc, err := dial(ctx, network, addr)
+        if err == nil {
+            e.setConn(nc)
+        }
+        return nc, err
+    }
+    return ctx, wrapped, e
+}
+
+// setConn set the connection to expire, it expires right away when the timer already fired
+func (e *expiry) setConn(nc net.Conn) {
+    e.lock.Lock()
+    defer e.lock.Unlock()
+    e.conn = nc
+    if e.fired && !e.done {
+        _ = nc.SetDeadline(time.Unix(1, 0))
+    }
+}
+
+// expire cancel the context and fail every pending read and write
+func (e *expiry) expire() {
+    e.lock.Lock()
+    defer e.lock.Unlock()
+    if e.done {
+        return
+    }
+    e.fired = true
+    if e.cancel != nil {
+        e.cancel()
+    }
+    if e.conn != nil {
+        _ = e.conn.SetDeadline(time.Unix(1, 0))
+    }
+}
+
+// stop the timer once the operation is over, when ok a deadline set by a late timer is cleared again
+func (e *expiry) stop(ok bool) {
+    e.lock.Lock()
+    defer e.lock.Unlock()
+    if e.done {
+        return
+    }
+    e.done = true
+    close(e.stopped)
+    e.timer.Stop()
+    if e.cancel != nil {
+        e.cancel()
+    }
+    if ok && e.fired && e.conn != nil {
+        _ = e.conn.SetDeadline(time.Time{})
+    }
+}
+
+// FakeClock is a clock that only moves when Advance is called, timers fire in the order of their deadline
+type FakeClock struct {
+    lock    sync.Mutex
+    changed *sync.Cond
+    now     time.Time
+    timers  []*fakeTimer
+}
+
+// NewFakeClock create a fake clock that starts at start
+func NewFakeClock(start time.Time) *FakeClock {
+    c := &FakeClock{now: start}
+    c.changed = sync.NewCond(&c.lock)
+    return c
+}
+
+// Now return the time of the clock
+func (c *FakeClock) Now() time.Time {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.now
+}
+
+// Sleep block until the clock has been advanced by d
+func (c *FakeClock) Sleep(d time.Duration) {
+    <-c.NewTimer(d).C()
+}
+
+// After return a channel that receives the time once the clock has been advanced by d
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+    return c.NewTimer(d).C()
+}
+
+// NewTimer create a timer that fires once the clock has been advanced by d
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+    t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+    t.Reset(d)
+    return t
+}
+
+// Advance move the clock forward and fire the timers that are due
+func (c *FakeClock) Advance(d time.Duration) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.now = c.now.Add(d)
+    c.fire()
+}
+
+// Waiters return the number of timers and sleeps that have not fired yet
+func (c *FakeClock) Waiters() int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return len(c.timers)
+}
+
+// BlockUntil wait until at least n timers or sleeps are waiting on the clock
+func (c *FakeClock) BlockUntil(n int) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    for len(c.timers) < n {
+        c.changed.Wait()
+    }
+}
+
+// fire send the time to every timer that is due, the lock must be held
+func (c *FakeClock) fire() {
+    sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+    for len(c.timers) > 0 && !c.timers[0].at.After(c.now) {
+        t := c.timers[0]
+        c.timers = c.timers[1:]
+        select {
+        case t.c <- c.now:
+        default:
+        }
+    }
+}
+
+// remove a timer, the lock must be held
+func (c *FakeClock) remove(t *fakeTimer) bool {
+    for i, o := range c.timers {
+        if o == t {
+            c.timers = append(c.timers[:i], c.timers[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+type fakeTimer struct {
+    clock *FakeClock
+    c     chan time.Time
+    at    time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+    t.clock.lock.Lock()
+    defer t.clock.lock.Unlock()
+    return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+    c := t.clock
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    active := c.remove(t)
+    t.at = c.now.Add(d)
+    c.timers = append(c.timers, t)
+    c.changed.Broadcast()
+    c.fire()
+    return active
+}
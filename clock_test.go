@@ -0,0 +1,223 @@
+package websocket
+
+import (
+    "errors"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+func TestFakeClock(t *testing.T) {
+    tests := []struct {
+        name    string
+        timers  []time.Duration
+        stop    int
+        advance []time.Duration
+        want    []bool
+    }{
+        {name: "nothing due", timers: []time.Duration{time.Second}, stop: -1, advance: []time.Duration{999 * time.Millisecond}, want: []bool{false}},
+        {name: "due at the deadline", timers: []time.Duration{time.Second}, stop: -1, advance: []time.Duration{time.Second}, want: []bool{true}},
+        {name: "zero fires right away", timers: []time.Duration{0}, stop: -1, want: []bool{true}},
+        {name: "in steps", timers: []time.Duration{time.Second, 3 * time.Second}, stop: -1, advance: []time.Duration{time.Second, time.Second}, want: []bool{true, false}},
+        {name: "stopped", timers: []time.Duration{time.Second, time.Second}, stop: 0, advance: []time.Duration{time.Minute}, want: []bool{false, true}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            start := time.Unix(1000, 0)
+            c := NewFakeClock(start)
+            var timers []Timer
+            for _, d := range tt.timers {
+                timers = append(timers, c.NewTimer(d))
+            }
+            if tt.stop >= 0 && !timers[tt.stop].Stop() {
+                t.Errorf("Stop() = false for a pending timer")
+            }
+            var total time.Duration
+            for _, d := range tt.advance {
+                c.Advance(d)
+                total += d
+            }
+            if got := c.Now(); !got.Equal(start.Add(total)) {
+                t.Errorf("Now() = %v, want %v", got, start.Add(total))
+            }
+            for i, timer := range timers {
+                select {
+                case <-timer.C():
+                    if !tt.want[i] {
+                        t.Errorf("timer %d fired", i)
+                    }
+                default:
+                    if tt.want[i] {
+                        t.Errorf("timer %d did not fire", i)
+                    }
+                }
+            }
+        })
+    }
+}
+
+func TestFakeClock_Sleep(t *testing.T) {
+    c := NewFakeClock(time.Unix(0, 0))
+    done := make(chan struct{})
+    go func() {
+        c.Sleep(time.Hour)
+        close(done)
+    }()
+    c.BlockUntil(1)
+    c.Advance(59 * time.Minute)
+    select {
+    case <-done:
+        t.Fatal("Sleep() returned before the clock reached its end")
+    default:
+    }
+    c.Advance(time.Minute)
+    <-done
+    if got := c.Waiters(); got != 0 {
+        t.Errorf("Waiters() = %v after the sleep ended, want 0", got)
+    }
+}
+
+func TestWs_SetClock_reconnectDelay(t *testing.T) {
+    srv := wstest.NewServer(wstest.Sequence(
+        wstest.Script(wstest.CloseWith(websocket.CloseTryAgainLater, "busy")),
+        wstest.Script(wstest.Drain()),
+    ))
+    defer srv.Close()
+    c := NewFakeClock(time.Unix(0, 0))
+    w := &Ws{}
+    w.SetClock(c)
+    w.SetUrl("ws", srv.Host, "/")
+    w.Reconnect(true)
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+    done := make(chan error, 1)
+    go func() {
+        _, _, err := w.Read()
+        done <- err
+    }()
+    c.BlockUntil(1)
+    if got := srv.Connections(); got != 1 {
+        t.Errorf("reconnected before the delay, %v connections", got)
+    }
+    c.Advance(5 * time.Second)
+    if err := <-done; err == nil {
+        t.Errorf("Read() did not report the close")
+    }
+    if got := srv.Connections(); got != 2 {
+        t.Errorf("made %v connections after the delay, want 2", got)
+    }
+}
+
+func TestWs_SetClock_writeQueueRetry(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer srv.Close()
+    c := NewFakeClock(time.Unix(0, 0))
+    w := &Ws{}
+    w.SetClock(c)
+    defer w.Close()
+    q := make(chan []byte, 2)
+    e := make(chan error, 2)
+    q <- []byte("retry")
+    w.WriteQueue(q, e)
+    <-e
+    c.BlockUntil(1)
+    w.SetUrl("ws", srv.Host, "/")
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    c.Advance(time.Second)
+    if !srv.WaitFor(1, time.Second) {
+        t.Fatalf("WriteQueue() did not retry after a second on the clock")
+    }
+    if got := string(srv.Received()[0].Data); got != "retry" {
+        t.Errorf("WriteQueue() sent %v, want retry", got)
+    }
+    close(q)
+}
+
+func TestWs_SetClock_initTimeout(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer srv.Close()
+    c := NewFakeClock(time.Unix(0, 0))
+    w := &Ws{}
+    w.SetClock(c)
+    w.SetUrl("ws", srv.Host, "/")
+    w.SetInitExchange(InitExchange{
+        Messages: [][]byte{[]byte("hello")},
+        Accept:   func(int, []byte) (bool, error) { return true, nil },
+        Timeout:  time.Minute,
+    })
+    done := make(chan error, 1)
+    go func() { done <- w.Connect() }()
+    c.BlockUntil(1)
+    c.Advance(time.Minute)
+    if err := <-done; !errors.Is(err, ErrInitTimeout) {
+        t.Errorf("Connect() error = %v, want %v", err, ErrInitTimeout)
+    }
+}
+
+func TestWs_SetClock_handshakeTimeout(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    // accept connections and never answer the tls handshake
+    go func() {
+        for {
+            nc, err := l.Accept()
+            if err != nil {
+                return
+            }
+            defer nc.Close()
+        }
+    }()
+    c := NewFakeClock(time.Unix(0, 0))
+    w := &Ws{}
+    w.SetClock(c)
+    w.SetSecure(true)
+    w.SetUrl("wss", l.Addr().String(), "/")
+    done := make(chan error, 1)
+    go func() { done <- w.Connect() }()
+    c.BlockUntil(1)
+    c.Advance(30 * time.Second)
+    select {
+    case err := <-done:
+        if !errors.Is(err, ErrDialFailed) {
+            t.Errorf("Connect() error = %v, want %v", err, ErrDialFailed)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Connect() did not time out on the clock")
+    }
+}
+
+func TestScheduler_clock(t *testing.T) {
+    w, srv := newTestWs(t, wstest.Script(wstest.Drain()))
+    c := NewFakeClock(time.Unix(0, 0))
+    w.SetClock(c)
+    s := w.NewScheduler(SchedulerConfig{MessagesPerSecond: 1, MessageBurst: 1, MaxBatch: 1})
+    defer s.Close()
+    first := s.Send(PriorityNormal, websocket.TextMessage, []byte("1"))
+    second := s.Send(PriorityNormal, websocket.TextMessage, []byte("2"))
+    if err := <-first; err != nil {
+        t.Fatal(err)
+    }
+    c.BlockUntil(1)
+    select {
+    case <-second:
+        t.Fatal("second message was sent before a token was available")
+    default:
+    }
+    c.Advance(time.Second)
+    if err := <-second; err != nil {
+        t.Fatal(err)
+    }
+    if !srv.WaitFor(2, time.Second) {
+        t.Errorf("server received %v, want 2 messages", srv.Received())
+    }
+}
@@ -0,0 +1,112 @@
+package websocket
+
+import (
+    "errors"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// CloseEvent describes the end of a connection
+type CloseEvent struct {
+    // close code and reason, connections that ended without a close frame use 1006
+    Code   int
+    Reason string
+
+    // Local is true when the connection was closed by calling Close
+    Local bool
+
+    // time between making the connection and losing it
+    Lifetime time.Duration
+
+    // ConnID is the id of the connection that ended
+    ConnID uint64
+
+    // Err is the error that ended the connection
+    Err error
+}
+
+// CloseAction tells the plugin what to do after a connection ended
+type CloseAction int
+
+const (
+    // ActionReconnect reconnect right away
+    ActionReconnect CloseAction = iota
+
+    // ActionReconnectAfter reconnect after the delay of the decision
+    ActionReconnectAfter
+
+    // ActionStop do not reconnect, the error is returned to the caller
+    ActionStop
+)
+
+// CloseDecision is returned by a close event handler
+type CloseDecision struct {
+    Action CloseAction
+    Delay  time.Duration
+}
+
+// SetCloseEventHandler set a handler that is called when a connection ends and decides if it is reconnected,
+// automatic reconnecting still has to be enabled with Reconnect
+func (w *Ws) SetCloseEventHandler(f func(CloseEvent) CloseDecision) {
+    w.closeEventHandler = f
+}
+
+// CloseEventHandler return the close event handler, it is nil when the default policy is used
+func (w *Ws) CloseEventHandler() func(CloseEvent) CloseDecision {
+    return w.closeEventHandler
+}
+
+// DefaultClosePolicy is used when no close event handler is set, it follows RetryableCloseCode:
+// local closes and codes that are not retryable stop, like a normal close by the peer or the
+// application defined 4000-4999 codes, 1013 try again later waits before reconnecting and
+// the other retryable codes reconnect right away
+func DefaultClosePolicy(e CloseEvent) CloseDecision {
+    if e.Local || !RetryableCloseCode(e.Code) {
+        return CloseDecision{Action: ActionStop}
+    }
+    if e.Code == websocket.CloseTryAgainLater {
+        return CloseDecision{Action: ActionReconnectAfter, Delay: 5 * time.Second}
+    }
+    return CloseDecision{Action: ActionReconnect}
+}
+
+// closeEvent build the close event for the error that ended the current connection
+func (w *Ws) closeEvent(err error) CloseEvent {
+    w.stateLock.Lock()
+    defer w.stateLock.Unlock()
+    e := CloseEvent{Code: websocket.CloseAbnormalClosure, Local: w.closing, ConnID: w.ConnID(), Err: err}
+    if !w.connectedAt.IsZero() {
+        e.Lifetime = w.now().Sub(w.connectedAt)
+    }
+    var ce *ClosedError
+    if errors.As(err, &ce) {
+        e.Code = ce.Code
+        e.Reason = ce.Reason
+    } else if e.Local {
+        e.Code = websocket.CloseNormalClosure
+    }
+    return e
+}
+
+// closeDecision ask the close event handler, or the default policy, what to do after e
+func (w *Ws) closeDecision(e CloseEvent) CloseDecision {
+    if w.closeEventHandler != nil {
+        return w.closeEventHandler(e)
+    }
+    return DefaultClosePolicy(e)
+}
+
+// handleClose call the close handler and echo the close frame like the gorilla default handler does
+func (w *Ws) handleClose(c *websocket.Conn) func(int, string) error {
+    return func(code int, text string) error {
+        if w.closeHandler != nil {
+            if err := w.closeHandler(code, text); err != nil {
+                return err
+            }
+        }
+        msg := websocket.FormatCloseMessage(code, "")
+        _ = c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+        return nil
+    }
+}
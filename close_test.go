@@ -0,0 +1,96 @@
+package websocket
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+func TestDefaultClosePolicy(t *testing.T) {
+    tests := []struct {
+        name  string
+        event CloseEvent
+        want  CloseDecision
+    }{
+        {name: "local close", event: CloseEvent{Code: websocket.CloseNormalClosure, Local: true}, want: CloseDecision{Action: ActionStop}},
+        {name: "abnormal closure", event: CloseEvent{Code: websocket.CloseAbnormalClosure}, want: CloseDecision{Action: ActionReconnect}},
+        {name: "going away", event: CloseEvent{Code: websocket.CloseGoingAway}, want: CloseDecision{Action: ActionReconnect}},
+        {name: "policy violation", event: CloseEvent{Code: websocket.ClosePolicyViolation}, want: CloseDecision{Action: ActionStop}},
+        {name: "protocol error", event: CloseEvent{Code: websocket.CloseProtocolError}, want: CloseDecision{Action: ActionStop}},
+        {name: "normal closure by the peer", event: CloseEvent{Code: websocket.CloseNormalClosure}, want: CloseDecision{Action: ActionStop}},
+        {name: "application code", event: CloseEvent{Code: 4003, Reason: "auth failed"}, want: CloseDecision{Action: ActionStop}},
+        {name: "last application code", event: CloseEvent{Code: 4999}, want: CloseDecision{Action: ActionStop}},
+        {name: "service restart", event: CloseEvent{Code: websocket.CloseServiceRestart}, want: CloseDecision{Action: ActionReconnect}},
+        {name: "try again later", event: CloseEvent{Code: websocket.CloseTryAgainLater}, want: CloseDecision{Action: ActionReconnectAfter, Delay: 5 * time.Second}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := DefaultClosePolicy(tt.event); got != tt.want {
+                t.Errorf("DefaultClosePolicy() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestWs_SetCloseEventHandler(t *testing.T) {
+    echoed := make(chan int, 1)
+    w, _ := newTestWs(t, func(c *wstest.Conn) {
+        msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "banned")
+        _ = c.WriteMessage(websocket.CloseMessage, msg)
+        _, _, err := c.ReadMessage()
+        var ce *websocket.CloseError
+        if errors.As(err, &ce) {
+            echoed <- ce.Code
+        }
+    })
+    var handlerCode int
+    w.SetCloseHandler(func(code int, text string) error {
+        handlerCode = code
+        return nil
+    })
+    events := make(chan CloseEvent, 1)
+    w.SetCloseEventHandler(func(e CloseEvent) CloseDecision {
+        events <- e
+        return DefaultClosePolicy(e)
+    })
+    w.Reconnect(true)
+
+    _, _, err := w.Read()
+    if !errors.Is(err, ErrClosed) {
+        t.Fatalf("Read() error = %v, want ErrClosed", err)
+    }
+    e := <-events
+    if e.Code != websocket.ClosePolicyViolation || e.Reason != "banned" || e.Local || e.ConnID != 1 || e.Lifetime <= 0 {
+        t.Errorf("close event = %+v, want a remote 1008 close of connection 1", e)
+    }
+    if handlerCode != websocket.ClosePolicyViolation {
+        t.Errorf("close handler code = %v, want %v", handlerCode, websocket.ClosePolicyViolation)
+    }
+    select {
+    case code := <-echoed:
+        if code != websocket.ClosePolicyViolation {
+            t.Errorf("echoed close code = %v, want %v", code, websocket.ClosePolicyViolation)
+        }
+    case <-time.After(time.Second):
+        t.Errorf("close frame was not echoed")
+    }
+    if got := w.Stats().Reconnects; got != 0 {
+        t.Errorf("Stats().Reconnects = %v, want no reconnect after a policy violation", got)
+    }
+}
+
+func TestWs_closeEvent_local(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Script(wstest.Echo()))
+    w.Close()
+    _, _, err := w.Read()
+    e := w.closeEvent(err)
+    if !e.Local || e.Code != websocket.CloseNormalClosure {
+        t.Errorf("closeEvent() = %+v, want a local normal closure", e)
+    }
+    if DefaultClosePolicy(e).Action != ActionStop {
+        t.Errorf("DefaultClosePolicy() does not stop after a local close")
+    }
+}
@@ -0,0 +1,150 @@
+package websocket
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+
+    "github.com/gorilla/websocket"
+)
+
+var (
+    // ErrNotConnected is returned when there is no connection and none could be made
+    ErrNotConnected = errors.New("not connected")
+
+    // ErrDialFailed is returned when the connection to the server could not be made
+    ErrDialFailed = errors.New("dial failed")
+
+    // ErrHandshakeRejected is returned when the server answered the upgrade request with an error
+    ErrHandshakeRejected = errors.New("handshake rejected")
+
+    // ErrClosed is returned when the connection was closed with a close frame
+    ErrClosed = errors.New("connection closed")
+
+    // ErrReconnectExhausted is returned when the automatic reconnect gave up
+    ErrReconnectExhausted = errors.New("reconnect attempts exhausted")
+)
+
+// NotConnectedError is returned by reads and writes when no connection could be made
+type NotConnectedError struct {
+    // Op is the operation that needed the connection, read or write
+    Op  string
+    Err error
+}
+
+func (e *NotConnectedError) Error() string {
+    return fmt.Sprintf("can not %s when there is no connection, and could not create a connection: %v", e.Op, e.Err)
+}
+
+func (e *NotConnectedError) Is(target error) bool { return target == ErrNotConnected }
+func (e *NotConnectedError) Unwrap() error        { return e.Err }
+
+// DialError is returned when dialing the server failed
+type DialError struct {
+    URL string
+    Err error
+}
+
+func (e *DialError) Error() string {
+    return fmt.Sprintf("dial %s: %v", e.URL, e.Err)
+}
+
+func (e *DialError) Is(target error) bool { return target == ErrDialFailed }
+func (e *DialError) Unwrap() error        { return e.Err }
+
+// HandshakeError is returned when the server did not accept the upgrade, it also matches ErrDialFailed
+type HandshakeError struct {
+    URL        string
+    StatusCode int
+    Status     string
+}
+
+func (e *HandshakeError) Error() string {
+    return fmt.Sprintf("dial %s: handshake rejected with status %s", e.URL, e.Status)
+}
+
+func (e *HandshakeError) Is(target error) bool {
+    return target == ErrHandshakeRejected || target == ErrDialFailed
+}
+
+func (e *HandshakeError) Unwrap() error { return websocket.ErrBadHandshake }
+
+// ClosedError is returned when the connection was closed with a close frame
+type ClosedError struct {
+    Code   int
+    Reason string
+    Err    error
+}
+
+func (e *ClosedError) Error() string {
+    return fmt.Sprintf("connection closed with code %d: %s", e.Code, e.Reason)
+}
+
+func (e *ClosedError) Is(target error) bool { return target == ErrClosed }
+func (e *ClosedError) Unwrap() error        { return e.Err }
+
+// Retryable return true when reconnecting after this close code could succeed
+func (e *ClosedError) Retryable() bool { return RetryableCloseCode(e.Code) }
+
+// ReconnectError is returned when the automatic reconnect gave up
+type ReconnectError struct {
+    Attempts int
+    Err      error
+}
+
+func (e *ReconnectError) Error() string {
+    return fmt.Sprintf("gave up reconnecting after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *ReconnectError) Is(target error) bool { return target == ErrReconnectExhausted }
+func (e *ReconnectError) Unwrap() error        { return e.Err }
+
+// RetryableCloseCode return true for the RFC 6455 close codes after which a reconnect could succeed,
+// codes that point at a problem with the client, like 1008 policy violation, are not retryable,
+// neither are the application defined 4000-4999 codes
+func RetryableCloseCode(code int) bool {
+    switch code {
+    case websocket.CloseGoingAway,
+        websocket.CloseNoStatusReceived,
+        websocket.CloseAbnormalClosure,
+        websocket.CloseInternalServerErr,
+        websocket.CloseServiceRestart,
+        websocket.CloseTryAgainLater,
+        1014: // bad gateway
+        return true
+    }
+    return false
+}
+
+// Retryable return true when an error returned by the plugin could go away after a reconnect
+func Retryable(err error) bool {
+    if err == nil {
+        return false
+    }
+    var ce *ClosedError
+    if errors.As(err, &ce) {
+        return ce.Retryable()
+    }
+    var he *HandshakeError
+    if errors.As(err, &he) {
+        return he.StatusCode >= 500 || he.StatusCode == http.StatusTooManyRequests
+    }
+    return !errors.Is(err, ErrReconnectExhausted)
+}
+
+// dialError turn an error from the dialer into a DialError or HandshakeError
+func dialError(u string, resp *http.Response, err error) error {
+    if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+        return &HandshakeError{URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+    }
+    return &DialError{URL: u, Err: err}
+}
+
+// connError wrap close frames in a ClosedError, other errors are returned unchanged
+func connError(err error) error {
+    var ce *websocket.CloseError
+    if errors.As(err, &ce) {
+        return &ClosedError{Code: ce.Code, Reason: ce.Text, Err: err}
+    }
+    return err
+}
@@ -0,0 +1,111 @@
+package websocket
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "testing"
+
+    "github.com/gorilla/websocket"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+func TestRetryableCloseCode(t *testing.T) {
+    tests := []struct {
+        name string
+        code int
+        want bool
+    }{
+        {name: "normal closure", code: websocket.CloseNormalClosure, want: false},
+        {name: "going away", code: websocket.CloseGoingAway, want: true},
+        {name: "abnormal closure", code: websocket.CloseAbnormalClosure, want: true},
+        {name: "policy violation", code: websocket.ClosePolicyViolation, want: false},
+        {name: "message too big", code: websocket.CloseMessageTooBig, want: false},
+        {name: "service restart", code: websocket.CloseServiceRestart, want: true},
+        {name: "try again later", code: websocket.CloseTryAgainLater, want: true},
+        {name: "application code", code: 4001, want: false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := RetryableCloseCode(tt.code); got != tt.want {
+                t.Errorf("RetryableCloseCode(%d) = %v, want %v", tt.code, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestRetryable(t *testing.T) {
+    tests := []struct {
+        name string
+        err  error
+        want bool
+    }{
+        {name: "nil", err: nil, want: false},
+        {name: "dial", err: &DialError{Err: errTest}, want: true},
+        {name: "forbidden", err: &HandshakeError{StatusCode: http.StatusForbidden}, want: false},
+        {name: "unavailable", err: &HandshakeError{StatusCode: http.StatusServiceUnavailable}, want: true},
+        {name: "policy violation", err: &ClosedError{Code: websocket.ClosePolicyViolation}, want: false},
+        {name: "exhausted", err: &ReconnectError{Attempts: 3, Err: errTest}, want: false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := Retryable(tt.err); got != tt.want {
+                t.Errorf("Retryable() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestWs_Connect_errors(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+        http.Error(rw, "forbidden", http.StatusForbidden)
+    }))
+    defer srv.Close()
+    u, _ := url.Parse(srv.URL)
+
+    w := &Ws{}
+    w.SetUrl("ws", u.Host, "/")
+    err := w.Connect()
+    var he *HandshakeError
+    if !errors.As(err, &he) || he.StatusCode != http.StatusForbidden {
+        t.Errorf("Connect() error = %v, want a HandshakeError with status 403", err)
+    }
+    if !errors.Is(err, ErrHandshakeRejected) || !errors.Is(err, ErrDialFailed) {
+        t.Errorf("Connect() error = %v, want ErrHandshakeRejected and ErrDialFailed", err)
+    }
+
+    srv.Close()
+    err = w.Connect()
+    if !errors.Is(err, ErrDialFailed) || errors.Is(err, ErrHandshakeRejected) {
+        t.Errorf("Connect() error = %v, want only ErrDialFailed", err)
+    }
+    err = w.WriteMessage(websocket.TextMessage, []byte("a"))
+    if !errors.Is(err, ErrNotConnected) || !errors.Is(err, ErrDialFailed) {
+        t.Errorf("WriteMessage() error = %v, want ErrNotConnected wrapping ErrDialFailed", err)
+    }
+}
+
+func TestWs_Read_closed(t *testing.T) {
+    w, srv := newTestWs(t, wstest.Script(wstest.CloseWith(websocket.ClosePolicyViolation, "bad token")))
+    _, _, err := w.Read()
+    var ce *ClosedError
+    if !errors.As(err, &ce) || ce.Code != websocket.ClosePolicyViolation || ce.Reason != "bad token" {
+        t.Fatalf("Read() error = %v, want a ClosedError with code 1008", err)
+    }
+    if !errors.Is(err, ErrClosed) {
+        t.Errorf("Read() error = %v, want ErrClosed", err)
+    }
+
+    // the end of a connection is handled once, a new one is closed to test the reconnect
+    w, srv = newTestWs(t, wstest.Script(wstest.CloseWith(websocket.ClosePolicyViolation, "bad token")))
+    srv.Close()
+    w.Reconnect(true)
+    w.SetMaxReconnectAttempts(1)
+    w.SetCloseEventHandler(func(CloseEvent) CloseDecision { return CloseDecision{Action: ActionReconnect} })
+    _, _, err = w.Read()
+    var re *ReconnectError
+    if !errors.As(err, &re) || re.Attempts != 1 || !errors.Is(err, ErrDialFailed) {
+        t.Errorf("Read() error = %v, want a ReconnectError after 1 attempt", err)
+    }
+}
@@ -0,0 +1,313 @@
+// Package faultnet wraps network connections to inject faults like latency, bandwidth caps,
+// stalls, resets, half-open connections and dial failures, decisions are deterministic under a seed
+package faultnet
+
+import (
+    "context"
+    "errors"
+    "math/rand"
+    "net"
+    "os"
+    "sync"
+    "time"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// ErrDialFailed is returned by an injected dial failure
+var ErrDialFailed = errors.New("faultnet: injected dial failure")
+
+// ErrReset is returned by reads and writes on a connection that was reset
+var ErrReset = errors.New("faultnet: connection reset")
+
+// Config describes the faults to inject, rates are probabilities between 0 and 1
+type Config struct {
+    // Seed makes every decision repeatable, connections get their own source derived from it
+    Seed int64
+
+    // time added to every dial
+    DialLatency time.Duration
+
+    // chance that a dial fails
+    DialFailRate float64
+
+    // time added before every write, plus a random part up to Jitter
+    Latency time.Duration
+    Jitter  time.Duration
+
+    // maximum bytes per second in each direction, 0 is unlimited
+    Bandwidth int
+
+    // chance that a read or write stalls for StallDuration first
+    StallRate     float64
+    StallDuration time.Duration
+
+    // chance that a read or write resets the connection
+    ResetRate float64
+
+    // chance that a read or write turns the connection half-open,
+    // writes are then silently dropped and reads block until the deadline or Close
+    HalfOpenRate float64
+
+    // Clock is used for every delay and for the read deadline of a half-open connection,
+    // the system clock is used when it is nil
+    Clock plugin.Clock
+}
+
+// Dialer dials connections with faults, use DialContext as the NetDialContext of a websocket dialer
+type Dialer struct {
+    cfg  Config
+    base func(ctx context.Context, network, addr string) (net.Conn, error)
+
+    lock  sync.Mutex
+    rand  *rand.Rand
+    conns []*Conn
+}
+
+// NewDialer create a dialer that uses a net.Dialer for the real connections
+func NewDialer(cfg Config) *Dialer {
+    if cfg.Clock == nil {
+        cfg.Clock = plugin.SystemClock
+    }
+    var nd net.Dialer
+    return &Dialer{cfg: cfg, base: nd.DialContext, rand: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+// SetBase replace the function used to make the real connections
+func (d *Dialer) SetBase(f func(ctx context.Context, network, addr string) (net.Conn, error)) {
+    d.base = f
+}
+
+// DialContext dial addr and wrap the connection
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+    d.lock.Lock()
+    fail := d.rand.Float64() < d.cfg.DialFailRate
+    seed := d.rand.Int63()
+    d.lock.Unlock()
+    if d.cfg.DialLatency > 0 {
+        d.cfg.Clock.Sleep(d.cfg.DialLatency)
+    }
+    if fail {
+        return nil, &net.OpError{Op: "dial", Net: network, Err: ErrDialFailed}
+    }
+    nc, err := d.base(ctx, network, addr)
+    if err != nil {
+        return nil, err
+    }
+    c := Wrap(nc, d.cfg, seed)
+    d.lock.Lock()
+    d.conns = append(d.conns, c)
+    d.lock.Unlock()
+    return c, nil
+}
+
+// Dial dial addr without a context
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+    return d.DialContext(context.Background(), network, addr)
+}
+
+// Conns return every connection made by the dialer
+func (d *Dialer) Conns() []*Conn {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    conns := make([]*Conn, len(d.conns))
+    copy(conns, d.conns)
+    return conns
+}
+
+// Conn is a connection with injected faults
+type Conn struct {
+    net.Conn
+    cfg Config
+
+    // reads and writes have their own source so the decisions do not depend on how they interleave
+    readRand  *rand.Rand
+    writeRand *rand.Rand
+
+    lock         sync.Mutex
+    reset        bool
+    halfOpen     bool
+    readDeadline time.Time
+    closed       chan struct{}
+    closeOnce    sync.Once
+
+    // deadlineSet is closed and replaced when the read deadline changes, so a blocked read sees it
+    deadlineSet chan struct{}
+}
+
+// Wrap add faults to an existing connection
+func Wrap(nc net.Conn, cfg Config, seed int64) *Conn {
+    if cfg.Clock == nil {
+        cfg.Clock = plugin.SystemClock
+    }
+    r := rand.New(rand.NewSource(seed))
+    return &Conn{
+        Conn:        nc,
+        cfg:         cfg,
+        readRand:    rand.New(rand.NewSource(r.Int63())),
+        writeRand:   rand.New(rand.NewSource(r.Int63())),
+        closed:      make(chan struct{}),
+        deadlineSet: make(chan struct{}),
+    }
+}
+
+// Reset close the connection abruptly, the peer sees a reset when the connection is tcp
+func (c *Conn) Reset() {
+    c.lock.Lock()
+    c.reset = true
+    c.lock.Unlock()
+    if tc, ok := c.Conn.(*net.TCPConn); ok {
+        _ = tc.SetLinger(0)
+    }
+    c.close()
+}
+
+// HalfOpen stop delivering data in both directions without closing the connection
+func (c *Conn) HalfOpen() {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.halfOpen = true
+}
+
+// Close the connection
+func (c *Conn) Close() error {
+    err := c.Conn.Close()
+    c.closeOnce.Do(func() { close(c.closed) })
+    return err
+}
+
+func (c *Conn) close() {
+    _ = c.Close()
+}
+
+// SetDeadline set the read and write deadline
+func (c *Conn) SetDeadline(t time.Time) error {
+    c.setReadDeadline(t)
+    return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline set the read deadline, it is also used while the connection is half-open
+func (c *Conn) SetReadDeadline(t time.Time) error {
+    c.setReadDeadline(t)
+    return c.Conn.SetReadDeadline(t)
+}
+
+// setReadDeadline keep the deadline for half-open reads and wake a read that is blocked
+func (c *Conn) setReadDeadline(t time.Time) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.readDeadline = t
+    close(c.deadlineSet)
+    c.deadlineSet = make(chan struct{})
+}
+
+// Read with injected faults
+func (c *Conn) Read(b []byte) (int, error) {
+    if err := c.inject(c.readRand, "read"); err != nil {
+        return 0, err
+    }
+    if c.isHalfOpen() {
+        return 0, c.blockRead()
+    }
+    n, err := c.Conn.Read(b)
+    c.throttle(n)
+    return n, err
+}
+
+// Write with injected faults
+func (c *Conn) Write(b []byte) (int, error) {
+    if err := c.inject(c.writeRand, "write"); err != nil {
+        return 0, err
+    }
+    if c.isHalfOpen() {
+        return len(b), nil
+    }
+    if c.cfg.Latency > 0 || c.cfg.Jitter > 0 {
+        d := c.cfg.Latency
+        if c.cfg.Jitter > 0 {
+            c.lock.Lock()
+            d += time.Duration(c.writeRand.Int63n(int64(c.cfg.Jitter)))
+            c.lock.Unlock()
+        }
+        c.cfg.Clock.Sleep(d)
+    }
+    n, err := c.Conn.Write(b)
+    c.throttle(n)
+    return n, err
+}
+
+// inject roll the dice for stalls, resets and half-open connections before a read or write
+func (c *Conn) inject(r *rand.Rand, op string) error {
+    c.lock.Lock()
+    if c.reset {
+        c.lock.Unlock()
+        return c.opError(op, ErrReset)
+    }
+    stall := r.Float64() < c.cfg.StallRate
+    reset := r.Float64() < c.cfg.ResetRate
+    halfOpen := r.Float64() < c.cfg.HalfOpenRate
+    if halfOpen {
+        c.halfOpen = true
+    }
+    c.lock.Unlock()
+    if stall && c.cfg.StallDuration > 0 {
+        c.cfg.Clock.Sleep(c.cfg.StallDuration)
+    }
+    if reset {
+        c.Reset()
+        return c.opError(op, ErrReset)
+    }
+    return nil
+}
+
+func (c *Conn) isHalfOpen() bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.halfOpen
+}
+
+// blockRead wait until the read deadline passes on the clock or the connection is closed
+func (c *Conn) blockRead() error {
+    for {
+        c.lock.Lock()
+        deadline, changed := c.readDeadline, c.deadlineSet
+        c.lock.Unlock()
+        var timeout <-chan time.Time
+        var timer plugin.Timer
+        if !deadline.IsZero() {
+            left := deadline.Sub(c.cfg.Clock.Now())
+            if left <= 0 {
+                return c.opError("read", os.ErrDeadlineExceeded)
+            }
+            timer = c.cfg.Clock.NewTimer(left)
+            timeout = timer.C()
+        }
+        select {
+        case <-c.closed:
+            stopTimer(timer)
+            return c.opError("read", net.ErrClosed)
+        case <-timeout:
+            return c.opError("read", os.ErrDeadlineExceeded)
+        case <-changed:
+            stopTimer(timer)
+        }
+    }
+}
+
+func stopTimer(t plugin.Timer) {
+    if t != nil {
+        t.Stop()
+    }
+}
+
+// throttle wait long enough to keep n bytes within the bandwidth
+func (c *Conn) throttle(n int) {
+    if c.cfg.Bandwidth <= 0 || n <= 0 {
+        return
+    }
+    c.cfg.Clock.Sleep(time.Duration(float64(n) / float64(c.cfg.Bandwidth) * float64(time.Second)))
+}
+
+func (c *Conn) opError(op string, err error) error {
+    return &net.OpError{Op: op, Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
@@ -0,0 +1,206 @@
+package faultnet
+
+import (
+    "errors"
+    "io"
+    "net"
+    "os"
+    "reflect"
+    "testing"
+    "time"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// sleepClock adds up the sleeps instead of sleeping
+type sleepClock struct {
+    plugin.Clock
+    slept time.Duration
+}
+
+func (c *sleepClock) Sleep(d time.Duration) {
+    c.slept += d
+}
+
+// listen start a tcp server that copies everything it reads back
+func listen(t *testing.T) string {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { l.Close() })
+    go func() {
+        for {
+            c, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer c.Close()
+                _, _ = io.Copy(c, c)
+            }()
+        }
+    }()
+    return l.Addr().String()
+}
+
+func TestDialer_seed(t *testing.T) {
+    addr := listen(t)
+    outcomes := func(seed int64) []bool {
+        d := NewDialer(Config{Seed: seed, DialFailRate: 0.5})
+        var got []bool
+        for i := 0; i < 16; i++ {
+            c, err := d.Dial("tcp", addr)
+            got = append(got, err == nil)
+            if err == nil {
+                c.Close()
+            }
+        }
+        return got
+    }
+    a, b := outcomes(7), outcomes(7)
+    if !reflect.DeepEqual(a, b) {
+        t.Errorf("dial outcomes differ for the same seed: %v and %v", a, b)
+    }
+    if reflect.DeepEqual(a, outcomes(8)) {
+        t.Errorf("dial outcomes are the same for different seeds: %v", a)
+    }
+}
+
+func TestDialer_DialContext(t *testing.T) {
+    addr := listen(t)
+    tests := []struct {
+        name    string
+        cfg     Config
+        wantErr error
+    }{
+        {name: "no faults", cfg: Config{}},
+        {name: "always fail", cfg: Config{DialFailRate: 1}, wantErr: ErrDialFailed},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            clock := &sleepClock{Clock: plugin.SystemClock}
+            tt.cfg.DialLatency = time.Second
+            tt.cfg.Clock = clock
+            c, err := NewDialer(tt.cfg).Dial("tcp", addr)
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("Dial() error = %v, want %v", err, tt.wantErr)
+            }
+            if c != nil {
+                c.Close()
+            }
+            if clock.slept != time.Second {
+                t.Errorf("Dial() slept %v, want the dial latency", clock.slept)
+            }
+        })
+    }
+}
+
+func TestConn_faults(t *testing.T) {
+    addr := listen(t)
+    tests := []struct {
+        name      string
+        cfg       Config
+        wantErr   error
+        wantSleep time.Duration
+    }{
+        {name: "latency", cfg: Config{Latency: 50 * time.Millisecond}, wantSleep: 50 * time.Millisecond},
+        {name: "bandwidth", cfg: Config{Bandwidth: 4}, wantSleep: 2 * time.Second},
+        {name: "stall", cfg: Config{StallRate: 1, StallDuration: time.Minute}, wantSleep: 2 * time.Minute},
+        {name: "reset", cfg: Config{ResetRate: 1}, wantErr: ErrReset},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            clock := &sleepClock{Clock: plugin.SystemClock}
+            tt.cfg.Clock = clock
+            c, err := NewDialer(tt.cfg).Dial("tcp", addr)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer c.Close()
+            _, err = c.Write([]byte("ping"))
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("Write() error = %v, want %v", err, tt.wantErr)
+            }
+            if err != nil {
+                return
+            }
+            buf := make([]byte, 4)
+            if _, err := io.ReadFull(c, buf); err != nil {
+                t.Fatal(err)
+            }
+            if clock.slept != tt.wantSleep {
+                t.Errorf("slept %v, want %v", clock.slept, tt.wantSleep)
+            }
+        })
+    }
+}
+
+func TestConn_HalfOpen(t *testing.T) {
+    addr := listen(t)
+    d := NewDialer(Config{})
+    nc, err := d.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer nc.Close()
+    c := d.Conns()[0]
+    c.HalfOpen()
+    if n, err := c.Write([]byte("lost")); n != 4 || err != nil {
+        t.Errorf("Write() = %v, %v, want the write to look successful", n, err)
+    }
+    _ = c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+    if _, err := c.Read(make([]byte, 4)); !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Errorf("Read() error = %v, want a deadline error", err)
+    }
+    var ne net.Error
+    if _, err := c.Read(make([]byte, 4)); !errors.As(err, &ne) || !ne.Timeout() {
+        t.Errorf("Read() error = %v, want a net timeout error", err)
+    }
+}
+
+func TestConn_HalfOpenClock(t *testing.T) {
+    addr := listen(t)
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    d := NewDialer(Config{Clock: clock})
+    nc, err := d.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer nc.Close()
+    c := d.Conns()[0]
+    c.HalfOpen()
+    _ = c.SetReadDeadline(clock.Now().Add(time.Minute))
+    errs := make(chan error, 1)
+    go func() {
+        _, err := c.Read(make([]byte, 4))
+        errs <- err
+    }()
+    clock.BlockUntil(1)
+    select {
+    case err := <-errs:
+        t.Fatalf("Read() = %v before the clock reached the deadline", err)
+    default:
+    }
+    clock.Advance(time.Minute)
+    if err := <-errs; !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Errorf("Read() error = %v, want a deadline error", err)
+    }
+
+    // a deadline moved into the past wakes a blocked read
+    _ = c.SetReadDeadline(time.Time{})
+    go func() {
+        _, err := c.Read(make([]byte, 4))
+        errs <- err
+    }()
+    time.Sleep(10 * time.Millisecond)
+    _ = c.SetReadDeadline(time.Unix(-1, 0))
+    select {
+    case err := <-errs:
+        if !errors.Is(err, os.ErrDeadlineExceeded) {
+            t.Errorf("Read() error = %v, want a deadline error", err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("the read did not notice the new deadline")
+    }
+}
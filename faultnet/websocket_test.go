@@ -0,0 +1,39 @@
+package faultnet_test
+
+import (
+    "testing"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/faultnet"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+func TestWs_reconnectAfterReset(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Echo()))
+    defer srv.Close()
+    d := faultnet.NewDialer(faultnet.Config{Seed: 1})
+
+    w := &plugin.Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    w.SetNetDial(d.DialContext)
+    w.Reconnect(true)
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+
+    d.Conns()[0].Reset()
+    if err := w.WriteMessage(websocket.TextMessage, []byte("lost")); err == nil {
+        t.Fatal("WriteMessage() on a reset connection did not fail")
+    }
+    if err := w.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+        t.Fatalf("WriteMessage() after reconnect error = %v", err)
+    }
+    if _, m, err := w.Read(); err != nil || string(m) != "hello" {
+        t.Errorf("Read() = %s, %v, want hello", m, err)
+    }
+    if got := len(d.Conns()); got != 2 {
+        t.Errorf("dialer made %d connections, want 2", got)
+    }
+}
@@ -0,0 +1,588 @@
+// Package graphqlws is a client for GraphQL over WebSocket with the graphql-transport-ws protocol,
+// every message is a json text message
+package graphqlws
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// Subprotocol is offered to the server when the connection is made
+const Subprotocol = "graphql-transport-ws"
+
+// message types
+const (
+    TypeConnectionInit = "connection_init"
+    TypeConnectionAck  = "connection_ack"
+    TypePing           = "ping"
+    TypePong           = "pong"
+    TypeSubscribe      = "subscribe"
+    TypeNext           = "next"
+    TypeError          = "error"
+    TypeComplete       = "complete"
+)
+
+// close codes used by the server
+const (
+    CloseBadRequest          = 4400
+    CloseUnauthorized        = 4401
+    CloseForbidden           = 4403
+    CloseInitTimeout         = 4408
+    CloseSubscriberExists    = 4409
+    CloseTooManyInitRequests = 4429
+)
+
+var (
+    // ErrPingTimeout is the error of a client that got no pong in time
+    ErrPingTimeout = errors.New("graphqlws: ping timed out")
+
+    // ErrClientClosed is returned after Close
+    ErrClientClosed = errors.New("graphqlws: client closed")
+
+    // ErrNoResult is returned by Execute when the operation completed without a result
+    ErrNoResult = errors.New("graphqlws: operation completed without a result")
+)
+
+// Request is the payload of a subscribe message
+type Request struct {
+    Query         string                 `json:"query"`
+    Variables     map[string]interface{} `json:"variables,omitempty"`
+    OperationName string                 `json:"operationName,omitempty"`
+    Extensions    map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Location of an error in the query
+type Location struct {
+    Line   int `json:"line"`
+    Column int `json:"column"`
+}
+
+// Error is a GraphQL error
+type Error struct {
+    Message    string                 `json:"message"`
+    Locations  []Location             `json:"locations,omitempty"`
+    Path       []interface{}          `json:"path,omitempty"`
+    Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Result is the payload of a next message, errors in it do not end the operation
+type Result struct {
+    Data       json.RawMessage        `json:"data,omitempty"`
+    Errors     []Error                `json:"errors,omitempty"`
+    Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Decode the data of the result into v
+func (r *Result) Decode(v interface{}) error {
+    return json.Unmarshal(r.Data, v)
+}
+
+// OperationError ends an operation, it holds the errors of an error message
+type OperationError struct {
+    ID     string
+    Errors []Error
+}
+
+func (e *OperationError) Error() string {
+    msgs := make([]string, len(e.Errors))
+    for i, err := range e.Errors {
+        msgs[i] = err.Message
+    }
+    return fmt.Sprintf("graphqlws: operation %s failed: %s", e.ID, strings.Join(msgs, "; "))
+}
+
+// ClosePolicy stops reconnecting after the close codes that a new connection would get again,
+// reconnects after 4408 because a new connection gets a new chance to initialise and leaves
+// other codes to the default policy of the plugin
+func ClosePolicy(e plugin.CloseEvent) plugin.CloseDecision {
+    if final(e.Code) {
+        return plugin.CloseDecision{Action: plugin.ActionStop}
+    }
+    if e.Code == CloseInitTimeout {
+        return plugin.CloseDecision{Action: plugin.ActionReconnect}
+    }
+    return plugin.DefaultClosePolicy(e)
+}
+
+// final return true for the close codes after which ClosePolicy stops reconnecting
+func final(code int) bool {
+    switch code {
+    case CloseBadRequest, CloseUnauthorized, CloseForbidden, CloseSubscriberExists, CloseTooManyInitRequests:
+        return true
+    }
+    return false
+}
+
+// Config of a Client
+type Config struct {
+    // Payload is sent with connection_init, for example to authenticate
+    Payload interface{}
+
+    // AckTimeout is how long to wait for connection_ack, 0 waits 30 seconds
+    AckTimeout time.Duration
+
+    // PingInterval is how often to ping the server, the connection is dropped when the pong
+    // did not arrive before the next ping, 0 disables it
+    PingInterval time.Duration
+
+    // Buffer is the size of the result channel of a subscription, 0 uses 16
+    Buffer int
+
+    // OnError is called for messages that can not be decoded, it must not block
+    OnError func(err error)
+
+    // Clock is used for pings, the system clock is used when it is nil
+    Clock plugin.Clock
+}
+
+// message is the envelope of every message
+type message struct {
+    ID      string          `json:"id,omitempty"`
+    Type    string          `json:"type"`
+    Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Client runs GraphQL operations over a Ws, active operations are subscribed again whenever the Ws makes a new connection
+type Client struct {
+    w     *plugin.Ws
+    cfg   Config
+    clock plugin.Clock
+
+    // writeLock makes sure there is only one writer
+    writeLock sync.Mutex
+
+    lock     sync.Mutex
+    ops      map[string]*Subscription
+    nextID   uint64
+    ackData  json.RawMessage
+    err      error
+    running  bool
+    closed   bool
+    stop     chan struct{}
+    gen      uint64
+    pingSent bool
+    timedOut bool
+}
+
+// Subscription is an active operation, its results arrive on C which is closed when the operation ends
+type Subscription struct {
+    ID      string
+    Request Request
+
+    // C receives the results, a subscription that is not read blocks the client
+    C <-chan *Result
+
+    client   *Client
+    results  chan *Result
+    done     chan struct{}
+    sendLock sync.Mutex
+    once     sync.Once
+    finished bool
+
+    // errLock guards err apart from sendLock, which is held while a result waits for the reader
+    errLock sync.Mutex
+    err     error
+}
+
+// NewClient create a client for w, connection_init is sent as the init exchange of w, the OnConnect hook of w
+// is wrapped to subscribe active operations again and the close event handler of w is wrapped to stop on the
+// codes of ClosePolicy, other codes are left to the handler that was set or to ClosePolicy
+func NewClient(w *plugin.Ws, cfg Config) (*Client, error) {
+    if cfg.Buffer <= 0 {
+        cfg.Buffer = 16
+    }
+    if cfg.Clock == nil {
+        cfg.Clock = plugin.SystemClock
+    }
+    init := message{Type: TypeConnectionInit}
+    if cfg.Payload != nil {
+        p, err := json.Marshal(cfg.Payload)
+        if err != nil {
+            return nil, err
+        }
+        init.Payload = p
+    }
+    data, err := json.Marshal(init)
+    if err != nil {
+        return nil, err
+    }
+    c := &Client{
+        w:     w,
+        cfg:   cfg,
+        clock: cfg.Clock,
+        ops:   map[string]*Subscription{},
+        stop:  make(chan struct{}),
+    }
+    w.SetSubprotocols(Subprotocol)
+    decide := w.CloseEventHandler()
+    w.SetCloseEventHandler(func(e plugin.CloseEvent) plugin.CloseDecision {
+        if decide == nil || final(e.Code) {
+            return ClosePolicy(e)
+        }
+        return decide(e)
+    })
+    w.SetInitExchange(plugin.InitExchange{
+        Messages: [][]byte{data},
+        Accept:   c.accept,
+        Timeout:  cfg.AckTimeout,
+    })
+    hooks := w.Hooks()
+    next := hooks.OnConnect
+    hooks.OnConnect = func(w *plugin.Ws, info plugin.ConnectInfo) error {
+        c.restore()
+        if next != nil {
+            return next(w, info)
+        }
+        return nil
+    }
+    w.SetHooks(hooks)
+    return c, nil
+}
+
+// Connect make the connection and start reading messages
+func (c *Client) Connect(ctx context.Context) error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return ErrClientClosed
+    }
+    c.lock.Unlock()
+    if err := c.w.ConnectContext(ctx); err != nil {
+        return err
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.err = nil
+    if !c.running {
+        c.running = true
+        go c.readLoop()
+    }
+    return nil
+}
+
+// AckPayload return the payload of the last connection_ack
+func (c *Client) AckPayload() json.RawMessage {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.ackData
+}
+
+// Err return why the client stopped reading, it is nil while it runs
+func (c *Client) Err() error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.err
+}
+
+// Subscribe start an operation, it stays active until the server completes it, it fails or Unsubscribe is called
+func (c *Client) Subscribe(ctx context.Context, req Request) (*Subscription, error) {
+    payload, err := json.Marshal(req)
+    if err != nil {
+        return nil, err
+    }
+    s := &Subscription{Request: req, client: c, results: make(chan *Result, c.cfg.Buffer), done: make(chan struct{})}
+    s.C = s.results
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil, ErrClientClosed
+    }
+    c.nextID++
+    s.ID = strconv.FormatUint(c.nextID, 10)
+    c.ops[s.ID] = s
+    c.lock.Unlock()
+    conn := c.w.ConnID()
+    if err := c.write(ctx, message{ID: s.ID, Type: TypeSubscribe, Payload: payload}); err != nil && !c.w.Reconnected(conn) {
+        c.remove(s)
+        s.finish(err)
+        return nil, err
+    }
+    return s, nil
+}
+
+// Execute run a query or mutation and return its single result
+func (c *Client) Execute(ctx context.Context, req Request) (*Result, error) {
+    s, err := c.Subscribe(ctx, req)
+    if err != nil {
+        return nil, err
+    }
+    select {
+    case r, ok := <-s.C:
+        if !ok {
+            if err := s.Err(); err != nil {
+                return nil, err
+            }
+            return nil, ErrNoResult
+        }
+        _ = s.Unsubscribe()
+        return r, nil
+    case <-ctx.Done():
+        _ = s.Unsubscribe()
+        return nil, ctx.Err()
+    }
+}
+
+// Unsubscribe stop the operation, C is closed without an error
+func (s *Subscription) Unsubscribe() error {
+    c := s.client
+    if !c.remove(s) {
+        return nil
+    }
+    s.once.Do(func() { close(s.done) })
+    s.finish(nil)
+    return c.write(context.Background(), message{ID: s.ID, Type: TypeComplete})
+}
+
+// Err return why the operation ended, it is nil while it runs and when it completed
+func (s *Subscription) Err() error {
+    s.errLock.Lock()
+    defer s.errLock.Unlock()
+    return s.err
+}
+
+// deliver a result, it waits for the reader unless the subscription is stopped
+func (s *Subscription) deliver(r *Result) {
+    s.sendLock.Lock()
+    defer s.sendLock.Unlock()
+    if s.finished {
+        return
+    }
+    select {
+    case s.results <- r:
+    case <-s.done:
+    }
+}
+
+// finish end the subscription and close its channel
+func (s *Subscription) finish(err error) {
+    s.once.Do(func() { close(s.done) })
+    s.sendLock.Lock()
+    defer s.sendLock.Unlock()
+    if s.finished {
+        return
+    }
+    s.finished = true
+    s.errLock.Lock()
+    s.err = err
+    s.errLock.Unlock()
+    close(s.results)
+}
+
+// remove an operation, it return false when it was not active
+func (c *Client) remove(s *Subscription) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.ops[s.ID] != s {
+        return false
+    }
+    delete(c.ops, s.ID)
+    return true
+}
+
+// Close complete every operation and close the connection
+func (c *Client) Close() error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil
+    }
+    c.closed = true
+    close(c.stop)
+    ops := c.ops
+    c.ops = map[string]*Subscription{}
+    c.lock.Unlock()
+    for _, s := range ops {
+        s.finish(ErrClientClosed)
+    }
+    return c.w.Close()
+}
+
+// write a message
+func (c *Client) write(ctx context.Context, m message) error {
+    c.writeLock.Lock()
+    defer c.writeLock.Unlock()
+    return c.w.WriteJSONContext(ctx, m)
+}
+
+// accept wait for connection_ack during the init exchange
+func (c *Client) accept(messageType int, data []byte) (bool, error) {
+    var m message
+    if err := json.Unmarshal(data, &m); err != nil {
+        return false, err
+    }
+    if m.Type != TypeConnectionAck {
+        return false, nil
+    }
+    c.lock.Lock()
+    c.ackData = m.Payload
+    c.lock.Unlock()
+    return true, nil
+}
+
+// restore subscribe the active operations after a new connection, the messages are sent from another goroutine
+// because a write that reconnected still holds the write lock
+func (c *Client) restore() {
+    c.lock.Lock()
+    c.gen++
+    gen := c.gen
+    c.pingSent = false
+    c.timedOut = false
+    ops := make([]*Subscription, 0, len(c.ops))
+    for _, s := range c.ops {
+        ops = append(ops, s)
+    }
+    c.lock.Unlock()
+    sort.Slice(ops, func(i, j int) bool { return idNumber(ops[i].ID) < idNumber(ops[j].ID) })
+    if len(ops) > 0 {
+        go func() {
+            for _, s := range ops {
+                c.lock.Lock()
+                current := c.gen == gen && c.ops[s.ID] == s
+                c.lock.Unlock()
+                if !current {
+                    continue
+                }
+                payload, _ := json.Marshal(s.Request)
+                if c.write(context.Background(), message{ID: s.ID, Type: TypeSubscribe, Payload: payload}) != nil {
+                    return
+                }
+            }
+        }()
+    }
+    if c.cfg.PingInterval > 0 {
+        go c.ping(gen)
+    }
+}
+
+// readLoop read messages until the connection fails and is not made again
+func (c *Client) readLoop() {
+    for {
+        conn := c.w.ConnID()
+        _, d, err := c.w.Read()
+        if err != nil {
+            c.lock.Lock()
+            stopped := c.closed || c.timedOut
+            c.lock.Unlock()
+            if !stopped && c.w.Reconnected(conn) {
+                // the plugin reconnected while reading
+                continue
+            }
+            c.fail(err)
+            return
+        }
+        var m message
+        if err := json.Unmarshal(d, &m); err != nil {
+            c.report(fmt.Errorf("graphqlws: bad message: %w", err))
+            continue
+        }
+        c.dispatch(m)
+    }
+}
+
+// dispatch a message received from the server
+func (c *Client) dispatch(m message) {
+    switch m.Type {
+    case TypePing:
+        _ = c.write(context.Background(), message{Type: TypePong})
+        return
+    case TypePong:
+        c.lock.Lock()
+        c.pingSent = false
+        c.lock.Unlock()
+        return
+    }
+    c.lock.Lock()
+    s := c.ops[m.ID]
+    c.lock.Unlock()
+    if s == nil {
+        return
+    }
+    switch m.Type {
+    case TypeNext:
+        var r Result
+        if err := json.Unmarshal(m.Payload, &r); err != nil {
+            c.report(fmt.Errorf("graphqlws: bad result for operation %s: %w", m.ID, err))
+            return
+        }
+        s.deliver(&r)
+    case TypeError:
+        var errs []Error
+        if err := json.Unmarshal(m.Payload, &errs); err != nil {
+            errs = []Error{{Message: string(m.Payload)}}
+        }
+        c.remove(s)
+        s.finish(&OperationError{ID: s.ID, Errors: errs})
+    case TypeComplete:
+        c.remove(s)
+        s.finish(nil)
+    }
+}
+
+// report an error to OnError
+func (c *Client) report(err error) {
+    if c.cfg.OnError != nil {
+        c.cfg.OnError(err)
+    }
+}
+
+// fail stop reading and end every operation
+func (c *Client) fail(err error) {
+    c.lock.Lock()
+    if c.timedOut {
+        err = ErrPingTimeout
+    } else if c.closed {
+        err = ErrClientClosed
+    }
+    c.err = err
+    c.running = false
+    c.gen++
+    ops := c.ops
+    c.ops = map[string]*Subscription{}
+    c.lock.Unlock()
+    for _, s := range ops {
+        s.finish(err)
+    }
+}
+
+// ping the server every interval and drop the connection when a pong did not arrive before the next ping
+func (c *Client) ping(gen uint64) {
+    for {
+        timer := c.clock.NewTimer(c.cfg.PingInterval)
+        select {
+        case <-timer.C():
+        case <-c.stop:
+            timer.Stop()
+            return
+        }
+        c.lock.Lock()
+        if c.gen != gen {
+            c.lock.Unlock()
+            return
+        }
+        missed := c.pingSent
+        c.timedOut = missed
+        c.pingSent = true
+        c.lock.Unlock()
+        if missed {
+            // a dropped connection is reconnected when the plugin reconnects
+            _ = c.w.Drop()
+            return
+        }
+        _ = c.write(context.Background(), message{Type: TypePing})
+    }
+}
+
+// idNumber return the number of an operation id
+func idNumber(id string) uint64 {
+    n, _ := strconv.ParseUint(id, 10, 64)
+    return n
+}
@@ -0,0 +1,388 @@
+package graphqlws
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+// server is a small graphql-transport-ws server for the tests, the query count sends n results,
+// fail sends an error and every other query sends the index of the connection and stays active,
+// a connection_init without the token secret is closed with 4401
+type server struct {
+    srv    *wstest.Server
+    noPong bool
+
+    lock sync.Mutex
+    log  []string
+}
+
+func newServer(t *testing.T) *server {
+    s := &server{}
+    s.srv = wstest.NewServer(s.serve)
+    s.srv.Upgrader.Subprotocols = []string{Subprotocol}
+    t.Cleanup(s.srv.Close)
+    return s
+}
+
+func (s *server) record(c *wstest.Conn, format string, args ...interface{}) {
+    s.lock.Lock()
+    s.log = append(s.log, fmt.Sprintf("%d ", c.Index)+fmt.Sprintf(format, args...))
+    s.lock.Unlock()
+}
+
+// waitFor wait until the server logged an entry
+func (s *server) waitFor(t *testing.T, entry string) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        s.lock.Lock()
+        for _, e := range s.log {
+            if e == entry {
+                s.lock.Unlock()
+                return
+            }
+        }
+        s.lock.Unlock()
+        time.Sleep(time.Millisecond)
+    }
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    t.Fatalf("server got %q, want %q", s.log, entry)
+}
+
+func (s *server) serve(c *wstest.Conn) {
+    write := func(m message) { _ = c.WriteJSON(m) }
+    for {
+        _, d, err := c.Receive()
+        if err != nil {
+            return
+        }
+        var m message
+        if err := json.Unmarshal(d, &m); err != nil {
+            return
+        }
+        switch m.Type {
+        case TypeConnectionInit:
+            s.record(c, "%s %s", m.Type, m.Payload)
+            var p struct{ Token string }
+            _ = json.Unmarshal(m.Payload, &p)
+            if p.Token != "secret" {
+                _ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(CloseUnauthorized, "Unauthorized"), time.Now().Add(time.Second))
+                return
+            }
+            write(message{Type: TypeConnectionAck, Payload: json.RawMessage(`{"server":"test"}`)})
+        case TypePing:
+            s.record(c, "ping")
+            if !s.noPong {
+                write(message{Type: TypePong})
+            }
+        case TypePong:
+            s.record(c, "pong")
+        case TypeComplete:
+            s.record(c, "complete %s", m.ID)
+        case TypeSubscribe:
+            var req Request
+            _ = json.Unmarshal(m.Payload, &req)
+            s.record(c, "subscribe %s %s", m.ID, req.Query)
+            switch req.Query {
+            case "count":
+                n, _ := req.Variables["n"].(float64)
+                for i := 1; i <= int(n); i++ {
+                    write(message{ID: m.ID, Type: TypeNext, Payload: json.RawMessage(fmt.Sprintf(`{"data":{"count":%d}}`, i))})
+                }
+                write(message{ID: m.ID, Type: TypeComplete})
+            case "fail":
+                write(message{ID: m.ID, Type: TypeError, Payload: json.RawMessage(`[{"message":"no such field"}]`)})
+            default:
+                write(message{ID: m.ID, Type: TypeNext, Payload: json.RawMessage(fmt.Sprintf(`{"data":{"conn":%d}}`, c.Index))})
+            }
+        case "serverping":
+            write(message{Type: TypePing})
+        }
+    }
+}
+
+// newTestClient connect a client to the server
+func newTestClient(t *testing.T, s *server, cfg Config, setup func(w *plugin.Ws)) (*Client, *plugin.Ws) {
+    w := &plugin.Ws{}
+    w.SetUrl("ws", s.srv.Host, "/graphql")
+    if setup != nil {
+        setup(w)
+    }
+    if cfg.Payload == nil {
+        cfg.Payload = map[string]string{"token": "secret"}
+    }
+    c, err := NewClient(w, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { c.Close() })
+    return c, w
+}
+
+// next wait for a result
+func next(t *testing.T, s *Subscription) *Result {
+    t.Helper()
+    select {
+    case r, ok := <-s.C:
+        if !ok {
+            t.Fatalf("operation ended with %v", s.Err())
+        }
+        return r
+    case <-time.After(5 * time.Second):
+        t.Fatal("no result received")
+        return nil
+    }
+}
+
+// ended wait until the results of s are closed
+func ended(t *testing.T, s *Subscription) {
+    t.Helper()
+    select {
+    case r, ok := <-s.C:
+        if ok {
+            t.Fatalf("got result %s, want the operation to end", r.Data)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("operation did not end")
+    }
+}
+
+func TestClient_Connect(t *testing.T) {
+    s := newServer(t)
+    c, w := newTestClient(t, s, Config{}, nil)
+    s.waitFor(t, `1 connection_init {"token":"secret"}`)
+    if string(c.AckPayload()) != `{"server":"test"}` || w.Subprotocol() != Subprotocol {
+        t.Errorf("AckPayload(), Subprotocol() = %s, %s", c.AckPayload(), w.Subprotocol())
+    }
+}
+
+func TestClient_Connect_unauthorized(t *testing.T) {
+    s := newServer(t)
+    w := &plugin.Ws{}
+    w.SetUrl("ws", s.srv.Host, "/graphql")
+    c, err := NewClient(w, Config{Payload: map[string]string{"token": "wrong"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = c.Connect(context.Background())
+    var ce *plugin.ClosedError
+    if !errors.As(err, &ce) || ce.Code != CloseUnauthorized {
+        t.Errorf("Connect() error = %v, want a close with %d", err, CloseUnauthorized)
+    }
+    if d := ClosePolicy(plugin.CloseEvent{Code: CloseUnauthorized}); d.Action != plugin.ActionStop {
+        t.Errorf("ClosePolicy(%d) = %v, want stop", CloseUnauthorized, d.Action)
+    }
+    if d := ClosePolicy(plugin.CloseEvent{Code: CloseInitTimeout}); d.Action != plugin.ActionReconnect {
+        t.Errorf("ClosePolicy(%d) = %v, want reconnect", CloseInitTimeout, d.Action)
+    }
+}
+
+func TestNewClient_closeEventHandler(t *testing.T) {
+    s := newServer(t)
+    events := make(chan plugin.CloseEvent, 1)
+    c, _ := newTestClient(t, s, Config{}, func(w *plugin.Ws) {
+        w.Reconnect(true)
+        w.SetCloseEventHandler(func(e plugin.CloseEvent) plugin.CloseDecision {
+            events <- e
+            return plugin.CloseDecision{Action: plugin.ActionStop}
+        })
+    })
+    s.srv.CloseConnections()
+    select {
+    case e := <-events:
+        if e.Code != websocket.CloseAbnormalClosure {
+            t.Errorf("close event = %+v, want code %d", e, websocket.CloseAbnormalClosure)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("the close event handler that was set before NewClient was not called")
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for c.Err() == nil && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if c.Err() == nil {
+        t.Error("Err() = nil, want the client to stop as the close event handler decided")
+    }
+}
+
+func TestClient_Subscribe(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, nil)
+    sub, err := c.Subscribe(context.Background(), Request{Query: "count", Variables: map[string]interface{}{"n": 3}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 1; i <= 3; i++ {
+        var data struct{ Count int }
+        if err := next(t, sub).Decode(&data); err != nil || data.Count != i {
+            t.Errorf("result %d = %v, %v", i, data.Count, err)
+        }
+    }
+    ended(t, sub)
+    if sub.Err() != nil {
+        t.Errorf("Err() = %v after complete", sub.Err())
+    }
+}
+
+func TestClient_Subscribe_error(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, nil)
+    sub, err := c.Subscribe(context.Background(), Request{Query: "fail"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ended(t, sub)
+    var oe *OperationError
+    if !errors.As(sub.Err(), &oe) || oe.ID != sub.ID || len(oe.Errors) != 1 || oe.Errors[0].Message != "no such field" {
+        t.Errorf("Err() = %v, want the errors of the error message", sub.Err())
+    }
+}
+
+func TestClient_Execute(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, nil)
+    r, err := c.Execute(context.Background(), Request{Query: "count", Variables: map[string]interface{}{"n": 1}})
+    if err != nil || string(r.Data) != `{"count":1}` {
+        t.Errorf("Execute() = %v, %v", r, err)
+    }
+    if _, err := c.Execute(context.Background(), Request{Query: "count", Variables: map[string]interface{}{"n": 0}}); !errors.Is(err, ErrNoResult) {
+        t.Errorf("Execute() error = %v, want %v", err, ErrNoResult)
+    }
+    if _, err := c.Execute(context.Background(), Request{Query: "fail"}); err == nil {
+        t.Error("Execute() did not return the error message")
+    }
+}
+
+func TestSubscription_ErrWhileDelivering(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{Buffer: 1}, nil)
+    sub, err := c.Subscribe(context.Background(), Request{Query: "count", Variables: map[string]interface{}{"n": 3}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the buffer is full and the second result waits for the reader
+    deadline := time.Now().Add(5 * time.Second)
+    for len(sub.C) == 0 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    time.Sleep(10 * time.Millisecond)
+    got := make(chan error, 1)
+    go func() { got <- sub.Err() }()
+    select {
+    case err := <-got:
+        if err != nil {
+            t.Errorf("Err() = %v for a running operation", err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Err() blocked while a result waits for the reader")
+    }
+    for i := 1; i <= 3; i++ {
+        if r := next(t, sub); string(r.Data) != fmt.Sprintf(`{"count":%d}`, i) {
+            t.Errorf("result %d = %s", i, r.Data)
+        }
+    }
+    ended(t, sub)
+}
+
+func TestSubscription_Unsubscribe(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, nil)
+    sub, err := c.Subscribe(context.Background(), Request{Query: "live"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    next(t, sub)
+    if err := sub.Unsubscribe(); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, "1 complete "+sub.ID)
+    ended(t, sub)
+    if sub.Err() != nil {
+        t.Errorf("Err() = %v after Unsubscribe()", sub.Err())
+    }
+}
+
+func TestClient_pong(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, nil)
+    if err := c.write(context.Background(), message{Type: "serverping"}); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, "1 pong")
+}
+
+func TestClient_ping(t *testing.T) {
+    s := newServer(t)
+    s.noPong = true
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    c, _ := newTestClient(t, s, Config{PingInterval: 10 * time.Second, Clock: clock}, nil)
+    sub, err := c.Subscribe(context.Background(), Request{Query: "live"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    clock.BlockUntil(1)
+    clock.Advance(10 * time.Second)
+    s.waitFor(t, "1 ping")
+    clock.BlockUntil(1)
+    clock.Advance(10 * time.Second)
+    next(t, sub)
+    ended(t, sub)
+    if !errors.Is(sub.Err(), ErrPingTimeout) || !errors.Is(c.Err(), ErrPingTimeout) {
+        t.Errorf("Err() = %v, %v, want %v", sub.Err(), c.Err(), ErrPingTimeout)
+    }
+}
+
+func TestClient_pingReconnect(t *testing.T) {
+    s := newServer(t)
+    s.noPong = true
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    c, _ := newTestClient(t, s, Config{PingInterval: 10 * time.Second, Clock: clock}, func(w *plugin.Ws) { w.Reconnect(true) })
+    sub, err := c.Subscribe(context.Background(), Request{Query: "live"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    next(t, sub)
+    // the pong does not arrive, the connection is dropped and the operation subscribed again
+    clock.BlockUntil(1)
+    clock.Advance(10 * time.Second)
+    s.waitFor(t, "1 ping")
+    clock.BlockUntil(1)
+    clock.Advance(10 * time.Second)
+    s.waitFor(t, "2 subscribe "+sub.ID+" live")
+    if r := next(t, sub); string(r.Data) != `{"conn":2}` {
+        t.Errorf("result = %s after the ping timeout", r.Data)
+    }
+    if err := c.Err(); err != nil {
+        t.Errorf("Err() = %v after the ping timeout, want a reconnect", err)
+    }
+}
+
+func TestClient_resubscribe(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, func(w *plugin.Ws) { w.Reconnect(true) })
+    sub, err := c.Subscribe(context.Background(), Request{Query: "live"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if r := next(t, sub); string(r.Data) != `{"conn":1}` {
+        t.Errorf("result = %s", r.Data)
+    }
+    s.srv.CloseConnections()
+    s.waitFor(t, "2 subscribe "+sub.ID+" live")
+    if r := next(t, sub); string(r.Data) != `{"conn":2}` {
+        t.Errorf("result = %s after the reconnect", r.Data)
+    }
+}
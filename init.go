@@ -0,0 +1,112 @@
+package websocket
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// ErrInitRejected is returned by Connect when the reply to the init messages was not accepted
+var ErrInitRejected = errors.New("init rejected")
+
+// ErrInitTimeout is returned by Connect when no accepted reply arrived in time
+var ErrInitTimeout = errors.New("init timed out")
+
+// InitExchange describes the messages sent when a connection is made and the reply that confirms them
+type InitExchange struct {
+    // Messages are sent in order, a resume message replaces them after a reconnect
+    Messages [][]byte
+
+    // MessageType of the messages, 0 sends text messages
+    MessageType int
+
+    // Accept is called for every received message until it returns true or an error,
+    // messages for which it returns false and no error are skipped
+    Accept func(messageType int, data []byte) (bool, error)
+
+    // Timeout is the time to wait for an accepted reply, 0 waits 30 seconds
+    Timeout time.Duration
+}
+
+// InitError is returned by Connect when the init exchange failed
+type InitError struct {
+    ConnID uint64
+
+    // Reply is the last message that was received, it is nil on a timeout without any reply
+    Reply []byte
+
+    Err error
+}
+
+func (e *InitError) Error() string {
+    if e.Reply != nil {
+        return fmt.Sprintf("init of connection %d failed: %v, last reply: %s", e.ConnID, e.Err, e.Reply)
+    }
+    return fmt.Sprintf("init of connection %d failed: %v", e.ConnID, e.Err)
+}
+
+func (e *InitError) Unwrap() error { return e.Err }
+
+// SetInitExchange send messages when a connection is made and wait for a reply before Connect returns,
+// it replaces the message set with SetInitMsg
+func (w *Ws) SetInitExchange(e InitExchange) {
+    w.sendInitMsg = false
+    w.initExchange = &e
+}
+
+// runInitExchange send the init messages, or the resume message, and wait for an accepted reply
+func (w *Ws) runInitExchange(ctx context.Context, resumeMsg []byte) error {
+    e := w.initExchange
+    msgs := e.Messages
+    if resumeMsg != nil {
+        msgs = [][]byte{resumeMsg}
+    }
+    messageType := e.MessageType
+    if messageType == 0 {
+        messageType = websocket.TextMessage
+    }
+    for _, m := range msgs {
+        if err := w.WriteMessageContext(ctx, messageType, m); err != nil {
+            return &InitError{ConnID: w.ConnID(), Err: err}
+        }
+    }
+    if e.Accept == nil {
+        return nil
+    }
+    timeout := e.Timeout
+    if timeout <= 0 {
+        timeout = 30 * time.Second
+    }
+    timer := newExpiry(w.getClock(), timeout, nil)
+    c, _ := w.current()
+    timer.setConn(c.UnderlyingConn())
+    defer timer.stop(false)
+    var reply []byte
+    for {
+        t, d, err := w.Read()
+        if err != nil {
+            if isTimeout(err) {
+                err = ErrInitTimeout
+            }
+            return &InitError{ConnID: w.ConnID(), Reply: reply, Err: err}
+        }
+        reply = d
+        ok, err := e.Accept(t, d)
+        if err != nil {
+            return &InitError{ConnID: w.ConnID(), Reply: reply, Err: fmt.Errorf("%w: %v", ErrInitRejected, err)}
+        }
+        if ok {
+            timer.stop(true)
+            return nil
+        }
+    }
+}
+
+// isTimeout return true for network timeouts
+func isTimeout(err error) bool {
+    var te interface{ Timeout() bool }
+    return errors.As(err, &te) && te.Timeout()
+}
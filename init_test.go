@@ -0,0 +1,203 @@
+package websocket
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net"
+    "net/http"
+    "net/url"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+func TestWs_SetInitExchange(t *testing.T) {
+    srv := wstest.NewServer(func(c *wstest.Conn) {
+        var login struct {
+            Token string `json:"token"`
+        }
+        if err := c.ReadJSON(&login); err != nil {
+            return
+        }
+        switch login.Token {
+        case "silent":
+            _, _, _ = c.ReadMessage()
+            return
+        case "secret":
+            _ = c.WriteJSON(map[string]string{"type": "hello"})
+            _ = c.WriteJSON(map[string]string{"type": "welcome"})
+        default:
+            _ = c.WriteJSON(map[string]string{"type": "error", "reason": "bad token"})
+        }
+        echo(c)
+    })
+    defer srv.Close()
+
+    accept := func(t int, d []byte) (bool, error) {
+        var reply struct {
+            Type   string `json:"type"`
+            Reason string `json:"reason"`
+        }
+        if err := json.Unmarshal(d, &reply); err != nil {
+            return false, err
+        }
+        switch reply.Type {
+        case "welcome":
+            return true, nil
+        case "error":
+            return false, errors.New(reply.Reason)
+        }
+        return false, nil
+    }
+    tests := []struct {
+        name    string
+        token   string
+        wantErr error
+    }{
+        {name: "accepted after skipping a message", token: "secret"},
+        {name: "rejected", token: "wrong", wantErr: ErrInitRejected},
+        {name: "timeout", token: "silent", wantErr: ErrInitTimeout},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            w := &Ws{}
+            w.SetUrl("ws", srv.Host, "/")
+            w.SetInitExchange(InitExchange{
+                Messages: [][]byte{[]byte(`{"token":"` + tt.token + `"}`)},
+                Accept:   accept,
+                Timeout:  100 * time.Millisecond,
+            })
+            err := w.Connect()
+            defer w.Close()
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("Connect() error = %v, want %v", err, tt.wantErr)
+            }
+            if tt.wantErr != nil {
+                var ie *InitError
+                if !errors.As(err, &ie) {
+                    t.Errorf("Connect() error = %v, want an InitError", err)
+                }
+                return
+            }
+            // the read deadline is removed after the exchange
+            if err := w.WriteMessage(websocket.TextMessage, []byte("ping")); err != nil {
+                t.Fatal(err)
+            }
+            if _, d, err := w.Read(); err != nil || string(d) != "ping" {
+                t.Errorf("Read() = %s, %v, want ping", d, err)
+            }
+        })
+    }
+}
+
+func TestWs_SetInitExchange_binary(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.ExpectBinary([]byte{0x10, 0x00}), wstest.Send(websocket.BinaryMessage, []byte{0x20, 0x00}), wstest.Drain()))
+    defer srv.Close()
+    w := &Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    w.SetInitExchange(InitExchange{
+        Messages:    [][]byte{{0x10, 0x00}},
+        MessageType: websocket.BinaryMessage,
+        Accept:      func(t int, d []byte) (bool, error) { return t == websocket.BinaryMessage && d[0] == 0x20, nil },
+    })
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+    if err := srv.Err(); err != nil {
+        t.Error(err)
+    }
+}
+
+// firstWriteConn fails every write after the upgrade request, like a server that closed the
+// connection before the first message
+type firstWriteConn struct {
+    net.Conn
+    writes int
+}
+
+func (c *firstWriteConn) Write(p []byte) (int, error) {
+    if c.writes++; c.writes > 1 {
+        _ = c.Conn.Close()
+        return 0, net.ErrClosed
+    }
+    return c.Conn.Write(p)
+}
+
+func TestWs_ConnectFirstMessageFails(t *testing.T) {
+    srv := wstest.NewServer(func(c *wstest.Conn) {})
+    defer srv.Close()
+    tests := []struct {
+        name   string
+        resume bool
+    }{
+        {name: "init message"},
+        {name: "resume message", resume: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            w := &Ws{}
+            w.SetUrl("ws", srv.Host, "/")
+            if tt.resume {
+                w.SetResume(Resume{SeqField: "s", Hook: func(int64, *url.URL, http.Header) []byte {
+                    return []byte("resume")
+                }})
+                w.lastSeq, w.seqSeen = 3, true
+            } else {
+                w.SetInitMsg([]byte("hi"))
+            }
+            w.SetNetDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+                c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+                if err != nil {
+                    return nil, err
+                }
+                return &firstWriteConn{Conn: c}, nil
+            })
+            if err := w.Connect(); err == nil {
+                t.Fatal("Connect() error = nil, want the failed write")
+            }
+            if w.conn != nil {
+                t.Errorf("connection was kept after the first message failed")
+            }
+            if w.Stats().Connected {
+                t.Errorf("Stats().Connected = true after the first message failed")
+            }
+        })
+    }
+}
+
+func TestWs_ConnectDuringInitExchange(t *testing.T) {
+    silent := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer silent.Close()
+    srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer srv.Close()
+    slow := &Ws{}
+    slow.SetUrl("ws", silent.Host, "/")
+    slow.SetInitExchange(InitExchange{
+        Messages: [][]byte{[]byte("hello")},
+        Accept:   func(int, []byte) (bool, error) { return true, nil },
+        Timeout:  2 * time.Second,
+    })
+    waiting := make(chan error, 1)
+    go func() { waiting <- slow.Connect() }()
+    if !silent.WaitFor(1, time.Second) {
+        t.Fatal("the init message was not sent")
+    }
+    // another Ws connects while the first waits for its reply
+    w := &Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    start := time.Now()
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("Connect() took %v while another Ws waited for its init reply", d)
+    }
+    if err := <-waiting; !errors.Is(err, ErrInitTimeout) {
+        t.Errorf("Connect() error = %v, want %v", err, ErrInitTimeout)
+    }
+}
@@ -0,0 +1,64 @@
+package websocket
+
+import (
+    "context"
+)
+
+// Message is a single frame that passes through the interceptors
+type Message struct {
+    Type int
+    Data []byte
+}
+
+// Handler processes a message, for outbound messages the last handler writes it to the connection,
+// for inbound messages the last handler delivers it to the reader
+type Handler func(ctx context.Context, m *Message) error
+
+// Interceptor wraps a handler, it can change the message before calling next,
+// drop it by returning nil without calling next or reject it by returning an error
+type Interceptor func(next Handler) Handler
+
+// UseOutbound add interceptors for every sent message, the first one added runs first
+func (w *Ws) UseOutbound(i ...Interceptor) {
+    w.interceptLock.Lock()
+    defer w.interceptLock.Unlock()
+    w.outbound = append(w.outbound, i...)
+}
+
+// UseInbound add interceptors for every received message, the first one added runs first
+func (w *Ws) UseInbound(i ...Interceptor) {
+    w.interceptLock.Lock()
+    defer w.interceptLock.Unlock()
+    w.inbound = append(w.inbound, i...)
+}
+
+// chain wrap h in the interceptors so the first interceptor is the outermost
+func chain(interceptors []Interceptor, h Handler) Handler {
+    for i := len(interceptors) - 1; i >= 0; i-- {
+        h = interceptors[i](h)
+    }
+    return h
+}
+
+// sendChain return the outbound chain ending in h
+func (w *Ws) sendChain(h Handler) Handler {
+    w.interceptLock.Lock()
+    defer w.interceptLock.Unlock()
+    return chain(w.outbound, h)
+}
+
+// receive run a received message through the inbound chain,
+// ok is false when an interceptor dropped the message
+func (w *Ws) receive(ctx context.Context, m Message) (out Message, ok bool, err error) {
+    w.interceptLock.Lock()
+    h := chain(w.inbound, func(ctx context.Context, m *Message) error {
+        out = *m
+        ok = true
+        return nil
+    })
+    w.interceptLock.Unlock()
+    if err := h(ctx, &m); err != nil {
+        return Message{}, false, err
+    }
+    return out, ok, nil
+}
@@ -0,0 +1,106 @@
+package websocket
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "reflect"
+    "testing"
+
+    "github.com/gorilla/websocket"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+func Test_chain(t *testing.T) {
+    var order []string
+    named := func(name string) Interceptor {
+        return func(next Handler) Handler {
+            return func(ctx context.Context, m *Message) error {
+                order = append(order, name)
+                return next(ctx, m)
+            }
+        }
+    }
+    h := chain([]Interceptor{named("first"), named("second")}, func(ctx context.Context, m *Message) error {
+        order = append(order, "handler")
+        return nil
+    })
+    if err := h(context.Background(), &Message{}); err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"first", "second", "handler"}; !reflect.DeepEqual(order, want) {
+        t.Errorf("chain() order = %v, want %v", order, want)
+    }
+}
+
+func TestWs_UseOutbound(t *testing.T) {
+    errRejected := errors.New("rejected")
+    w, _ := newTestWs(t, wstest.Script(wstest.Echo()))
+    w.UseOutbound(func(next Handler) Handler {
+        return func(ctx context.Context, m *Message) error {
+            switch string(m.Data) {
+            case "drop":
+                return nil
+            case "reject":
+                return errRejected
+            }
+            m.Data = bytes.ToUpper(m.Data)
+            return next(ctx, m)
+        }
+    })
+    tests := []struct {
+        name    string
+        data    string
+        wantErr error
+    }{
+        {name: "dropped", data: "drop"},
+        {name: "rejected", data: "reject", wantErr: errRejected},
+        {name: "modified", data: "hello"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if err := w.WriteMessage(websocket.TextMessage, []byte(tt.data)); err != tt.wantErr {
+                t.Errorf("WriteMessage() error = %v, want %v", err, tt.wantErr)
+            }
+        })
+    }
+    // only the modified message reached the server
+    _, d, err := w.Read()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(d) != "HELLO" {
+        t.Errorf("Read() = %s, want HELLO", d)
+    }
+}
+
+func TestWs_UseInbound(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Script(wstest.Echo()))
+    w.UseInbound(func(next Handler) Handler {
+        return func(ctx context.Context, m *Message) error {
+            if string(m.Data) == "heartbeat" {
+                return nil
+            }
+            return next(ctx, m)
+        }
+    })
+    for _, m := range []string{"heartbeat", "data"} {
+        if err := w.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    var v string
+    if err := w.WriteJSON("json"); err != nil {
+        t.Fatal(err)
+    }
+    _, d, err := w.Read()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(d) != "data" {
+        t.Errorf("Read() = %s, want data", d)
+    }
+    if err := w.ReadJSON(&v); err != nil || v != "json" {
+        t.Errorf("ReadJSON() = %v, %v, want json", v, err)
+    }
+}
@@ -0,0 +1,91 @@
+package websocket
+
+import (
+    "fmt"
+    "net/http"
+)
+
+// ConnectInfo is passed to the OnConnect hook
+type ConnectInfo struct {
+    // ConnID is the generation of the connection, it is increased for every connection that is made
+    ConnID uint64
+
+    // Response is the response of the server to the upgrade request
+    Response *http.Response
+
+    // Attempt is the reconnect attempt that made the connection, 0 when Connect was called directly
+    Attempt int
+}
+
+// Hooks are called on changes in the life of a connection, every hook is optional
+type Hooks struct {
+    // OnConnect is called after a connection is made and the init message was sent,
+    // it can read and write on the connection, when it returns an error the connection
+    // is closed and Connect returns the error
+    OnConnect func(w *Ws, info ConnectInfo) error
+
+    // OnDisconnect is called when a connection ended with an error, it runs on the goroutine
+    // that reconnects and must not read or write on the connection
+    OnDisconnect func(e CloseEvent)
+
+    // OnReconnectAttempt is called before every reconnect attempt with the error of the previous attempt,
+    // like OnDisconnect it must not read or write on the connection
+    OnReconnectAttempt func(attempt int, lastErr error)
+
+    // OnGiveUp is called when the plugin stops reconnecting, because of the close decision
+    // or because the maximum number of attempts was reached
+    OnGiveUp func(attempts int, err error)
+}
+
+// HookError is returned by Connect when the OnConnect hook rejected the connection
+type HookError struct {
+    ConnID uint64
+    Err    error
+}
+
+func (e *HookError) Error() string {
+    return fmt.Sprintf("connection %d aborted by the connect hook: %v", e.ConnID, e.Err)
+}
+
+func (e *HookError) Unwrap() error { return e.Err }
+
+// SetHooks set the lifecycle hooks
+func (w *Ws) SetHooks(h Hooks) {
+    w.hooks = h
+}
+
+// Hooks return the lifecycle hooks, so a layer on top of the plugin can wrap them
+func (w *Ws) Hooks() Hooks {
+    return w.hooks
+}
+
+// onConnect run the OnConnect hook, the connection is closed when it fails
+func (w *Ws) onConnect(info ConnectInfo) error {
+    if w.hooks.OnConnect == nil {
+        return nil
+    }
+    if err := w.hooks.OnConnect(w, info); err != nil {
+        w.log().Warn("connect hook failed", w.logArgs("err", err)...)
+        w.abortConnect()
+        return &HookError{ConnID: info.ConnID, Err: err}
+    }
+    return nil
+}
+
+func (w *Ws) onDisconnect(e CloseEvent) {
+    if w.hooks.OnDisconnect != nil {
+        w.hooks.OnDisconnect(e)
+    }
+}
+
+func (w *Ws) onReconnectAttempt(attempt int, lastErr error) {
+    if w.hooks.OnReconnectAttempt != nil {
+        w.hooks.OnReconnectAttempt(attempt, lastErr)
+    }
+}
+
+func (w *Ws) onGiveUp(attempts int, err error) {
+    if w.hooks.OnGiveUp != nil {
+        w.hooks.OnGiveUp(attempts, err)
+    }
+}
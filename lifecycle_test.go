@@ -0,0 +1,126 @@
+package websocket
+
+import (
+    "errors"
+    "net/http"
+    "testing"
+
+    "github.com/gorilla/websocket"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+func TestHooks_OnConnect(t *testing.T) {
+    errDenied := errors.New("denied")
+    srv := wstest.NewServer(func(c *wstest.Conn) {
+        _, d, err := c.Receive()
+        if err != nil {
+            return
+        }
+        reply := "denied"
+        if string(d) == "auth:secret" {
+            reply = "ok"
+        }
+        _ = c.WriteMessage(websocket.TextMessage, []byte(reply))
+        echo(c)
+    })
+    defer srv.Close()
+
+    tests := []struct {
+        name    string
+        token   string
+        wantErr error
+    }{
+        {name: "accepted", token: "secret"},
+        {name: "rejected", token: "wrong", wantErr: errDenied},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var info ConnectInfo
+            w := &Ws{}
+            w.SetUrl("ws", srv.Host, "/")
+            w.SetHooks(Hooks{OnConnect: func(w *Ws, i ConnectInfo) error {
+                info = i
+                if err := w.WriteMessage(websocket.TextMessage, []byte("auth:"+tt.token)); err != nil {
+                    return err
+                }
+                _, d, err := w.Read()
+                if err != nil {
+                    return err
+                }
+                if string(d) != "ok" {
+                    return errDenied
+                }
+                return nil
+            }})
+            err := w.Connect()
+            defer w.Close()
+            var he *HookError
+            if tt.wantErr == nil && err != nil {
+                t.Fatalf("Connect() error = %v", err)
+            }
+            if tt.wantErr != nil && (!errors.As(err, &he) || !errors.Is(err, tt.wantErr)) {
+                t.Fatalf("Connect() error = %v, want a HookError wrapping %v", err, tt.wantErr)
+            }
+            if info.ConnID != 1 || info.Response == nil || info.Response.StatusCode != http.StatusSwitchingProtocols {
+                t.Errorf("ConnectInfo = %+v, want connection 1 with the upgrade response", info)
+            }
+            if tt.wantErr != nil && w.conn != nil {
+                t.Errorf("connection was kept after the hook failed")
+            }
+        })
+    }
+}
+
+func TestHooks_reconnect(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Sequence(
+        wstest.Script(wstest.CloseWith(websocket.CloseGoingAway, "restart")),
+        wstest.Script(wstest.Echo()),
+    ))
+    var events []string
+    var connected ConnectInfo
+    w.SetHooks(Hooks{
+        OnConnect:          func(w *Ws, i ConnectInfo) error { connected = i; return nil },
+        OnDisconnect:       func(e CloseEvent) { events = append(events, "disconnect") },
+        OnReconnectAttempt: func(attempt int, err error) { events = append(events, "attempt") },
+        OnGiveUp:           func(attempts int, err error) { events = append(events, "give up") },
+    })
+    w.Reconnect(true)
+    if _, _, err := w.Read(); !errors.Is(err, ErrClosed) {
+        t.Fatalf("Read() error = %v, want ErrClosed", err)
+    }
+    if len(events) != 2 || events[0] != "disconnect" || events[1] != "attempt" {
+        t.Errorf("events = %v, want disconnect and attempt", events)
+    }
+    if connected.ConnID != 2 || connected.Attempt != 1 {
+        t.Errorf("ConnectInfo = %+v, want connection 2 made by attempt 1", connected)
+    }
+}
+
+func TestHooks_OnGiveUp(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Script(wstest.CloseWith(websocket.ClosePolicyViolation, "banned")))
+    var gaveUp error
+    w.SetHooks(Hooks{OnGiveUp: func(attempts int, err error) { gaveUp = err }})
+    w.Reconnect(true)
+    _, _, err := w.Read()
+    if gaveUp == nil || gaveUp != err {
+        t.Errorf("OnGiveUp() error = %v, want %v", gaveUp, err)
+    }
+}
+
+func TestHooks_endedOnce(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Script(wstest.CloseWith(websocket.ClosePolicyViolation, "banned")))
+    var disconnects, giveUps int
+    w.SetHooks(Hooks{
+        OnDisconnect: func(CloseEvent) { disconnects++ },
+        OnGiveUp:     func(int, error) { giveUps++ },
+    })
+    w.Reconnect(true)
+    for i := 0; i < 3; i++ {
+        if _, _, err := w.Read(); err == nil {
+            t.Fatalf("Read() error = nil, want the close of the connection")
+        }
+    }
+    if disconnects != 1 || giveUps != 1 {
+        t.Errorf("OnDisconnect() called %d times and OnGiveUp() %d times, want 1 and 1", disconnects, giveUps)
+    }
+}
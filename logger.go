@@ -0,0 +1,74 @@
+package websocket
+
+import (
+    "fmt"
+    "log"
+    "strings"
+)
+
+// Logger is the logging interface used by the plugin, a *slog.Logger satisfies it,
+// args are alternating keys and values like in log/slog
+type Logger interface {
+    Debug(msg string, args ...interface{})
+    Info(msg string, args ...interface{})
+    Warn(msg string, args ...interface{})
+    Error(msg string, args ...interface{})
+}
+
+// NopLogger discards everything, it is used when no logger is set
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// StdLogger wraps a standard library logger, key value pairs are printed as key=value
+func StdLogger(l *log.Logger) Logger {
+    return stdLogger{l: l}
+}
+
+// stdLogger writes every level to a *log.Logger with the level as prefix
+type stdLogger struct {
+    l *log.Logger
+}
+
+func (s stdLogger) Debug(msg string, args ...interface{}) { s.print("DEBUG", msg, args) }
+func (s stdLogger) Info(msg string, args ...interface{})  { s.print("INFO", msg, args) }
+func (s stdLogger) Warn(msg string, args ...interface{})  { s.print("WARN", msg, args) }
+func (s stdLogger) Error(msg string, args ...interface{}) { s.print("ERROR", msg, args) }
+
+func (s stdLogger) print(level, msg string, args []interface{}) {
+    var b strings.Builder
+    b.WriteString(level)
+    b.WriteString(" ")
+    b.WriteString(msg)
+    for i := 0; i < len(args); i += 2 {
+        if i+1 == len(args) {
+            fmt.Fprintf(&b, " %v", args[i])
+            break
+        }
+        fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+    }
+    s.l.Println(b.String())
+}
+
+// SetLogger set the logger used for connection events, nil makes the plugin silent again
+func (w *Ws) SetLogger(l Logger) {
+    w.logger = l
+}
+
+// log return the configured logger or one that discards everything
+func (w *Ws) log() Logger {
+    if w.logger == nil {
+        return NopLogger
+    }
+    return w.logger
+}
+
+// logArgs return the fields that are added to every log line of this connection
+func (w *Ws) logArgs(args ...interface{}) []interface{} {
+    return append([]interface{}{"url", w.url.String(), "conn_id", w.ConnID()}, args...)
+}
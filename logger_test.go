@@ -0,0 +1,44 @@
+package websocket
+
+import (
+    "bytes"
+    "errors"
+    "log"
+    "testing"
+)
+
+func TestStdLogger(t *testing.T) {
+    tests := []struct {
+        name string
+        log  func(Logger)
+        want string
+    }{
+        {name: "message only", log: func(l Logger) { l.Info("made a connection") }, want: "INFO made a connection\n"},
+        {name: "fields", log: func(l Logger) { l.Warn("reconnect failed", "attempt", 2, "conn_id", 7) }, want: "WARN reconnect failed attempt=2 conn_id=7\n"},
+        {name: "odd fields", log: func(l Logger) { l.Error("oops", "err") }, want: "ERROR oops err\n"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var buf bytes.Buffer
+            tt.log(StdLogger(log.New(&buf, "", 0)))
+            if got := buf.String(); got != tt.want {
+                t.Errorf("StdLogger() = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestWs_SetLogger(t *testing.T) {
+    w := &Ws{}
+    if _, ok := w.log().(nopLogger); !ok {
+        t.Errorf("log() = %T, want a silent logger by default", w.log())
+    }
+    var buf bytes.Buffer
+    w.SetLogger(StdLogger(log.New(&buf, "", 0)))
+    w.errCheck(0, errTest)
+    if buf.Len() == 0 {
+        t.Errorf("errCheck() did not log with a logger set")
+    }
+}
+
+var errTest = errors.New("test error")
@@ -0,0 +1,196 @@
+package websocket
+
+import (
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Stats is a snapshot of the counters of a Ws, they are kept over reconnects
+type Stats struct {
+    // connections that were made and dial attempts that failed
+    Connects   uint64
+    DialErrors uint64
+
+    // reconnect attempts made by the automatic reconnect
+    Reconnects uint64
+
+    // messages and bytes sent and received
+    MessagesIn  uint64
+    MessagesOut uint64
+    BytesIn     uint64
+    BytesOut    uint64
+
+    // failed reads and writes
+    ReadErrors  uint64
+    WriteErrors uint64
+
+    // number of messages waiting in a write queue or scheduler
+    QueueDepth int
+
+    // latency of the last dial and the sum over all dials
+    LastDialLatency  time.Duration
+    DialLatencySum   time.Duration
+    DialLatencyCount uint64
+
+    // total time spent without a connection after the first connect
+    Disconnected time.Duration
+
+    // true while there is a connection
+    Connected bool
+}
+
+// MetricsHook receives every event that is counted in Stats
+type MetricsHook interface {
+    OnDial(latency time.Duration, err error)
+    OnReconnect(attempt int)
+    OnDisconnect(err error)
+    OnMessageIn(messageType int, size int)
+    OnMessageOut(messageType int, size int, err error)
+    OnQueueDepth(n int)
+}
+
+// metrics holds the counters behind Stats
+type metrics struct {
+    lock              sync.Mutex
+    stats             Stats
+    disconnectedSince time.Time
+    hook              MetricsHook
+}
+
+// SetMetricsHook set a hook that is called for every counted event
+func (w *Ws) SetMetricsHook(h MetricsHook) {
+    w.metrics.lock.Lock()
+    defer w.metrics.lock.Unlock()
+    w.metrics.hook = h
+}
+
+// Stats return a snapshot of the connection and traffic counters
+func (w *Ws) Stats() Stats {
+    w.metrics.lock.Lock()
+    defer w.metrics.lock.Unlock()
+    s := w.metrics.stats
+    if !w.metrics.disconnectedSince.IsZero() {
+        s.Disconnected += w.now().Sub(w.metrics.disconnectedSince)
+    }
+    return s
+}
+
+// update change the counters under the lock and return the hook to call afterwards
+func (m *metrics) update(f func(s *Stats)) MetricsHook {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    f(&m.stats)
+    return m.hook
+}
+
+func (m *metrics) dial(latency time.Duration, now time.Time, err error) {
+    h := m.update(func(s *Stats) {
+        if err != nil {
+            s.DialErrors++
+            return
+        }
+        s.Connects++
+        s.LastDialLatency = latency
+        s.DialLatencySum += latency
+        s.DialLatencyCount++
+        s.Connected = true
+        if !m.disconnectedSince.IsZero() {
+            s.Disconnected += now.Sub(m.disconnectedSince)
+            m.disconnectedSince = time.Time{}
+        }
+    })
+    if h != nil {
+        h.OnDial(latency, err)
+    }
+}
+
+func (m *metrics) reconnect(attempt int) {
+    h := m.update(func(s *Stats) { s.Reconnects++ })
+    if h != nil {
+        h.OnReconnect(attempt)
+    }
+}
+
+func (m *metrics) disconnect(now time.Time, err error) {
+    h := m.update(func(s *Stats) {
+        if !s.Connected {
+            return
+        }
+        s.Connected = false
+        m.disconnectedSince = now
+    })
+    if h != nil {
+        h.OnDisconnect(err)
+    }
+}
+
+func (m *metrics) messageIn(messageType int, size int, err error) {
+    h := m.update(func(s *Stats) {
+        if err != nil {
+            s.ReadErrors++
+            return
+        }
+        s.MessagesIn++
+        s.BytesIn += uint64(size)
+    })
+    if h != nil && err == nil {
+        h.OnMessageIn(messageType, size)
+    }
+}
+
+func (m *metrics) messageOut(messageType int, size int, err error) {
+    h := m.update(func(s *Stats) {
+        if err != nil {
+            s.WriteErrors++
+            return
+        }
+        s.MessagesOut++
+        s.BytesOut += uint64(size)
+    })
+    if h != nil {
+        h.OnMessageOut(messageType, size, err)
+    }
+}
+
+func (m *metrics) queueDepth(n int) {
+    h := m.update(func(s *Stats) { s.QueueDepth = n })
+    if h != nil {
+        h.OnQueueDepth(n)
+    }
+}
+
+// MetricsHandler serve the stats in the prometheus text exposition format,
+// every metric name starts with the namespace followed by an underscore
+func (w *Ws) MetricsHandler(namespace string) http.Handler {
+    if namespace == "" {
+        namespace = "websocket"
+    }
+    return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+        s := w.Stats()
+        rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        metric := func(name, kind, help string, value interface{}) {
+            fmt.Fprintf(rw, "# HELP %s_%s %s\n# TYPE %s_%s %s\n%s_%s %v\n", namespace, name, help, namespace, name, kind, namespace, name, value)
+        }
+        connected := 0
+        if s.Connected {
+            connected = 1
+        }
+        metric("connects_total", "counter", "Number of connections made.", s.Connects)
+        metric("dial_errors_total", "counter", "Number of failed dial attempts.", s.DialErrors)
+        metric("reconnects_total", "counter", "Number of automatic reconnect attempts.", s.Reconnects)
+        metric("messages_received_total", "counter", "Number of messages received.", s.MessagesIn)
+        metric("messages_sent_total", "counter", "Number of messages sent.", s.MessagesOut)
+        metric("received_bytes_total", "counter", "Number of payload bytes received.", s.BytesIn)
+        metric("sent_bytes_total", "counter", "Number of payload bytes sent.", s.BytesOut)
+        metric("read_errors_total", "counter", "Number of failed reads.", s.ReadErrors)
+        metric("write_errors_total", "counter", "Number of failed writes.", s.WriteErrors)
+        metric("queue_depth", "gauge", "Number of messages waiting to be sent.", s.QueueDepth)
+        metric("connected", "gauge", "1 while there is a connection.", connected)
+        metric("disconnected_seconds_total", "counter", "Time spent without a connection.", s.Disconnected.Seconds())
+        fmt.Fprintf(rw, "# HELP %s_dial_latency_seconds Time taken to dial.\n# TYPE %s_dial_latency_seconds summary\n", namespace, namespace)
+        fmt.Fprintf(rw, "%s_dial_latency_seconds_sum %v\n", namespace, s.DialLatencySum.Seconds())
+        fmt.Fprintf(rw, "%s_dial_latency_seconds_count %v\n", namespace, s.DialLatencyCount)
+    })
+}
@@ -0,0 +1,97 @@
+package websocket
+
+import (
+    "errors"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/gorilla/websocket"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+func TestWs_Stats(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Script(wstest.Echo()))
+    for _, m := range []string{"hello", "world!"} {
+        if err := w.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
+            t.Fatal(err)
+        }
+        if _, _, err := w.Read(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    tests := []struct {
+        name string
+        got  uint64
+        want uint64
+    }{
+        {name: "connects", got: w.Stats().Connects, want: 1},
+        {name: "messages out", got: w.Stats().MessagesOut, want: 2},
+        {name: "messages in", got: w.Stats().MessagesIn, want: 2},
+        {name: "bytes out", got: w.Stats().BytesOut, want: 11},
+        {name: "bytes in", got: w.Stats().BytesIn, want: 11},
+        {name: "dial count", got: w.Stats().DialLatencyCount, want: 1},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if tt.got != tt.want {
+                t.Errorf("Stats() %s = %v, want %v", tt.name, tt.got, tt.want)
+            }
+        })
+    }
+    if !w.Stats().Connected {
+        t.Errorf("Stats() Connected = false, want true")
+    }
+}
+
+func TestWs_StatsSurviveConnect(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Script(wstest.Echo()))
+    if err := w.WriteMessage(websocket.TextMessage, []byte("a")); err != nil {
+        t.Fatal(err)
+    }
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    s := w.Stats()
+    if s.Connects != 2 || s.MessagesOut != 1 {
+        t.Errorf("Stats() = %+v, want 2 connects and 1 message out", s)
+    }
+}
+
+func TestWs_StatsConnectedAfterReconnect(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Sequence(
+        wstest.Script(wstest.CloseWith(websocket.CloseGoingAway, "restart")),
+        wstest.Script(wstest.Echo()),
+        wstest.Script(wstest.Echo()),
+    ))
+    w.Reconnect(true)
+    if _, _, err := w.Read(); !errors.Is(err, ErrClosed) {
+        t.Fatalf("Read() error = %v, want ErrClosed", err)
+    }
+    if s := w.Stats(); !s.Connected || s.Reconnects != 1 {
+        t.Errorf("Stats() = %+v, want connected after 1 reconnect", s)
+    }
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    if s := w.Stats(); !s.Connected || s.Connects != 3 {
+        t.Errorf("Stats() = %+v, want connected after 3 connects", s)
+    }
+}
+
+func TestWs_MetricsHandler(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Script(wstest.Echo()))
+    rec := httptest.NewRecorder()
+    w.MetricsHandler("ws").ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+    body := rec.Body.String()
+    for _, want := range []string{
+        "# TYPE ws_connects_total counter\nws_connects_total 1\n",
+        "ws_connected 1\n",
+        "# TYPE ws_dial_latency_seconds summary\n",
+        "ws_dial_latency_seconds_count 1\n",
+    } {
+        if !strings.Contains(body, want) {
+            t.Errorf("MetricsHandler() body does not contain %q:\n%s", want, body)
+        }
+    }
+}
@@ -0,0 +1,740 @@
+package mqtt
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+var (
+    // ErrKeepAliveTimeout is the error of a client that got no PINGRESP in time
+    ErrKeepAliveTimeout = errors.New("mqtt: keepalive timed out")
+
+    // ErrClientClosed is returned after Disconnect
+    ErrClientClosed = errors.New("mqtt: client closed")
+
+    // ErrNoPacketID is returned when every packet id is in use
+    ErrNoPacketID = errors.New("mqtt: no free packet id")
+
+    // ErrBadTopic is returned for topics and filters that are not valid
+    ErrBadTopic = errors.New("mqtt: bad topic")
+)
+
+// ReasonError is a refusal from the broker, a CONNACK with a return code or a packet with an MQTT 5 reason code
+type ReasonError struct {
+    Type byte
+    Code byte
+}
+
+func (e *ReasonError) Error() string {
+    return fmt.Sprintf("mqtt: %s refused with code 0x%02x", TypeName(e.Type), e.Code)
+}
+
+// Config of a Client
+type Config struct {
+    // Version is V311 or V5, 0 uses V311
+    Version byte
+
+    // ClientID identifies the session, an MQTT 5 broker can assign one when it is empty
+    ClientID string
+
+    // Username and Password are sent when they are set
+    Username string
+    Password []byte
+
+    // CleanStart drops the session on the broker for the first connection,
+    // reconnects always resume the session
+    CleanStart bool
+
+    // SessionExpiry is the MQTT 5 session expiry interval in seconds, 3.1.1 sessions are kept by the broker
+    SessionExpiry uint32
+
+    // KeepAlive is the longest time without sending a packet, a PINGREQ is sent when it passes,
+    // 0 disables it, it is sent in whole seconds
+    KeepAlive time.Duration
+
+    // Will is published by the broker when the connection ends without a DISCONNECT
+    Will *Message
+
+    // ConnectTimeout is how long to wait for CONNACK, 0 waits 30 seconds
+    ConnectTimeout time.Duration
+
+    // OnError is called for packets that can not be decoded and for a DISCONNECT from the broker, it must not block
+    OnError func(err error)
+
+    // Clock is used for the keepalive, the system clock is used when it is nil
+    Clock plugin.Clock
+}
+
+// Client speaks MQTT over a Ws, it resumes its session whenever the Ws makes a new connection
+type Client struct {
+    w     *plugin.Ws
+    cfg   Config
+    clock plugin.Clock
+
+    // writeLock makes sure there is only one writer
+    writeLock sync.Mutex
+
+    lock           sync.Mutex
+    clientID       string
+    resumed        bool
+    sessionPresent bool
+    keepAlive      time.Duration
+    nextID         uint16
+    seq            uint64
+    inflight       map[uint16]*pending
+    requests       map[uint16]*pending
+    subs           map[string]*subscription
+    inbound        map[uint16]bool
+    stash          []*Packet
+    err            error
+    running        bool
+    closed         bool
+    stop           chan struct{}
+
+    // the time packets were last seen, the PINGREQ that waits for an answer and the connection they belong to
+    lastRead  time.Time
+    lastWrite time.Time
+    pingSent  time.Time
+    gen       uint64
+    timedOut  bool
+}
+
+// pending is a packet that waits for the broker, the PUBLISH is replaced by its PUBREL after a PUBREC
+type pending struct {
+    packet *Packet
+    reply  *Packet
+    done   chan error
+    seq    uint64
+}
+
+type subscription struct {
+    filter  string
+    qos     byte
+    handler func(m *Message)
+    seq     uint64
+}
+
+// NewClient create a client for w, the CONNECT packet is sent as the init exchange of w
+// and the OnConnect hook of w is wrapped to resume the session
+func NewClient(w *plugin.Ws, cfg Config) *Client {
+    if cfg.Version == 0 {
+        cfg.Version = V311
+    }
+    if cfg.Clock == nil {
+        cfg.Clock = plugin.SystemClock
+    }
+    c := &Client{
+        w:         w,
+        cfg:       cfg,
+        clock:     cfg.Clock,
+        clientID:  cfg.ClientID,
+        keepAlive: cfg.KeepAlive,
+        inflight:  map[uint16]*pending{},
+        requests:  map[uint16]*pending{},
+        subs:      map[string]*subscription{},
+        inbound:   map[uint16]bool{},
+        stop:      make(chan struct{}),
+    }
+    w.SetSubprotocols("mqtt")
+    w.SetInitExchange(c.exchange())
+    hooks := w.Hooks()
+    next := hooks.OnConnect
+    hooks.OnConnect = func(w *plugin.Ws, info plugin.ConnectInfo) error {
+        c.restore()
+        if next != nil {
+            return next(w, info)
+        }
+        return nil
+    }
+    w.SetHooks(hooks)
+    return c
+}
+
+// Connect make the connection and start reading packets
+func (c *Client) Connect(ctx context.Context) error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return ErrClientClosed
+    }
+    c.lock.Unlock()
+    if err := c.w.ConnectContext(ctx); err != nil {
+        return err
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.err = nil
+    if !c.running {
+        c.running = true
+        go c.readLoop()
+    }
+    return nil
+}
+
+// ClientID return the client id, it is the one the broker assigned when the config had none
+func (c *Client) ClientID() string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.clientID
+}
+
+// SessionPresent return true when the broker still had the session of the current connection
+func (c *Client) SessionPresent() bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.sessionPresent
+}
+
+// Err return why the client stopped reading, it is nil while it runs
+func (c *Client) Err() error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.err
+}
+
+// Publish a message, QoS 1 and 2 wait until the broker confirmed the message or ctx is done,
+// a message that is not confirmed stays in the session and is sent again after a reconnect
+func (c *Client) Publish(ctx context.Context, m Message) error {
+    if m.QoS > 2 {
+        return fmt.Errorf("mqtt: bad qos %d", m.QoS)
+    }
+    if m.Topic == "" || strings.ContainsAny(m.Topic, "+#") {
+        return fmt.Errorf("%w: %q", ErrBadTopic, m.Topic)
+    }
+    p := &Packet{Type: PUBLISH, QoS: m.QoS, Retain: m.Retain, Topic: m.Topic, Payload: m.Payload, Properties: m.Properties}
+    if m.QoS == 0 {
+        return c.write(p)
+    }
+    _, err := c.await(ctx, c.inflight, p)
+    return err
+}
+
+// Subscribe to a topic filter and return the QoS the broker granted, handler is called for every message
+// on the goroutine that reads packets, so it must not publish with QoS 1 or 2
+func (c *Client) Subscribe(ctx context.Context, filter string, qos byte, handler func(m *Message)) (byte, error) {
+    if !validFilter(filter) {
+        return 0, fmt.Errorf("%w: %q", ErrBadTopic, filter)
+    }
+    c.lock.Lock()
+    prev := c.subs[filter]
+    c.seq++
+    c.subs[filter] = &subscription{filter: filter, qos: qos, handler: handler, seq: c.seq}
+    c.lock.Unlock()
+    reply, err := c.await(ctx, c.requests, &Packet{Type: SUBSCRIBE, Topics: []TopicFilter{{Filter: filter, QoS: qos}}})
+    if err == nil && (len(reply.Codes) == 0 || reply.Codes[0] >= 0x80) {
+        code := byte(0x80)
+        if len(reply.Codes) > 0 {
+            code = reply.Codes[0]
+        }
+        err = &ReasonError{Type: SUBACK, Code: code}
+    }
+    if err != nil {
+        c.lock.Lock()
+        if prev != nil {
+            c.subs[filter] = prev
+        } else {
+            delete(c.subs, filter)
+        }
+        c.lock.Unlock()
+        return 0, err
+    }
+    return reply.Codes[0], nil
+}
+
+// Unsubscribe from a topic filter, it is not subscribed again after a reconnect
+func (c *Client) Unsubscribe(ctx context.Context, filter string) error {
+    c.lock.Lock()
+    delete(c.subs, filter)
+    c.lock.Unlock()
+    reply, err := c.await(ctx, c.requests, &Packet{Type: UNSUBSCRIBE, Topics: []TopicFilter{{Filter: filter}}})
+    if err != nil {
+        return err
+    }
+    if len(reply.Codes) > 0 && reply.Codes[0] >= 0x80 {
+        return &ReasonError{Type: UNSUBACK, Code: reply.Codes[0]}
+    }
+    return nil
+}
+
+// Disconnect send DISCONNECT and close the connection, the broker drops the will
+func (c *Client) Disconnect() error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil
+    }
+    c.closed = true
+    close(c.stop)
+    c.lock.Unlock()
+    err := c.write(&Packet{Type: DISCONNECT})
+    if cerr := c.w.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// await give p a packet id, send it and wait for the packet that completes it,
+// the packet stays in the session when the write failed because the plugin reconnected
+func (c *Client) await(ctx context.Context, set map[uint16]*pending, p *Packet) (*Packet, error) {
+    pe := &pending{packet: p, done: make(chan error, 1)}
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil, ErrClientClosed
+    }
+    if p.PacketID = c.newID(); p.PacketID == 0 {
+        c.lock.Unlock()
+        return nil, ErrNoPacketID
+    }
+    c.seq++
+    pe.seq = c.seq
+    set[p.PacketID] = pe
+    c.lock.Unlock()
+    conn := c.w.ConnID()
+    if err := c.write(p); err != nil && !c.w.Reconnected(conn) {
+        c.lock.Lock()
+        delete(set, p.PacketID)
+        c.lock.Unlock()
+        return nil, err
+    }
+    select {
+    case err := <-pe.done:
+        return pe.reply, err
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// newID return a packet id that is not in use, or 0 when there is none, the lock must be held
+func (c *Client) newID() uint16 {
+    for i := 0; i < 1<<16; i++ {
+        c.nextID++
+        if c.nextID == 0 {
+            continue
+        }
+        if c.inflight[c.nextID] == nil && c.requests[c.nextID] == nil {
+            return c.nextID
+        }
+    }
+    return 0
+}
+
+// write a packet
+func (c *Client) write(p *Packet) error {
+    c.writeLock.Lock()
+    defer c.writeLock.Unlock()
+    if err := c.w.WriteMessage(websocket.BinaryMessage, Encode(p, c.cfg.Version)); err != nil {
+        return err
+    }
+    c.lock.Lock()
+    c.lastWrite = c.clock.Now()
+    c.lock.Unlock()
+    return nil
+}
+
+// exchange build the init exchange, the first connection uses CleanStart from the config and the others resume
+func (c *Client) exchange() plugin.InitExchange {
+    c.lock.Lock()
+    conn := &Connect{
+        Version:    c.cfg.Version,
+        ClientID:   c.clientID,
+        Username:   c.cfg.Username,
+        Password:   c.cfg.Password,
+        CleanStart: c.cfg.CleanStart && !c.resumed,
+        KeepAlive:  uint16((c.cfg.KeepAlive + time.Second - 1) / time.Second),
+        Will:       c.cfg.Will,
+    }
+    c.lock.Unlock()
+    p := &Packet{Type: CONNECT, Connect: conn}
+    if c.cfg.SessionExpiry > 0 {
+        p.Properties = Properties{{ID: PropSessionExpiry, Value: c.cfg.SessionExpiry}}
+    }
+    return plugin.InitExchange{
+        Messages:    [][]byte{Encode(p, c.cfg.Version)},
+        MessageType: websocket.BinaryMessage,
+        Accept:      c.accept,
+        Timeout:     c.cfg.ConnectTimeout,
+    }
+}
+
+// accept wait for the CONNACK during the init exchange, packets after it in the same message are kept for the read loop
+func (c *Client) accept(messageType int, data []byte) (bool, error) {
+    packets, err := decodeAll(data, c.cfg.Version)
+    if err != nil {
+        return false, err
+    }
+    if len(packets) == 0 {
+        return false, nil
+    }
+    p := packets[0]
+    if p.Type != CONNACK {
+        return false, fmt.Errorf("mqtt: got %s before CONNACK", TypeName(p.Type))
+    }
+    if p.Code != 0 {
+        return false, &ReasonError{Type: CONNACK, Code: p.Code}
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.sessionPresent = p.SessionPresent
+    if id := p.Properties.String(PropAssignedClientID); id != "" {
+        c.clientID = id
+    }
+    if ka, ok := p.Properties.Get(PropServerKeepAlive); ok {
+        c.keepAlive = time.Duration(ka.Value) * time.Second
+    }
+    c.stash = packets[1:]
+    return true, nil
+}
+
+// decodeAll decode every packet in a websocket message
+func decodeAll(data []byte, version byte) ([]*Packet, error) {
+    var packets []*Packet
+    for len(data) > 0 {
+        p, n, err := Decode(data, version)
+        if err != nil {
+            return packets, err
+        }
+        if n == 0 {
+            return packets, fmt.Errorf("%w: incomplete packet", ErrMalformed)
+        }
+        packets = append(packets, p)
+        data = data[n:]
+    }
+    return packets, nil
+}
+
+// restore resume the session after a new connection, the packets are sent again from another goroutine
+// because a write that reconnected still holds the write lock
+func (c *Client) restore() {
+    c.lock.Lock()
+    c.resumed = true
+    c.gen++
+    gen := c.gen
+    c.timedOut = false
+    c.lastRead = c.clock.Now()
+    c.lastWrite = c.lastRead
+    c.pingSent = time.Time{}
+    present := c.sessionPresent
+    if !present {
+        c.inbound = map[uint16]bool{}
+    }
+    var resend []*pending
+    for _, pe := range c.inflight {
+        resend = append(resend, pe)
+    }
+    for _, pe := range c.requests {
+        resend = append(resend, pe)
+    }
+    sort.Slice(resend, func(i, j int) bool { return resend[i].seq < resend[j].seq })
+    packets := make([]*Packet, 0, len(resend)+1)
+    for _, pe := range resend {
+        p := *pe.packet
+        if p.Type == PUBLISH {
+            p.Dup = true
+        }
+        packets = append(packets, &p)
+    }
+    if !present && len(c.subs) > 0 {
+        // the broker lost the subscriptions, the SUBACK is not waited for
+        p := &Packet{Type: SUBSCRIBE, PacketID: c.newID()}
+        for _, s := range c.sortedSubs() {
+            p.Topics = append(p.Topics, TopicFilter{Filter: s.filter, QoS: s.qos})
+        }
+        if p.PacketID != 0 {
+            c.seq++
+            c.requests[p.PacketID] = &pending{packet: p, seq: c.seq}
+            packets = append(packets, p)
+        }
+    }
+    keepAlive := c.keepAlive
+    c.lock.Unlock()
+    c.w.SetInitExchange(c.exchange())
+    go func() {
+        for _, p := range packets {
+            c.lock.Lock()
+            current := c.gen
+            c.lock.Unlock()
+            if current != gen || c.write(p) != nil {
+                return
+            }
+        }
+    }()
+    if keepAlive > 0 {
+        go c.keepalive(gen, keepAlive)
+    }
+}
+
+// sortedSubs return the subscriptions in the order they were made, the lock must be held
+func (c *Client) sortedSubs() []*subscription {
+    subs := make([]*subscription, 0, len(c.subs))
+    for _, s := range c.subs {
+        subs = append(subs, s)
+    }
+    sort.Slice(subs, func(i, j int) bool { return subs[i].seq < subs[j].seq })
+    return subs
+}
+
+// readLoop read packets until the connection fails and is not made again
+func (c *Client) readLoop() {
+    var buf []byte
+    var conn uint64
+    for {
+        c.lock.Lock()
+        stash := c.stash
+        c.stash = nil
+        c.lock.Unlock()
+        for _, p := range stash {
+            c.dispatch(p)
+        }
+        if id := c.w.ConnID(); id != conn {
+            // a packet is never split over connections
+            conn, buf = id, nil
+        }
+        _, d, err := c.w.Read()
+        if err != nil {
+            c.lock.Lock()
+            stopped := c.closed || c.timedOut
+            c.lock.Unlock()
+            if !stopped && c.w.Reconnected(conn) {
+                // the plugin reconnected while reading
+                continue
+            }
+            c.fail(err)
+            return
+        }
+        c.lock.Lock()
+        c.lastRead = c.clock.Now()
+        c.lock.Unlock()
+        buf = append(buf, d...)
+        for len(buf) > 0 {
+            p, n, err := Decode(buf, c.cfg.Version)
+            if err != nil {
+                buf = nil
+                c.report(err)
+                break
+            }
+            if n == 0 {
+                break
+            }
+            buf = buf[n:]
+            c.dispatch(p)
+        }
+    }
+}
+
+// dispatch a packet received from the broker
+func (c *Client) dispatch(p *Packet) {
+    switch p.Type {
+    case PUBLISH:
+        c.receive(p)
+    case PUBREL:
+        c.lock.Lock()
+        delete(c.inbound, p.PacketID)
+        c.lock.Unlock()
+        _ = c.write(&Packet{Type: PUBCOMP, PacketID: p.PacketID})
+    case PUBACK, PUBCOMP:
+        c.complete(c.inflight, p, 0x80)
+    case PUBREC:
+        if p.Code >= 0x80 {
+            c.complete(c.inflight, p, 0x80)
+            return
+        }
+        rel := &Packet{Type: PUBREL, PacketID: p.PacketID}
+        c.lock.Lock()
+        if pe := c.inflight[p.PacketID]; pe != nil {
+            pe.packet = rel
+        }
+        c.lock.Unlock()
+        _ = c.write(rel)
+    case SUBACK, UNSUBACK:
+        c.complete(c.requests, p, 0)
+    case PINGRESP:
+        c.lock.Lock()
+        c.pingSent = time.Time{}
+        c.lock.Unlock()
+    case DISCONNECT:
+        c.report(&ReasonError{Type: DISCONNECT, Code: p.Code})
+    }
+}
+
+// complete end the wait for a packet id, refused is the lowest code that is an error, 0 when codes are not checked
+func (c *Client) complete(set map[uint16]*pending, p *Packet, refused byte) {
+    c.lock.Lock()
+    pe := set[p.PacketID]
+    delete(set, p.PacketID)
+    c.lock.Unlock()
+    if pe == nil || pe.done == nil {
+        return
+    }
+    var err error
+    if refused > 0 && p.Code >= refused {
+        err = &ReasonError{Type: p.Type, Code: p.Code}
+    }
+    pe.reply = p
+    select {
+    case pe.done <- err:
+    default:
+    }
+}
+
+// receive a PUBLISH, a QoS 2 message is only delivered once until its PUBREL arrives
+func (c *Client) receive(p *Packet) {
+    m := &Message{Topic: p.Topic, Payload: p.Payload, QoS: p.QoS, Retain: p.Retain, Properties: p.Properties}
+    switch p.QoS {
+    case 0:
+        c.deliver(m)
+    case 1:
+        c.deliver(m)
+        _ = c.write(&Packet{Type: PUBACK, PacketID: p.PacketID})
+    case 2:
+        c.lock.Lock()
+        seen := c.inbound[p.PacketID]
+        c.inbound[p.PacketID] = true
+        c.lock.Unlock()
+        if !seen {
+            c.deliver(m)
+        }
+        _ = c.write(&Packet{Type: PUBREC, PacketID: p.PacketID})
+    }
+}
+
+// deliver a message to the handlers of the matching subscriptions
+func (c *Client) deliver(m *Message) {
+    c.lock.Lock()
+    var handlers []func(m *Message)
+    for _, s := range c.sortedSubs() {
+        if s.handler != nil && Match(s.filter, m.Topic) {
+            handlers = append(handlers, s.handler)
+        }
+    }
+    c.lock.Unlock()
+    for _, h := range handlers {
+        h(m)
+    }
+}
+
+// report an error to OnError
+func (c *Client) report(err error) {
+    if c.cfg.OnError != nil {
+        c.cfg.OnError(err)
+    }
+}
+
+// fail stop reading and fail the calls that wait for the broker, unconfirmed messages stay in the session
+func (c *Client) fail(err error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.timedOut {
+        err = ErrKeepAliveTimeout
+    } else if c.closed {
+        err = ErrClientClosed
+    }
+    c.err = err
+    c.running = false
+    c.gen++
+    for _, pe := range c.inflight {
+        select {
+        case pe.done <- err:
+        default:
+        }
+    }
+    for id, pe := range c.requests {
+        if pe.done != nil {
+            select {
+            case pe.done <- err:
+            default:
+            }
+        }
+        delete(c.requests, id)
+    }
+}
+
+// keepalive send a PINGREQ when nothing was sent for the keepalive interval and drop the connection
+// when the PINGRESP does not arrive within the same interval
+func (c *Client) keepalive(gen uint64, every time.Duration) {
+    for {
+        now := c.clock.Now()
+        c.lock.Lock()
+        if c.gen != gen {
+            c.lock.Unlock()
+            return
+        }
+        ping := c.pingSent
+        deadline := c.lastWrite.Add(every)
+        if !ping.IsZero() {
+            deadline = ping.Add(every)
+        }
+        c.lock.Unlock()
+        if wait := deadline.Sub(now); wait > 0 {
+            timer := c.clock.NewTimer(wait)
+            select {
+            case <-timer.C():
+            case <-c.stop:
+                timer.Stop()
+                return
+            }
+            continue
+        }
+        if !ping.IsZero() {
+            c.lock.Lock()
+            current := c.gen == gen
+            c.timedOut = current
+            c.lock.Unlock()
+            if current {
+                // a dropped connection is reconnected when the plugin reconnects
+                _ = c.w.Drop()
+            }
+            return
+        }
+        c.lock.Lock()
+        c.pingSent = now
+        c.lock.Unlock()
+        _ = c.write(&Packet{Type: PINGREQ})
+    }
+}
+
+// Match return true when a topic matches a filter, wildcards do not match topics that start with $
+func Match(filter, topic string) bool {
+    if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+        return false
+    }
+    fs := strings.Split(filter, "/")
+    ts := strings.Split(topic, "/")
+    for i, f := range fs {
+        if f == "#" {
+            return true
+        }
+        if i >= len(ts) || (f != "+" && f != ts[i]) {
+            return false
+        }
+    }
+    return len(fs) == len(ts)
+}
+
+// validFilter return false for empty filters and misplaced wildcards
+func validFilter(filter string) bool {
+    if filter == "" {
+        return false
+    }
+    levels := strings.Split(filter, "/")
+    for i, l := range levels {
+        if l == "#" && i == len(levels)-1 {
+            continue
+        }
+        if l != "+" && strings.ContainsAny(l, "+#") {
+            return false
+        }
+        if l == "#" {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,571 @@
+package mqtt
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+// broker is a small MQTT broker for the tests, sessions outlive their connections and queue
+// QoS 1 and 2 messages while they are offline, a first PUBLISH to drop ends the connection before it is
+// acknowledged and the username bad is refused
+type broker struct {
+    srv *wstest.Server
+
+    lock     sync.Mutex
+    log      []string
+    sessions map[string]*session
+    assigned int
+    noPong   bool
+}
+
+type session struct {
+    conn    *wstest.Conn
+    version byte
+    subs    map[string]byte
+    queue   []*Packet
+    nextID  uint16
+    inbound map[uint16]*Packet
+}
+
+func newBroker(t *testing.T) *broker {
+    b := &broker{sessions: map[string]*session{}}
+    b.srv = wstest.NewServer(b.serve)
+    b.srv.Upgrader.Subprotocols = []string{"mqtt"}
+    t.Cleanup(b.srv.Close)
+    return b
+}
+
+// record a log entry, the lock must be held
+func (b *broker) record(c *wstest.Conn, format string, args ...interface{}) {
+    b.log = append(b.log, fmt.Sprintf("%d ", c.Index)+fmt.Sprintf(format, args...))
+}
+
+// waitFor wait until the broker logged an entry
+func (b *broker) waitFor(t *testing.T, entry string) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        if b.logged(entry) {
+            return
+        }
+        time.Sleep(time.Millisecond)
+    }
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    t.Fatalf("broker got %q, want %q", b.log, entry)
+}
+
+// logged return true when the broker logged an entry
+func (b *broker) logged(entry string) bool {
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    for _, e := range b.log {
+        if e == entry {
+            return true
+        }
+    }
+    return false
+}
+
+// forget drop every session
+func (b *broker) forget() {
+    b.lock.Lock()
+    b.sessions = map[string]*session{}
+    b.lock.Unlock()
+}
+
+// send a packet to a session, the lock must be held
+func (b *broker) send(s *session, p *Packet) {
+    _ = s.conn.WriteMessage(websocket.BinaryMessage, Encode(p, s.version))
+}
+
+// route a message to the matching subscriptions, the lock must be held
+func (b *broker) route(m *Packet) {
+    for _, s := range b.sessions {
+        for filter, qos := range s.subs {
+            if !Match(filter, m.Topic) {
+                continue
+            }
+            p := &Packet{Type: PUBLISH, Topic: m.Topic, Payload: m.Payload, QoS: m.QoS, Properties: m.Properties}
+            if qos < p.QoS {
+                p.QoS = qos
+            }
+            if p.QoS > 0 {
+                s.nextID++
+                p.PacketID = s.nextID
+            }
+            if s.conn != nil {
+                b.send(s, p)
+            } else if p.QoS > 0 {
+                s.queue = append(s.queue, p)
+            }
+        }
+    }
+}
+
+func (b *broker) serve(c *wstest.Conn) {
+    _, d, err := c.Receive()
+    if err != nil {
+        return
+    }
+    p, _, err := Decode(d, V5)
+    if err != nil || p.Type != CONNECT {
+        return
+    }
+    conn := p.Connect
+    will := ""
+    if conn.Will != nil {
+        will = conn.Will.Topic
+    }
+    b.lock.Lock()
+    b.record(c, "CONNECT id=%s clean=%v keepalive=%d will=%s", conn.ClientID, conn.CleanStart, conn.KeepAlive, will)
+    if conn.Username == "bad" {
+        code := byte(5)
+        if conn.Version == V5 {
+            code = 0x87
+        }
+        _ = c.WriteMessage(websocket.BinaryMessage, Encode(&Packet{Type: CONNACK, Code: code}, conn.Version))
+        b.lock.Unlock()
+        return
+    }
+    id := conn.ClientID
+    ack := &Packet{Type: CONNACK}
+    if id == "" {
+        b.assigned++
+        id = fmt.Sprintf("assigned-%d", b.assigned)
+        ack.Properties = Properties{{ID: PropAssignedClientID, Data: []byte(id)}}
+    }
+    s := b.sessions[id]
+    ack.SessionPresent = s != nil && !conn.CleanStart
+    if !ack.SessionPresent {
+        s = &session{subs: map[string]byte{}, inbound: map[uint16]*Packet{}}
+        b.sessions[id] = s
+    }
+    s.conn, s.version = c, conn.Version
+    b.send(s, ack)
+    for _, q := range s.queue {
+        b.send(s, q)
+    }
+    s.queue = nil
+    b.lock.Unlock()
+
+    clean := false
+    defer func() {
+        b.lock.Lock()
+        defer b.lock.Unlock()
+        if s.conn == c {
+            s.conn = nil
+        }
+        if !clean && conn.Will != nil {
+            b.route(&Packet{Topic: conn.Will.Topic, Payload: conn.Will.Payload, QoS: conn.Will.QoS})
+        }
+        b.record(c, "GONE")
+    }()
+    for {
+        _, d, err := c.Receive()
+        if err != nil {
+            return
+        }
+        packets, err := decodeAll(d, s.version)
+        if err != nil {
+            return
+        }
+        for _, p := range packets {
+            if stop := b.handle(c, s, p); stop {
+                clean = p.Type == DISCONNECT
+                return
+            }
+        }
+    }
+}
+
+// handle a packet from a client and return true when the connection ends
+func (b *broker) handle(c *wstest.Conn, s *session, p *Packet) bool {
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    switch p.Type {
+    case PUBLISH:
+        b.record(c, "PUBLISH %s qos=%d dup=%v", p.Topic, p.QoS, p.Dup)
+        if p.Topic == "drop" && !p.Dup {
+            _ = c.Close()
+            return true
+        }
+        switch p.QoS {
+        case 0:
+            b.route(p)
+        case 1:
+            b.route(p)
+            b.send(s, &Packet{Type: PUBACK, PacketID: p.PacketID})
+        case 2:
+            s.inbound[p.PacketID] = p
+            b.send(s, &Packet{Type: PUBREC, PacketID: p.PacketID})
+        }
+    case PUBREL:
+        b.record(c, "PUBREL")
+        if m := s.inbound[p.PacketID]; m != nil {
+            b.route(m)
+            delete(s.inbound, p.PacketID)
+        }
+        b.send(s, &Packet{Type: PUBCOMP, PacketID: p.PacketID})
+    case PUBREC:
+        b.record(c, "PUBREC")
+        b.send(s, &Packet{Type: PUBREL, PacketID: p.PacketID})
+    case PUBACK, PUBCOMP:
+        b.record(c, TypeName(p.Type))
+    case SUBSCRIBE, UNSUBSCRIBE:
+        var filters []string
+        ack := &Packet{Type: SUBACK, PacketID: p.PacketID}
+        if p.Type == UNSUBSCRIBE {
+            ack.Type = UNSUBACK
+        }
+        for _, t := range p.Topics {
+            filters = append(filters, fmt.Sprintf("%s:%d", t.Filter, t.QoS))
+            switch {
+            case p.Type == UNSUBSCRIBE:
+                delete(s.subs, t.Filter)
+                ack.Codes = append(ack.Codes, 0)
+            case t.Filter == "reject":
+                ack.Codes = append(ack.Codes, 0x80)
+            default:
+                s.subs[t.Filter] = t.QoS
+                ack.Codes = append(ack.Codes, t.QoS)
+            }
+        }
+        b.record(c, "%s %s", TypeName(p.Type), strings.Join(filters, " "))
+        b.send(s, ack)
+    case PINGREQ:
+        b.record(c, "PINGREQ")
+        if !b.noPong {
+            b.send(s, &Packet{Type: PINGRESP})
+        }
+    case DISCONNECT:
+        b.record(c, "DISCONNECT")
+        return true
+    }
+    return false
+}
+
+// newTestClient connect a client to the broker
+func newTestClient(t *testing.T, b *broker, cfg Config, setup func(w *plugin.Ws)) (*Client, *plugin.Ws) {
+    w := &plugin.Ws{}
+    w.SetUrl("ws", b.srv.Host, "/")
+    if setup != nil {
+        setup(w)
+    }
+    c := NewClient(w, cfg)
+    if err := c.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { w.Close() })
+    return c, w
+}
+
+// collect return a handler that sends messages to a channel
+func collect() (func(m *Message), chan *Message) {
+    ch := make(chan *Message, 16)
+    return func(m *Message) { ch <- m }, ch
+}
+
+// next wait for a message
+func next(t *testing.T, ch chan *Message) *Message {
+    t.Helper()
+    select {
+    case m := <-ch:
+        return m
+    case <-time.After(5 * time.Second):
+        t.Fatal("no message received")
+        return nil
+    }
+}
+
+func TestClient_Connect(t *testing.T) {
+    b := newBroker(t)
+    c, w := newTestClient(t, b, Config{ClientID: "c1", CleanStart: true, KeepAlive: 30 * time.Second}, nil)
+    b.waitFor(t, "1 CONNECT id=c1 clean=true keepalive=30 will=")
+    if w.Subprotocol() != "mqtt" || c.SessionPresent() || c.ClientID() != "c1" {
+        t.Errorf("Subprotocol(), SessionPresent(), ClientID() = %v, %v, %v", w.Subprotocol(), c.SessionPresent(), c.ClientID())
+    }
+}
+
+func TestClient_Connect_refused(t *testing.T) {
+    b := newBroker(t)
+    w := &plugin.Ws{}
+    w.SetUrl("ws", b.srv.Host, "/")
+    c := NewClient(w, Config{ClientID: "c1", Username: "bad"})
+    err := c.Connect(context.Background())
+    if !errors.Is(err, plugin.ErrInitRejected) || !strings.Contains(err.Error(), "CONNACK refused with code 0x05") {
+        t.Errorf("Connect() error = %v, want the CONNACK to reject the init", err)
+    }
+}
+
+func TestClient_Publish(t *testing.T) {
+    tests := []struct {
+        qos  byte
+        want []string
+    }{
+        {qos: 0},
+        {qos: 1, want: []string{"1 PUBACK"}},
+        {qos: 2, want: []string{"1 PUBREL", "1 PUBREC", "1 PUBCOMP"}},
+    }
+    for _, tt := range tests {
+        t.Run(fmt.Sprintf("qos %d", tt.qos), func(t *testing.T) {
+            b := newBroker(t)
+            c, _ := newTestClient(t, b, Config{ClientID: "c1"}, nil)
+            handler, ch := collect()
+            granted, err := c.Subscribe(context.Background(), "a/+", 2, handler)
+            if err != nil || granted != 2 {
+                t.Fatalf("Subscribe() = %v, %v", granted, err)
+            }
+            if err := c.Publish(context.Background(), Message{Topic: "a/x", Payload: []byte("hello"), QoS: tt.qos}); err != nil {
+                t.Fatal(err)
+            }
+            m := next(t, ch)
+            if m.Topic != "a/x" || string(m.Payload) != "hello" || m.QoS != tt.qos {
+                t.Errorf("message = %+v", m)
+            }
+            b.waitFor(t, fmt.Sprintf("1 PUBLISH a/x qos=%d dup=false", tt.qos))
+            for _, e := range tt.want {
+                b.waitFor(t, e)
+            }
+        })
+    }
+}
+
+func TestClient_Publish_badTopic(t *testing.T) {
+    c := NewClient(&plugin.Ws{}, Config{})
+    for _, topic := range []string{"", "a/+", "a/#"} {
+        if err := c.Publish(context.Background(), Message{Topic: topic}); !errors.Is(err, ErrBadTopic) {
+            t.Errorf("Publish(%q) error = %v, want %v", topic, err, ErrBadTopic)
+        }
+    }
+}
+
+func TestClient_Subscribe_refused(t *testing.T) {
+    b := newBroker(t)
+    c, _ := newTestClient(t, b, Config{ClientID: "c1"}, nil)
+    _, err := c.Subscribe(context.Background(), "reject", 1, nil)
+    var re *ReasonError
+    if !errors.As(err, &re) || re.Type != SUBACK || re.Code != 0x80 {
+        t.Errorf("Subscribe() error = %v, want a refused SUBACK", err)
+    }
+    if _, err := c.Subscribe(context.Background(), "a/#/b", 1, nil); !errors.Is(err, ErrBadTopic) {
+        t.Errorf("Subscribe() error = %v, want %v", err, ErrBadTopic)
+    }
+}
+
+func TestClient_Unsubscribe(t *testing.T) {
+    b := newBroker(t)
+    c, _ := newTestClient(t, b, Config{ClientID: "c1"}, nil)
+    handler, ch := collect()
+    if _, err := c.Subscribe(context.Background(), "a", 1, handler); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Unsubscribe(context.Background(), "a"); err != nil {
+        t.Fatal(err)
+    }
+    b.waitFor(t, "1 UNSUBSCRIBE a:0")
+    // the broker routes before it acknowledges, so a delivery would arrive before Publish returns
+    if err := c.Publish(context.Background(), Message{Topic: "a", Payload: []byte("late"), QoS: 1}); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case m := <-ch:
+        t.Errorf("received %s after Unsubscribe()", m.Payload)
+    default:
+    }
+}
+
+func TestClient_receiveQoS2Once(t *testing.T) {
+    send := func(p *Packet) wstest.Step { return wstest.Send(websocket.BinaryMessage, Encode(p, V311)) }
+    expect := func(typ byte) wstest.Step {
+        return wstest.Expect(func(_ int, data []byte) error {
+            if p, _, err := Decode(data, V311); err != nil || p.Type != typ {
+                return fmt.Errorf("got %v %v, want %s", p, err, TypeName(typ))
+            }
+            return nil
+        })
+    }
+    publish := func(payload string, dup bool) *Packet {
+        return &Packet{Type: PUBLISH, QoS: 2, PacketID: 5, Topic: "a", Payload: []byte(payload), Dup: dup}
+    }
+    srv := wstest.NewServer(wstest.Script(
+        expect(CONNECT), send(&Packet{Type: CONNACK}),
+        expect(SUBSCRIBE), send(&Packet{Type: SUBACK, PacketID: 1, Codes: []byte{2}}),
+        send(publish("one", false)), send(publish("one", true)),
+        expect(PUBREC), expect(PUBREC),
+        send(&Packet{Type: PUBREL, PacketID: 5}), expect(PUBCOMP),
+        send(publish("two", false)), expect(PUBREC),
+        wstest.Drain(),
+    ))
+    defer srv.Close()
+    w := &plugin.Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    defer w.Close()
+    c := NewClient(w, Config{ClientID: "c1"})
+    if err := c.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    handler, ch := collect()
+    if _, err := c.Subscribe(context.Background(), "a", 2, handler); err != nil {
+        t.Fatal(err)
+    }
+    if a, b := next(t, ch), next(t, ch); string(a.Payload) != "one" || string(b.Payload) != "two" {
+        t.Errorf("received %s and %s, want one and two", a.Payload, b.Payload)
+    }
+    select {
+    case m := <-ch:
+        t.Errorf("received %s twice", m.Payload)
+    case <-time.After(50 * time.Millisecond):
+    }
+    if err := srv.Err(); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestClient_will(t *testing.T) {
+    b := newBroker(t)
+    observer, _ := newTestClient(t, b, Config{ClientID: "observer"}, nil)
+    handler, ch := collect()
+    if _, err := observer.Subscribe(context.Background(), "will/#", 1, handler); err != nil {
+        t.Fatal(err)
+    }
+    _, w := newTestClient(t, b, Config{ClientID: "lost", Will: &Message{Topic: "will/lost", Payload: []byte("gone"), QoS: 1}}, nil)
+    b.waitFor(t, "2 CONNECT id=lost clean=false keepalive=0 will=will/lost")
+    _ = w.Close()
+    if m := next(t, ch); m.Topic != "will/lost" || string(m.Payload) != "gone" {
+        t.Errorf("will = %+v", m)
+    }
+
+    polite, _ := newTestClient(t, b, Config{ClientID: "polite", Will: &Message{Topic: "will/polite", Payload: []byte("gone")}}, nil)
+    if err := polite.Disconnect(); err != nil {
+        t.Fatal(err)
+    }
+    b.waitFor(t, "3 GONE")
+    select {
+    case m := <-ch:
+        t.Errorf("received will %s after Disconnect()", m.Topic)
+    default:
+    }
+}
+
+func TestClient_keepalive(t *testing.T) {
+    b := newBroker(t)
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    c, _ := newTestClient(t, b, Config{ClientID: "c1", KeepAlive: 10 * time.Second, Clock: clock}, nil)
+    clock.BlockUntil(1)
+    clock.Advance(10 * time.Second)
+    b.waitFor(t, "1 PINGREQ")
+
+    // the next PINGREQ is not answered
+    b.lock.Lock()
+    b.noPong = true
+    b.lock.Unlock()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        c.lock.Lock()
+        answered := c.pingSent.IsZero()
+        c.lock.Unlock()
+        if answered {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("PINGRESP was not seen")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    clock.BlockUntil(1)
+    clock.Advance(10 * time.Second)
+    clock.BlockUntil(1)
+    clock.Advance(10 * time.Second)
+    for c.Err() == nil && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if !errors.Is(c.Err(), ErrKeepAliveTimeout) {
+        t.Errorf("Err() = %v, want %v", c.Err(), ErrKeepAliveTimeout)
+    }
+}
+
+func TestClient_keepaliveReconnect(t *testing.T) {
+    b := newBroker(t)
+    b.noPong = true
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    c, _ := newTestClient(t, b, Config{ClientID: "c1", KeepAlive: 10 * time.Second, Clock: clock}, func(w *plugin.Ws) { w.Reconnect(true) })
+    // the PINGREQ is not answered, the connection is dropped and made again
+    clock.BlockUntil(1)
+    clock.Advance(10 * time.Second)
+    b.waitFor(t, "1 PINGREQ")
+    clock.BlockUntil(1)
+    clock.Advance(10 * time.Second)
+    b.waitFor(t, "2 CONNECT id=c1 clean=false keepalive=10 will=")
+    if err := c.Err(); err != nil {
+        t.Errorf("Err() = %v after the keepalive timeout, want a reconnect", err)
+    }
+}
+
+func TestClient_sessionResumption(t *testing.T) {
+    b := newBroker(t)
+    c, _ := newTestClient(t, b, Config{ClientID: "c1", CleanStart: true}, func(w *plugin.Ws) { w.Reconnect(true) })
+    handler, ch := collect()
+    if _, err := c.Subscribe(context.Background(), "t", 1, handler); err != nil {
+        t.Fatal(err)
+    }
+
+    // the broker drops the connection before it acknowledges, the message is sent again with DUP
+    if err := c.Publish(context.Background(), Message{Topic: "drop", Payload: []byte("x"), QoS: 1}); err != nil {
+        t.Fatal(err)
+    }
+    b.waitFor(t, "2 CONNECT id=c1 clean=false keepalive=0 will=")
+    b.waitFor(t, "2 PUBLISH drop qos=1 dup=true")
+    if !c.SessionPresent() || b.logged("2 SUBSCRIBE t:1") {
+        t.Errorf("SessionPresent() = %v, want the session to be resumed without subscribing", c.SessionPresent())
+    }
+    if err := c.Publish(context.Background(), Message{Topic: "t", Payload: []byte("kept"), QoS: 1}); err != nil {
+        t.Fatal(err)
+    }
+    if m := next(t, ch); string(m.Payload) != "kept" {
+        t.Errorf("message = %s, want kept", m.Payload)
+    }
+
+    // the broker lost the session, the subscriptions are made again
+    b.forget()
+    b.srv.CloseConnections()
+    b.waitFor(t, "3 SUBSCRIBE t:1")
+    if c.SessionPresent() {
+        t.Error("SessionPresent() = true after the broker lost the session")
+    }
+    if err := c.Publish(context.Background(), Message{Topic: "t", Payload: []byte("again"), QoS: 1}); err != nil {
+        t.Fatal(err)
+    }
+    if m := next(t, ch); string(m.Payload) != "again" {
+        t.Errorf("message = %s, want again", m.Payload)
+    }
+}
+
+func TestClient_v5(t *testing.T) {
+    b := newBroker(t)
+    c, _ := newTestClient(t, b, Config{Version: V5, SessionExpiry: 60}, nil)
+    if c.ClientID() != "assigned-1" {
+        t.Errorf("ClientID() = %q, want the assigned id", c.ClientID())
+    }
+    handler, ch := collect()
+    if _, err := c.Subscribe(context.Background(), "a", 1, handler); err != nil {
+        t.Fatal(err)
+    }
+    props := Properties{{ID: PropUserProperty, Key: "k", Data: []byte("v")}}
+    if err := c.Publish(context.Background(), Message{Topic: "a", Payload: []byte("x"), QoS: 1, Properties: props}); err != nil {
+        t.Fatal(err)
+    }
+    if m := next(t, ch); !reflect.DeepEqual(m.Properties, props) {
+        t.Errorf("properties = %+v, want %+v", m.Properties, props)
+    }
+}
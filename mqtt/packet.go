@@ -0,0 +1,578 @@
+// Package mqtt is an MQTT 3.1.1 and 5 client that uses the plugin as its transport,
+// packets are sent as binary websocket messages with the mqtt subprotocol
+package mqtt
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+)
+
+// protocol versions
+const (
+    V311 byte = 4
+    V5   byte = 5
+)
+
+// packet types
+const (
+    CONNECT     byte = 1
+    CONNACK     byte = 2
+    PUBLISH     byte = 3
+    PUBACK      byte = 4
+    PUBREC      byte = 5
+    PUBREL      byte = 6
+    PUBCOMP     byte = 7
+    SUBSCRIBE   byte = 8
+    SUBACK      byte = 9
+    UNSUBSCRIBE byte = 10
+    UNSUBACK    byte = 11
+    PINGREQ     byte = 12
+    PINGRESP    byte = 13
+    DISCONNECT  byte = 14
+    AUTH        byte = 15
+)
+
+var typeNames = [...]string{"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+    "SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH"}
+
+// TypeName return the name of a packet type
+func TypeName(t byte) string {
+    if int(t) < len(typeNames) {
+        return typeNames[t]
+    }
+    return fmt.Sprintf("TYPE(%d)", t)
+}
+
+// ErrMalformed is returned for packets that can not be decoded
+var ErrMalformed = errors.New("mqtt: malformed packet")
+
+// Connect holds the fields of a CONNECT packet
+type Connect struct {
+    Version    byte
+    ClientID   string
+    Username   string
+    Password   []byte
+    CleanStart bool
+    KeepAlive  uint16
+
+    // Will is published by the broker when the connection ends without a DISCONNECT
+    Will *Message
+}
+
+// Message is an application message, the will of a connection or a received publish
+type Message struct {
+    Topic      string
+    Payload    []byte
+    QoS        byte
+    Retain     bool
+    Properties Properties
+}
+
+// TopicFilter is an entry of a SUBSCRIBE or UNSUBSCRIBE packet, QoS holds the subscription options byte
+type TopicFilter struct {
+    Filter string
+    QoS    byte
+}
+
+// Packet is a decoded MQTT control packet, only the fields of its type are used
+type Packet struct {
+    Type byte
+
+    // flags of a PUBLISH
+    Dup    bool
+    QoS    byte
+    Retain bool
+
+    PacketID uint16
+    Topic    string
+    Payload  []byte
+
+    // Code is the return code of a 3.1.1 CONNACK or the reason code of an MQTT 5 packet
+    Code           byte
+    SessionPresent bool
+    Properties     Properties
+
+    // Topics of a SUBSCRIBE or UNSUBSCRIBE and the Codes of the SUBACK or UNSUBACK
+    Topics []TopicFilter
+    Codes  []byte
+
+    // Connect is set for CONNECT packets
+    Connect *Connect
+}
+
+// property ids
+const (
+    PropPayloadFormat          byte = 0x01
+    PropMessageExpiry          byte = 0x02
+    PropContentType            byte = 0x03
+    PropResponseTopic          byte = 0x08
+    PropCorrelationData        byte = 0x09
+    PropSubscriptionID         byte = 0x0B
+    PropSessionExpiry          byte = 0x11
+    PropAssignedClientID       byte = 0x12
+    PropServerKeepAlive        byte = 0x13
+    PropAuthMethod             byte = 0x15
+    PropAuthData               byte = 0x16
+    PropRequestProblemInfo     byte = 0x17
+    PropWillDelay              byte = 0x18
+    PropRequestResponseInfo    byte = 0x19
+    PropResponseInfo           byte = 0x1A
+    PropServerReference        byte = 0x1C
+    PropReasonString           byte = 0x1F
+    PropReceiveMaximum         byte = 0x21
+    PropTopicAliasMaximum      byte = 0x22
+    PropTopicAlias             byte = 0x23
+    PropMaximumQoS             byte = 0x24
+    PropRetainAvailable        byte = 0x25
+    PropUserProperty           byte = 0x26
+    PropMaximumPacketSize      byte = 0x27
+    PropWildcardSubAvailable   byte = 0x28
+    PropSubIDAvailable         byte = 0x29
+    PropSharedSubAvailable     byte = 0x2A
+)
+
+// property value types
+const (
+    propByte = iota + 1
+    propTwo
+    propFour
+    propVarint
+    propString
+    propBinary
+    propPair
+)
+
+var propTypes = map[byte]int{
+    PropPayloadFormat: propByte, PropMessageExpiry: propFour, PropContentType: propString,
+    PropResponseTopic: propString, PropCorrelationData: propBinary, PropSubscriptionID: propVarint,
+    PropSessionExpiry: propFour, PropAssignedClientID: propString, PropServerKeepAlive: propTwo,
+    PropAuthMethod: propString, PropAuthData: propBinary, PropRequestProblemInfo: propByte,
+    PropWillDelay: propFour, PropRequestResponseInfo: propByte, PropResponseInfo: propString,
+    PropServerReference: propString, PropReasonString: propString, PropReceiveMaximum: propTwo,
+    PropTopicAliasMaximum: propTwo, PropTopicAlias: propTwo, PropMaximumQoS: propByte,
+    PropRetainAvailable: propByte, PropUserProperty: propPair, PropMaximumPacketSize: propFour,
+    PropWildcardSubAvailable: propByte, PropSubIDAvailable: propByte, PropSharedSubAvailable: propByte,
+}
+
+// Property is an MQTT 5 property, numbers are in Value, strings and binary data in Data
+// and user properties have their name in Key
+type Property struct {
+    ID    byte
+    Value uint32
+    Data  []byte
+    Key   string
+}
+
+// Properties of an MQTT 5 packet, they are ignored for 3.1.1
+type Properties []Property
+
+// Get return the first property with an id
+func (ps Properties) Get(id byte) (Property, bool) {
+    for _, p := range ps {
+        if p.ID == id {
+            return p, true
+        }
+    }
+    return Property{}, false
+}
+
+// Uint return a numeric property, 0 when it is not set
+func (ps Properties) Uint(id byte) uint32 {
+    p, _ := ps.Get(id)
+    return p.Value
+}
+
+// String return a string property, empty when it is not set
+func (ps Properties) String(id byte) string {
+    p, _ := ps.Get(id)
+    return string(p.Data)
+}
+
+// Encode a packet for a protocol version, CONNECT packets use the version of their Connect
+func Encode(p *Packet, version byte) []byte {
+    if p.Type == CONNECT && p.Connect != nil {
+        version = p.Connect.Version
+    }
+    var e encoder
+    var flags byte
+    switch p.Type {
+    case CONNECT:
+        encodeConnect(&e, p)
+    case CONNACK:
+        e.byte(boolBit(p.SessionPresent, 0))
+        e.byte(p.Code)
+        e.props(p.Properties, version)
+    case PUBLISH:
+        flags = boolBit(p.Dup, 3) | p.QoS<<1 | boolBit(p.Retain, 0)
+        e.string(p.Topic)
+        if p.QoS > 0 {
+            e.two(p.PacketID)
+        }
+        e.props(p.Properties, version)
+        e.buf = append(e.buf, p.Payload...)
+    case PUBACK, PUBREC, PUBREL, PUBCOMP:
+        if p.Type == PUBREL {
+            flags = 0x02
+        }
+        e.two(p.PacketID)
+        if version >= V5 && (p.Code != 0 || len(p.Properties) > 0) {
+            e.byte(p.Code)
+            e.props(p.Properties, version)
+        }
+    case SUBSCRIBE, UNSUBSCRIBE:
+        flags = 0x02
+        e.two(p.PacketID)
+        e.props(p.Properties, version)
+        for _, t := range p.Topics {
+            e.string(t.Filter)
+            if p.Type == SUBSCRIBE {
+                e.byte(t.QoS)
+            }
+        }
+    case SUBACK, UNSUBACK:
+        e.two(p.PacketID)
+        e.props(p.Properties, version)
+        if p.Type == SUBACK || version >= V5 {
+            e.buf = append(e.buf, p.Codes...)
+        }
+    case DISCONNECT, AUTH:
+        if version >= V5 && (p.Code != 0 || len(p.Properties) > 0) {
+            e.byte(p.Code)
+            e.props(p.Properties, version)
+        }
+    }
+    out := []byte{p.Type<<4 | flags}
+    out = appendVarint(out, uint32(len(e.buf)))
+    return append(out, e.buf...)
+}
+
+func encodeConnect(e *encoder, p *Packet) {
+    c := p.Connect
+    e.string("MQTT")
+    e.byte(c.Version)
+    var flags byte
+    if c.Username != "" {
+        flags |= 0x80
+    }
+    if c.Password != nil {
+        flags |= 0x40
+    }
+    if c.Will != nil {
+        flags |= 0x04 | c.Will.QoS<<3 | boolBit(c.Will.Retain, 5)
+    }
+    flags |= boolBit(c.CleanStart, 1)
+    e.byte(flags)
+    e.two(c.KeepAlive)
+    e.props(p.Properties, c.Version)
+    e.string(c.ClientID)
+    if c.Will != nil {
+        e.props(c.Will.Properties, c.Version)
+        e.string(c.Will.Topic)
+        e.binary(c.Will.Payload)
+    }
+    if c.Username != "" {
+        e.string(c.Username)
+    }
+    if c.Password != nil {
+        e.binary(c.Password)
+    }
+}
+
+// Decode the first packet in data, n is the number of bytes it used and 0 when data holds no complete packet,
+// CONNECT packets are decoded with their own version
+func Decode(data []byte, version byte) (p *Packet, n int, err error) {
+    if len(data) < 2 {
+        return nil, 0, nil
+    }
+    length, size, ok, err := readVarint(data[1:])
+    if err != nil {
+        return nil, 0, err
+    }
+    if !ok || len(data) < 1+size+int(length) {
+        return nil, 0, nil
+    }
+    n = 1 + size + int(length)
+    p = &Packet{Type: data[0] >> 4}
+    flags := data[0] & 0x0F
+    d := decoder{buf: data[1+size : n]}
+    switch p.Type {
+    case CONNECT:
+        decodeConnect(&d, p)
+    case CONNACK:
+        p.SessionPresent = d.byte()&1 == 1
+        p.Code = d.byte()
+        p.Properties = d.props(version)
+    case PUBLISH:
+        p.Dup = flags&0x08 != 0
+        p.QoS = flags >> 1 & 0x03
+        p.Retain = flags&0x01 != 0
+        if p.QoS > 2 {
+            d.fail("qos 3")
+        }
+        p.Topic = d.string()
+        if p.QoS > 0 {
+            p.PacketID = d.two()
+        }
+        p.Properties = d.props(version)
+        p.Payload = d.rest()
+    case PUBACK, PUBREC, PUBREL, PUBCOMP:
+        p.PacketID = d.two()
+        if version >= V5 && d.left() > 0 {
+            p.Code = d.byte()
+            if d.left() > 0 {
+                p.Properties = d.props(version)
+            }
+        }
+    case SUBSCRIBE, UNSUBSCRIBE:
+        p.PacketID = d.two()
+        p.Properties = d.props(version)
+        for d.err == nil && d.left() > 0 {
+            t := TopicFilter{Filter: d.string()}
+            if p.Type == SUBSCRIBE {
+                t.QoS = d.byte()
+            }
+            p.Topics = append(p.Topics, t)
+        }
+    case SUBACK, UNSUBACK:
+        p.PacketID = d.two()
+        p.Properties = d.props(version)
+        p.Codes = d.rest()
+    case PINGREQ, PINGRESP:
+    case DISCONNECT, AUTH:
+        if version >= V5 && d.left() > 0 {
+            p.Code = d.byte()
+            if d.left() > 0 {
+                p.Properties = d.props(version)
+            }
+        }
+    default:
+        d.fail("unknown packet type")
+    }
+    if d.err == nil && d.left() > 0 {
+        d.fail("trailing bytes")
+    }
+    if d.err != nil {
+        return nil, n, fmt.Errorf("%w: %s: %v", ErrMalformed, TypeName(p.Type), d.err)
+    }
+    return p, n, nil
+}
+
+func decodeConnect(d *decoder, p *Packet) {
+    if name := d.string(); d.err == nil && name != "MQTT" {
+        d.fail("protocol name " + name)
+        return
+    }
+    c := &Connect{Version: d.byte()}
+    p.Connect = c
+    flags := d.byte()
+    c.CleanStart = flags&0x02 != 0
+    c.KeepAlive = d.two()
+    p.Properties = d.props(c.Version)
+    c.ClientID = d.string()
+    if flags&0x04 != 0 {
+        c.Will = &Message{QoS: flags >> 3 & 0x03, Retain: flags&0x20 != 0}
+        c.Will.Properties = d.props(c.Version)
+        c.Will.Topic = d.string()
+        c.Will.Payload = d.binary()
+    }
+    if flags&0x80 != 0 {
+        c.Username = d.string()
+    }
+    if flags&0x40 != 0 {
+        c.Password = d.binary()
+    }
+}
+
+func boolBit(b bool, bit uint) byte {
+    if b {
+        return 1 << bit
+    }
+    return 0
+}
+
+// appendVarint append a variable byte integer
+func appendVarint(b []byte, v uint32) []byte {
+    for {
+        c := byte(v % 128)
+        v /= 128
+        if v > 0 {
+            c |= 0x80
+        }
+        b = append(b, c)
+        if v == 0 {
+            return b
+        }
+    }
+}
+
+// readVarint read a variable byte integer, ok is false when data ends before it does
+func readVarint(data []byte) (v uint32, n int, ok bool, err error) {
+    var mult uint32 = 1
+    for i := 0; i < 4; i++ {
+        if i >= len(data) {
+            return 0, 0, false, nil
+        }
+        v += uint32(data[i]&0x7F) * mult
+        if data[i]&0x80 == 0 {
+            return v, i + 1, true, nil
+        }
+        mult *= 128
+    }
+    return 0, 0, false, fmt.Errorf("%w: variable byte integer longer than 4 bytes", ErrMalformed)
+}
+
+type encoder struct {
+    buf []byte
+}
+
+func (e *encoder) byte(b byte) { e.buf = append(e.buf, b) }
+
+func (e *encoder) two(v uint16) { e.buf = append(e.buf, byte(v>>8), byte(v)) }
+
+func (e *encoder) string(s string) { e.binary([]byte(s)) }
+
+func (e *encoder) binary(b []byte) {
+    e.two(uint16(len(b)))
+    e.buf = append(e.buf, b...)
+}
+
+// props write the properties of an MQTT 5 packet, nothing is written for older versions
+func (e *encoder) props(ps Properties, version byte) {
+    if version < V5 {
+        return
+    }
+    var p encoder
+    for _, prop := range ps {
+        p.byte(prop.ID)
+        switch propTypes[prop.ID] {
+        case propByte:
+            p.byte(byte(prop.Value))
+        case propTwo:
+            p.two(uint16(prop.Value))
+        case propFour:
+            p.buf = append(p.buf, 0, 0, 0, 0)
+            binary.BigEndian.PutUint32(p.buf[len(p.buf)-4:], prop.Value)
+        case propVarint:
+            p.buf = appendVarint(p.buf, prop.Value)
+        case propString, propBinary:
+            p.binary(prop.Data)
+        case propPair:
+            p.string(prop.Key)
+            p.binary(prop.Data)
+        }
+    }
+    e.buf = appendVarint(e.buf, uint32(len(p.buf)))
+    e.buf = append(e.buf, p.buf...)
+}
+
+// decoder reads fields until the first error, after that every read returns a zero value
+type decoder struct {
+    buf []byte
+    err error
+}
+
+func (d *decoder) fail(msg string) {
+    if d.err == nil {
+        d.err = errors.New(msg)
+    }
+}
+
+func (d *decoder) left() int { return len(d.buf) }
+
+func (d *decoder) take(n int) []byte {
+    if d.err != nil {
+        return nil
+    }
+    if n > len(d.buf) {
+        d.fail("packet is too short")
+        return nil
+    }
+    b := d.buf[:n]
+    d.buf = d.buf[n:]
+    return b
+}
+
+func (d *decoder) byte() byte {
+    if b := d.take(1); b != nil {
+        return b[0]
+    }
+    return 0
+}
+
+func (d *decoder) two() uint16 {
+    if b := d.take(2); b != nil {
+        return binary.BigEndian.Uint16(b)
+    }
+    return 0
+}
+
+func (d *decoder) binary() []byte {
+    n := d.two()
+    b := d.take(int(n))
+    if b == nil {
+        return nil
+    }
+    return append([]byte{}, b...)
+}
+
+func (d *decoder) string() string { return string(d.binary()) }
+
+func (d *decoder) rest() []byte {
+    b := append([]byte{}, d.buf...)
+    d.buf = nil
+    return b
+}
+
+func (d *decoder) varint() uint32 {
+    if d.err != nil {
+        return 0
+    }
+    v, n, ok, err := readVarint(d.buf)
+    if err != nil || !ok {
+        d.fail("bad variable byte integer")
+        return 0
+    }
+    d.buf = d.buf[n:]
+    return v
+}
+
+// props read the properties of an MQTT 5 packet
+func (d *decoder) props(version byte) Properties {
+    if version < V5 {
+        return nil
+    }
+    length := d.varint()
+    sub := decoder{buf: d.take(int(length))}
+    if d.err != nil {
+        return nil
+    }
+    var ps Properties
+    for sub.err == nil && sub.left() > 0 {
+        p := Property{ID: sub.byte()}
+        switch propTypes[p.ID] {
+        case propByte:
+            p.Value = uint32(sub.byte())
+        case propTwo:
+            p.Value = uint32(sub.two())
+        case propFour:
+            if b := sub.take(4); b != nil {
+                p.Value = binary.BigEndian.Uint32(b)
+            }
+        case propVarint:
+            p.Value = sub.varint()
+        case propString, propBinary:
+            p.Data = sub.binary()
+        case propPair:
+            p.Key = sub.string()
+            p.Data = sub.binary()
+        default:
+            sub.fail(fmt.Sprintf("unknown property 0x%02x", p.ID))
+        }
+        ps = append(ps, p)
+    }
+    if sub.err != nil {
+        d.fail(sub.err.Error())
+    }
+    return ps
+}
@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+    "bytes"
+    "errors"
+    "reflect"
+    "testing"
+)
+
+func TestEncode(t *testing.T) {
+    tests := []struct {
+        name    string
+        packet  Packet
+        version byte
+        want    []byte
+    }{
+        {name: "pingreq", packet: Packet{Type: PINGREQ}, version: V311, want: []byte{0xC0, 0}},
+        {name: "puback", packet: Packet{Type: PUBACK, PacketID: 0x0102}, version: V311, want: []byte{0x40, 2, 1, 2}},
+        {name: "pubrel has flags", packet: Packet{Type: PUBREL, PacketID: 7}, version: V311, want: []byte{0x62, 2, 0, 7}},
+        {name: "publish qos 1", packet: Packet{Type: PUBLISH, QoS: 1, Retain: true, Dup: true, Topic: "a/b", PacketID: 9, Payload: []byte("hi")},
+            version: V311, want: []byte{0x3B, 9, 0, 3, 'a', '/', 'b', 0, 9, 'h', 'i'}},
+        {name: "publish v5 has properties", packet: Packet{Type: PUBLISH, Topic: "t", Properties: Properties{{ID: PropContentType, Data: []byte("x")}}},
+            version: V5, want: []byte{0x30, 8, 0, 1, 't', 4, PropContentType, 0, 1, 'x'}},
+        {name: "subscribe", packet: Packet{Type: SUBSCRIBE, PacketID: 1, Topics: []TopicFilter{{Filter: "a/#", QoS: 2}}},
+            version: V311, want: []byte{0x82, 8, 0, 1, 0, 3, 'a', '/', '#', 2}},
+        {name: "connect", packet: Packet{Type: CONNECT, Connect: &Connect{Version: V311, ClientID: "c", CleanStart: true, KeepAlive: 60}},
+            version: V311, want: []byte{0x10, 13, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 1, 'c'}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := Encode(&tt.packet, tt.version); !bytes.Equal(got, tt.want) {
+                t.Errorf("Encode() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestDecode_roundTrip(t *testing.T) {
+    will := &Message{Topic: "status", Payload: []byte("gone"), QoS: 1, Retain: true}
+    tests := []struct {
+        name    string
+        packet  Packet
+        version byte
+    }{
+        {name: "connect with will", packet: Packet{Type: CONNECT, Connect: &Connect{Version: V311, ClientID: "c", Username: "u", Password: []byte("p"), KeepAlive: 30, Will: will}}},
+        {name: "connect v5", packet: Packet{Type: CONNECT, Properties: Properties{{ID: PropSessionExpiry, Value: 3600}},
+            Connect: &Connect{Version: V5, ClientID: "c", CleanStart: true, Will: &Message{Topic: "w", Payload: []byte{}, Properties: Properties{{ID: PropWillDelay, Value: 5}}}}}},
+        {name: "connack", packet: Packet{Type: CONNACK, SessionPresent: true, Code: 0}, version: V311},
+        {name: "connack v5", packet: Packet{Type: CONNACK, Properties: Properties{{ID: PropAssignedClientID, Data: []byte("id")}, {ID: PropServerKeepAlive, Value: 20}}}, version: V5},
+        {name: "publish qos 2", packet: Packet{Type: PUBLISH, QoS: 2, PacketID: 300, Topic: "a", Payload: []byte("x")}, version: V311},
+        {name: "publish v5 user property", packet: Packet{Type: PUBLISH, QoS: 1, PacketID: 1, Topic: "a", Payload: []byte{},
+            Properties: Properties{{ID: PropUserProperty, Key: "k", Data: []byte("v")}, {ID: PropSubscriptionID, Value: 200000}}}, version: V5},
+        {name: "pubrec v5 reason", packet: Packet{Type: PUBREC, PacketID: 2, Code: 0x10}, version: V5},
+        {name: "suback", packet: Packet{Type: SUBACK, PacketID: 3, Codes: []byte{0, 1, 0x80}}, version: V311},
+        {name: "unsubscribe", packet: Packet{Type: UNSUBSCRIBE, PacketID: 4, Topics: []TopicFilter{{Filter: "a"}, {Filter: "b/+"}}}, version: V5},
+        {name: "unsuback v5", packet: Packet{Type: UNSUBACK, PacketID: 4, Codes: []byte{0, 0x11}}, version: V5},
+        {name: "disconnect v5", packet: Packet{Type: DISCONNECT, Code: 0x8E}, version: V5},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            data := Encode(&tt.packet, tt.version)
+            got, n, err := Decode(data, tt.version)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if n != len(data) {
+                t.Errorf("Decode() used %d bytes, want %d", n, len(data))
+            }
+            if !reflect.DeepEqual(got, &tt.packet) {
+                t.Errorf("Decode() = %+v, want %+v", got, tt.packet)
+            }
+        })
+    }
+}
+
+func TestDecode_partial(t *testing.T) {
+    data := Encode(&Packet{Type: PUBLISH, Topic: "a", Payload: make([]byte, 200)}, V311)
+    for _, cut := range []int{0, 1, 2, len(data) - 1} {
+        if p, n, err := Decode(data[:cut], V311); p != nil || n != 0 || err != nil {
+            t.Errorf("Decode(%d bytes) = %v, %d, %v, want nothing", cut, p, n, err)
+        }
+    }
+    two := append(append([]byte{}, data...), 0xD0, 0)
+    p, n, err := Decode(two, V311)
+    if err != nil || n != len(data) || p.Type != PUBLISH {
+        t.Fatalf("Decode() = %v, %d, %v", p, n, err)
+    }
+    if p, _, err = Decode(two[n:], V311); err != nil || p.Type != PINGRESP {
+        t.Errorf("Decode() = %v, %v, want PINGRESP", p, err)
+    }
+}
+
+func TestDecode_malformed(t *testing.T) {
+    tests := []struct {
+        name string
+        data []byte
+    }{
+        {name: "long varint", data: []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}},
+        {name: "qos 3", data: []byte{0x36, 3, 0, 1, 'a'}},
+        {name: "short string", data: []byte{0x30, 2, 0, 5}},
+        {name: "trailing bytes", data: []byte{0xC0, 1, 0}},
+        {name: "protocol name", data: []byte{0x10, 6, 0, 4, 'H', 'T', 'T', 'P'}},
+        {name: "unknown property", data: []byte{0xE0, 3, 0, 1, 0x7F}},
+        {name: "reserved type", data: []byte{0x00, 0}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, _, err := Decode(tt.data, V5); !errors.Is(err, ErrMalformed) {
+                t.Errorf("Decode() error = %v, want %v", err, ErrMalformed)
+            }
+        })
+    }
+}
+
+func TestMatch(t *testing.T) {
+    tests := []struct {
+        filter, topic string
+        want          bool
+    }{
+        {"a/b", "a/b", true},
+        {"a/b", "a/c", false},
+        {"a/+", "a/b", true},
+        {"a/+", "a/b/c", false},
+        {"a/+/c", "a//c", true},
+        {"a/#", "a", true},
+        {"a/#", "a/b/c", true},
+        {"#", "a/b", true},
+        {"#", "$SYS/x", false},
+        {"+/x", "$SYS/x", false},
+        {"$SYS/#", "$SYS/x", true},
+    }
+    for _, tt := range tests {
+        if got := Match(tt.filter, tt.topic); got != tt.want {
+            t.Errorf("Match(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+        }
+    }
+}
+
+func TestValidFilter(t *testing.T) {
+    for filter, want := range map[string]bool{"a/b": true, "+/b/#": true, "#": true, "": false, "a/#/b": false, "a+": false, "a/b#": false} {
+        if got := validFilter(filter); got != want {
+            t.Errorf("validFilter(%q) = %v, want %v", filter, got, want)
+        }
+    }
+}
@@ -0,0 +1,123 @@
+package mux
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// NewClient create the client side of a session on w, the OnConnect hook of w is wrapped to send
+// a hello on every connection so the server can resume the session
+func NewClient(w *plugin.Ws, cfg Config) *Session {
+    s := newSession(cfg, newID(), false)
+    s.w = w
+    hooks := w.Hooks()
+    next := hooks.OnConnect
+    hooks.OnConnect = func(w *plugin.Ws, info plugin.ConnectInfo) error {
+        s.restore()
+        if next != nil {
+            return next(w, info)
+        }
+        return nil
+    }
+    w.SetHooks(hooks)
+    return s
+}
+
+// newID return a random session id
+func newID() string {
+    b := make([]byte, 16)
+    _, _ = rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// Connect make the connection of a client session and start reading frames, streams can be opened
+// before the server answered
+func (s *Session) Connect(ctx context.Context) error {
+    s.lock.Lock()
+    if s.err != nil {
+        s.lock.Unlock()
+        return s.err
+    }
+    s.lock.Unlock()
+    if err := s.w.ConnectContext(ctx); err != nil {
+        return err
+    }
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if !s.running {
+        s.running = true
+        go s.readLoop()
+    }
+    return nil
+}
+
+// restore send a hello on a new connection, frames wait until the server answered it
+func (s *Session) restore() {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.err != nil {
+        return
+    }
+    s.detach()
+    if s.established && !s.cfg.Resume {
+        s.reset(ErrConnectionLost)
+        s.id = newID()
+    }
+    s.conn = s.w
+    s.priority = []*Frame{{Type: FrameHello, Seq: s.recvSeq, Payload: hello{id: s.id}.encode()}}
+    s.wake.Broadcast()
+}
+
+// welcome handle the hello of the server, the streams end when it did not resume the session
+func (s *Session) welcome(f *Frame) error {
+    h, err := decodeHello(f.Payload)
+    if err != nil {
+        return err
+    }
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if h.id != s.id {
+        return fmt.Errorf("%w: hello for session %q", ErrBadFrame, h.id)
+    }
+    if s.established && s.cfg.Resume && !h.resumed {
+        s.reset(ErrConnectionLost)
+    }
+    s.established = true
+    s.attach(s.w, nil, f.Seq)
+    return nil
+}
+
+// readLoop read frames until the connection closed for good
+func (s *Session) readLoop() {
+    for {
+        conn := s.w.ConnID()
+        _, d, err := s.w.Read()
+        if err != nil {
+            s.lock.Lock()
+            stopped := s.closed
+            s.lock.Unlock()
+            if !stopped && s.w.Reconnected(conn) {
+                // the plugin reconnected while reading
+                continue
+            }
+            s.fail(err)
+            return
+        }
+        f, err := Decode(d)
+        if err != nil {
+            s.report(err)
+            continue
+        }
+        if f.Type == FrameHello {
+            if err := s.welcome(f); err != nil {
+                s.report(err)
+            }
+            continue
+        }
+        s.handle(f)
+    }
+}
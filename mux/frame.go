@@ -0,0 +1,113 @@
+// Package mux carries independent byte streams over a single websocket connection,
+// the same session runs on both ends so a server can demultiplex what a client multiplexes
+package mux
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+)
+
+// frame types
+const (
+    // FrameHello starts a session on a connection, its sequence is the last one received from the other side
+    FrameHello byte = iota
+
+    // FrameOpen opens a stream
+    FrameOpen
+
+    // FrameData carries bytes of a stream
+    FrameData
+
+    // FrameWindow gives the sender of a stream more credit, the payload is the increment
+    FrameWindow
+
+    // FrameClose ends the writing side of a stream
+    FrameClose
+
+    // FrameReset aborts a stream, the payload is the reason
+    FrameReset
+
+    // FrameAck confirms every frame up to its sequence
+    FrameAck
+)
+
+// headerSize is the size of the type, stream id and sequence of a frame
+const headerSize = 13
+
+// DefaultWindow is the receive window every stream starts with
+const DefaultWindow = 256 << 10
+
+// ErrBadFrame is returned for frames that can not be decoded
+var ErrBadFrame = errors.New("mux: bad frame")
+
+// Frame is a frame of the mux protocol, it is sent as a binary message
+type Frame struct {
+    Type    byte
+    Stream  uint32
+    Seq     uint64
+    Payload []byte
+}
+
+// sequenced return true for frames that are numbered and replayed after a resumption
+func (f *Frame) sequenced() bool {
+    return f.Type != FrameHello && f.Type != FrameAck
+}
+
+// Encode the frame
+func (f *Frame) Encode() []byte {
+    b := make([]byte, headerSize+len(f.Payload))
+    b[0] = f.Type
+    binary.BigEndian.PutUint32(b[1:5], f.Stream)
+    binary.BigEndian.PutUint64(b[5:13], f.Seq)
+    copy(b[headerSize:], f.Payload)
+    return b
+}
+
+// Decode a frame, the payload shares the memory of data
+func Decode(data []byte) (*Frame, error) {
+    if len(data) < headerSize {
+        return nil, fmt.Errorf("%w: %d bytes", ErrBadFrame, len(data))
+    }
+    f := &Frame{
+        Type:    data[0],
+        Stream:  binary.BigEndian.Uint32(data[1:5]),
+        Seq:     binary.BigEndian.Uint64(data[5:13]),
+        Payload: data[headerSize:],
+    }
+    if f.Type > FrameAck {
+        return nil, fmt.Errorf("%w: type %d", ErrBadFrame, f.Type)
+    }
+    if f.Type == FrameWindow && len(f.Payload) != 4 {
+        return nil, fmt.Errorf("%w: window payload of %d bytes", ErrBadFrame, len(f.Payload))
+    }
+    return f, nil
+}
+
+// windowFrame build a window update
+func windowFrame(stream uint32, increment uint32) *Frame {
+    p := make([]byte, 4)
+    binary.BigEndian.PutUint32(p, increment)
+    return &Frame{Type: FrameWindow, Stream: stream, Payload: p}
+}
+
+// hello is the payload of a hello frame, the flag tells the client if the server resumed the session
+type hello struct {
+    resumed bool
+    id      string
+}
+
+func (h hello) encode() []byte {
+    b := []byte{0}
+    if h.resumed {
+        b[0] = 1
+    }
+    return append(b, h.id...)
+}
+
+func decodeHello(p []byte) (hello, error) {
+    if len(p) < 1 {
+        return hello{}, fmt.Errorf("%w: empty hello", ErrBadFrame)
+    }
+    return hello{resumed: p[0] == 1, id: string(p[1:])}, nil
+}
@@ -0,0 +1,43 @@
+package mux
+
+import (
+    "bytes"
+    "errors"
+    "testing"
+)
+
+func TestFrameEncode(t *testing.T) {
+    f := &Frame{Type: FrameData, Stream: 7, Seq: 1 << 40, Payload: []byte("abc")}
+    got, err := Decode(f.Encode())
+    if err != nil || got.Type != f.Type || got.Stream != f.Stream || got.Seq != f.Seq || !bytes.Equal(got.Payload, f.Payload) {
+        t.Fatalf("Decode(Encode()) = %+v, %v, want %+v", got, err, f)
+    }
+    w, err := Decode(windowFrame(3, 1024).Encode())
+    if err != nil || w.Type != FrameWindow || w.Stream != 3 || !bytes.Equal(w.Payload, []byte{0, 0, 4, 0}) {
+        t.Errorf("window frame = %+v, %v", w, err)
+    }
+}
+
+func TestDecodeBadFrame(t *testing.T) {
+    for _, data := range [][]byte{
+        {FrameData, 0, 0},
+        (&Frame{Type: FrameAck + 1}).Encode(),
+        (&Frame{Type: FrameWindow, Payload: []byte{1}}).Encode(),
+    } {
+        if _, err := Decode(data); !errors.Is(err, ErrBadFrame) {
+            t.Errorf("Decode(%v) error = %v, want %v", data, err, ErrBadFrame)
+        }
+    }
+}
+
+func TestHello(t *testing.T) {
+    for _, h := range []hello{{resumed: true, id: "abc"}, {id: "x"}} {
+        got, err := decodeHello(h.encode())
+        if err != nil || got != h {
+            t.Errorf("decodeHello(encode(%+v)) = %+v, %v", h, got, err)
+        }
+    }
+    if _, err := decodeHello(nil); !errors.Is(err, ErrBadFrame) {
+        t.Errorf("decodeHello(nil) error = %v, want %v", err, ErrBadFrame)
+    }
+}
@@ -0,0 +1,414 @@
+package mux
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io"
+    "sync"
+    "testing"
+    "time"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+// conn reads the server side of a wstest connection
+type conn struct {
+    *wstest.Conn
+}
+
+func (c conn) Read() (int, []byte, error) {
+    return c.ReadMessage()
+}
+
+// testServer runs a mux server and keeps the sessions it created
+type testServer struct {
+    srv *wstest.Server
+    mux *Server
+
+    lock     sync.Mutex
+    sessions []*Session
+}
+
+func newTestServer(t *testing.T, cfg Config, handle func(s *Session)) *testServer {
+    ts := &testServer{}
+    ts.mux = NewServer(cfg, func(s *Session) {
+        ts.lock.Lock()
+        ts.sessions = append(ts.sessions, s)
+        ts.lock.Unlock()
+        if handle != nil {
+            handle(s)
+        }
+    })
+    ts.srv = wstest.NewServer(func(c *wstest.Conn) {
+        _ = ts.mux.Serve(conn{c})
+    })
+    t.Cleanup(ts.srv.Close)
+    return ts
+}
+
+// session wait for the nth session of the server, starting at 1
+func (ts *testServer) session(t *testing.T, n int) *Session {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        ts.lock.Lock()
+        if len(ts.sessions) >= n {
+            s := ts.sessions[n-1]
+            ts.lock.Unlock()
+            return s
+        }
+        ts.lock.Unlock()
+        time.Sleep(5 * time.Millisecond)
+    }
+    t.Fatalf("no session %d", n)
+    return nil
+}
+
+func newTestClient(t *testing.T, ts *testServer, cfg Config, setup func(w *plugin.Ws)) *Session {
+    w := &plugin.Ws{}
+    w.SetUrl("ws", ts.srv.Host, "/mux")
+    if setup != nil {
+        setup(w)
+    }
+    s := NewClient(w, cfg)
+    if err := s.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { s.Close() })
+    return s
+}
+
+// echo write back everything read from the streams of a session
+func echo(s *Session) {
+    for {
+        st, err := s.Accept()
+        if err != nil {
+            return
+        }
+        go func() {
+            _, _ = io.Copy(st, st)
+            _ = st.CloseWrite()
+        }()
+    }
+}
+
+// roundTrip write data, close the writing side and read everything back
+func roundTrip(t *testing.T, st *Stream, data []byte) {
+    t.Helper()
+    errs := make(chan error, 1)
+    go func() {
+        _, err := st.Write(data)
+        if err == nil {
+            err = st.CloseWrite()
+        }
+        errs <- err
+    }()
+    got, err := io.ReadAll(st)
+    if err != nil {
+        t.Fatalf("read stream %d: %v", st.ID(), err)
+    }
+    if err := <-errs; err != nil {
+        t.Fatalf("write stream %d: %v", st.ID(), err)
+    }
+    if !bytes.Equal(got, data) {
+        t.Fatalf("stream %d echoed %d bytes, want %d", st.ID(), len(got), len(data))
+    }
+}
+
+// pattern return n bytes that differ per stream
+func pattern(n int, seed byte) []byte {
+    b := make([]byte, n)
+    for i := range b {
+        b[i] = byte(i) ^ seed
+    }
+    return b
+}
+
+// waitErr wait until a stream read fails
+func waitErr(t *testing.T, st *Stream) error {
+    t.Helper()
+    errs := make(chan error, 1)
+    go func() {
+        _, err := st.Read(make([]byte, 1))
+        errs <- err
+    }()
+    select {
+    case err := <-errs:
+        return err
+    case <-time.After(5 * time.Second):
+        t.Fatalf("stream %d still open", st.ID())
+        return nil
+    }
+}
+
+func TestEcho(t *testing.T) {
+    ts := newTestServer(t, Config{}, echo)
+    s := newTestClient(t, ts, Config{}, nil)
+    st, err := s.Open()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if st.ID() != 1 {
+        t.Errorf("ID() = %d, want 1", st.ID())
+    }
+    roundTrip(t, st, []byte("ping"))
+}
+
+func TestConcurrentStreams(t *testing.T) {
+    ts := newTestServer(t, Config{}, echo)
+    s := newTestClient(t, ts, Config{MaxFrame: 4096}, nil)
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        st, err := s.Open()
+        if err != nil {
+            t.Fatal(err)
+        }
+        wg.Add(1)
+        go func(seed byte) {
+            defer wg.Done()
+            roundTrip(t, st, pattern(3*DefaultWindow+100, seed))
+        }(byte(i))
+    }
+    wg.Wait()
+}
+
+func TestServerOpens(t *testing.T) {
+    ts := newTestServer(t, Config{}, func(s *Session) {
+        st, err := s.Open()
+        if err != nil {
+            return
+        }
+        _, _ = st.Write([]byte("hello"))
+        _ = st.Close()
+    })
+    s := newTestClient(t, ts, Config{}, nil)
+    st, err := s.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    got, err := io.ReadAll(st)
+    if err != nil || string(got) != "hello" || st.ID() != 2 {
+        t.Errorf("stream %d read %q, %v, want stream 2 with hello", st.ID(), got, err)
+    }
+}
+
+func TestFlowControl(t *testing.T) {
+    accepted := make(chan *Stream, 1)
+    ts := newTestServer(t, Config{}, func(s *Session) {
+        st, err := s.Accept()
+        if err == nil {
+            accepted <- st
+        }
+    })
+    s := newTestClient(t, ts, Config{}, nil)
+    st, err := s.Open()
+    if err != nil {
+        t.Fatal(err)
+    }
+    data := pattern(DefaultWindow+10, 1)
+    written := make(chan error, 1)
+    go func() {
+        _, err := st.Write(data)
+        written <- err
+    }()
+    peer := <-accepted
+    select {
+    case err := <-written:
+        t.Fatalf("Write() = %v before the peer read anything", err)
+    case <-time.After(100 * time.Millisecond):
+    }
+    got := make([]byte, len(data))
+    if _, err := io.ReadFull(peer, got); err != nil {
+        t.Fatal(err)
+    }
+    if err := <-written; err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, data) {
+        t.Error("received bytes differ")
+    }
+}
+
+func TestWindowViolation(t *testing.T) {
+    s := newSession(Config{}, "x", true)
+    defer s.fail(ErrSessionClosed)
+    s.handle(&Frame{Type: FrameOpen, Stream: 1, Seq: 1})
+    st, err := s.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.handle(&Frame{Type: FrameData, Stream: 1, Seq: 2, Payload: make([]byte, DefaultWindow)})
+    s.handle(&Frame{Type: FrameData, Stream: 1, Seq: 3, Payload: []byte{1}})
+    if _, err := st.Read(make([]byte, 1)); err != ErrFlowControl {
+        t.Errorf("Read() error = %v, want %v", err, ErrFlowControl)
+    }
+    s.lock.Lock()
+    last := s.outbox[len(s.outbox)-1]
+    s.lock.Unlock()
+    if last.Type != FrameReset || last.Stream != 1 {
+        t.Errorf("last frame = %+v, want a reset of stream 1", last)
+    }
+}
+
+func TestReset(t *testing.T) {
+    accepted := make(chan *Stream, 1)
+    ts := newTestServer(t, Config{}, func(s *Session) {
+        st, err := s.Accept()
+        if err == nil {
+            accepted <- st
+        }
+    })
+    s := newTestClient(t, ts, Config{}, nil)
+    st, err := s.Open()
+    if err != nil {
+        t.Fatal(err)
+    }
+    peer := <-accepted
+    if err := st.Reset(); err != nil {
+        t.Fatal(err)
+    }
+    var reset *ResetError
+    if err := waitErr(t, peer); !errors.As(err, &reset) || reset.Stream != 1 {
+        t.Errorf("Read() error = %v, want a reset of stream 1", err)
+    }
+    if _, err := st.Write([]byte("x")); err != ErrStreamClosed {
+        t.Errorf("Write() error = %v after Reset, want %v", err, ErrStreamClosed)
+    }
+}
+
+func TestCloseWrite(t *testing.T) {
+    ts := newTestServer(t, Config{}, echo)
+    s := newTestClient(t, ts, Config{}, nil)
+    st, err := s.Open()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := st.CloseWrite(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := st.Write([]byte("x")); err != ErrStreamClosed {
+        t.Errorf("Write() error = %v after CloseWrite, want %v", err, ErrStreamClosed)
+    }
+    if err := waitErr(t, st); err != io.EOF {
+        t.Errorf("Read() error = %v, want %v", err, io.EOF)
+    }
+}
+
+func TestReconnectWithoutResume(t *testing.T) {
+    ts := newTestServer(t, Config{}, echo)
+    s := newTestClient(t, ts, Config{}, func(w *plugin.Ws) { w.Reconnect(true) })
+    st, err := s.Open()
+    if err != nil {
+        t.Fatal(err)
+    }
+    id := s.ID()
+    first := ts.session(t, 1)
+    ts.srv.CloseConnections()
+    if err := waitErr(t, st); err != ErrConnectionLost {
+        t.Errorf("Read() error = %v, want %v", err, ErrConnectionLost)
+    }
+    <-first.Done()
+    if s.ID() == id {
+        t.Error("the session id was kept without resumption")
+    }
+    st, err = s.Open()
+    if err != nil {
+        t.Fatal(err)
+    }
+    roundTrip(t, st, []byte("again"))
+}
+
+func TestResume(t *testing.T) {
+    cfg := Config{Resume: true}
+    ts := newTestServer(t, cfg, echo)
+    s := newTestClient(t, ts, cfg, func(w *plugin.Ws) { w.Reconnect(true) })
+    st, err := s.Open()
+    if err != nil {
+        t.Fatal(err)
+    }
+    data := pattern(2*DefaultWindow, 3)
+    if _, err := st.Write(data[:DefaultWindow]); err != nil {
+        t.Fatal(err)
+    }
+    got := make([]byte, len(data))
+    if _, err := io.ReadFull(st, got[:DefaultWindow/2]); err != nil {
+        t.Fatal(err)
+    }
+    ts.srv.CloseConnections()
+    done := make(chan error, 1)
+    go func() {
+        _, err := st.Write(data[DefaultWindow:])
+        if err == nil {
+            err = st.CloseWrite()
+        }
+        done <- err
+    }()
+    if _, err := io.ReadFull(st, got[DefaultWindow/2:]); err != nil {
+        t.Fatal(err)
+    }
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, data) {
+        t.Error("the stream lost or repeated bytes across the reconnect")
+    }
+    if err := waitErr(t, st); err != io.EOF {
+        t.Errorf("Read() error = %v, want %v", err, io.EOF)
+    }
+    if n := len(ts.srv.Handshakes()); n != 2 {
+        t.Errorf("%d connections, want 2", n)
+    }
+    ts.lock.Lock()
+    n := len(ts.sessions)
+    ts.lock.Unlock()
+    if n != 1 {
+        t.Errorf("%d sessions on the server, want the resumed one", n)
+    }
+}
+
+func TestResumeTimeout(t *testing.T) {
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    ts := newTestServer(t, Config{Resume: true, ResumeTimeout: time.Minute, Clock: clock}, echo)
+    s := newTestClient(t, ts, Config{Resume: true}, nil)
+    if _, err := s.Open(); err != nil {
+        t.Fatal(err)
+    }
+    peer := ts.session(t, 1)
+    ts.srv.CloseConnections()
+    clock.BlockUntil(1)
+    clock.Advance(time.Minute)
+    select {
+    case <-peer.Done():
+    case <-time.After(5 * time.Second):
+        t.Fatal("the detached session was kept after the resume timeout")
+    }
+    if err := peer.Err(); err != ErrConnectionLost {
+        t.Errorf("Err() = %v, want %v", err, ErrConnectionLost)
+    }
+}
+
+func TestClose(t *testing.T) {
+    ts := newTestServer(t, Config{}, echo)
+    s := newTestClient(t, ts, Config{}, nil)
+    st, err := s.Open()
+    if err != nil {
+        t.Fatal(err)
+    }
+    peer := ts.session(t, 1)
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := waitErr(t, st); err != ErrSessionClosed {
+        t.Errorf("Read() error = %v, want %v", err, ErrSessionClosed)
+    }
+    select {
+    case <-peer.Done():
+    case <-time.After(5 * time.Second):
+        t.Fatal("the server kept the session of a closed client")
+    }
+    if _, err := s.Open(); err != ErrSessionClosed {
+        t.Errorf("Open() error = %v, want %v", err, ErrSessionClosed)
+    }
+}
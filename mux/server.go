@@ -0,0 +1,127 @@
+package mux
+
+import (
+    "fmt"
+    "sync"
+)
+
+// Server demultiplexes the sessions of clients, with Resume a client that reconnects gets
+// its session back with every stream intact
+type Server struct {
+    cfg    Config
+    handle func(s *Session)
+
+    lock     sync.Mutex
+    sessions map[string]*Session
+}
+
+// NewServer create a server, handle is called on its own goroutine for every new session
+func NewServer(cfg Config, handle func(s *Session)) *Server {
+    cfg.defaults()
+    return &Server{cfg: cfg, handle: handle, sessions: map[string]*Session{}}
+}
+
+// Serve run a session on c until the connection ends, a resumable session outlives it
+// for the resume timeout
+func (sv *Server) Serve(c Conn) error {
+    _, d, err := c.Read()
+    if err != nil {
+        return err
+    }
+    f, err := Decode(d)
+    if err != nil {
+        return err
+    }
+    if f.Type != FrameHello {
+        return fmt.Errorf("%w: expected hello, got type %d", ErrBadFrame, f.Type)
+    }
+    h, err := decodeHello(f.Payload)
+    if err != nil {
+        return err
+    }
+    s, resumed := sv.session(h.id)
+    s.lock.Lock()
+    if s.conn != nil && s.conn != c {
+        // the old connection has not noticed it is gone yet
+        _ = s.conn.Close()
+    }
+    s.attach(c, &Frame{Type: FrameHello, Seq: s.recvSeq, Payload: hello{resumed: resumed, id: h.id}.encode()}, f.Seq)
+    s.lock.Unlock()
+    if !resumed {
+        go sv.handle(s)
+    }
+    for {
+        _, d, err := c.Read()
+        if err != nil {
+            sv.detach(s, c, err)
+            return err
+        }
+        f, err := Decode(d)
+        if err != nil {
+            s.report(err)
+            continue
+        }
+        if f.Type == FrameHello {
+            s.report(fmt.Errorf("%w: unexpected hello", ErrBadFrame))
+            continue
+        }
+        s.handle(f)
+    }
+}
+
+// session return the session to resume or a new one
+func (sv *Server) session(id string) (*Session, bool) {
+    sv.lock.Lock()
+    defer sv.lock.Unlock()
+    if s := sv.sessions[id]; s != nil && s.Err() == nil {
+        return s, true
+    }
+    s := newSession(sv.cfg, id, true)
+    if sv.cfg.Resume {
+        sv.sessions[id] = s
+        go func() {
+            <-s.Done()
+            sv.lock.Lock()
+            if sv.sessions[id] == s {
+                delete(sv.sessions, id)
+            }
+            sv.lock.Unlock()
+        }()
+    }
+    return s, false
+}
+
+// detach the session from a connection that ended, a resumable session waits for the client
+// until the resume timeout passed
+func (sv *Server) detach(s *Session, c Conn, err error) {
+    s.lock.Lock()
+    if s.conn != c {
+        // a newer connection took over
+        s.lock.Unlock()
+        return
+    }
+    s.conn = nil
+    s.detach()
+    gen := s.gen
+    if !sv.cfg.Resume || s.closed {
+        s.lock.Unlock()
+        s.fail(err)
+        return
+    }
+    s.lock.Unlock()
+    go func() {
+        timer := sv.cfg.Clock.NewTimer(sv.cfg.ResumeTimeout)
+        defer timer.Stop()
+        select {
+        case <-timer.C():
+        case <-s.Done():
+            return
+        }
+        s.lock.Lock()
+        expired := s.gen == gen
+        s.lock.Unlock()
+        if expired {
+            s.fail(ErrConnectionLost)
+        }
+    }()
+}
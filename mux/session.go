@@ -0,0 +1,393 @@
+package mux
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+var (
+    // ErrSessionClosed is returned after Close
+    ErrSessionClosed = errors.New("mux: session closed")
+
+    // ErrConnectionLost ends the streams of a session that could not be resumed
+    ErrConnectionLost = errors.New("mux: connection lost")
+
+    // ErrStreamClosed is returned when reading a closed stream or writing after CloseWrite
+    ErrStreamClosed = errors.New("mux: stream closed")
+
+    // ErrFlowControl resets a stream that received more than its window
+    ErrFlowControl = errors.New("mux: flow control violated")
+)
+
+// ResetError is the error of a stream that was reset by the other side
+type ResetError struct {
+    Stream uint32
+    Reason string
+}
+
+func (e *ResetError) Error() string {
+    return fmt.Sprintf("mux: stream %d reset: %s", e.Stream, e.Reason)
+}
+
+// Conn is the connection a session runs on, *websocket.Ws and *server.Peer implement it
+type Conn interface {
+    Read() (int, []byte, error)
+    WriteMessage(messageType int, data []byte) error
+    Close() error
+}
+
+// Config of a session, both ends should use the same settings
+type Config struct {
+    // Window is the receive window of every stream, values below DefaultWindow use DefaultWindow
+    Window int
+
+    // MaxFrame is the largest data payload of a frame, 0 uses 32 KiB
+    MaxFrame int
+
+    // Backlog is the number of opened streams waiting for Accept, more are reset, 0 uses 16
+    Backlog int
+
+    // Resume keeps the streams across a new connection, sent frames are kept until the other side
+    // acknowledged them and are sent again when the session is resumed
+    Resume bool
+
+    // ResumeTimeout is how long the server keeps a session without connection, 0 waits 30 seconds
+    ResumeTimeout time.Duration
+
+    // OnError is called for frames that can not be decoded, it must not block
+    OnError func(err error)
+
+    // Clock is used for the resume timeout, the system clock is used when it is nil
+    Clock plugin.Clock
+}
+
+// ackEvery is the number of received frames after which a resumable session sends an ack
+const ackEvery = 16
+
+func (c *Config) defaults() {
+    if c.Window < DefaultWindow {
+        c.Window = DefaultWindow
+    }
+    if c.MaxFrame <= 0 {
+        c.MaxFrame = 32 << 10
+    }
+    if c.Backlog <= 0 {
+        c.Backlog = 16
+    }
+    if c.ResumeTimeout <= 0 {
+        c.ResumeTimeout = 30 * time.Second
+    }
+    if c.Clock == nil {
+        c.Clock = plugin.SystemClock
+    }
+}
+
+// Session multiplexes streams over a connection, frames are written by a single goroutine
+// so a blocked connection never stops the session from reading
+type Session struct {
+    cfg Config
+
+    lock sync.Mutex
+
+    // wake is signalled when frames are queued or the session becomes ready
+    wake *sync.Cond
+
+    id         string
+    conn       Conn
+    gen        uint64
+    ready      bool
+    streams    map[uint32]*Stream
+    nextStream uint32
+    accept     chan *Stream
+
+    // priority frames are written even when the session is not ready, the outbox only when it is
+    priority []*Frame
+    outbox   []*Frame
+
+    // unacked holds the sent sequenced frames of a resumable session until they are acknowledged
+    sendSeq  uint64
+    recvSeq  uint64
+    ackedSeq uint64
+    unacked  []*Frame
+
+    // w is the connection of a client, established is set after its first hello
+    w           *plugin.Ws
+    running     bool
+    established bool
+
+    err    error
+    closed bool
+    done   chan struct{}
+}
+
+// newSession create a session, clients open odd streams and servers even ones
+func newSession(cfg Config, id string, server bool) *Session {
+    cfg.defaults()
+    s := &Session{
+        cfg:        cfg,
+        id:         id,
+        streams:    map[uint32]*Stream{},
+        nextStream: 1,
+        accept:     make(chan *Stream, cfg.Backlog),
+        done:       make(chan struct{}),
+    }
+    if server {
+        s.nextStream = 2
+    }
+    s.wake = sync.NewCond(&s.lock)
+    go s.writeLoop()
+    return s
+}
+
+// ID return the id of the session
+func (s *Session) ID() string {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return s.id
+}
+
+// Err return why the session ended, it is nil while it runs
+func (s *Session) Err() error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return s.err
+}
+
+// Done is closed when the session ended
+func (s *Session) Done() <-chan struct{} {
+    return s.done
+}
+
+// Open a stream
+func (s *Session) Open() (*Stream, error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.err != nil {
+        return nil, s.err
+    }
+    st := s.newStream(s.nextStream)
+    s.nextStream += 2
+    s.queue(&Frame{Type: FrameOpen, Stream: st.id})
+    st.grant()
+    return st, nil
+}
+
+// Accept wait for a stream opened by the other side
+func (s *Session) Accept() (*Stream, error) {
+    select {
+    case st := <-s.accept:
+        return st, nil
+    case <-s.done:
+        // streams that were accepted before the end are still handed out
+        select {
+        case st := <-s.accept:
+            return st, nil
+        default:
+        }
+        return nil, s.Err()
+    }
+}
+
+// Close end every stream and close the connection
+func (s *Session) Close() error {
+    s.lock.Lock()
+    s.closed = true
+    conn := s.conn
+    s.lock.Unlock()
+    s.fail(ErrSessionClosed)
+    if conn != nil {
+        return conn.Close()
+    }
+    return nil
+}
+
+// queue a frame, sequenced frames are numbered and kept for a resumption, the lock must be held
+func (s *Session) queue(f *Frame) {
+    if s.err != nil {
+        return
+    }
+    if f.sequenced() {
+        s.sendSeq++
+        f.Seq = s.sendSeq
+        if s.cfg.Resume {
+            s.unacked = append(s.unacked, f)
+        }
+    } else if !s.ready {
+        // acks of a connection that is gone are not needed
+        return
+    }
+    s.outbox = append(s.outbox, f)
+    s.wake.Broadcast()
+}
+
+// attach start using a connection, hello is written first and the frames the other side did not receive
+// follow, the lock must be held
+func (s *Session) attach(conn Conn, hello *Frame, peerSeq uint64) {
+    s.gen++
+    s.conn = conn
+    s.priority = nil
+    if hello != nil {
+        s.priority = append(s.priority, hello)
+    }
+    s.ack(peerSeq)
+    if s.cfg.Resume {
+        s.outbox = append([]*Frame(nil), s.unacked...)
+    }
+    s.ready = true
+    s.wake.Broadcast()
+}
+
+// detach stop using the connection, the lock must be held
+func (s *Session) detach() {
+    s.gen++
+    s.ready = false
+    s.priority = nil
+}
+
+// reset forget the state of a session that was not resumed, the lock must be held
+func (s *Session) reset(err error) {
+    for id, st := range s.streams {
+        st.end(err)
+        delete(s.streams, id)
+    }
+    s.sendSeq, s.recvSeq, s.ackedSeq = 0, 0, 0
+    s.unacked = nil
+    s.outbox = nil
+}
+
+// ack drop the kept frames up to seq
+func (s *Session) ack(seq uint64) {
+    i := 0
+    for i < len(s.unacked) && s.unacked[i].Seq <= seq {
+        i++
+    }
+    s.unacked = s.unacked[i:]
+}
+
+// writeLoop write the queued frames until the session ended
+func (s *Session) writeLoop() {
+    for {
+        s.lock.Lock()
+        for s.err == nil && len(s.priority) == 0 && (!s.ready || len(s.outbox) == 0) {
+            s.wake.Wait()
+        }
+        if s.err != nil {
+            s.lock.Unlock()
+            return
+        }
+        var f *Frame
+        if len(s.priority) > 0 {
+            f, s.priority = s.priority[0], s.priority[1:]
+        } else {
+            f, s.outbox = s.outbox[0], s.outbox[1:]
+        }
+        conn, gen := s.conn, s.gen
+        s.lock.Unlock()
+        err := conn.WriteMessage(websocket.BinaryMessage, f.Encode())
+        if err != nil {
+            s.writeFailed(gen, err)
+        }
+    }
+}
+
+// writeFailed stop writing on a connection that failed, a resumable session and a client wait
+// for the next connection, the read loop of a client ends the session when there is none
+func (s *Session) writeFailed(gen uint64, err error) {
+    s.lock.Lock()
+    if s.gen != gen {
+        // the connection was replaced while writing
+        s.lock.Unlock()
+        return
+    }
+    if s.cfg.Resume || s.w != nil {
+        s.detach()
+        s.lock.Unlock()
+        return
+    }
+    s.lock.Unlock()
+    s.fail(err)
+}
+
+// handle a frame received from the other side
+func (s *Session) handle(f *Frame) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if f.Type == FrameAck {
+        s.ack(f.Seq)
+        return
+    }
+    if f.Seq <= s.recvSeq {
+        // sent again after a resumption
+        return
+    }
+    s.recvSeq = f.Seq
+    if s.cfg.Resume && s.recvSeq-s.ackedSeq >= ackEvery {
+        s.ackedSeq = s.recvSeq
+        s.queue(&Frame{Type: FrameAck, Seq: s.recvSeq})
+    }
+    st := s.streams[f.Stream]
+    switch f.Type {
+    case FrameOpen:
+        if st != nil {
+            return
+        }
+        st = s.newStream(f.Stream)
+        select {
+        case s.accept <- st:
+            st.grant()
+        default:
+            delete(s.streams, f.Stream)
+            s.queue(&Frame{Type: FrameReset, Stream: f.Stream, Payload: []byte("backlog full")})
+        }
+        return
+    }
+    if st == nil {
+        return
+    }
+    switch f.Type {
+    case FrameData:
+        st.receive(f.Payload)
+    case FrameWindow:
+        st.credit += int64(binary.BigEndian.Uint32(f.Payload))
+        st.cond.Broadcast()
+    case FrameClose:
+        st.remoteClosed = true
+        st.cond.Broadcast()
+        st.maybeRemove()
+    case FrameReset:
+        st.end(&ResetError{Stream: st.id, Reason: string(f.Payload)})
+        delete(s.streams, st.id)
+    }
+}
+
+// report an error to OnError
+func (s *Session) report(err error) {
+    if s.cfg.OnError != nil {
+        s.cfg.OnError(err)
+    }
+}
+
+// fail end the session and its streams
+func (s *Session) fail(err error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.err != nil {
+        return
+    }
+    if s.closed {
+        err = ErrSessionClosed
+    }
+    s.err = err
+    for id, st := range s.streams {
+        st.end(err)
+        delete(s.streams, id)
+    }
+    s.wake.Broadcast()
+    close(s.done)
+}
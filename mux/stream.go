@@ -0,0 +1,206 @@
+package mux
+
+import (
+    "bytes"
+    "io"
+    "sync"
+)
+
+// Stream is a bidirectional byte stream of a session, it can be used like a connection
+// with one reader and one writer at a time
+type Stream struct {
+    id uint32
+    s  *Session
+
+    // cond uses the lock of the session
+    cond *sync.Cond
+
+    // credit is the number of bytes the other side accepts
+    credit int64
+
+    // buf holds the received bytes, recvCredit is what the other side may still send
+    // and consumed what was read since the last window update
+    buf        bytes.Buffer
+    recvCredit int64
+    consumed   int
+
+    localClosed  bool
+    remoteClosed bool
+    readClosed   bool
+    err          error
+}
+
+// newStream add a stream to the session, the lock must be held
+func (s *Session) newStream(id uint32) *Stream {
+    st := &Stream{
+        id:         id,
+        s:          s,
+        cond:       sync.NewCond(&s.lock),
+        credit:     DefaultWindow,
+        recvCredit: DefaultWindow,
+    }
+    s.streams[id] = st
+    return st
+}
+
+// grant give the other side the part of the window above the default, the lock must be held
+func (st *Stream) grant() {
+    if extra := st.s.cfg.Window - DefaultWindow; extra > 0 {
+        st.recvCredit += int64(extra)
+        st.s.queue(windowFrame(st.id, uint32(extra)))
+    }
+}
+
+// ID return the id of the stream, streams opened by a client are odd and by a server even
+func (st *Stream) ID() uint32 {
+    return st.id
+}
+
+// Read received bytes, it returns io.EOF after the other side closed its writing side
+func (st *Stream) Read(p []byte) (int, error) {
+    s := st.s
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    for st.buf.Len() == 0 && !st.remoteClosed && !st.readClosed && st.err == nil {
+        st.cond.Wait()
+    }
+    if st.err != nil {
+        return 0, st.err
+    }
+    if st.readClosed {
+        return 0, ErrStreamClosed
+    }
+    if st.buf.Len() == 0 {
+        return 0, io.EOF
+    }
+    n, _ := st.buf.Read(p)
+    st.consumed += n
+    if st.consumed >= s.cfg.Window/2 {
+        st.giveBack(st.consumed)
+        st.consumed = 0
+    }
+    return n, nil
+}
+
+// giveBack return credit for n bytes, the lock must be held
+func (st *Stream) giveBack(n int) {
+    if n <= 0 || st.remoteClosed {
+        return
+    }
+    st.recvCredit += int64(n)
+    st.s.queue(windowFrame(st.id, uint32(n)))
+}
+
+// Write bytes, it waits while the other side has no room for them
+func (st *Stream) Write(p []byte) (int, error) {
+    s := st.s
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    written := 0
+    for len(p) > 0 {
+        for st.credit <= 0 && st.err == nil && !st.localClosed {
+            st.cond.Wait()
+        }
+        if st.err != nil {
+            return written, st.err
+        }
+        if st.localClosed {
+            return written, ErrStreamClosed
+        }
+        n := len(p)
+        if int64(n) > st.credit {
+            n = int(st.credit)
+        }
+        if n > s.cfg.MaxFrame {
+            n = s.cfg.MaxFrame
+        }
+        st.credit -= int64(n)
+        s.queue(&Frame{Type: FrameData, Stream: st.id, Payload: append([]byte(nil), p[:n]...)})
+        written += n
+        p = p[n:]
+    }
+    return written, nil
+}
+
+// CloseWrite end the writing side, the other side reads io.EOF once it read everything before it
+func (st *Stream) CloseWrite() error {
+    s := st.s
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if st.err != nil {
+        return st.err
+    }
+    if st.localClosed {
+        return nil
+    }
+    st.localClosed = true
+    s.queue(&Frame{Type: FrameClose, Stream: st.id})
+    st.cond.Broadcast()
+    st.maybeRemove()
+    return nil
+}
+
+// Close both sides of the stream, bytes that arrive later are dropped
+func (st *Stream) Close() error {
+    if err := st.CloseWrite(); err != nil {
+        return err
+    }
+    s := st.s
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if st.readClosed {
+        return nil
+    }
+    st.readClosed = true
+    st.giveBack(st.buf.Len() + st.consumed)
+    st.buf.Reset()
+    st.consumed = 0
+    st.cond.Broadcast()
+    return nil
+}
+
+// Reset abort the stream on both sides
+func (st *Stream) Reset() error {
+    s := st.s
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if st.err != nil {
+        return nil
+    }
+    s.queue(&Frame{Type: FrameReset, Stream: st.id, Payload: []byte("reset by peer")})
+    st.end(ErrStreamClosed)
+    delete(s.streams, st.id)
+    return nil
+}
+
+// receive bytes from the other side, the lock must be held
+func (st *Stream) receive(p []byte) {
+    st.recvCredit -= int64(len(p))
+    if st.recvCredit < 0 {
+        st.s.queue(&Frame{Type: FrameReset, Stream: st.id, Payload: []byte(ErrFlowControl.Error())})
+        st.end(ErrFlowControl)
+        delete(st.s.streams, st.id)
+        return
+    }
+    if st.readClosed {
+        st.giveBack(len(p))
+        return
+    }
+    st.buf.Write(p)
+    st.cond.Broadcast()
+}
+
+// end the stream with an error, the lock must be held
+func (st *Stream) end(err error) {
+    if st.err == nil {
+        st.err = err
+    }
+    st.cond.Broadcast()
+}
+
+// maybeRemove forget a stream that was closed on both sides, the lock must be held
+func (st *Stream) maybeRemove() {
+    if st.localClosed && st.remoteClosed {
+        delete(st.s.streams, st.id)
+    }
+}
@@ -0,0 +1,606 @@
+// Package phoenix is a client for Elixir Phoenix channels with the 2.0.0 json serializer on top of the plugin
+package phoenix
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/url"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// events and the topic used by the protocol
+const (
+    EventJoin      = "phx_join"
+    EventLeave     = "phx_leave"
+    EventReply     = "phx_reply"
+    EventError     = "phx_error"
+    EventClose     = "phx_close"
+    EventHeartbeat = "heartbeat"
+    TopicPhoenix   = "phoenix"
+)
+
+var (
+    // ErrTimeout is returned when the server did not reply in time
+    ErrTimeout = errors.New("phoenix: push timed out")
+
+    // ErrHeartbeatTimeout is the error of a socket whose heartbeat was not answered before the next one
+    ErrHeartbeatTimeout = errors.New("phoenix: heartbeat timed out")
+
+    // ErrSocketClosed is returned after Close
+    ErrSocketClosed = errors.New("phoenix: socket closed")
+
+    // ErrNotJoined is returned when pushing to a channel that is not joined
+    ErrNotJoined = errors.New("phoenix: channel not joined")
+)
+
+// ReplyError is a reply with a status other than ok
+type ReplyError struct {
+    Topic    string
+    Event    string
+    Status   string
+    Response json.RawMessage
+}
+
+func (e *ReplyError) Error() string {
+    return fmt.Sprintf("phoenix: %s %s replied %s: %s", e.Topic, e.Event, e.Status, e.Response)
+}
+
+// Message is a message of the 2.0.0 serializer, it is sent as [join_ref, ref, topic, event, payload]
+// and empty refs are null
+type Message struct {
+    JoinRef string
+    Ref     string
+    Topic   string
+    Event   string
+    Payload json.RawMessage
+}
+
+// MarshalJSON encode the message as an array
+func (m Message) MarshalJSON() ([]byte, error) {
+    payload := m.Payload
+    if payload == nil {
+        payload = json.RawMessage("{}")
+    }
+    return json.Marshal([]interface{}{nullable(m.JoinRef), nullable(m.Ref), m.Topic, m.Event, payload})
+}
+
+// UnmarshalJSON decode a message from an array
+func (m *Message) UnmarshalJSON(data []byte) error {
+    var parts []json.RawMessage
+    if err := json.Unmarshal(data, &parts); err != nil {
+        return err
+    }
+    if len(parts) != 5 {
+        return fmt.Errorf("phoenix: message has %d parts, want 5", len(parts))
+    }
+    var joinRef, ref *string
+    if err := json.Unmarshal(parts[0], &joinRef); err != nil {
+        return err
+    }
+    if err := json.Unmarshal(parts[1], &ref); err != nil {
+        return err
+    }
+    if err := json.Unmarshal(parts[2], &m.Topic); err != nil {
+        return err
+    }
+    if err := json.Unmarshal(parts[3], &m.Event); err != nil {
+        return err
+    }
+    m.JoinRef, m.Ref, m.Payload = "", "", parts[4]
+    if joinRef != nil {
+        m.JoinRef = *joinRef
+    }
+    if ref != nil {
+        m.Ref = *ref
+    }
+    return nil
+}
+
+func nullable(s string) interface{} {
+    if s == "" {
+        return nil
+    }
+    return s
+}
+
+// reply is the payload of phx_reply
+type reply struct {
+    Status   string          `json:"status"`
+    Response json.RawMessage `json:"response"`
+}
+
+// Config of a Socket
+type Config struct {
+    // Params are added to the query of the url, vsn is set by the socket
+    Params url.Values
+
+    // Heartbeat is the heartbeat interval, 0 uses 30 seconds
+    Heartbeat time.Duration
+
+    // Timeout is how long joins and pushes wait for a reply, 0 waits 10 seconds
+    Timeout time.Duration
+
+    // RejoinAfter is the wait before joining a channel again after a phx_error, 0 waits 1 second
+    RejoinAfter time.Duration
+
+    // OnError is called for messages that can not be decoded and failed rejoins, it must not block
+    OnError func(err error)
+
+    // Clock is used for heartbeats and timeouts, the system clock is used when it is nil
+    Clock plugin.Clock
+}
+
+// Socket multiplexes Phoenix channels over a Ws, joined channels are joined again whenever the Ws makes a new connection
+type Socket struct {
+    w     *plugin.Ws
+    cfg   Config
+    clock plugin.Clock
+
+    // writeLock makes sure there is only one writer
+    writeLock sync.Mutex
+
+    lock         sync.Mutex
+    channels     map[string]*Channel
+    replies      map[string]chan Message
+    nextRef      uint64
+    heartbeatRef string
+    err          error
+    running      bool
+    closed       bool
+    stop         chan struct{}
+    gen          uint64
+    timedOut     bool
+}
+
+// channel states
+const (
+    stateClosed = iota
+    stateJoining
+    stateJoined
+    stateErrored
+)
+
+// Channel is a topic on the socket
+type Channel struct {
+    Topic string
+
+    socket   *Socket
+    params   interface{}
+    state    int
+    joinRef  string
+    wanted   bool
+    handlers map[string][]func(payload json.RawMessage)
+}
+
+// NewSocket create a socket for w, the url of w must point at the websocket path of the Phoenix socket,
+// the OnConnect hook of w is wrapped to join the channels again
+func NewSocket(w *plugin.Ws, cfg Config) *Socket {
+    if cfg.Heartbeat <= 0 {
+        cfg.Heartbeat = 30 * time.Second
+    }
+    if cfg.Timeout <= 0 {
+        cfg.Timeout = 10 * time.Second
+    }
+    if cfg.RejoinAfter <= 0 {
+        cfg.RejoinAfter = time.Second
+    }
+    if cfg.Clock == nil {
+        cfg.Clock = plugin.SystemClock
+    }
+    s := &Socket{
+        w:        w,
+        cfg:      cfg,
+        clock:    cfg.Clock,
+        channels: map[string]*Channel{},
+        replies:  map[string]chan Message{},
+        stop:     make(chan struct{}),
+    }
+    q := url.Values{}
+    for k, v := range cfg.Params {
+        q[k] = v
+    }
+    q.Set("vsn", "2.0.0")
+    w.SetQuery(q)
+    hooks := w.Hooks()
+    next := hooks.OnConnect
+    hooks.OnConnect = func(w *plugin.Ws, info plugin.ConnectInfo) error {
+        s.restore()
+        if next != nil {
+            return next(w, info)
+        }
+        return nil
+    }
+    w.SetHooks(hooks)
+    return s
+}
+
+// Connect make the connection and start reading messages
+func (s *Socket) Connect(ctx context.Context) error {
+    s.lock.Lock()
+    if s.closed {
+        s.lock.Unlock()
+        return ErrSocketClosed
+    }
+    s.lock.Unlock()
+    if err := s.w.ConnectContext(ctx); err != nil {
+        return err
+    }
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.err = nil
+    if !s.running {
+        s.running = true
+        go s.readLoop()
+    }
+    return nil
+}
+
+// Err return why the socket stopped reading, it is nil while it runs
+func (s *Socket) Err() error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return s.err
+}
+
+// Close the connection, the channels are not joined again
+func (s *Socket) Close() error {
+    s.lock.Lock()
+    if s.closed {
+        s.lock.Unlock()
+        return nil
+    }
+    s.closed = true
+    close(s.stop)
+    s.lock.Unlock()
+    return s.w.Close()
+}
+
+// Channel return the channel of a topic, params are sent when it is joined
+func (s *Socket) Channel(topic string, params interface{}) *Channel {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    ch := s.channels[topic]
+    if ch == nil {
+        ch = &Channel{Topic: topic, socket: s, handlers: map[string][]func(payload json.RawMessage){}}
+        s.channels[topic] = ch
+    }
+    ch.params = params
+    return ch
+}
+
+// Joined return true while the channel is joined
+func (ch *Channel) Joined() bool {
+    ch.socket.lock.Lock()
+    defer ch.socket.lock.Unlock()
+    return ch.state == stateJoined
+}
+
+// On add a handler for an event of the channel, it is called on the goroutine that reads messages
+// so it must not wait for replies, phx_error and phx_close are passed to handlers as well
+func (ch *Channel) On(event string, handler func(payload json.RawMessage)) {
+    ch.socket.lock.Lock()
+    defer ch.socket.lock.Unlock()
+    ch.handlers[event] = append(ch.handlers[event], handler)
+}
+
+// Join the channel and return the response of the server, it is joined again after reconnects and phx_error
+// until Leave is called
+func (ch *Channel) Join(ctx context.Context) (json.RawMessage, error) {
+    s := ch.socket
+    s.lock.Lock()
+    ch.wanted = true
+    s.lock.Unlock()
+    resp, err := ch.join(ctx)
+    if err != nil {
+        var re *ReplyError
+        if errors.As(err, &re) {
+            s.lock.Lock()
+            ch.wanted = false
+            s.lock.Unlock()
+        }
+        return nil, err
+    }
+    return resp, nil
+}
+
+// join send phx_join with a new join ref
+func (ch *Channel) join(ctx context.Context) (json.RawMessage, error) {
+    s := ch.socket
+    s.lock.Lock()
+    ref := s.ref()
+    ch.joinRef = ref
+    ch.state = stateJoining
+    params := ch.params
+    s.lock.Unlock()
+    payload, err := json.Marshal(params)
+    if err != nil {
+        return nil, err
+    }
+    if params == nil {
+        payload = json.RawMessage("{}")
+    }
+    resp, err := s.request(ctx, Message{JoinRef: ref, Ref: ref, Topic: ch.Topic, Event: EventJoin, Payload: payload})
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if ch.joinRef == ref {
+        if err != nil {
+            ch.state = stateErrored
+        } else {
+            ch.state = stateJoined
+        }
+    }
+    return resp, err
+}
+
+// rejoin join the channel again while it is wanted and the connection did not change
+func (ch *Channel) rejoin(gen uint64) {
+    s := ch.socket
+    s.lock.Lock()
+    current := s.gen == gen && ch.wanted
+    s.lock.Unlock()
+    if !current {
+        return
+    }
+    _, err := ch.join(context.Background())
+    if err == nil {
+        return
+    }
+    s.report(err)
+    var re *ReplyError
+    if errors.As(err, &re) {
+        s.lock.Lock()
+        ch.wanted = false
+        s.lock.Unlock()
+        return
+    }
+    s.rejoinAfter(ch, gen)
+}
+
+// Leave the channel
+func (ch *Channel) Leave(ctx context.Context) error {
+    s := ch.socket
+    s.lock.Lock()
+    ch.wanted = false
+    joinRef := ch.joinRef
+    ch.state = stateClosed
+    ref := s.ref()
+    s.lock.Unlock()
+    _, err := s.request(ctx, Message{JoinRef: joinRef, Ref: ref, Topic: ch.Topic, Event: EventLeave})
+    return err
+}
+
+// Push an event to the channel and return the response of the reply
+func (ch *Channel) Push(ctx context.Context, event string, payload interface{}) (json.RawMessage, error) {
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return nil, err
+    }
+    s := ch.socket
+    s.lock.Lock()
+    if ch.state != stateJoined {
+        s.lock.Unlock()
+        return nil, fmt.Errorf("%w: %s", ErrNotJoined, ch.Topic)
+    }
+    m := Message{JoinRef: ch.joinRef, Ref: s.ref(), Topic: ch.Topic, Event: event, Payload: data}
+    s.lock.Unlock()
+    return s.request(ctx, m)
+}
+
+// ref return a new ref, the lock must be held
+func (s *Socket) ref() string {
+    s.nextRef++
+    return strconv.FormatUint(s.nextRef, 10)
+}
+
+// request send a message and wait for the phx_reply with its ref
+func (s *Socket) request(ctx context.Context, m Message) (json.RawMessage, error) {
+    ch := make(chan Message, 1)
+    s.lock.Lock()
+    if s.closed {
+        s.lock.Unlock()
+        return nil, ErrSocketClosed
+    }
+    s.replies[m.Ref] = ch
+    s.lock.Unlock()
+    defer func() {
+        s.lock.Lock()
+        delete(s.replies, m.Ref)
+        s.lock.Unlock()
+    }()
+    if err := s.write(m); err != nil {
+        return nil, err
+    }
+    timer := s.clock.NewTimer(s.cfg.Timeout)
+    defer timer.Stop()
+    select {
+    case r, ok := <-ch:
+        if !ok {
+            return nil, s.Err()
+        }
+        var rep reply
+        if err := json.Unmarshal(r.Payload, &rep); err != nil {
+            return nil, err
+        }
+        if rep.Status != "ok" {
+            return nil, &ReplyError{Topic: m.Topic, Event: m.Event, Status: rep.Status, Response: rep.Response}
+        }
+        return rep.Response, nil
+    case <-timer.C():
+        return nil, fmt.Errorf("%w: %s %s", ErrTimeout, m.Topic, m.Event)
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// write a message
+func (s *Socket) write(m Message) error {
+    s.writeLock.Lock()
+    defer s.writeLock.Unlock()
+    return s.w.WriteJSON(m)
+}
+
+// restore join the wanted channels again after a new connection and start the heartbeat,
+// the joins run on other goroutines because a write that reconnected still holds the write lock
+func (s *Socket) restore() {
+    s.lock.Lock()
+    s.gen++
+    gen := s.gen
+    s.timedOut = false
+    s.heartbeatRef = ""
+    var rejoin []*Channel
+    for _, ch := range s.channels {
+        if ch.wanted {
+            ch.state = stateErrored
+            rejoin = append(rejoin, ch)
+        }
+    }
+    s.lock.Unlock()
+    sort.Slice(rejoin, func(i, j int) bool { return rejoin[i].Topic < rejoin[j].Topic })
+    for _, ch := range rejoin {
+        go ch.rejoin(gen)
+    }
+    go s.heartbeat(gen)
+}
+
+// rejoinAfter join a channel again after the rejoin wait
+func (s *Socket) rejoinAfter(ch *Channel, gen uint64) {
+    go func() {
+        timer := s.clock.NewTimer(s.cfg.RejoinAfter)
+        select {
+        case <-timer.C():
+            ch.rejoin(gen)
+        case <-s.stop:
+            timer.Stop()
+        }
+    }()
+}
+
+// readLoop read messages until the connection fails and is not made again
+func (s *Socket) readLoop() {
+    for {
+        conn := s.w.ConnID()
+        _, d, err := s.w.Read()
+        if err != nil {
+            s.lock.Lock()
+            stopped := s.closed || s.timedOut
+            s.lock.Unlock()
+            if !stopped && s.w.Reconnected(conn) {
+                // the plugin reconnected while reading
+                continue
+            }
+            s.fail(err)
+            return
+        }
+        var m Message
+        if err := json.Unmarshal(d, &m); err != nil {
+            s.report(err)
+            continue
+        }
+        s.dispatch(m)
+    }
+}
+
+// dispatch a message received from the server
+func (s *Socket) dispatch(m Message) {
+    s.lock.Lock()
+    if m.Event == EventReply && m.Ref != "" {
+        if m.Topic == TopicPhoenix && m.Ref == s.heartbeatRef {
+            s.heartbeatRef = ""
+        }
+        if r := s.replies[m.Ref]; r != nil {
+            delete(s.replies, m.Ref)
+            s.lock.Unlock()
+            r <- m
+            return
+        }
+    }
+    ch := s.channels[m.Topic]
+    if ch == nil || (m.JoinRef != "" && m.JoinRef != ch.joinRef) {
+        // a message for a channel that was not joined or for an earlier join
+        s.lock.Unlock()
+        return
+    }
+    gen := s.gen
+    switch m.Event {
+    case EventError:
+        ch.state = stateErrored
+        if ch.wanted {
+            s.rejoinAfter(ch, gen)
+        }
+    case EventClose:
+        ch.state = stateClosed
+        ch.wanted = false
+    }
+    handlers := append([]func(payload json.RawMessage){}, ch.handlers[m.Event]...)
+    s.lock.Unlock()
+    for _, h := range handlers {
+        h(m.Payload)
+    }
+}
+
+// report an error to OnError
+func (s *Socket) report(err error) {
+    if s.cfg.OnError != nil {
+        s.cfg.OnError(err)
+    }
+}
+
+// fail stop reading and end the waits for replies
+func (s *Socket) fail(err error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.timedOut {
+        err = ErrHeartbeatTimeout
+    } else if s.closed {
+        err = ErrSocketClosed
+    }
+    s.err = err
+    s.running = false
+    s.gen++
+    for ref, ch := range s.replies {
+        close(ch)
+        delete(s.replies, ref)
+    }
+    for _, ch := range s.channels {
+        if ch.state != stateClosed {
+            ch.state = stateErrored
+        }
+    }
+}
+
+// heartbeat send a heartbeat every interval and drop the connection when the last one was not answered
+func (s *Socket) heartbeat(gen uint64) {
+    for {
+        timer := s.clock.NewTimer(s.cfg.Heartbeat)
+        select {
+        case <-timer.C():
+        case <-s.stop:
+            timer.Stop()
+            return
+        }
+        s.lock.Lock()
+        if s.gen != gen {
+            s.lock.Unlock()
+            return
+        }
+        missed := s.heartbeatRef != ""
+        s.timedOut = missed
+        ref := s.ref()
+        if !missed {
+            s.heartbeatRef = ref
+        }
+        s.lock.Unlock()
+        if missed {
+            _ = s.w.Close()
+            return
+        }
+        _ = s.write(Message{Ref: ref, Topic: TopicPhoenix, Event: EventHeartbeat})
+    }
+}
@@ -0,0 +1,346 @@
+package phoenix
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/url"
+    "sync"
+    "testing"
+    "time"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+// server is a small Phoenix socket for the tests, the topic room:secret needs the token secret,
+// the event echo replies with its payload, shout is broadcast to the channel, crash sends phx_error,
+// slow is not replied to and every other event is replied to with an error
+type server struct {
+    srv         *wstest.Server
+    noHeartbeat bool
+
+    lock sync.Mutex
+    log  []string
+}
+
+func newServer(t *testing.T) *server {
+    s := &server{}
+    s.srv = wstest.NewServer(s.serve)
+    t.Cleanup(s.srv.Close)
+    return s
+}
+
+func (s *server) record(c *wstest.Conn, format string, args ...interface{}) {
+    s.lock.Lock()
+    s.log = append(s.log, fmt.Sprintf("%d ", c.Index)+fmt.Sprintf(format, args...))
+    s.lock.Unlock()
+}
+
+// waitFor wait until the server logged an entry
+func (s *server) waitFor(t *testing.T, entry string) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        s.lock.Lock()
+        for _, e := range s.log {
+            if e == entry {
+                s.lock.Unlock()
+                return
+            }
+        }
+        s.lock.Unlock()
+        time.Sleep(time.Millisecond)
+    }
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    t.Fatalf("server got %q, want %q", s.log, entry)
+}
+
+func (s *server) serve(c *wstest.Conn) {
+    reply := func(m Message, status string, response interface{}) {
+        payload, _ := json.Marshal(map[string]interface{}{"status": status, "response": response})
+        _ = c.WriteJSON(Message{JoinRef: m.JoinRef, Ref: m.Ref, Topic: m.Topic, Event: EventReply, Payload: payload})
+    }
+    for {
+        _, d, err := c.Receive()
+        if err != nil {
+            return
+        }
+        var m Message
+        if err := json.Unmarshal(d, &m); err != nil {
+            return
+        }
+        switch m.Event {
+        case EventHeartbeat:
+            s.record(c, "heartbeat")
+            if !s.noHeartbeat {
+                reply(m, "ok", struct{}{})
+            }
+        case EventJoin:
+            s.record(c, "join %s %s", m.Topic, m.Payload)
+            var p struct{ Token string }
+            _ = json.Unmarshal(m.Payload, &p)
+            if m.Topic == "room:secret" && p.Token != "secret" {
+                reply(m, "error", map[string]string{"reason": "unauthorized"})
+                continue
+            }
+            reply(m, "ok", map[string]int{"conn": c.Index})
+        case EventLeave:
+            s.record(c, "leave %s", m.Topic)
+            reply(m, "ok", struct{}{})
+            _ = c.WriteJSON(Message{JoinRef: m.JoinRef, Ref: m.Ref, Topic: m.Topic, Event: EventClose})
+        case "echo":
+            reply(m, "ok", m.Payload)
+        case "shout":
+            reply(m, "ok", struct{}{})
+            _ = c.WriteJSON(Message{Topic: m.Topic, Event: "shout", Payload: m.Payload})
+        case "crash":
+            _ = c.WriteJSON(Message{JoinRef: m.JoinRef, Topic: m.Topic, Event: EventError})
+        case "slow":
+            s.record(c, "slow")
+        default:
+            reply(m, "error", map[string]string{"reason": "unmatched topic"})
+        }
+    }
+}
+
+// newTestSocket connect a socket to the server
+func newTestSocket(t *testing.T, s *server, cfg Config, setup func(w *plugin.Ws)) *Socket {
+    w := &plugin.Ws{}
+    w.SetUrl("ws", s.srv.Host, "/socket/websocket")
+    if setup != nil {
+        setup(w)
+    }
+    sock := NewSocket(w, cfg)
+    if err := sock.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { sock.Close() })
+    return sock
+}
+
+func TestMessage_JSON(t *testing.T) {
+    data, err := json.Marshal(Message{Ref: "1", Topic: TopicPhoenix, Event: EventHeartbeat})
+    if err != nil || string(data) != `[null,"1","phoenix","heartbeat",{}]` {
+        t.Errorf("Marshal() = %s, %v", data, err)
+    }
+    var m Message
+    if err := json.Unmarshal([]byte(`["3",null,"room:a","new",{"body":"hi"}]`), &m); err != nil {
+        t.Fatal(err)
+    }
+    if m.JoinRef != "3" || m.Ref != "" || m.Topic != "room:a" || m.Event != "new" || string(m.Payload) != `{"body":"hi"}` {
+        t.Errorf("Unmarshal() = %+v", m)
+    }
+    if err := json.Unmarshal([]byte(`["3","room:a"]`), &m); err == nil {
+        t.Error("Unmarshal() accepted a message with 2 parts")
+    }
+}
+
+func TestSocket_Connect(t *testing.T) {
+    s := newServer(t)
+    newTestSocket(t, s, Config{Params: url.Values{"token": {"abc"}}}, nil)
+    if got := s.srv.Handshakes()[0].URL.String(); got != "/socket/websocket?token=abc&vsn=2.0.0" {
+        t.Errorf("handshake url = %q", got)
+    }
+}
+
+func TestChannel_Join(t *testing.T) {
+    s := newServer(t)
+    sock := newTestSocket(t, s, Config{}, nil)
+    ch := sock.Channel("room:a", map[string]string{"name": "bob"})
+    resp, err := ch.Join(context.Background())
+    if err != nil || string(resp) != `{"conn":1}` || !ch.Joined() {
+        t.Errorf("Join() = %s, %v, Joined() = %v", resp, err, ch.Joined())
+    }
+    s.waitFor(t, `1 join room:a {"name":"bob"}`)
+
+    secret := sock.Channel("room:secret", map[string]string{"token": "wrong"})
+    _, err = secret.Join(context.Background())
+    var re *ReplyError
+    if !errors.As(err, &re) || re.Status != "error" || string(re.Response) != `{"reason":"unauthorized"}` || secret.Joined() {
+        t.Errorf("Join() error = %v, want the error reply", err)
+    }
+    if _, err := secret.Push(context.Background(), "echo", nil); !errors.Is(err, ErrNotJoined) {
+        t.Errorf("Push() error = %v, want %v", err, ErrNotJoined)
+    }
+}
+
+func TestChannel_Push(t *testing.T) {
+    s := newServer(t)
+    sock := newTestSocket(t, s, Config{}, nil)
+    ch := sock.Channel("room:a", nil)
+    if _, err := ch.Join(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    resp, err := ch.Push(context.Background(), "echo", map[string]string{"body": "hi"})
+    if err != nil || string(resp) != `{"body":"hi"}` {
+        t.Errorf("Push() = %s, %v", resp, err)
+    }
+    var re *ReplyError
+    if _, err := ch.Push(context.Background(), "unknown", nil); !errors.As(err, &re) || re.Event != "unknown" {
+        t.Errorf("Push() error = %v, want the error reply", err)
+    }
+}
+
+func TestChannel_Push_timeout(t *testing.T) {
+    s := newServer(t)
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    sock := newTestSocket(t, s, Config{Timeout: time.Second, Clock: clock}, nil)
+    ch := sock.Channel("room:a", nil)
+    joined := make(chan error, 1)
+    go func() {
+        _, err := ch.Join(context.Background())
+        joined <- err
+    }()
+    if err := <-joined; err != nil {
+        t.Fatal(err)
+    }
+    done := make(chan error, 1)
+    go func() {
+        _, err := ch.Push(context.Background(), "slow", nil)
+        done <- err
+    }()
+    s.waitFor(t, "1 slow")
+    // the heartbeat and the push wait
+    clock.BlockUntil(2)
+    clock.Advance(time.Second)
+    if err := <-done; !errors.Is(err, ErrTimeout) {
+        t.Errorf("Push() error = %v, want %v", err, ErrTimeout)
+    }
+}
+
+func TestChannel_On(t *testing.T) {
+    s := newServer(t)
+    sock := newTestSocket(t, s, Config{}, nil)
+    ch := sock.Channel("room:a", nil)
+    got := make(chan string, 1)
+    ch.On("shout", func(payload json.RawMessage) { got <- string(payload) })
+    if _, err := ch.Join(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := ch.Push(context.Background(), "shout", map[string]string{"body": "hey"}); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case p := <-got:
+        if p != `{"body":"hey"}` {
+            t.Errorf("broadcast payload = %s", p)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("broadcast not received")
+    }
+}
+
+func TestChannel_Leave(t *testing.T) {
+    s := newServer(t)
+    sock := newTestSocket(t, s, Config{}, nil)
+    ch := sock.Channel("room:a", nil)
+    closed := make(chan struct{})
+    ch.On(EventClose, func(json.RawMessage) { close(closed) })
+    if _, err := ch.Join(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if err := ch.Leave(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, "1 leave room:a")
+    select {
+    case <-closed:
+    case <-time.After(5 * time.Second):
+        t.Fatal("phx_close not received")
+    }
+    if ch.Joined() {
+        t.Error("Joined() = true after Leave()")
+    }
+}
+
+func TestSocket_heartbeat(t *testing.T) {
+    s := newServer(t)
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    sock := newTestSocket(t, s, Config{Heartbeat: 30 * time.Second, Clock: clock}, nil)
+    for i := 0; i < 3; i++ {
+        clock.BlockUntil(1)
+        clock.Advance(30 * time.Second)
+        s.waitFor(t, "1 heartbeat")
+    }
+    if sock.Err() != nil {
+        t.Errorf("Err() = %v with answered heartbeats", sock.Err())
+    }
+}
+
+func TestSocket_heartbeatTimeout(t *testing.T) {
+    s := newServer(t)
+    s.noHeartbeat = true
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    sock := newTestSocket(t, s, Config{Heartbeat: 30 * time.Second, Clock: clock}, func(w *plugin.Ws) { w.Reconnect(true) })
+    clock.BlockUntil(1)
+    clock.Advance(30 * time.Second)
+    s.waitFor(t, "1 heartbeat")
+    clock.BlockUntil(1)
+    clock.Advance(30 * time.Second)
+    deadline := time.Now().Add(5 * time.Second)
+    for sock.Err() == nil && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if !errors.Is(sock.Err(), ErrHeartbeatTimeout) {
+        t.Errorf("Err() = %v, want %v", sock.Err(), ErrHeartbeatTimeout)
+    }
+}
+
+func TestChannel_rejoin(t *testing.T) {
+    s := newServer(t)
+    sock := newTestSocket(t, s, Config{}, func(w *plugin.Ws) { w.Reconnect(true) })
+    ch := sock.Channel("room:a", map[string]string{"name": "bob"})
+    if _, err := ch.Join(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    s.srv.CloseConnections()
+    s.waitFor(t, `2 join room:a {"name":"bob"}`)
+    deadline := time.Now().Add(5 * time.Second)
+    for !ch.Joined() && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    resp, err := ch.Push(context.Background(), "echo", "after")
+    if err != nil || string(resp) != `"after"` {
+        t.Errorf("Push() = %s, %v after the reconnect", resp, err)
+    }
+}
+
+func TestChannel_rejoinAfterError(t *testing.T) {
+    s := newServer(t)
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    sock := newTestSocket(t, s, Config{RejoinAfter: 5 * time.Second, Heartbeat: time.Hour, Clock: clock}, nil)
+    ch := sock.Channel("room:a", nil)
+    errored := make(chan struct{}, 1)
+    ch.On(EventError, func(json.RawMessage) { errored <- struct{}{} })
+    joined := make(chan error, 1)
+    go func() {
+        _, err := ch.Join(context.Background())
+        joined <- err
+    }()
+    if err := <-joined; err != nil {
+        t.Fatal(err)
+    }
+    go func() { _, _ = ch.Push(context.Background(), "crash", nil) }()
+    select {
+    case <-errored:
+    case <-time.After(5 * time.Second):
+        t.Fatal("phx_error not received")
+    }
+    if ch.Joined() {
+        t.Error("Joined() = true after phx_error")
+    }
+    // the heartbeat, the push and the rejoin wait
+    clock.BlockUntil(3)
+    clock.Advance(5 * time.Second)
+    s.waitFor(t, "1 join room:a {}")
+    deadline := time.Now().Add(5 * time.Second)
+    for !ch.Joined() && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if !ch.Joined() {
+        t.Error("channel not joined again after phx_error")
+    }
+}
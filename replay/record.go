@@ -0,0 +1,244 @@
+// Package replay records websocket sessions and plays them back,
+// recordings are stored as json lines or in a compact binary format
+package replay
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+    "time"
+    "unicode/utf8"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// directions of a recorded frame, seen from the client that made the recording
+const (
+    In  = "in"
+    Out = "out"
+)
+
+// Format of a recording
+type Format int
+
+const (
+    JSONLines Format = iota
+    Binary
+)
+
+// magic starts every binary recording
+var magic = []byte("WSREC\x01")
+
+// maxEntrySize is the largest frame a binary recording may hold
+const maxEntrySize = 1 << 30
+
+// ErrBadRecording is returned when a recording can not be decoded
+var ErrBadRecording = errors.New("replay: bad recording")
+
+// Entry is a single recorded frame
+type Entry struct {
+    Time time.Time
+    Dir  string
+    Type int
+    Conn uint64
+    Data []byte
+}
+
+// jsonEntry is the json lines form of an entry, text frames are stored readable
+type jsonEntry struct {
+    Time time.Time `json:"time"`
+    Dir  string    `json:"dir"`
+    Type int       `json:"type"`
+    Conn uint64    `json:"conn"`
+    Text *string   `json:"text,omitempty"`
+    Data []byte    `json:"data,omitempty"`
+}
+
+// MarshalJSON store text frames as a string and other frames as base64
+func (e Entry) MarshalJSON() ([]byte, error) {
+    j := jsonEntry{Time: e.Time, Dir: e.Dir, Type: e.Type, Conn: e.Conn}
+    if e.Type == websocket.TextMessage && utf8.Valid(e.Data) {
+        text := string(e.Data)
+        j.Text = &text
+    } else {
+        j.Data = e.Data
+    }
+    return json.Marshal(j)
+}
+
+// UnmarshalJSON read an entry written by MarshalJSON
+func (e *Entry) UnmarshalJSON(b []byte) error {
+    var j jsonEntry
+    if err := json.Unmarshal(b, &j); err != nil {
+        return err
+    }
+    *e = Entry{Time: j.Time, Dir: j.Dir, Type: j.Type, Conn: j.Conn, Data: j.Data}
+    if j.Text != nil {
+        e.Data = []byte(*j.Text)
+    }
+    return nil
+}
+
+// Recorder writes frames to a recording
+type Recorder struct {
+    lock   sync.Mutex
+    out    *bufio.Writer
+    format Format
+    err    error
+}
+
+// NewRecorder create a recorder that writes to out in the given format
+func NewRecorder(out io.Writer, format Format) *Recorder {
+    r := &Recorder{out: bufio.NewWriter(out), format: format}
+    if format == Binary {
+        _, r.err = r.out.Write(magic)
+    }
+    return r
+}
+
+// Attach record every frame of w
+func (r *Recorder) Attach(w *plugin.Ws) {
+    w.SetTap(r.Tap)
+}
+
+// Tap record a frame from a Ws tap
+func (r *Recorder) Tap(f plugin.Frame) {
+    dir := In
+    if f.Outbound {
+        dir = Out
+    }
+    _ = r.Record(Entry{Time: f.Time, Dir: dir, Type: f.Type, Conn: f.ConnID, Data: f.Data})
+}
+
+// Record write an entry, it is flushed right away so a crash does not lose it
+func (r *Recorder) Record(e Entry) error {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    if r.err != nil {
+        return r.err
+    }
+    switch r.format {
+    case Binary:
+        r.err = writeBinary(r.out, e)
+    default:
+        var b []byte
+        b, r.err = json.Marshal(e)
+        if r.err == nil {
+            b = append(b, '\n')
+            _, r.err = r.out.Write(b)
+        }
+    }
+    if r.err == nil {
+        r.err = r.out.Flush()
+    }
+    return r.err
+}
+
+// Err return the first error that happened while recording
+func (r *Recorder) Err() error {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    return r.err
+}
+
+// writeBinary write time, direction, type, connection, length and data
+func writeBinary(w io.Writer, e Entry) error {
+    buf := make([]byte, 0, 8+1+3*binary.MaxVarintLen64+len(e.Data))
+    var ts [8]byte
+    binary.BigEndian.PutUint64(ts[:], uint64(e.Time.UnixNano()))
+    buf = append(buf, ts[:]...)
+    dir := byte(0)
+    if e.Dir == Out {
+        dir = 1
+    }
+    buf = append(buf, dir)
+    var v [binary.MaxVarintLen64]byte
+    buf = append(buf, v[:binary.PutUvarint(v[:], uint64(e.Type))]...)
+    buf = append(buf, v[:binary.PutUvarint(v[:], e.Conn)]...)
+    buf = append(buf, v[:binary.PutUvarint(v[:], uint64(len(e.Data)))]...)
+    buf = append(buf, e.Data...)
+    _, err := w.Write(buf)
+    return err
+}
+
+// Load read a recording, the format is detected from its first bytes
+func Load(in io.Reader) ([]Entry, error) {
+    r := bufio.NewReader(in)
+    head, err := r.Peek(len(magic))
+    if err == nil && bytes.Equal(head, magic) {
+        _, _ = r.Discard(len(magic))
+        return loadBinary(r)
+    }
+    var entries []Entry
+    dec := json.NewDecoder(r)
+    for {
+        var e Entry
+        if err := dec.Decode(&e); err == io.EOF {
+            return entries, nil
+        } else if err != nil {
+            return entries, fmt.Errorf("%w: entry %d: %v", ErrBadRecording, len(entries)+1, err)
+        }
+        entries = append(entries, e)
+    }
+}
+
+func loadBinary(r *bufio.Reader) ([]Entry, error) {
+    var entries []Entry
+    for {
+        var ts [8]byte
+        if _, err := io.ReadFull(r, ts[:]); err == io.EOF {
+            return entries, nil
+        } else if err != nil {
+            return entries, fmt.Errorf("%w: entry %d: %v", ErrBadRecording, len(entries)+1, err)
+        }
+        e, err := readBinary(r, ts)
+        if err != nil {
+            return entries, fmt.Errorf("%w: entry %d: %v", ErrBadRecording, len(entries)+1, err)
+        }
+        entries = append(entries, e)
+    }
+}
+
+// readBinary read the rest of an entry after its timestamp
+func readBinary(r *bufio.Reader, ts [8]byte) (Entry, error) {
+    e := Entry{Time: time.Unix(0, int64(binary.BigEndian.Uint64(ts[:])))}
+    dir, err := r.ReadByte()
+    if err != nil {
+        return e, err
+    }
+    e.Dir = In
+    if dir == 1 {
+        e.Dir = Out
+    }
+    t, err := binary.ReadUvarint(r)
+    if err != nil {
+        return e, err
+    }
+    e.Type = int(t)
+    if e.Conn, err = binary.ReadUvarint(r); err != nil {
+        return e, err
+    }
+    n, err := binary.ReadUvarint(r)
+    if err != nil {
+        return e, err
+    }
+    if n > maxEntrySize {
+        return e, fmt.Errorf("frame of %d bytes", n)
+    }
+    // the buffer grows with the bytes that are there, a truncated file does not allocate the full length
+    var data bytes.Buffer
+    if _, err := io.CopyN(&data, r, int64(n)); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return e, err
+    }
+    e.Data = data.Bytes()
+    return e, nil
+}
@@ -0,0 +1,143 @@
+package replay
+
+import (
+    "context"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// Server plays the inbound frames of a recording to the clients that connect to it,
+// the n-th connection gets the frames of the n-th recorded connection
+type Server struct {
+    // Upgrader is used for every connection
+    Upgrader websocket.Upgrader
+
+    // Clock paces the frames, it can be replaced before the first connection
+    Clock plugin.Clock
+
+    sessions [][]Entry
+    speed    float64
+
+    lock  sync.Mutex
+    conns int
+}
+
+// NewServer create a replay server, speed 1 keeps the original timing, 10 plays ten times faster
+// and 0 or less sends everything without waiting
+func NewServer(entries []Entry, speed float64) *Server {
+    return &Server{
+        Upgrader: websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }},
+        Clock:    plugin.SystemClock,
+        sessions: sessions(entries),
+        speed:    speed,
+    }
+}
+
+// ServeHTTP upgrade the request and play the next recorded connection
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+    s.lock.Lock()
+    n := s.conns
+    s.conns++
+    s.lock.Unlock()
+    if n >= len(s.sessions) {
+        http.Error(rw, "no more recorded connections", http.StatusServiceUnavailable)
+        return
+    }
+    c, err := s.Upgrader.Upgrade(rw, r, nil)
+    if err != nil {
+        return
+    }
+    defer c.Close()
+    // frames sent by the client are read and discarded so control frames are handled
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for {
+            if _, _, err := c.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }()
+    entries := s.sessions[n]
+    for i, e := range entries {
+        if i > 0 && !wait(r.Context(), s.Clock, done, e.Time.Sub(entries[i-1].Time), s.speed) {
+            return
+        }
+        if e.Dir != In {
+            continue
+        }
+        if err := c.WriteMessage(e.Type, e.Data); err != nil {
+            return
+        }
+    }
+    msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "end of recording")
+    _ = c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+    select {
+    case <-done:
+    case <-s.Clock.After(time.Second):
+    }
+}
+
+// Play send the outbound frames of a recording through w with the recorded timing on the clock of w,
+// w is reconnected whenever the recording moves to the next connection
+func Play(ctx context.Context, w *plugin.Ws, entries []Entry, speed float64) error {
+    var last *Entry
+    for i := range entries {
+        e := &entries[i]
+        if last != nil {
+            if !wait(ctx, w.Clock(), nil, e.Time.Sub(last.Time), speed) {
+                return ctx.Err()
+            }
+            if e.Conn != last.Conn {
+                if err := w.ConnectContext(ctx); err != nil {
+                    return err
+                }
+            }
+        }
+        last = e
+        if e.Dir != Out {
+            continue
+        }
+        if err := w.WriteMessageContext(ctx, e.Type, e.Data); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// sessions split a recording per connection in the order the connections appear
+func sessions(entries []Entry) [][]Entry {
+    var out [][]Entry
+    index := map[uint64]int{}
+    for _, e := range entries {
+        i, ok := index[e.Conn]
+        if !ok {
+            i = len(out)
+            index[e.Conn] = i
+            out = append(out, nil)
+        }
+        out[i] = append(out[i], e)
+    }
+    return out
+}
+
+// wait for d divided by speed on the clock, false when ctx or done ended first
+func wait(ctx context.Context, clock plugin.Clock, done <-chan struct{}, d time.Duration, speed float64) bool {
+    if speed <= 0 || d <= 0 {
+        return ctx.Err() == nil
+    }
+    t := clock.NewTimer(time.Duration(float64(d) / speed))
+    defer t.Stop()
+    select {
+    case <-t.C():
+        return true
+    case <-ctx.Done():
+        return false
+    case <-done:
+        return false
+    }
+}
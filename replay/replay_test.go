@@ -0,0 +1,215 @@
+package replay
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+// session is a recording of two connections
+func session() []Entry {
+    t0 := time.Unix(1700000000, 0)
+    return []Entry{
+        {Time: t0, Dir: Out, Type: websocket.TextMessage, Conn: 1, Data: []byte(`{"op":"login"}`)},
+        {Time: t0.Add(10 * time.Millisecond), Dir: In, Type: websocket.TextMessage, Conn: 1, Data: []byte(`{"op":"welcome"}`)},
+        {Time: t0.Add(20 * time.Millisecond), Dir: In, Type: websocket.BinaryMessage, Conn: 1, Data: []byte{0, 1, 2}},
+        {Time: t0.Add(30 * time.Millisecond), Dir: Out, Type: websocket.TextMessage, Conn: 2, Data: []byte(`{"op":"resume"}`)},
+        {Time: t0.Add(40 * time.Millisecond), Dir: In, Type: websocket.TextMessage, Conn: 2, Data: []byte(`{"op":"resumed"}`)},
+    }
+}
+
+func TestRecorder_formats(t *testing.T) {
+    tests := []struct {
+        name   string
+        format Format
+    }{
+        {name: "json lines", format: JSONLines},
+        {name: "binary", format: Binary},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var buf bytes.Buffer
+            r := NewRecorder(&buf, tt.format)
+            for _, e := range session() {
+                if err := r.Record(e); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            got, err := Load(&buf)
+            if err != nil {
+                t.Fatal(err)
+            }
+            want := session()
+            if len(got) != len(want) {
+                t.Fatalf("Load() = %d entries, want %d", len(got), len(want))
+            }
+            for i := range want {
+                if !got[i].Time.Equal(want[i].Time) || got[i].Dir != want[i].Dir || got[i].Type != want[i].Type ||
+                    got[i].Conn != want[i].Conn || !bytes.Equal(got[i].Data, want[i].Data) {
+                    t.Errorf("Load() entry %d = %+v, want %+v", i, got[i], want[i])
+                }
+            }
+        })
+    }
+}
+
+func TestLoad_bad(t *testing.T) {
+    if _, err := Load(strings.NewReader("{\"dir\":\"in\"}\nnot json\n")); err == nil {
+        t.Errorf("Load() of a broken recording did not fail")
+    }
+    if _, err := Load(bytes.NewReader(append(append([]byte{}, magic...), 1, 2, 3))); err == nil {
+        t.Errorf("Load() of a truncated binary recording did not fail")
+    }
+    header := append(append([]byte{}, magic...), 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1)
+    for _, size := range [][]byte{
+        {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+        {0xff, 0xff, 0xff, 0x03},
+    } {
+        data := append(append(append([]byte{}, header...), size...), 'x')
+        if _, err := Load(bytes.NewReader(data)); !errors.Is(err, ErrBadRecording) {
+            t.Errorf("Load() error = %v for a frame length of %x, want %v", err, size, ErrBadRecording)
+        }
+    }
+}
+
+func TestRecorder_Attach(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Echo()))
+    defer srv.Close()
+    var buf bytes.Buffer
+    rec := NewRecorder(&buf, JSONLines)
+    w := &plugin.Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    rec.Attach(w)
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+    if err := w.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := w.Read(); err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(buf.String(), `"text":"hello"`) {
+        t.Errorf("recording is not readable json lines: %s", buf.String())
+    }
+    entries, err := Load(&buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 2 || entries[0].Dir != Out || entries[1].Dir != In || entries[1].Conn != 1 {
+        t.Errorf("recorded %+v, want the sent and echoed frame of connection 1", entries)
+    }
+}
+
+func TestServer(t *testing.T) {
+    srv := httptest.NewServer(NewServer(session(), 0))
+    defer srv.Close()
+    host := strings.TrimPrefix(srv.URL, "http://")
+    tests := []struct {
+        name string
+        want []string
+    }{
+        {name: "first connection", want: []string{`{"op":"welcome"}`, "\x00\x01\x02"}},
+        {name: "second connection", want: []string{`{"op":"resumed"}`}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            w := &plugin.Ws{}
+            w.SetUrl("ws", host, "/")
+            if err := w.Connect(); err != nil {
+                t.Fatal(err)
+            }
+            defer w.Close()
+            for _, want := range tt.want {
+                if _, d, err := w.Read(); err != nil || string(d) != want {
+                    t.Errorf("Read() = %q, %v, want %q", d, err, want)
+                }
+            }
+            if _, _, err := w.Read(); err == nil {
+                t.Errorf("Read() after the recording did not fail")
+            }
+        })
+    }
+}
+
+func TestPlay(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer srv.Close()
+    w := &plugin.Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+    start := time.Now()
+    if err := Play(context.Background(), w, session(), 2); err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+        t.Errorf("Play() took %v, want the recorded timing at double speed", elapsed)
+    }
+    if !srv.WaitFor(2, time.Second) {
+        t.Fatalf("server received %v, want 2 frames", srv.Received())
+    }
+    got := srv.Received()
+    if string(got[0].Data) != `{"op":"login"}` || got[0].Conn != 1 || string(got[1].Data) != `{"op":"resume"}` || got[1].Conn != 2 {
+        t.Errorf("server received %+v, want login on connection 1 and resume on connection 2", got)
+    }
+}
+
+func TestServer_clock(t *testing.T) {
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    s := NewServer(session(), 1)
+    s.Clock = clock
+    srv := httptest.NewServer(s)
+    defer srv.Close()
+    w := &plugin.Ws{}
+    w.SetUrl("ws", strings.TrimPrefix(srv.URL, "http://"), "/")
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+    for _, want := range []string{`{"op":"welcome"}`, "\x00\x01\x02"} {
+        clock.BlockUntil(1)
+        clock.Advance(10 * time.Millisecond)
+        if _, d, err := w.Read(); err != nil || string(d) != want {
+            t.Errorf("Read() = %q, %v, want %q", d, err, want)
+        }
+    }
+}
+
+func TestPlay_clock(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer srv.Close()
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    w := &plugin.Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    w.SetClock(clock)
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+    played := make(chan error, 1)
+    go func() { played <- Play(context.Background(), w, session(), 1) }()
+    for i := 0; i < 4; i++ {
+        clock.BlockUntil(1)
+        select {
+        case err := <-played:
+            t.Fatalf("Play() = %v before the clock moved", err)
+        default:
+        }
+        clock.Advance(10 * time.Millisecond)
+    }
+    if err := <-played; err != nil {
+        t.Fatal(err)
+    }
+}
@@ -0,0 +1,159 @@
+package websocket
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+)
+
+// Resume contains the settings used to resume a session after a reconnect
+type Resume struct {
+    // SeqField is the json field that holds the sequence number of a received message,
+    // nested fields are separated by a dot, for example "meta.seq"
+    SeqField string
+
+    // Hook is called before a reconnect with the last received sequence number,
+    // it may change the url and headers of the handshake and can return a message
+    // that is sent instead of the init message once the connection is made
+    Hook func(seq int64, u *url.URL, h http.Header) []byte
+
+    // OnGap is called when one or more sequence numbers are missing
+    OnGap func(GapEvent)
+}
+
+// GapEvent describes a range of sequence numbers that were never received
+type GapEvent struct {
+    // first missing sequence number
+    Expected int64
+
+    // sequence number that was received instead
+    Got int64
+}
+
+// Missing return the number of messages that were skipped
+func (g GapEvent) Missing() int64 {
+    return g.Got - g.Expected
+}
+
+// ResumeQuery return a hook that adds the sequence number as a query parameter
+func ResumeQuery(name string) func(int64, *url.URL, http.Header) []byte {
+    return func(seq int64, u *url.URL, h http.Header) []byte {
+        q := u.Query()
+        q.Set(name, strconv.FormatInt(seq, 10))
+        u.RawQuery = q.Encode()
+        return nil
+    }
+}
+
+// ResumeHeader return a hook that adds the sequence number as a handshake header
+func ResumeHeader(name string) func(int64, *url.URL, http.Header) []byte {
+    return func(seq int64, u *url.URL, h http.Header) []byte {
+        h.Set(name, strconv.FormatInt(seq, 10))
+        return nil
+    }
+}
+
+// ResumeMessage return a hook that sends the message created by f after reconnecting
+func ResumeMessage(f func(seq int64) []byte) func(int64, *url.URL, http.Header) []byte {
+    return func(seq int64, u *url.URL, h http.Header) []byte {
+        return f(seq)
+    }
+}
+
+// SetResume enable session resumption, the sequence number is tracked from every received message
+func (w *Ws) SetResume(r Resume) {
+    w.seqLock.Lock()
+    defer w.seqLock.Unlock()
+    w.resume = &r
+}
+
+// LastSeq return the last received sequence number and whether one was received at all
+func (w *Ws) LastSeq() (int64, bool) {
+    w.seqLock.Lock()
+    defer w.seqLock.Unlock()
+    return w.lastSeq, w.seqSeen
+}
+
+// ResetSeq forget the last received sequence number, the next connect will start a new session
+func (w *Ws) ResetSeq() {
+    w.seqLock.Lock()
+    defer w.seqLock.Unlock()
+    w.lastSeq = 0
+    w.seqSeen = false
+}
+
+// trackSeq read the sequence number from a message and report gaps
+func (w *Ws) trackSeq(data []byte) {
+    w.seqLock.Lock()
+    if w.resume == nil || w.resume.SeqField == "" {
+        w.seqLock.Unlock()
+        return
+    }
+    seq, ok := seqFromJSON(data, w.resume.SeqField)
+    if !ok {
+        w.seqLock.Unlock()
+        return
+    }
+    var gap *GapEvent
+    if w.seqSeen && seq > w.lastSeq+1 {
+        gap = &GapEvent{Expected: w.lastSeq + 1, Got: seq}
+    }
+    // older or duplicate messages are replays and do not move the sequence back
+    if !w.seqSeen || seq > w.lastSeq {
+        w.lastSeq = seq
+        w.seqSeen = true
+    }
+    onGap := w.resume.OnGap
+    w.seqLock.Unlock()
+    if gap != nil && onGap != nil {
+        onGap(*gap)
+    }
+}
+
+// resumeHandshake apply the resume hook to the handshake of a reconnect, the hook runs without the lock
+// so it can call LastSeq
+func (w *Ws) resumeHandshake(u *url.URL, h http.Header) []byte {
+    w.seqLock.Lock()
+    if w.resume == nil || w.resume.Hook == nil || !w.seqSeen {
+        w.seqLock.Unlock()
+        return nil
+    }
+    hook, seq := w.resume.Hook, w.lastSeq
+    w.seqLock.Unlock()
+    return hook(seq, u, h)
+}
+
+// seqFromJSON find a numeric field in a json object
+func seqFromJSON(data []byte, field string) (int64, bool) {
+    raw := json.RawMessage(data)
+    for _, key := range strings.Split(field, ".") {
+        var obj map[string]json.RawMessage
+        if err := json.Unmarshal(raw, &obj); err != nil {
+            return 0, false
+        }
+        var ok bool
+        raw, ok = obj[key]
+        if !ok {
+            return 0, false
+        }
+    }
+    if string(raw) == "null" {
+        return 0, false
+    }
+    var seq int64
+    if err := json.Unmarshal(raw, &seq); err != nil {
+        // some servers send the sequence number as a string
+        var s string
+        if err := json.Unmarshal(raw, &s); err != nil {
+            return 0, false
+        }
+        n, err := strconv.ParseInt(s, 10, 64)
+        if err != nil {
+            return 0, false
+        }
+        return n, true
+    }
+    return seq, true
+}
@@ -0,0 +1,128 @@
+package websocket
+
+import (
+    "net/http"
+    "net/url"
+    "reflect"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func Test_seqFromJSON(t *testing.T) {
+    type args struct {
+        data  []byte
+        field string
+    }
+    tests := []struct {
+        name   string
+        args   args
+        want   int64
+        wantOk bool
+    }{
+        {name: "top level field", args: args{data: []byte(`{"s":42}`), field: "s"}, want: 42, wantOk: true},
+        {name: "nested field", args: args{data: []byte(`{"meta":{"seq":7}}`), field: "meta.seq"}, want: 7, wantOk: true},
+        {name: "string number", args: args{data: []byte(`{"seq":"12"}`), field: "seq"}, want: 12, wantOk: true},
+        {name: "null field", args: args{data: []byte(`{"s":null}`), field: "s"}, wantOk: false},
+        {name: "missing field", args: args{data: []byte(`{"op":1}`), field: "s"}, wantOk: false},
+        {name: "not json", args: args{data: []byte(`hello`), field: "s"}, wantOk: false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, ok := seqFromJSON(tt.args.data, tt.args.field)
+            if ok != tt.wantOk {
+                t.Errorf("seqFromJSON() ok = %v, want %v", ok, tt.wantOk)
+                return
+            }
+            if got != tt.want {
+                t.Errorf("seqFromJSON() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestWs_trackSeq(t *testing.T) {
+    tests := []struct {
+        name     string
+        messages []string
+        wantSeq  int64
+        wantGaps []GapEvent
+    }{
+        {name: "in order", messages: []string{`{"s":1}`, `{"s":2}`, `{"s":3}`}, wantSeq: 3},
+        {name: "gap", messages: []string{`{"s":1}`, `{"s":4}`}, wantSeq: 4, wantGaps: []GapEvent{{Expected: 2, Got: 4}}},
+        {name: "replay does not go back", messages: []string{`{"s":5}`, `{"s":3}`}, wantSeq: 5},
+        {name: "messages without seq", messages: []string{`{"s":1}`, `{"op":11}`, `{"s":2}`}, wantSeq: 2},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var gaps []GapEvent
+            w := &Ws{}
+            w.SetResume(Resume{SeqField: "s", OnGap: func(g GapEvent) { gaps = append(gaps, g) }})
+            for _, m := range tt.messages {
+                w.trackSeq([]byte(m))
+            }
+            if got, _ := w.LastSeq(); got != tt.wantSeq {
+                t.Errorf("LastSeq() = %v, want %v", got, tt.wantSeq)
+            }
+            if !reflect.DeepEqual(gaps, tt.wantGaps) {
+                t.Errorf("gaps = %v, want %v", gaps, tt.wantGaps)
+            }
+        })
+    }
+}
+
+func TestWs_resumeHandshake(t *testing.T) {
+    tests := []struct {
+        name      string
+        hook      func(int64, *url.URL, http.Header) []byte
+        seen      bool
+        wantQuery string
+        wantHead  string
+        wantMsg   []byte
+    }{
+        {name: "no seq yet", hook: ResumeQuery("seq"), seen: false},
+        {name: "query", hook: ResumeQuery("seq"), seen: true, wantQuery: "seq=9"},
+        {name: "header", hook: ResumeHeader("Last-Event-Id"), seen: true, wantHead: "9"},
+        {name: "message", hook: ResumeMessage(func(seq int64) []byte { return []byte("resume") }), seen: true, wantMsg: []byte("resume")},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            w := &Ws{}
+            w.SetResume(Resume{SeqField: "s", Hook: tt.hook})
+            if tt.seen {
+                w.trackSeq([]byte(`{"s":9}`))
+            }
+            u := url.URL{Scheme: "ws", Host: "localhost"}
+            h := http.Header{}
+            msg := w.resumeHandshake(&u, h)
+            if u.RawQuery != tt.wantQuery {
+                t.Errorf("query = %v, want %v", u.RawQuery, tt.wantQuery)
+            }
+            if got := h.Get("Last-Event-Id"); got != tt.wantHead {
+                t.Errorf("header = %v, want %v", got, tt.wantHead)
+            }
+            if !reflect.DeepEqual(msg, tt.wantMsg) {
+                t.Errorf("message = %v, want %v", msg, tt.wantMsg)
+            }
+        })
+    }
+}
+
+func TestWs_resumeHandshakeLastSeq(t *testing.T) {
+    w := &Ws{}
+    w.SetResume(Resume{SeqField: "s", Hook: func(int64, *url.URL, http.Header) []byte {
+        seq, _ := w.LastSeq()
+        return []byte(strconv.FormatInt(seq, 10))
+    }})
+    w.trackSeq([]byte(`{"s":4}`))
+    done := make(chan []byte, 1)
+    go func() { done <- w.resumeHandshake(&url.URL{}, http.Header{}) }()
+    select {
+    case msg := <-done:
+        if string(msg) != "4" {
+            t.Errorf("message = %s, want 4", msg)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("a hook that calls LastSeq deadlocked")
+    }
+}
@@ -0,0 +1,318 @@
+package websocket
+
+import (
+    "errors"
+    "sync"
+    "time"
+)
+
+// Priority of an outbound message, lanes with a lower value are always sent first
+type Priority int
+
+const (
+    PriorityControl Priority = iota
+    PriorityHigh
+    PriorityNormal
+    PriorityLow
+    priorityLanes
+)
+
+// ErrDropped is returned for a message that was pushed out of a full lane
+var ErrDropped = errors.New("message dropped from a full queue")
+
+// ErrSchedulerClosed is returned for messages that were still queued when the scheduler stopped
+var ErrSchedulerClosed = errors.New("scheduler is closed")
+
+// SchedulerConfig contains the limits used by a Scheduler, zero values disable a limit
+type SchedulerConfig struct {
+    // maximum number of frames per second and the burst allowed on top of it
+    MessagesPerSecond float64
+    MessageBurst      int
+
+    // maximum number of bytes per second and the burst allowed on top of it
+    BytesPerSecond float64
+    ByteBurst      int
+
+    // Merge joins small messages of the same lane and type into a single frame,
+    // batching is disabled when it is nil
+    Merge func([][]byte) []byte
+
+    // limits for a single batch, messages larger than MaxBatchBytes are never merged
+    MaxBatch      int
+    MaxBatchBytes int
+
+    // number of messages each lane can hold, when a lane is full the oldest message is dropped
+    QueueSize int
+}
+
+// outbound is a message waiting in one of the lanes
+type outbound struct {
+    messageType int
+    data        []byte
+    result      chan error
+}
+
+// Scheduler sends messages over a Ws in priority order within the configured rate limits
+type Scheduler struct {
+    w      *Ws
+    cfg    SchedulerConfig
+    lock   sync.Mutex
+    lanes  [priorityLanes][]outbound
+    signal chan struct{}
+    done   chan struct{}
+    closed bool
+    wg     sync.WaitGroup
+
+    messages *tokenBucket
+    bytes    *tokenBucket
+}
+
+// NewScheduler create a scheduler that writes to w, it runs until Close is called
+func (w *Ws) NewScheduler(cfg SchedulerConfig) *Scheduler {
+    if cfg.QueueSize <= 0 {
+        cfg.QueueSize = 1024
+    }
+    if cfg.MaxBatch <= 0 {
+        cfg.MaxBatch = 16
+    }
+    if cfg.MaxBatchBytes <= 0 {
+        cfg.MaxBatchBytes = 4096
+    }
+    s := &Scheduler{
+        w:      w,
+        cfg:    cfg,
+        signal: make(chan struct{}, 1),
+        done:   make(chan struct{}),
+    }
+    if cfg.MessagesPerSecond > 0 {
+        s.messages = newTokenBucket(w.getClock(), cfg.MessagesPerSecond, cfg.MessageBurst)
+    }
+    if cfg.BytesPerSecond > 0 {
+        s.bytes = newTokenBucket(w.getClock(), cfg.BytesPerSecond, cfg.ByteBurst)
+    }
+    s.wg.Add(1)
+    go s.run()
+    return s
+}
+
+// Send queue a message, the returned channel receives the result of the write
+func (s *Scheduler) Send(p Priority, messageType int, data []byte) <-chan error {
+    result := make(chan error, 1)
+    if p < PriorityControl {
+        p = PriorityControl
+    }
+    if p >= priorityLanes {
+        p = priorityLanes - 1
+    }
+    s.lock.Lock()
+    if s.closed {
+        s.lock.Unlock()
+        result <- ErrSchedulerClosed
+        return result
+    }
+    lane := s.lanes[p]
+    if len(lane) >= s.cfg.QueueSize {
+        // drop the oldest message so the lane always holds the most recent ones
+        lane[0].result <- ErrDropped
+        lane = lane[1:]
+    }
+    s.lanes[p] = append(lane, outbound{messageType: messageType, data: data, result: result})
+    s.lock.Unlock()
+    s.w.metrics.queueDepth(s.Len())
+    select {
+    case s.signal <- struct{}{}:
+    default:
+    }
+    return result
+}
+
+// Len return the number of queued messages over all lanes
+func (s *Scheduler) Len() int {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    n := 0
+    for _, lane := range s.lanes {
+        n += len(lane)
+    }
+    return n
+}
+
+// Close stop the scheduler, messages that are still queued receive ErrSchedulerClosed
+func (s *Scheduler) Close() {
+    s.lock.Lock()
+    if s.closed {
+        s.lock.Unlock()
+        return
+    }
+    s.closed = true
+    close(s.done)
+    s.lock.Unlock()
+    s.wg.Wait()
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    for i, lane := range s.lanes {
+        for _, m := range lane {
+            m.result <- ErrSchedulerClosed
+        }
+        s.lanes[i] = nil
+    }
+}
+
+// run send messages until the scheduler is closed
+func (s *Scheduler) run() {
+    defer s.wg.Done()
+    for {
+        select {
+        case <-s.done:
+            return
+        default:
+        }
+        batch, ok := s.next()
+        if !ok {
+            select {
+            case <-s.signal:
+                continue
+            case <-s.done:
+                return
+            }
+        }
+        s.w.metrics.queueDepth(s.Len())
+        messageType, data := s.merge(batch)
+        if !s.wait(len(data)) {
+            s.requeue(batch)
+            return
+        }
+        err := s.w.WriteMessage(messageType, data)
+        for _, m := range batch {
+            m.result <- err
+        }
+    }
+}
+
+// next take the next message, or batch of messages, from the highest priority lane
+func (s *Scheduler) next() ([]outbound, bool) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    for i, lane := range s.lanes {
+        if len(lane) == 0 {
+            continue
+        }
+        n := 1
+        if s.cfg.Merge != nil && len(lane[0].data) <= s.cfg.MaxBatchBytes {
+            size := len(lane[0].data)
+            for n < len(lane) && n < s.cfg.MaxBatch {
+                m := lane[n]
+                if m.messageType != lane[0].messageType || size+len(m.data) > s.cfg.MaxBatchBytes {
+                    break
+                }
+                size += len(m.data)
+                n++
+            }
+        }
+        batch := make([]outbound, n)
+        copy(batch, lane[:n])
+        s.lanes[i] = lane[n:]
+        return batch, true
+    }
+    return nil, false
+}
+
+// requeue put a batch back in front of the queue when the scheduler stops before sending it
+func (s *Scheduler) requeue(batch []outbound) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.lanes[PriorityControl] = append(batch, s.lanes[PriorityControl]...)
+}
+
+// merge turn a batch into a single frame
+func (s *Scheduler) merge(batch []outbound) (int, []byte) {
+    if len(batch) == 1 {
+        return batch[0].messageType, batch[0].data
+    }
+    parts := make([][]byte, len(batch))
+    for i, m := range batch {
+        parts[i] = m.data
+    }
+    return batch[0].messageType, s.cfg.Merge(parts)
+}
+
+// wait until both token buckets allow a frame of size bytes, false when the scheduler was closed
+func (s *Scheduler) wait(size int) bool {
+    for {
+        var d time.Duration
+        if s.messages != nil {
+            d = s.messages.reserve(1)
+        }
+        if s.bytes != nil {
+            if bd := s.bytes.reserve(size); bd > d {
+                d = bd
+            }
+        }
+        if d <= 0 {
+            if s.messages != nil {
+                s.messages.take(1)
+            }
+            if s.bytes != nil {
+                s.bytes.take(size)
+            }
+            return true
+        }
+        t := s.w.getClock().NewTimer(d)
+        select {
+        case <-t.C():
+        case <-s.done:
+            t.Stop()
+            return false
+        }
+    }
+}
+
+// tokenBucket is a rate limiter that refills rate tokens per second up to burst tokens
+type tokenBucket struct {
+    clock  Clock
+    rate   float64
+    burst  float64
+    tokens float64
+    last   time.Time
+}
+
+// newTokenBucket create a full bucket, the burst is at least one second worth of tokens when it is not set
+func newTokenBucket(clock Clock, rate float64, burst int) *tokenBucket {
+    b := float64(burst)
+    if b <= 0 {
+        b = rate
+    }
+    if b < 1 {
+        b = 1
+    }
+    return &tokenBucket{clock: clock, rate: rate, burst: b, tokens: b, last: clock.Now()}
+}
+
+// refill add the tokens earned since the last call
+func (b *tokenBucket) refill() {
+    now := b.clock.Now()
+    b.tokens += now.Sub(b.last).Seconds() * b.rate
+    if b.tokens > b.burst {
+        b.tokens = b.burst
+    }
+    b.last = now
+}
+
+// reserve return how long to wait until n tokens are available,
+// requests larger than the burst only wait for a full bucket
+func (b *tokenBucket) reserve(n int) time.Duration {
+    b.refill()
+    need := float64(n)
+    if need > b.burst {
+        need = b.burst
+    }
+    if b.tokens >= need {
+        return 0
+    }
+    return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take remove n tokens, the bucket may go negative for frames larger than the burst
+func (b *tokenBucket) take(n int) {
+    b.tokens -= float64(n)
+}
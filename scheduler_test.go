@@ -0,0 +1,112 @@
+package websocket
+
+import (
+    "bytes"
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+func TestScheduler_next(t *testing.T) {
+    join := func(parts [][]byte) []byte { return bytes.Join(parts, []byte("\n")) }
+    tests := []struct {
+        name  string
+        cfg   SchedulerConfig
+        queue map[Priority][]string
+        want  [][]string
+    }{
+        {
+            name:  "control before data",
+            cfg:   SchedulerConfig{},
+            queue: map[Priority][]string{PriorityLow: {"low"}, PriorityNormal: {"data"}, PriorityControl: {"ping"}},
+            want:  [][]string{{"ping"}, {"data"}, {"low"}},
+        },
+        {
+            name:  "fifo within a lane",
+            cfg:   SchedulerConfig{},
+            queue: map[Priority][]string{PriorityNormal: {"a", "b", "c"}},
+            want:  [][]string{{"a"}, {"b"}, {"c"}},
+        },
+        {
+            name:  "batch small messages",
+            cfg:   SchedulerConfig{Merge: join, MaxBatch: 2, MaxBatchBytes: 64},
+            queue: map[Priority][]string{PriorityNormal: {"a", "b", "c"}},
+            want:  [][]string{{"a", "b"}, {"c"}},
+        },
+        {
+            name:  "batch limited by size",
+            cfg:   SchedulerConfig{Merge: join, MaxBatch: 8, MaxBatchBytes: 4},
+            queue: map[Priority][]string{PriorityNormal: {"aa", "bb", "cc"}},
+            want:  [][]string{{"aa", "bb"}, {"cc"}},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := &Scheduler{cfg: tt.cfg}
+            for p, msgs := range tt.queue {
+                for _, m := range msgs {
+                    s.lanes[p] = append(s.lanes[p], outbound{messageType: websocket.TextMessage, data: []byte(m)})
+                }
+            }
+            var got [][]string
+            for {
+                batch, ok := s.next()
+                if !ok {
+                    break
+                }
+                var b []string
+                for _, m := range batch {
+                    b = append(b, string(m.data))
+                }
+                got = append(got, b)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("next() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestScheduler_Send(t *testing.T) {
+    w, srv := newTestWs(t, wstest.Script(wstest.Drain()))
+
+    s := w.NewScheduler(SchedulerConfig{MessagesPerSecond: 50, MessageBurst: 1})
+    defer s.Close()
+    start := time.Now()
+    var results []<-chan error
+    for _, m := range []string{"one", "two", "three"} {
+        results = append(results, s.Send(PriorityNormal, websocket.TextMessage, []byte(m)))
+    }
+    for i, r := range results {
+        if err := <-r; err != nil {
+            t.Errorf("Send() message %d error = %v", i, err)
+        }
+    }
+    if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+        t.Errorf("Send() took %v, rate limit was not applied", elapsed)
+    }
+    if !srv.WaitFor(3, time.Second) {
+        t.Fatalf("received %v, want 3 messages", srv.Received())
+    }
+    for i, want := range []string{"one", "two", "three"} {
+        if got := string(srv.Received()[i].Data); got != want {
+            t.Errorf("received %v, want %v", got, want)
+        }
+    }
+}
+
+func TestScheduler_dropOldest(t *testing.T) {
+    s := &Scheduler{w: &Ws{}, cfg: SchedulerConfig{QueueSize: 2}, signal: make(chan struct{}, 1)}
+    first := s.Send(PriorityNormal, websocket.TextMessage, []byte("1"))
+    s.Send(PriorityNormal, websocket.TextMessage, []byte("2"))
+    s.Send(PriorityNormal, websocket.TextMessage, []byte("3"))
+    if err := <-first; err != ErrDropped {
+        t.Errorf("Send() error = %v, want %v", err, ErrDropped)
+    }
+    if got := s.Len(); got != 2 {
+        t.Errorf("Len() = %v, want 2", got)
+    }
+}
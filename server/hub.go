@@ -0,0 +1,304 @@
+package server
+
+import (
+    "sort"
+    "sync"
+
+    "github.com/gorilla/websocket"
+)
+
+// PresenceKind tells if a peer arrived or went away
+type PresenceKind int
+
+const (
+    PresenceJoin PresenceKind = iota
+    PresenceLeave
+)
+
+func (k PresenceKind) String() string {
+    if k == PresenceJoin {
+        return "join"
+    }
+    return "leave"
+}
+
+// PresenceEvent is sent when a peer joins or leaves the hub or one of its rooms
+type PresenceEvent struct {
+    Kind PresenceKind
+    Peer *Peer
+
+    // Room is empty for the hub itself
+    Room string
+}
+
+// HubConfig of a Hub
+type HubConfig struct {
+    // QueueSize is the number of messages buffered for every peer, the oldest message is dropped
+    // when the queue is full, 0 buffers 64
+    QueueSize int
+
+    // MaxDropped disconnects a peer with 1013 try again later once it dropped more messages
+    // since its last successful write, 0 never disconnects
+    MaxDropped int
+
+    // OnPresence is called for every join and leave, it must not block
+    OnPresence func(PresenceEvent)
+}
+
+// Hub tracks connected peers and fans messages out to all of them, to a room or to a filtered set
+type Hub struct {
+    cfg HubConfig
+
+    lock    sync.Mutex
+    members map[*Peer]*member
+    rooms   map[string]map[*Peer]bool
+}
+
+// outgoing is a queued message
+type outgoing struct {
+    messageType int
+    data        []byte
+}
+
+// member is a peer in the hub with its send queue
+type member struct {
+    peer  *Peer
+    queue chan outgoing
+    stop  chan struct{}
+    rooms map[string]bool
+
+    lock    sync.Mutex
+    dropped int
+    slow    bool
+}
+
+// NewHub create an empty hub
+func NewHub(cfg HubConfig) *Hub {
+    if cfg.QueueSize <= 0 {
+        cfg.QueueSize = 64
+    }
+    return &Hub{cfg: cfg, members: map[*Peer]*member{}, rooms: map[string]map[*Peer]bool{}}
+}
+
+// Serve wrap a serve function so every peer is in the hub while it runs, it can be passed to NewHandler
+func (h *Hub) Serve(serve func(p *Peer)) func(p *Peer) {
+    return func(p *Peer) {
+        h.Add(p)
+        defer h.Remove(p)
+        serve(p)
+    }
+}
+
+// Add a peer to the hub, it is removed again when its connection ends
+func (h *Hub) Add(p *Peer) {
+    h.lock.Lock()
+    if _, ok := h.members[p]; ok {
+        h.lock.Unlock()
+        return
+    }
+    m := &member{peer: p, queue: make(chan outgoing, h.cfg.QueueSize), stop: make(chan struct{}), rooms: map[string]bool{}}
+    h.members[p] = m
+    h.lock.Unlock()
+    go m.run()
+    go func() {
+        select {
+        case <-p.Done():
+            h.Remove(p)
+        case <-m.stop:
+        }
+    }()
+    h.presence(PresenceEvent{Kind: PresenceJoin, Peer: p})
+}
+
+// Remove a peer from the hub and from all its rooms
+func (h *Hub) Remove(p *Peer) {
+    h.lock.Lock()
+    m, ok := h.members[p]
+    if !ok {
+        h.lock.Unlock()
+        return
+    }
+    delete(h.members, p)
+    var rooms []string
+    for room := range m.rooms {
+        rooms = append(rooms, room)
+        h.leave(m, room)
+    }
+    close(m.stop)
+    h.lock.Unlock()
+    sort.Strings(rooms)
+    for _, room := range rooms {
+        h.presence(PresenceEvent{Kind: PresenceLeave, Peer: p, Room: room})
+    }
+    h.presence(PresenceEvent{Kind: PresenceLeave, Peer: p})
+}
+
+// Join add a peer that is in the hub to a room
+func (h *Hub) Join(p *Peer, room string) {
+    h.lock.Lock()
+    m, ok := h.members[p]
+    if !ok || m.rooms[room] {
+        h.lock.Unlock()
+        return
+    }
+    m.rooms[room] = true
+    if h.rooms[room] == nil {
+        h.rooms[room] = map[*Peer]bool{}
+    }
+    h.rooms[room][p] = true
+    h.lock.Unlock()
+    h.presence(PresenceEvent{Kind: PresenceJoin, Peer: p, Room: room})
+}
+
+// Leave remove a peer from a room
+func (h *Hub) Leave(p *Peer, room string) {
+    h.lock.Lock()
+    m, ok := h.members[p]
+    if !ok || !m.rooms[room] {
+        h.lock.Unlock()
+        return
+    }
+    h.leave(m, room)
+    h.lock.Unlock()
+    h.presence(PresenceEvent{Kind: PresenceLeave, Peer: p, Room: room})
+}
+
+// leave remove a member from a room, the lock must be held
+func (h *Hub) leave(m *member, room string) {
+    delete(m.rooms, room)
+    delete(h.rooms[room], m.peer)
+    if len(h.rooms[room]) == 0 {
+        delete(h.rooms, room)
+    }
+}
+
+// Broadcast queue a message for every peer in the hub
+func (h *Hub) Broadcast(messageType int, data []byte) {
+    h.BroadcastFilter(nil, messageType, data)
+}
+
+// BroadcastRoom queue a message for every peer in a room
+func (h *Hub) BroadcastRoom(room string, messageType int, data []byte) {
+    h.lock.Lock()
+    targets := make([]*member, 0, len(h.rooms[room]))
+    for p := range h.rooms[room] {
+        targets = append(targets, h.members[p])
+    }
+    h.lock.Unlock()
+    h.send(targets, messageType, data)
+}
+
+// BroadcastFilter queue a message for every peer for which filter returns true, nil sends to everyone
+func (h *Hub) BroadcastFilter(filter func(p *Peer) bool, messageType int, data []byte) {
+    h.lock.Lock()
+    targets := make([]*member, 0, len(h.members))
+    for p, m := range h.members {
+        if filter == nil || filter(p) {
+            targets = append(targets, m)
+        }
+    }
+    h.lock.Unlock()
+    h.send(targets, messageType, data)
+}
+
+// Peers return the peers in the hub
+func (h *Hub) Peers() []*Peer {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    peers := make([]*Peer, 0, len(h.members))
+    for p := range h.members {
+        peers = append(peers, p)
+    }
+    return peers
+}
+
+// Members return the peers in a room
+func (h *Hub) Members(room string) []*Peer {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    peers := make([]*Peer, 0, len(h.rooms[room]))
+    for p := range h.rooms[room] {
+        peers = append(peers, p)
+    }
+    return peers
+}
+
+// Rooms return the rooms of a peer in sorted order
+func (h *Hub) Rooms(p *Peer) []string {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    m, ok := h.members[p]
+    if !ok {
+        return nil
+    }
+    rooms := make([]string, 0, len(m.rooms))
+    for room := range m.rooms {
+        rooms = append(rooms, room)
+    }
+    sort.Strings(rooms)
+    return rooms
+}
+
+// send queue a message for every target
+func (h *Hub) send(targets []*member, messageType int, data []byte) {
+    for _, m := range targets {
+        if m.enqueue(outgoing{messageType: messageType, data: data}, h.cfg.MaxDropped) {
+            go func(p *Peer) {
+                p.cfg.Logger.Warn("disconnecting slow consumer", p.logArgs()...)
+                _ = p.CloseWith(websocket.CloseTryAgainLater, "slow consumer")
+            }(m.peer)
+        }
+    }
+}
+
+// presence call the presence hook
+func (h *Hub) presence(e PresenceEvent) {
+    if h.cfg.OnPresence != nil {
+        h.cfg.OnPresence(e)
+    }
+}
+
+// enqueue add a message, when the queue is full the oldest message is dropped like in Ws.WriteQueue,
+// true is returned once the peer dropped more than maxDropped messages
+func (m *member) enqueue(o outgoing, maxDropped int) bool {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    if m.slow {
+        return false
+    }
+    for {
+        select {
+        case m.queue <- o:
+            return false
+        default:
+        }
+        if maxDropped > 0 && m.dropped >= maxDropped {
+            m.slow = true
+            return true
+        }
+        select {
+        case <-m.queue:
+            m.dropped++
+        default:
+        }
+    }
+}
+
+// run write queued messages until the peer is gone
+func (m *member) run() {
+    for {
+        select {
+        case o := <-m.queue:
+            if err := m.peer.WriteMessage(o.messageType, o.data); err != nil {
+                return
+            }
+            m.lock.Lock()
+            m.dropped = 0
+            m.lock.Unlock()
+        case <-m.stop:
+            return
+        case <-m.peer.Done():
+            return
+        }
+    }
+}
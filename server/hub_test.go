@@ -0,0 +1,227 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// presenceLog collects presence events as strings like "join alice lobby"
+type presenceLog struct {
+    lock   sync.Mutex
+    events []string
+    signal chan struct{}
+}
+
+func newPresenceLog() *presenceLog {
+    return &presenceLog{signal: make(chan struct{}, 128)}
+}
+
+func (l *presenceLog) add(e PresenceEvent) {
+    l.lock.Lock()
+    l.events = append(l.events, strings.TrimSpace(fmt.Sprintf("%v %v %v", e.Kind, e.Peer.Identity(), e.Room)))
+    l.lock.Unlock()
+    l.signal <- struct{}{}
+}
+
+// wait until n events arrived and return them
+func (l *presenceLog) wait(t *testing.T, n int) []string {
+    for {
+        l.lock.Lock()
+        if len(l.events) >= n {
+            events := append([]string{}, l.events...)
+            l.lock.Unlock()
+            return events
+        }
+        l.lock.Unlock()
+        select {
+        case <-l.signal:
+        case <-time.After(5 * time.Second):
+            t.Fatalf("got presence events %v, want %d", l.events, n)
+        }
+    }
+}
+
+// newTestHub start a hub behind a handler, peers connect to /name/rooms and are named
+// by the first part of the path and join the comma separated rooms in the second
+func newTestHub(t *testing.T, cfg HubConfig, serve func(h *Hub, p *Peer)) (*Hub, string) {
+    hub := NewHub(cfg)
+    auth := func(r *http.Request) (interface{}, error) { return strings.Split(r.URL.Path, "/")[1], nil }
+    _, u := newTestServer(t, Config{Auth: auth}, hub.Serve(func(p *Peer) {
+        for _, room := range strings.Split(strings.Split(p.Request().URL.Path, "/")[2], ",") {
+            if room != "" {
+                hub.Join(p, room)
+            }
+        }
+        serve(hub, p)
+    }))
+    return hub, u
+}
+
+// join connect a client with a name and rooms
+func join(t *testing.T, u, name, rooms string) *plugin.Ws {
+    w := &plugin.Ws{}
+    w.SetUrl("ws", strings.TrimPrefix(u, "ws://"), "/"+name+"/"+rooms)
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { w.Close() })
+    return w
+}
+
+func TestHub_broadcast(t *testing.T) {
+    tests := []struct {
+        name string
+        send func(h *Hub)
+        want []string
+    }{
+        {name: "everyone", send: func(h *Hub) { h.Broadcast(websocket.TextMessage, []byte("msg")) }, want: []string{"alice", "bob", "carol"}},
+        {name: "room", send: func(h *Hub) { h.BroadcastRoom("ops", websocket.TextMessage, []byte("msg")) }, want: []string{"alice", "carol"}},
+        {name: "empty room", send: func(h *Hub) { h.BroadcastRoom("nobody", websocket.TextMessage, []byte("msg")) }},
+        {name: "filter", send: func(h *Hub) {
+            h.BroadcastFilter(func(p *Peer) bool { return p.Identity() == "bob" }, websocket.TextMessage, []byte("msg"))
+        }, want: []string{"bob"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            presence := newPresenceLog()
+            hub, u := newTestHub(t, HubConfig{OnPresence: presence.add}, func(h *Hub, p *Peer) { <-p.Done() })
+            clients := map[string]*plugin.Ws{
+                "alice": join(t, u, "alice", "ops,lobby"),
+                "bob":   join(t, u, "bob", "lobby"),
+                "carol": join(t, u, "carol", "ops"),
+            }
+            presence.wait(t, 7)
+            tt.send(hub)
+            // the marker reaches everyone after the message, so a client that gets it first got nothing
+            hub.Broadcast(websocket.TextMessage, []byte("marker"))
+            var got []string
+            for _, name := range []string{"alice", "bob", "carol"} {
+                _, d, err := clients[name].Read()
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if string(d) == "msg" {
+                    got = append(got, name)
+                }
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("received by %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestHub_presence(t *testing.T) {
+    presence := newPresenceLog()
+    _, u := newTestHub(t, HubConfig{OnPresence: presence.add}, func(h *Hub, p *Peer) {
+        if _, _, err := p.Read(); err != nil {
+            return
+        }
+        h.Leave(p, "a")
+        <-p.Done()
+    })
+    w := join(t, u, "alice", "a,b")
+    presence.wait(t, 3)
+    if err := w.WriteMessage(websocket.TextMessage, []byte("leave a")); err != nil {
+        t.Fatal(err)
+    }
+    presence.wait(t, 4)
+    w.Close()
+    got := presence.wait(t, 6)
+    want := []string{"join alice", "join alice a", "join alice b", "leave alice a", "leave alice b", "leave alice"}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("presence events = %v, want %v", got, want)
+    }
+}
+
+func TestHub_rooms(t *testing.T) {
+    ready := make(chan *Peer, 1)
+    hub, u := newTestHub(t, HubConfig{}, func(h *Hub, p *Peer) {
+        ready <- p
+        <-p.Done()
+    })
+    join(t, u, "alice", "b,a")
+    p := <-ready
+    if got := hub.Rooms(p); !reflect.DeepEqual(got, []string{"a", "b"}) {
+        t.Errorf("Rooms() = %v, want [a b]", got)
+    }
+    if got := hub.Members("a"); len(got) != 1 || got[0] != p {
+        t.Errorf("Members() = %v, want the peer", got)
+    }
+    if got := len(hub.Peers()); got != 1 {
+        t.Errorf("Peers() has %d peers, want 1", got)
+    }
+}
+
+func TestMember_enqueue(t *testing.T) {
+    tests := []struct {
+        name       string
+        queueSize  int
+        maxDropped int
+        send       int
+        wantQueue  []string
+        wantSlow   bool
+    }{
+        {name: "fits", queueSize: 3, send: 2, wantQueue: []string{"0", "1"}},
+        {name: "drop oldest", queueSize: 2, send: 5, wantQueue: []string{"3", "4"}},
+        {name: "drops allowed", queueSize: 2, maxDropped: 3, send: 5, wantQueue: []string{"3", "4"}},
+        {name: "slow consumer", queueSize: 2, maxDropped: 2, send: 5, wantQueue: []string{"2", "3"}, wantSlow: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            m := &member{queue: make(chan outgoing, tt.queueSize)}
+            slow := false
+            for i := 0; i < tt.send; i++ {
+                if m.enqueue(outgoing{data: []byte(fmt.Sprint(i))}, tt.maxDropped) {
+                    slow = true
+                }
+            }
+            close(m.queue)
+            var got []string
+            for o := range m.queue {
+                got = append(got, string(o.data))
+            }
+            if !reflect.DeepEqual(got, tt.wantQueue) || slow != tt.wantSlow {
+                t.Errorf("queue = %v, slow %v, want %v, slow %v", got, slow, tt.wantQueue, tt.wantSlow)
+            }
+        })
+    }
+}
+
+func TestHub_slowConsumer(t *testing.T) {
+    ready := make(chan *Peer, 1)
+    hub, u := newTestHub(t, HubConfig{QueueSize: 2, MaxDropped: 3}, func(h *Hub, p *Peer) {
+        // hold the write lock so the queue of the peer fills up
+        p.writeLock.Lock()
+        ready <- p
+        <-p.Done()
+        p.writeLock.Unlock()
+    })
+    w := join(t, u, "slow", "")
+    p := <-ready
+    for i := 0; i < 10; i++ {
+        hub.Broadcast(websocket.TextMessage, []byte(fmt.Sprint(i)))
+    }
+    var ce *plugin.ClosedError
+    if _, _, err := w.Read(); !errors.As(err, &ce) || ce.Code != websocket.CloseTryAgainLater {
+        t.Errorf("client Read() error = %v, want close code 1013", err)
+    }
+    <-p.Done()
+    // the peer is removed by the hub shortly after its connection ended
+    deadline := time.Now().Add(5 * time.Second)
+    for len(hub.Peers()) != 0 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if got := len(hub.Peers()); got != 0 {
+        t.Errorf("Peers() has %d peers after the disconnect, want 0", got)
+    }
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// message is a received message waiting for Read
+type message struct {
+    messageType int
+    data        []byte
+}
+
+// Peer is a connected client, reads and writes can be used from different goroutines
+type Peer struct {
+    id       uint64
+    conn     *websocket.Conn
+    req      *http.Request
+    identity interface{}
+    cfg      *Config
+
+    // inbox holds the received messages, it is closed when the connection ended
+    inbox chan message
+
+    // writeLock makes sure there is only one writer
+    writeLock sync.Mutex
+
+    lock     sync.Mutex
+    err      error
+    closing  bool
+    lastSeen time.Time
+
+    // stopping is closed when a close starts, done when the connection ended
+    stopping chan struct{}
+    done     chan struct{}
+
+    ctx    context.Context
+    cancel context.CancelFunc
+}
+
+// newPeer start reading and sending heartbeats for a connection
+func newPeer(id uint64, c *websocket.Conn, r *http.Request, identity interface{}, cfg *Config) *Peer {
+    p := &Peer{
+        id:       id,
+        conn:     c,
+        req:      r,
+        identity: identity,
+        cfg:      cfg,
+        inbox:    make(chan message, cfg.ReadBuffer),
+        lastSeen: cfg.Clock.Now(),
+        stopping: make(chan struct{}),
+        done:     make(chan struct{}),
+    }
+    p.ctx, p.cancel = context.WithCancel(r.Context())
+    if cfg.ReadLimit > 0 {
+        c.SetReadLimit(cfg.ReadLimit)
+    }
+    c.SetPongHandler(func(string) error {
+        p.touch()
+        return nil
+    })
+    c.SetPingHandler(func(data string) error {
+        p.touch()
+        err := c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+        if err == websocket.ErrCloseSent {
+            return nil
+        }
+        return err
+    })
+    go p.readLoop()
+    if cfg.Heartbeat > 0 {
+        go p.heartbeat()
+    }
+    return p
+}
+
+// ID return the id of the peer, it is unique for the handler
+func (p *Peer) ID() uint64 {
+    return p.id
+}
+
+// Request return the upgrade request
+func (p *Peer) Request() *http.Request {
+    return p.req
+}
+
+// Identity return what the auth hook returned for the peer
+func (p *Peer) Identity() interface{} {
+    return p.identity
+}
+
+// Subprotocol return the negotiated subprotocol, it is empty when none was agreed on
+func (p *Peer) Subprotocol() string {
+    return p.conn.Subprotocol()
+}
+
+// Context is cancelled when the connection ended
+func (p *Peer) Context() context.Context {
+    return p.ctx
+}
+
+// Done is closed when the connection ended
+func (p *Peer) Done() <-chan struct{} {
+    return p.done
+}
+
+// Err return why the connection ended, it is nil while the peer is connected
+func (p *Peer) Err() error {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    return p.err
+}
+
+// Read a message, messages received before the connection ended are returned before the error
+func (p *Peer) Read() (int, []byte, error) {
+    m, ok := <-p.inbox
+    if !ok {
+        return 0, []byte{}, p.Err()
+    }
+    return m.messageType, m.data, nil
+}
+
+// ReadJSON read a message and decode it into v
+func (p *Peer) ReadJSON(v interface{}) error {
+    _, d, err := p.Read()
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(d, v)
+}
+
+// WriteMessage write a message, a failed write ends the connection
+func (p *Peer) WriteMessage(messageType int, data []byte) error {
+    p.writeLock.Lock()
+    defer p.writeLock.Unlock()
+    if err := p.closedErr(); err != nil {
+        return err
+    }
+    if err := p.conn.WriteMessage(messageType, data); err != nil {
+        p.terminate(err)
+        return err
+    }
+    return nil
+}
+
+// WriteJSON encode v and write it as a text message
+func (p *Peer) WriteJSON(v interface{}) error {
+    b, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    return p.WriteMessage(websocket.TextMessage, b)
+}
+
+// WriteQueue write the messages from c as text messages and send errors to e,
+// failed messages are requeued like in Ws.WriteQueue until the connection ended
+func (p *Peer) WriteQueue(c chan []byte, e chan error) {
+    go func() {
+        for bytes := range c {
+            err := p.WriteMessage(websocket.TextMessage, bytes)
+            if err == nil {
+                continue
+            }
+            e <- err
+            select {
+            case <-p.done:
+                return
+            default:
+            }
+            if len(c) == cap(c) {
+                <-c
+            }
+            c <- bytes
+            p.cfg.Clock.Sleep(time.Second)
+        }
+    }()
+}
+
+// Close the connection with 1000 normal closure
+func (p *Peer) Close() error {
+    return p.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// CloseWith send a close frame and wait for the peer to answer it, the connection is dropped
+// when no answer arrived within the close timeout
+func (p *Peer) CloseWith(code int, reason string) error {
+    p.lock.Lock()
+    if p.closing {
+        p.lock.Unlock()
+        <-p.done
+        return nil
+    }
+    select {
+    case <-p.done:
+        p.closing = true
+        p.lock.Unlock()
+        return nil
+    default:
+    }
+    p.closing = true
+    close(p.stopping)
+    if p.err == nil {
+        p.err = &plugin.ClosedError{Code: code, Reason: reason}
+    }
+    p.lock.Unlock()
+    p.cfg.Logger.Debug("closing peer", p.logArgs("close_code", code, "reason", reason)...)
+    msg := websocket.FormatCloseMessage(code, reason)
+    if err := p.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil && err != websocket.ErrCloseSent {
+        p.terminate(err)
+        <-p.done
+        return err
+    }
+    timer := p.cfg.Clock.NewTimer(p.cfg.CloseTimeout)
+    defer timer.Stop()
+    select {
+    case <-p.done:
+    case <-timer.C():
+        p.cfg.Logger.Warn("peer did not answer the close frame", p.logArgs()...)
+        p.terminate(ErrCloseTimeout)
+        <-p.done
+    }
+    return nil
+}
+
+// readLoop move received messages to the inbox until the connection fails
+func (p *Peer) readLoop() {
+    for {
+        t, d, err := p.conn.ReadMessage()
+        if err != nil {
+            p.finish(err)
+            return
+        }
+        p.touch()
+        select {
+        case p.inbox <- message{messageType: t, data: d}:
+        case <-p.stopping:
+            // messages that arrive while closing are dropped so the close answer can be read
+        }
+    }
+}
+
+// heartbeat send pings and drop the peer when it stayed silent for too long
+func (p *Peer) heartbeat() {
+    timer := p.cfg.Clock.NewTimer(p.cfg.Heartbeat)
+    defer timer.Stop()
+    for {
+        select {
+        case <-p.done:
+            return
+        case <-timer.C():
+        }
+        p.lock.Lock()
+        silent := p.cfg.Clock.Now().Sub(p.lastSeen)
+        p.lock.Unlock()
+        if silent > p.cfg.PongTimeout {
+            p.cfg.Logger.Warn("peer stopped answering pings", p.logArgs("silent", silent)...)
+            p.terminate(ErrHeartbeatTimeout)
+            return
+        }
+        if err := p.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+            p.terminate(err)
+            return
+        }
+        timer.Reset(p.cfg.Heartbeat)
+    }
+}
+
+// touch remember that the peer was heard from
+func (p *Peer) touch() {
+    p.lock.Lock()
+    p.lastSeen = p.cfg.Clock.Now()
+    p.lock.Unlock()
+}
+
+// terminate drop the connection without a close handshake, err is kept when the peer has no error yet
+func (p *Peer) terminate(err error) {
+    p.lock.Lock()
+    if p.err == nil {
+        p.err = err
+    }
+    p.lock.Unlock()
+    _ = p.conn.UnderlyingConn().SetDeadline(time.Unix(1, 0))
+    _ = p.conn.Close()
+}
+
+// finish end the connection after the read loop failed
+func (p *Peer) finish(err error) {
+    p.lock.Lock()
+    if p.err == nil {
+        var ce *websocket.CloseError
+        if errors.As(err, &ce) {
+            err = &plugin.ClosedError{Code: ce.Code, Reason: ce.Text, Err: err}
+        }
+        p.err = err
+    }
+    p.lock.Unlock()
+    _ = p.conn.Close()
+    close(p.inbox)
+    close(p.done)
+    p.cancel()
+}
+
+// closedErr return the error of a peer that is closing or closed
+func (p *Peer) closedErr() error {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    if !p.closing {
+        select {
+        case <-p.done:
+        default:
+            return nil
+        }
+    }
+    if p.err != nil {
+        return p.err
+    }
+    return plugin.ErrClosed
+}
+
+// logArgs add the peer id and remote address to log arguments
+func (p *Peer) logArgs(args ...interface{}) []interface{} {
+    return append([]interface{}{"peer", p.id, "remote", p.req.RemoteAddr}, args...)
+}
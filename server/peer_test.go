@@ -0,0 +1,221 @@
+package server
+
+import (
+    "errors"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// connect a Ws client to a test server
+func connect(t *testing.T, u string) *plugin.Ws {
+    w := &plugin.Ws{}
+    w.SetUrl("ws", strings.TrimPrefix(u, "ws://"), "/")
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { w.Close() })
+    return w
+}
+
+func TestPeer_echo(t *testing.T) {
+    _, u := newTestServer(t, Config{}, func(p *Peer) {
+        for {
+            t, d, err := p.Read()
+            if err != nil {
+                return
+            }
+            if err := p.WriteMessage(t, d); err != nil {
+                return
+            }
+        }
+    })
+    w := connect(t, u)
+    tests := []struct {
+        name        string
+        messageType int
+        data        string
+    }{
+        {name: "text", messageType: websocket.TextMessage, data: "hello"},
+        {name: "binary", messageType: websocket.BinaryMessage, data: "\x00\x01"},
+        {name: "empty", messageType: websocket.TextMessage, data: ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if err := w.WriteMessage(tt.messageType, []byte(tt.data)); err != nil {
+                t.Fatal(err)
+            }
+            mt, d, err := w.Read()
+            if err != nil || mt != tt.messageType || string(d) != tt.data {
+                t.Errorf("Read() = %v, %q, %v, want %v, %q", mt, d, err, tt.messageType, tt.data)
+            }
+        })
+    }
+}
+
+func TestPeer_JSON(t *testing.T) {
+    type msg struct {
+        Op string `json:"op"`
+        N  int    `json:"n"`
+    }
+    _, u := newTestServer(t, Config{}, func(p *Peer) {
+        var m msg
+        if err := p.ReadJSON(&m); err != nil {
+            return
+        }
+        m.N++
+        _ = p.WriteJSON(m)
+    })
+    w := connect(t, u)
+    if err := w.WriteJSON(msg{Op: "inc", N: 1}); err != nil {
+        t.Fatal(err)
+    }
+    var got msg
+    if err := w.ReadJSON(&got); err != nil || got != (msg{Op: "inc", N: 2}) {
+        t.Errorf("ReadJSON() = %+v, %v, want op inc and n 2", got, err)
+    }
+}
+
+func TestPeer_WriteQueue(t *testing.T) {
+    _, u := newTestServer(t, Config{}, func(p *Peer) {
+        q := make(chan []byte, 3)
+        e := make(chan error, 3)
+        for _, m := range []string{"1", "2", "3"} {
+            q <- []byte(m)
+        }
+        p.WriteQueue(q, e)
+        <-p.Done()
+        close(q)
+    })
+    w := connect(t, u)
+    for _, want := range []string{"1", "2", "3"} {
+        if _, d, err := w.Read(); err != nil || string(d) != want {
+            t.Errorf("Read() = %q, %v, want %q", d, err, want)
+        }
+    }
+}
+
+func TestPeer_CloseWith(t *testing.T) {
+    result := make(chan error, 1)
+    _, u := newTestServer(t, Config{}, func(p *Peer) {
+        _ = p.CloseWith(4000, "bye")
+        result <- p.Err()
+    })
+    w := connect(t, u)
+    var ce *plugin.ClosedError
+    if _, _, err := w.Read(); !errors.As(err, &ce) || ce.Code != 4000 || ce.Reason != "bye" {
+        t.Errorf("client Read() error = %v, want close code 4000", err)
+    }
+    if err := <-result; !errors.As(err, &ce) || ce.Code != 4000 {
+        t.Errorf("Peer.Err() = %v, want the local close", err)
+    }
+}
+
+func TestPeer_closedByClient(t *testing.T) {
+    result := make(chan error, 1)
+    _, u := newTestServer(t, Config{}, func(p *Peer) {
+        _, _, err := p.Read()
+        result <- err
+    })
+    c, _, err := dial(u, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "leaving")
+    if err := c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+        t.Fatal(err)
+    }
+    var ce *plugin.ClosedError
+    if err := <-result; !errors.As(err, &ce) || ce.Code != websocket.CloseGoingAway || ce.Reason != "leaving" {
+        t.Errorf("Peer.Read() error = %v, want close code 1001", err)
+    }
+}
+
+func TestPeer_closeTimeout(t *testing.T) {
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    result := make(chan error, 1)
+    _, u := newTestServer(t, Config{Clock: clock, CloseTimeout: 3 * time.Second}, func(p *Peer) {
+        result <- p.Close()
+    })
+    // the client never reads so it does not answer the close frame
+    c, _, err := dial(u, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    clock.BlockUntil(1)
+    select {
+    case <-result:
+        t.Fatal("Close() returned before the close timeout")
+    default:
+    }
+    clock.Advance(3 * time.Second)
+    if err := <-result; err != nil {
+        t.Errorf("Close() error = %v", err)
+    }
+}
+
+func TestPeer_heartbeat(t *testing.T) {
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    result := make(chan error, 1)
+    _, u := newTestServer(t, Config{Clock: clock, Heartbeat: 10 * time.Second}, func(p *Peer) {
+        <-p.Done()
+        result <- p.Err()
+    })
+    // the client never reads so pings are not answered
+    c, _, err := dial(u, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    // two pings are sent, the third tick finds the peer silent for longer than twice the heartbeat
+    for i := 0; i < 3; i++ {
+        clock.BlockUntil(1)
+        clock.Advance(10 * time.Second)
+    }
+    select {
+    case err := <-result:
+        if !errors.Is(err, ErrHeartbeatTimeout) {
+            t.Errorf("Peer.Err() = %v, want %v", err, ErrHeartbeatTimeout)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("peer was not dropped")
+    }
+}
+
+func TestPeer_heartbeatAnswered(t *testing.T) {
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    pinged := make(chan struct{}, 16)
+    _, u := newTestServer(t, Config{Clock: clock, Heartbeat: 10 * time.Second}, func(p *Peer) { <-p.Done() })
+    c, _, err := dial(u, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    c.SetPingHandler(func(data string) error {
+        pinged <- struct{}{}
+        return c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+    })
+    go func() {
+        for {
+            if _, _, err := c.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }()
+    for i := 0; i < 5; i++ {
+        clock.BlockUntil(1)
+        clock.Advance(10 * time.Second)
+        select {
+        case <-pinged:
+        case <-time.After(5 * time.Second):
+            t.Fatalf("ping %d was not sent, the peer was dropped", i+1)
+        }
+        // give the pong time to arrive before the clock moves again
+        time.Sleep(20 * time.Millisecond)
+    }
+}
@@ -0,0 +1,245 @@
+// Package server is the accepting side of the plugin, it upgrades http requests to websocket connections
+// and hands every peer to the application with the same read and write api as the client
+package server
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+var (
+    // ErrUnauthorized is the error of an AuthError made without one
+    ErrUnauthorized = errors.New("unauthorized")
+
+    // ErrHeartbeatTimeout is the error of a peer that did not answer pings in time
+    ErrHeartbeatTimeout = errors.New("heartbeat timed out")
+
+    // ErrCloseTimeout is the error of a peer that did not answer a close frame in time
+    ErrCloseTimeout = errors.New("close timed out")
+
+    // ErrShutdown is returned for requests that arrive after the handler was closed
+    ErrShutdown = errors.New("server is shutting down")
+)
+
+// AuthError is returned by an auth hook to reject a request with a specific status
+type AuthError struct {
+    // Status is the http status of the response, 0 sends 401
+    Status int
+    Err    error
+}
+
+func (e *AuthError) Error() string {
+    return fmt.Sprintf("auth failed with status %d: %v", e.status(), e.Err)
+}
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+func (e *AuthError) status() int {
+    if e.Status == 0 {
+        return http.StatusUnauthorized
+    }
+    return e.Status
+}
+
+// Config of a Handler
+type Config struct {
+    // Origins that may connect, entries are full origins like https://example.com or hosts like example.com,
+    // "*" allows every origin and an empty list only allows requests from the host they were sent to
+    Origins []string
+
+    // Subprotocols the server speaks in order of preference
+    Subprotocols []string
+
+    // RequireSubprotocol rejects clients that do not offer one of the subprotocols
+    RequireSubprotocol bool
+
+    // Auth is called before the upgrade, the identity it returns is available through Peer.Identity,
+    // an error rejects the request with 401 or with the status of an AuthError
+    Auth func(r *http.Request) (identity interface{}, err error)
+
+    // Heartbeat is the time between pings, 0 sends no pings
+    Heartbeat time.Duration
+
+    // PongTimeout is how long a peer may stay silent before it is dropped, 0 uses twice the heartbeat
+    PongTimeout time.Duration
+
+    // CloseTimeout is how long a graceful close waits for the answer of the peer, 0 waits 5 seconds
+    CloseTimeout time.Duration
+
+    // ReadLimit is the maximum size of a received message, 0 has no limit
+    ReadLimit int64
+
+    // ReadBuffer is the number of received messages that are buffered for every peer, 0 buffers 16
+    ReadBuffer int
+
+    // Clock is used for heartbeats and close timeouts, the system clock is used when it is nil
+    Clock plugin.Clock
+
+    // Logger receives connection events, nothing is logged when it is nil
+    Logger plugin.Logger
+}
+
+// Handler upgrades requests and calls serve for every peer, the connection is closed when serve returns
+type Handler struct {
+    cfg      Config
+    serve    func(p *Peer)
+    upgrader websocket.Upgrader
+
+    lock   sync.Mutex
+    peers  map[uint64]*Peer
+    nextID uint64
+    closed bool
+}
+
+// NewHandler create a handler that calls serve for every peer
+func NewHandler(cfg Config, serve func(p *Peer)) *Handler {
+    if cfg.PongTimeout <= 0 {
+        cfg.PongTimeout = 2 * cfg.Heartbeat
+    }
+    if cfg.CloseTimeout <= 0 {
+        cfg.CloseTimeout = 5 * time.Second
+    }
+    if cfg.ReadBuffer <= 0 {
+        cfg.ReadBuffer = 16
+    }
+    if cfg.Clock == nil {
+        cfg.Clock = plugin.SystemClock
+    }
+    if cfg.Logger == nil {
+        cfg.Logger = plugin.NopLogger
+    }
+    h := &Handler{cfg: cfg, serve: serve, peers: map[uint64]*Peer{}}
+    h.upgrader = websocket.Upgrader{
+        Subprotocols: cfg.Subprotocols,
+        // the origin is checked before the upgrade so it can be logged
+        CheckOrigin: func(*http.Request) bool { return true },
+    }
+    return h
+}
+
+// ServeHTTP check the origin, subprotocol and credentials of the request, upgrade it and serve the peer
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+    log := h.cfg.Logger
+    if !h.checkOrigin(r) {
+        log.Warn("rejected origin", "origin", r.Header.Get("Origin"), "remote", r.RemoteAddr)
+        http.Error(rw, "origin not allowed", http.StatusForbidden)
+        return
+    }
+    if h.cfg.RequireSubprotocol && !h.offersSubprotocol(r) {
+        log.Warn("rejected subprotocols", "subprotocols", websocket.Subprotocols(r), "remote", r.RemoteAddr)
+        http.Error(rw, "unsupported subprotocol", http.StatusBadRequest)
+        return
+    }
+    var identity interface{}
+    if h.cfg.Auth != nil {
+        var err error
+        if identity, err = h.cfg.Auth(r); err != nil {
+            ae := &AuthError{Err: err}
+            errors.As(err, &ae)
+            log.Warn("rejected credentials", "status", ae.status(), "err", err, "remote", r.RemoteAddr)
+            http.Error(rw, http.StatusText(ae.status()), ae.status())
+            return
+        }
+    }
+    h.lock.Lock()
+    if h.closed {
+        h.lock.Unlock()
+        http.Error(rw, ErrShutdown.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    h.nextID++
+    id := h.nextID
+    h.lock.Unlock()
+    c, err := h.upgrader.Upgrade(rw, r, nil)
+    if err != nil {
+        log.Warn("upgrade failed", "err", err, "remote", r.RemoteAddr)
+        return
+    }
+    p := newPeer(id, c, r, identity, &h.cfg)
+    h.lock.Lock()
+    if h.closed {
+        h.lock.Unlock()
+        _ = p.CloseWith(websocket.CloseGoingAway, ErrShutdown.Error())
+        return
+    }
+    h.peers[id] = p
+    h.lock.Unlock()
+    log.Info("peer connected", p.logArgs("subprotocol", c.Subprotocol())...)
+    defer func() {
+        h.lock.Lock()
+        delete(h.peers, id)
+        h.lock.Unlock()
+        _ = p.Close()
+        log.Info("peer disconnected", p.logArgs("err", p.Err())...)
+    }()
+    h.serve(p)
+}
+
+// Peers return the peers that are connected
+func (h *Handler) Peers() []*Peer {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    peers := make([]*Peer, 0, len(h.peers))
+    for _, p := range h.peers {
+        peers = append(peers, p)
+    }
+    return peers
+}
+
+// Close reject new requests and close every peer with 1001 going away
+func (h *Handler) Close() error {
+    h.lock.Lock()
+    h.closed = true
+    h.lock.Unlock()
+    var wg sync.WaitGroup
+    for _, p := range h.Peers() {
+        wg.Add(1)
+        go func(p *Peer) {
+            defer wg.Done()
+            _ = p.CloseWith(websocket.CloseGoingAway, ErrShutdown.Error())
+        }(p)
+    }
+    wg.Wait()
+    return nil
+}
+
+// checkOrigin return true when the origin of the request is allowed
+func (h *Handler) checkOrigin(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" {
+        return true
+    }
+    u, err := url.Parse(origin)
+    if err != nil {
+        return false
+    }
+    if len(h.cfg.Origins) == 0 {
+        return strings.EqualFold(u.Host, r.Host)
+    }
+    for _, o := range h.cfg.Origins {
+        if o == "*" || strings.EqualFold(o, origin) || strings.EqualFold(o, u.Host) {
+            return true
+        }
+    }
+    return false
+}
+
+// offersSubprotocol return true when the client offers one of the subprotocols of the server
+func (h *Handler) offersSubprotocol(r *http.Request) bool {
+    for _, offered := range websocket.Subprotocols(r) {
+        for _, s := range h.cfg.Subprotocols {
+            if offered == s {
+                return true
+            }
+        }
+    }
+    return false
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+// newTestServer start a handler on a test server and return the websocket url
+func newTestServer(t *testing.T, cfg Config, serve func(p *Peer)) (*Handler, string) {
+    h := NewHandler(cfg, serve)
+    srv := httptest.NewServer(h)
+    t.Cleanup(srv.Close)
+    return h, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dial connect with the gorilla dialer and return the status of the response
+func dial(u string, header http.Header, subprotocols ...string) (*websocket.Conn, int, error) {
+    d := websocket.Dialer{Subprotocols: subprotocols}
+    c, resp, err := d.Dial(u, header)
+    if resp == nil {
+        return c, 0, err
+    }
+    return c, resp.StatusCode, err
+}
+
+func TestHandler_origin(t *testing.T) {
+    tests := []struct {
+        name    string
+        origins []string
+        origin  string
+        want    int
+    }{
+        {name: "no origin header", origin: "", want: http.StatusSwitchingProtocols},
+        {name: "same host", origin: "http://HOST", want: http.StatusSwitchingProtocols},
+        {name: "other host", origin: "http://evil.example", want: http.StatusForbidden},
+        {name: "listed origin", origins: []string{"https://app.example"}, origin: "https://app.example", want: http.StatusSwitchingProtocols},
+        {name: "listed host", origins: []string{"app.example"}, origin: "http://app.example", want: http.StatusSwitchingProtocols},
+        {name: "scheme differs", origins: []string{"https://app.example"}, origin: "http://app.example", want: http.StatusForbidden},
+        {name: "wildcard", origins: []string{"*"}, origin: "http://evil.example", want: http.StatusSwitchingProtocols},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, u := newTestServer(t, Config{Origins: tt.origins}, func(p *Peer) {})
+            h := http.Header{}
+            if tt.origin != "" {
+                h.Set("Origin", strings.Replace(tt.origin, "HOST", strings.TrimPrefix(u, "ws://"), 1))
+            }
+            c, status, _ := dial(u, h)
+            if c != nil {
+                c.Close()
+            }
+            if status != tt.want {
+                t.Errorf("status = %v, want %v", status, tt.want)
+            }
+        })
+    }
+}
+
+func TestHandler_subprotocol(t *testing.T) {
+    tests := []struct {
+        name       string
+        require    bool
+        offered    []string
+        wantStatus int
+        want       string
+    }{
+        {name: "preferred by the server", offered: []string{"v1", "v2"}, wantStatus: http.StatusSwitchingProtocols, want: "v2"},
+        {name: "only one shared", offered: []string{"v1"}, wantStatus: http.StatusSwitchingProtocols, want: "v1"},
+        {name: "none shared", offered: []string{"v3"}, wantStatus: http.StatusSwitchingProtocols, want: ""},
+        {name: "none shared but required", require: true, offered: []string{"v3"}, wantStatus: http.StatusBadRequest},
+        {name: "none offered but required", require: true, wantStatus: http.StatusBadRequest},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := make(chan string, 1)
+            _, u := newTestServer(t, Config{Subprotocols: []string{"v2", "v1"}, RequireSubprotocol: tt.require}, func(p *Peer) {
+                got <- p.Subprotocol()
+            })
+            c, status, _ := dial(u, nil, tt.offered...)
+            if status != tt.wantStatus {
+                t.Fatalf("status = %v, want %v", status, tt.wantStatus)
+            }
+            if c == nil {
+                return
+            }
+            defer c.Close()
+            if c.Subprotocol() != tt.want {
+                t.Errorf("client subprotocol = %q, want %q", c.Subprotocol(), tt.want)
+            }
+            if s := <-got; s != tt.want {
+                t.Errorf("Peer.Subprotocol() = %q, want %q", s, tt.want)
+            }
+        })
+    }
+}
+
+func TestHandler_auth(t *testing.T) {
+    auth := func(r *http.Request) (interface{}, error) {
+        switch r.Header.Get("Authorization") {
+        case "Bearer good":
+            return "alice", nil
+        case "Bearer banned":
+            return nil, &AuthError{Status: http.StatusForbidden, Err: errors.New("banned")}
+        }
+        return nil, errors.New("no token")
+    }
+    tests := []struct {
+        name     string
+        token    string
+        want     int
+        identity interface{}
+    }{
+        {name: "accepted", token: "Bearer good", want: http.StatusSwitchingProtocols, identity: "alice"},
+        {name: "missing", want: http.StatusUnauthorized},
+        {name: "custom status", token: "Bearer banned", want: http.StatusForbidden},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := make(chan interface{}, 1)
+            _, u := newTestServer(t, Config{Auth: auth}, func(p *Peer) { got <- p.Identity() })
+            c, status, _ := dial(u, http.Header{"Authorization": []string{tt.token}})
+            if status != tt.want {
+                t.Fatalf("status = %v, want %v", status, tt.want)
+            }
+            if c == nil {
+                return
+            }
+            defer c.Close()
+            if id := <-got; id != tt.identity {
+                t.Errorf("Peer.Identity() = %v, want %v", id, tt.identity)
+            }
+        })
+    }
+}
+
+func TestHandler_Close(t *testing.T) {
+    h, u := newTestServer(t, Config{}, func(p *Peer) { <-p.Done() })
+    w := &plugin.Ws{}
+    w.SetUrl("ws", strings.TrimPrefix(u, "ws://"), "/")
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+    read := make(chan error, 1)
+    go func() {
+        _, _, err := w.Read()
+        read <- err
+    }()
+    for len(h.Peers()) == 0 {
+        time.Sleep(time.Millisecond)
+    }
+    if err := h.Close(); err != nil {
+        t.Fatal(err)
+    }
+    var ce *plugin.ClosedError
+    if err := <-read; !errors.As(err, &ce) || ce.Code != websocket.CloseGoingAway {
+        t.Errorf("client read error = %v, want close code 1001", err)
+    }
+    if _, status, _ := dial(u, nil); status != http.StatusServiceUnavailable {
+        t.Errorf("status after Close() = %v, want 503", status)
+    }
+}
@@ -0,0 +1,790 @@
+package signalr
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+var (
+    // ErrServerTimeout is the error of a client that did not receive anything from the server for too long
+    ErrServerTimeout = errors.New("signalr: server timed out")
+
+    // ErrClientClosed is returned after Close
+    ErrClientClosed = errors.New("signalr: client closed")
+
+    // ErrConnectionLost ends invocations and streams that were running when the connection was made again,
+    // the server does not know them on the new connection
+    ErrConnectionLost = errors.New("signalr: connection lost")
+
+    // ErrNoWebSockets is returned when the negotiate response does not offer the websocket transport
+    ErrNoWebSockets = errors.New("signalr: server does not offer websockets")
+)
+
+// HubError is the error of a completion
+type HubError struct {
+    Target  string
+    Message string
+}
+
+func (e *HubError) Error() string {
+    return fmt.Sprintf("signalr: %s failed: %s", e.Target, e.Message)
+}
+
+// CloseError is a close message of the server
+type CloseError struct {
+    Message        string
+    AllowReconnect bool
+}
+
+func (e *CloseError) Error() string {
+    if e.Message == "" {
+        return "signalr: closed by the server"
+    }
+    return "signalr: closed by the server: " + e.Message
+}
+
+// NegotiateError is returned when the negotiate request failed
+type NegotiateError struct {
+    StatusCode int
+    Message    string
+}
+
+func (e *NegotiateError) Error() string {
+    if e.StatusCode != 0 {
+        return fmt.Sprintf("signalr: negotiate failed with status %d: %s", e.StatusCode, e.Message)
+    }
+    return "signalr: negotiate failed: " + e.Message
+}
+
+// negotiateResponse is the reply to the negotiate request, a reply with a url redirects the client to another server
+type negotiateResponse struct {
+    ConnectionID        string `json:"connectionId"`
+    ConnectionToken     string `json:"connectionToken"`
+    NegotiateVersion    int    `json:"negotiateVersion"`
+    AvailableTransports []struct {
+        Transport       string   `json:"transport"`
+        TransferFormats []string `json:"transferFormats"`
+    } `json:"availableTransports"`
+    URL         string `json:"url"`
+    AccessToken string `json:"accessToken"`
+    Error       string `json:"error"`
+}
+
+// maxRedirects is the number of negotiate redirects that are followed
+const maxRedirects = 5
+
+// Config of a Client
+type Config struct {
+    // URL is the http or https url of the hub
+    URL string
+
+    // AccessToken is sent as bearer token with the negotiate request and as access_token on the websocket url
+    AccessToken string
+
+    // HTTPClient is used for the negotiate request, http.DefaultClient is used when it is nil
+    HTTPClient *http.Client
+
+    // SkipNegotiation connects to the websocket url of the hub right away, the server must allow it
+    SkipNegotiation bool
+
+    // KeepAlive is the interval of the pings sent to the server, 0 uses 15 seconds
+    KeepAlive time.Duration
+
+    // ServerTimeout is how long the client waits for any message before it drops the connection, 0 waits 30 seconds
+    ServerTimeout time.Duration
+
+    // Buffer is the size of the item channel of a stream, 0 uses 16
+    Buffer int
+
+    // ConnectTimeout is the time to wait for the handshake response, 0 uses the default of the init exchange
+    ConnectTimeout time.Duration
+
+    // OnError is called for messages that can not be decoded, failed negotiations during reconnects
+    // and close messages that allow a reconnect, it must not block
+    OnError func(err error)
+
+    // Clock is used for pings and the server timeout, the system clock is used when it is nil
+    Clock plugin.Clock
+}
+
+// Handler handles an invocation of a hub method on the client, the result is sent back
+// when the server waits for one
+type Handler func(args []json.RawMessage) (interface{}, error)
+
+// Client calls hub methods over a Ws, it negotiates again before every reconnect attempt of the Ws
+type Client struct {
+    w     *plugin.Ws
+    cfg   Config
+    clock plugin.Clock
+    hub   *url.URL
+    http  *http.Client
+
+    // writeLock makes sure there is only one writer
+    writeLock sync.Mutex
+
+    lock         sync.Mutex
+    connID       string
+    handlers     map[string]Handler
+    calls        map[string]*call
+    nextID       uint64
+    early        []byte
+    lastReceived time.Time
+    connected    bool
+    err          error
+    running      bool
+    closed       bool
+    stop         chan struct{}
+    gen          uint64
+    timedOut     bool
+    closeErr     *CloseError
+
+    // negotiateErr fails the reconnect attempt whose negotiation failed
+    negotiateErr error
+}
+
+// call is an invocation waiting for its completion, streams get their items as well
+type call struct {
+    target string
+    reply  chan Message
+    stream *Stream
+}
+
+// Stream is the result of a stream invocation
+type Stream struct {
+    ID     string
+    Target string
+
+    // C receives the items of the stream, it is closed when the stream ends
+    C <-chan json.RawMessage
+
+    client   *Client
+    items    chan json.RawMessage
+    done     chan struct{}
+    once     sync.Once
+    sendLock sync.Mutex
+    finished bool
+    err      error
+}
+
+// NewClient create a client for w, the url of w is set from the url of the hub,
+// the OnConnect and OnReconnectAttempt hooks and the net dial function of w are wrapped
+func NewClient(w *plugin.Ws, cfg Config) (*Client, error) {
+    hub, err := url.Parse(cfg.URL)
+    if err != nil {
+        return nil, err
+    }
+    if hub.Scheme != "http" && hub.Scheme != "https" {
+        return nil, fmt.Errorf("signalr: hub url %q is not http or https", cfg.URL)
+    }
+    if cfg.KeepAlive <= 0 {
+        cfg.KeepAlive = 15 * time.Second
+    }
+    if cfg.ServerTimeout <= 0 {
+        cfg.ServerTimeout = 30 * time.Second
+    }
+    if cfg.Buffer <= 0 {
+        cfg.Buffer = 16
+    }
+    if cfg.Clock == nil {
+        cfg.Clock = plugin.SystemClock
+    }
+    c := &Client{
+        w:        w,
+        cfg:      cfg,
+        clock:    cfg.Clock,
+        hub:      hub,
+        http:     cfg.HTTPClient,
+        handlers: map[string]Handler{},
+        calls:    map[string]*call{},
+        stop:     make(chan struct{}),
+    }
+    if c.http == nil {
+        c.http = http.DefaultClient
+    }
+    if hub.Scheme == "https" {
+        w.SetSecure(true)
+    }
+    c.target(hub, "", cfg.AccessToken)
+    handshake, err := Encode(handshakeRequest{Protocol: "json", Version: 1})
+    if err != nil {
+        return nil, err
+    }
+    w.SetInitExchange(plugin.InitExchange{Messages: [][]byte{handshake}, Accept: c.accept, Timeout: cfg.ConnectTimeout})
+    hooks := w.Hooks()
+    nextConnect := hooks.OnConnect
+    hooks.OnConnect = func(w *plugin.Ws, info plugin.ConnectInfo) error {
+        c.restore()
+        if nextConnect != nil {
+            return nextConnect(w, info)
+        }
+        return nil
+    }
+    nextAttempt := hooks.OnReconnectAttempt
+    hooks.OnReconnectAttempt = func(attempt int, lastErr error) {
+        err := c.prepare(context.Background())
+        if err != nil {
+            c.report(err)
+        }
+        c.lock.Lock()
+        c.negotiateErr = err
+        c.lock.Unlock()
+        if nextAttempt != nil {
+            nextAttempt(attempt, lastErr)
+        }
+    }
+    w.SetHooks(hooks)
+    dial := w.NetDial()
+    if dial == nil {
+        dial = (&net.Dialer{}).DialContext
+    }
+    w.SetNetDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+        // an attempt whose negotiation failed fails before the hub is dialed
+        c.lock.Lock()
+        err := c.negotiateErr
+        c.negotiateErr = nil
+        c.lock.Unlock()
+        if err != nil {
+            return nil, err
+        }
+        return dial(ctx, network, addr)
+    })
+    return c, nil
+}
+
+// target point w at the websocket url of a hub
+func (c *Client) target(hub *url.URL, id, token string) {
+    scheme := "ws"
+    if hub.Scheme == "https" {
+        scheme = "wss"
+    }
+    q := hub.Query()
+    if id != "" {
+        q.Set("id", id)
+    }
+    if token != "" {
+        q.Set("access_token", token)
+    }
+    c.w.SetUrl(scheme, hub.Host, hub.Path)
+    c.w.SetQuery(q)
+}
+
+// prepare negotiate a connection and point w at it
+func (c *Client) prepare(ctx context.Context) error {
+    if c.cfg.SkipNegotiation {
+        return nil
+    }
+    hub, token := c.hub, c.cfg.AccessToken
+    for i := 0; ; i++ {
+        resp, err := c.negotiate(ctx, hub, token)
+        if err != nil {
+            return err
+        }
+        if resp.URL != "" {
+            if i == maxRedirects {
+                return &NegotiateError{Message: "too many redirects"}
+            }
+            if hub, err = url.Parse(resp.URL); err != nil {
+                return err
+            }
+            token = resp.AccessToken
+            continue
+        }
+        ok := false
+        for _, t := range resp.AvailableTransports {
+            if t.Transport == "WebSockets" {
+                ok = true
+            }
+        }
+        if !ok {
+            return ErrNoWebSockets
+        }
+        id := resp.ConnectionToken
+        if resp.NegotiateVersion == 0 {
+            id = resp.ConnectionID
+        }
+        c.lock.Lock()
+        c.connID = resp.ConnectionID
+        c.lock.Unlock()
+        c.target(hub, id, token)
+        return nil
+    }
+}
+
+// negotiate send the negotiate request of a hub
+func (c *Client) negotiate(ctx context.Context, hub *url.URL, token string) (*negotiateResponse, error) {
+    u := *hub
+    u.Path = strings.TrimSuffix(u.Path, "/") + "/negotiate"
+    q := u.Query()
+    q.Set("negotiateVersion", "1")
+    u.RawQuery = q.Encode()
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+    if err != nil {
+        return nil, err
+    }
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+    res, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer res.Body.Close()
+    body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+    if err != nil {
+        return nil, err
+    }
+    if res.StatusCode != http.StatusOK {
+        return nil, &NegotiateError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(body))}
+    }
+    var resp negotiateResponse
+    if err := json.Unmarshal(body, &resp); err != nil {
+        return nil, err
+    }
+    if resp.Error != "" {
+        return nil, &NegotiateError{Message: resp.Error}
+    }
+    return &resp, nil
+}
+
+// accept wait for the handshake response, messages sent in the same frame are kept for the read loop
+func (c *Client) accept(_ int, data []byte) (bool, error) {
+    i := bytes.IndexByte(data, RecordSeparator)
+    if i < 0 {
+        return false, ErrIncomplete
+    }
+    var resp handshakeResponse
+    if err := json.Unmarshal(data[:i], &resp); err != nil {
+        return false, err
+    }
+    if resp.Error != "" {
+        return false, errors.New(resp.Error)
+    }
+    c.lock.Lock()
+    c.early = append([]byte(nil), data[i+1:]...)
+    c.lock.Unlock()
+    return true, nil
+}
+
+// Connect negotiate, make the connection and start reading messages
+func (c *Client) Connect(ctx context.Context) error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return ErrClientClosed
+    }
+    c.lock.Unlock()
+    if err := c.prepare(ctx); err != nil {
+        return err
+    }
+    c.lock.Lock()
+    c.negotiateErr = nil
+    c.lock.Unlock()
+    if err := c.w.ConnectContext(ctx); err != nil {
+        return err
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.err = nil
+    if !c.running {
+        c.running = true
+        go c.readLoop()
+    }
+    return nil
+}
+
+// ConnectionID return the connection id of the last negotiation
+func (c *Client) ConnectionID() string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.connID
+}
+
+// Err return why the client stopped reading, it is nil while it runs
+func (c *Client) Err() error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.err
+}
+
+// Close the connection, invocations and streams end with ErrClientClosed
+func (c *Client) Close() error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil
+    }
+    c.closed = true
+    close(c.stop)
+    c.lock.Unlock()
+    return c.w.Close()
+}
+
+// On set the handler of a hub method the server can invoke on the client, it is called on the goroutine
+// that reads messages so it must not wait for invocations
+func (c *Client) On(target string, handler Handler) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.handlers[strings.ToLower(target)] = handler
+}
+
+// Send invoke a hub method without waiting for it
+func (c *Client) Send(ctx context.Context, target string, args ...interface{}) error {
+    arguments, err := encodeArgs(args)
+    if err != nil {
+        return err
+    }
+    return c.write(ctx, Message{Type: TypeInvocation, Target: target, Arguments: arguments})
+}
+
+// Invoke a hub method and wait for its result
+func (c *Client) Invoke(ctx context.Context, target string, args ...interface{}) (json.RawMessage, error) {
+    arguments, err := encodeArgs(args)
+    if err != nil {
+        return nil, err
+    }
+    cl := &call{target: target, reply: make(chan Message, 1)}
+    id, err := c.register(cl)
+    if err != nil {
+        return nil, err
+    }
+    if err := c.write(ctx, Message{Type: TypeInvocation, InvocationID: id, Target: target, Arguments: arguments}); err != nil {
+        c.remove(id, cl)
+        return nil, err
+    }
+    select {
+    case m, ok := <-cl.reply:
+        if !ok {
+            return nil, c.lost()
+        }
+        if m.Error != "" {
+            return nil, &HubError{Target: target, Message: m.Error}
+        }
+        return m.Result, nil
+    case <-ctx.Done():
+        c.remove(id, cl)
+        return nil, ctx.Err()
+    }
+}
+
+// Stream invoke a streaming hub method, the items arrive on the channel of the stream
+func (c *Client) Stream(ctx context.Context, target string, args ...interface{}) (*Stream, error) {
+    arguments, err := encodeArgs(args)
+    if err != nil {
+        return nil, err
+    }
+    s := &Stream{Target: target, client: c, items: make(chan json.RawMessage, c.cfg.Buffer), done: make(chan struct{})}
+    s.C = s.items
+    cl := &call{target: target, stream: s}
+    if s.ID, err = c.register(cl); err != nil {
+        return nil, err
+    }
+    if err := c.write(ctx, Message{Type: TypeStreamInvocation, InvocationID: s.ID, Target: target, Arguments: arguments}); err != nil {
+        c.remove(s.ID, cl)
+        return nil, err
+    }
+    return s, nil
+}
+
+// Cancel the stream, its channel is closed
+func (s *Stream) Cancel() error {
+    c := s.client
+    c.lock.Lock()
+    cl := c.calls[s.ID]
+    c.lock.Unlock()
+    if cl == nil || cl.stream != s || !c.remove(s.ID, cl) {
+        return nil
+    }
+    s.finish(nil)
+    return c.write(context.Background(), Message{Type: TypeCancelInvocation, InvocationID: s.ID})
+}
+
+// Err return why the stream ended, it is nil while it runs and when it completed
+func (s *Stream) Err() error {
+    s.sendLock.Lock()
+    defer s.sendLock.Unlock()
+    return s.err
+}
+
+// deliver an item, it waits for the reader unless the stream is stopped
+func (s *Stream) deliver(item json.RawMessage) {
+    s.sendLock.Lock()
+    defer s.sendLock.Unlock()
+    if s.finished {
+        return
+    }
+    select {
+    case s.items <- item:
+    case <-s.done:
+    }
+}
+
+// finish end the stream and close its channel
+func (s *Stream) finish(err error) {
+    s.once.Do(func() { close(s.done) })
+    s.sendLock.Lock()
+    defer s.sendLock.Unlock()
+    if s.finished {
+        return
+    }
+    s.finished = true
+    s.err = err
+    close(s.items)
+}
+
+// register a call under a new invocation id
+func (c *Client) register(cl *call) (string, error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.closed {
+        return "", ErrClientClosed
+    }
+    c.nextID++
+    id := strconv.FormatUint(c.nextID, 10)
+    c.calls[id] = cl
+    return id, nil
+}
+
+// remove a call, it return false when it was not waiting
+func (c *Client) remove(id string, cl *call) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.calls[id] != cl {
+        return false
+    }
+    delete(c.calls, id)
+    return true
+}
+
+// lost return the error of a call that ended without a completion
+func (c *Client) lost() error {
+    if err := c.Err(); err != nil {
+        return err
+    }
+    return ErrConnectionLost
+}
+
+// write a message
+func (c *Client) write(ctx context.Context, m Message) error {
+    data, err := Encode(m)
+    if err != nil {
+        return err
+    }
+    c.writeLock.Lock()
+    defer c.writeLock.Unlock()
+    return c.w.WriteMessageContext(ctx, websocket.TextMessage, data)
+}
+
+// restore end the calls of the previous connection, the server does not know them, and start the pings
+func (c *Client) restore() {
+    c.lock.Lock()
+    c.gen++
+    gen := c.gen
+    c.timedOut = false
+    c.closeErr = nil
+    c.lastReceived = c.clock.Now()
+    var lost []*call
+    if c.connected {
+        for id, cl := range c.calls {
+            lost = append(lost, cl)
+            delete(c.calls, id)
+        }
+    }
+    c.connected = true
+    c.lock.Unlock()
+    for _, cl := range lost {
+        cl.end(ErrConnectionLost)
+    }
+    go c.keepAlive(gen)
+}
+
+// end a call without a completion
+func (cl *call) end(err error) {
+    if cl.stream != nil {
+        cl.stream.finish(err)
+        return
+    }
+    close(cl.reply)
+}
+
+// readLoop read messages until the connection fails and is not made again
+func (c *Client) readLoop() {
+    for {
+        c.lock.Lock()
+        early := c.early
+        c.early = nil
+        c.lock.Unlock()
+        if len(early) > 0 {
+            c.handle(early)
+        }
+        conn := c.w.ConnID()
+        _, d, err := c.w.Read()
+        if err != nil {
+            c.lock.Lock()
+            stopped := c.closed || c.timedOut || (c.closeErr != nil && !c.closeErr.AllowReconnect)
+            c.lock.Unlock()
+            if !stopped && c.w.Reconnected(conn) {
+                // the plugin reconnected while reading
+                continue
+            }
+            c.fail(err)
+            return
+        }
+        c.handle(d)
+    }
+}
+
+// handle the messages of a frame
+func (c *Client) handle(data []byte) {
+    c.lock.Lock()
+    c.lastReceived = c.clock.Now()
+    c.lock.Unlock()
+    msgs, err := Parse(data)
+    if err != nil {
+        c.report(err)
+        return
+    }
+    for _, m := range msgs {
+        c.dispatch(m)
+    }
+}
+
+// dispatch a message received from the server
+func (c *Client) dispatch(m Message) {
+    switch m.Type {
+    case TypeInvocation:
+        c.invoke(m)
+    case TypeStreamItem:
+        c.lock.Lock()
+        cl := c.calls[m.InvocationID]
+        c.lock.Unlock()
+        if cl != nil && cl.stream != nil {
+            cl.stream.deliver(m.Item)
+        }
+    case TypeCompletion:
+        c.lock.Lock()
+        cl := c.calls[m.InvocationID]
+        delete(c.calls, m.InvocationID)
+        c.lock.Unlock()
+        if cl == nil {
+            return
+        }
+        if cl.stream == nil {
+            cl.reply <- m
+            return
+        }
+        var err error
+        if m.Error != "" {
+            err = &HubError{Target: cl.target, Message: m.Error}
+        }
+        cl.stream.finish(err)
+    case TypeClose:
+        ce := &CloseError{Message: m.Error, AllowReconnect: m.AllowReconnect}
+        c.lock.Lock()
+        c.closeErr = ce
+        c.lock.Unlock()
+        if ce.AllowReconnect {
+            // the server closes the connection and the plugin makes a new one
+            c.report(ce)
+            return
+        }
+        _ = c.w.Close()
+    }
+}
+
+// invoke the handler of a hub method and send its result when the server waits for one
+func (c *Client) invoke(m Message) {
+    c.lock.Lock()
+    h := c.handlers[strings.ToLower(m.Target)]
+    c.lock.Unlock()
+    var result interface{}
+    var err error
+    if h == nil {
+        err = fmt.Errorf("client has no handler for %s", m.Target)
+    } else if args, aerr := m.Args(); aerr != nil {
+        err = aerr
+    } else {
+        result, err = h(args)
+    }
+    if m.InvocationID == "" {
+        if err != nil {
+            c.report(err)
+        }
+        return
+    }
+    reply := Message{Type: TypeCompletion, InvocationID: m.InvocationID}
+    if err != nil {
+        reply.Error = err.Error()
+    } else if reply.Result, err = json.Marshal(result); err != nil {
+        reply.Result, reply.Error = nil, err.Error()
+    }
+    _ = c.write(context.Background(), reply)
+}
+
+// report an error to OnError
+func (c *Client) report(err error) {
+    if c.cfg.OnError != nil {
+        c.cfg.OnError(err)
+    }
+}
+
+// fail stop reading and end the calls
+func (c *Client) fail(err error) {
+    c.lock.Lock()
+    if c.timedOut {
+        err = ErrServerTimeout
+    } else if c.closeErr != nil && !c.closeErr.AllowReconnect {
+        err = c.closeErr
+    } else if c.closed {
+        err = ErrClientClosed
+    }
+    c.err = err
+    c.running = false
+    c.gen++
+    calls := c.calls
+    c.calls = map[string]*call{}
+    c.lock.Unlock()
+    for _, cl := range calls {
+        cl.end(err)
+    }
+}
+
+// keepAlive ping the server every interval and drop the connection when nothing was received for the server timeout
+func (c *Client) keepAlive(gen uint64) {
+    for {
+        timer := c.clock.NewTimer(c.cfg.KeepAlive)
+        select {
+        case <-timer.C():
+        case <-c.stop:
+            timer.Stop()
+            return
+        }
+        c.lock.Lock()
+        if c.gen != gen {
+            c.lock.Unlock()
+            return
+        }
+        silent := c.clock.Now().Sub(c.lastReceived) >= c.cfg.ServerTimeout
+        c.timedOut = silent
+        c.lock.Unlock()
+        if silent {
+            _ = c.w.Close()
+            return
+        }
+        _ = c.write(context.Background(), Message{Type: TypePing})
+    }
+}
@@ -0,0 +1,462 @@
+package signalr
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+// server is a small SignalR hub for the tests, negotiate needs the token secret,
+// Add returns the sum of its arguments, Fail returns an error, Echo invokes Echo on the client,
+// Ask invokes Question on the client and waits for the result, Quit sends a close message,
+// Counter streams 1 to n and Live streams the index of the connection and stays active
+type server struct {
+    http       *httptest.Server
+    ws         *wstest.Server
+    noPing     bool
+    negotiated int
+    refuse     bool
+
+    lock sync.Mutex
+    log  []string
+}
+
+func newServer(t *testing.T) *server {
+    s := &server{}
+    s.ws = wstest.NewServer(s.serve)
+    mux := http.NewServeMux()
+    mux.HandleFunc("/hub/negotiate", s.negotiate)
+    mux.Handle("/hub", s.ws)
+    s.http = httptest.NewServer(mux)
+    t.Cleanup(func() {
+        s.ws.Close()
+        s.http.Close()
+    })
+    return s
+}
+
+func (s *server) record(n int, format string, args ...interface{}) {
+    s.lock.Lock()
+    s.log = append(s.log, fmt.Sprintf("%d ", n)+fmt.Sprintf(format, args...))
+    s.lock.Unlock()
+}
+
+// waitFor wait until the server logged an entry
+func (s *server) waitFor(t *testing.T, entry string) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        s.lock.Lock()
+        for _, e := range s.log {
+            if e == entry {
+                s.lock.Unlock()
+                return
+            }
+        }
+        s.lock.Unlock()
+        time.Sleep(time.Millisecond)
+    }
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    t.Fatalf("server got %q, want %q", s.log, entry)
+}
+
+func (s *server) negotiate(rw http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost || r.URL.Query().Get("negotiateVersion") != "1" {
+        http.Error(rw, "bad negotiate", http.StatusBadRequest)
+        return
+    }
+    if r.Header.Get("Authorization") != "Bearer secret" {
+        http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    s.lock.Lock()
+    if s.refuse {
+        s.lock.Unlock()
+        http.Error(rw, "Unavailable", http.StatusServiceUnavailable)
+        return
+    }
+    s.negotiated++
+    n := s.negotiated
+    s.lock.Unlock()
+    s.record(n, "negotiate")
+    fmt.Fprintf(rw, `{"connectionId":"conn-%d","connectionToken":"tok-%d","negotiateVersion":1,`+
+        `"availableTransports":[{"transport":"WebSockets","transferFormats":["Text","Binary"]}]}`, n, n)
+}
+
+func (s *server) serve(c *wstest.Conn) {
+    var writeLock sync.Mutex
+    write := func(msgs ...interface{}) {
+        var data []byte
+        for _, m := range msgs {
+            d, _ := Encode(m)
+            data = append(data, d...)
+        }
+        writeLock.Lock()
+        defer writeLock.Unlock()
+        _ = c.WriteMessage(websocket.TextMessage, data)
+    }
+    _, d, err := c.Receive()
+    if err != nil || string(d) != `{"protocol":"json","version":1}`+"\x1e" {
+        return
+    }
+    q := c.Request.URL.Query()
+    s.record(c.Index, "handshake %s %s", q.Get("id"), q.Get("access_token"))
+    welcome, _ := json.Marshal([]int{c.Index})
+    write(handshakeResponse{}, Message{Type: TypeInvocation, Target: "Welcome", Arguments: welcome})
+    for {
+        _, d, err := c.Receive()
+        if err != nil {
+            return
+        }
+        msgs, err := Parse(d)
+        if err != nil {
+            return
+        }
+        for _, m := range msgs {
+            args, _ := m.Args()
+            switch m.Type {
+            case TypePing:
+                s.record(c.Index, "ping")
+                if !s.noPing {
+                    write(Message{Type: TypePing})
+                }
+            case TypeCancelInvocation:
+                s.record(c.Index, "cancel %s", m.InvocationID)
+            case TypeCompletion:
+                s.record(c.Index, "completion %s %s %s", m.InvocationID, string(m.Result), m.Error)
+            case TypeInvocation:
+                s.record(c.Index, "invoke %s %s", m.Target, m.Arguments)
+                switch m.Target {
+                case "Add":
+                    var a, b int
+                    _ = json.Unmarshal(args[0], &a)
+                    _ = json.Unmarshal(args[1], &b)
+                    sum, _ := json.Marshal(a + b)
+                    write(Message{Type: TypeCompletion, InvocationID: m.InvocationID, Result: sum})
+                case "Fail":
+                    write(Message{Type: TypeCompletion, InvocationID: m.InvocationID, Error: "boom"})
+                case "Echo":
+                    write(Message{Type: TypeInvocation, Target: "echo", Arguments: m.Arguments})
+                case "Ask":
+                    write(Message{Type: TypeInvocation, InvocationID: "s1", Target: "Question", Arguments: m.Arguments})
+                case "Quit":
+                    write(Message{Type: TypeClose, Error: "bye"})
+                    return
+                }
+            case TypeStreamInvocation:
+                s.record(c.Index, "stream %s %s", m.Target, m.Arguments)
+                switch m.Target {
+                case "Counter":
+                    var n int
+                    _ = json.Unmarshal(args[0], &n)
+                    for i := 1; i <= n; i++ {
+                        item, _ := json.Marshal(i)
+                        write(Message{Type: TypeStreamItem, InvocationID: m.InvocationID, Item: item})
+                    }
+                    write(Message{Type: TypeCompletion, InvocationID: m.InvocationID})
+                case "Live":
+                    item, _ := json.Marshal(c.Index)
+                    write(Message{Type: TypeStreamItem, InvocationID: m.InvocationID, Item: item})
+                }
+            }
+        }
+    }
+}
+
+// newTestClient connect a client to the server
+func newTestClient(t *testing.T, s *server, cfg Config, setup func(c *Client, w *plugin.Ws)) *Client {
+    w := &plugin.Ws{}
+    cfg.URL = s.http.URL + "/hub"
+    if cfg.AccessToken == "" {
+        cfg.AccessToken = "secret"
+    }
+    c, err := NewClient(w, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if setup != nil {
+        setup(c, w)
+    }
+    if err := c.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { c.Close() })
+    return c
+}
+
+// next wait for a stream item
+func next(t *testing.T, s *Stream) string {
+    t.Helper()
+    select {
+    case item, ok := <-s.C:
+        if !ok {
+            t.Fatalf("stream ended with %v", s.Err())
+        }
+        return string(item)
+    case <-time.After(5 * time.Second):
+        t.Fatal("no item received")
+        return ""
+    }
+}
+
+// ended wait until the items of s are closed
+func ended(t *testing.T, s *Stream) {
+    t.Helper()
+    select {
+    case item, ok := <-s.C:
+        if ok {
+            t.Fatalf("got item %s, want the stream to end", item)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("stream did not end")
+    }
+}
+
+// waitErr wait until the client stopped
+func waitErr(c *Client) error {
+    deadline := time.Now().Add(5 * time.Second)
+    for c.Err() == nil && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    return c.Err()
+}
+
+func TestClient_Connect(t *testing.T) {
+    s := newServer(t)
+    welcome := make(chan string, 1)
+    c := newTestClient(t, s, Config{}, func(c *Client, _ *plugin.Ws) {
+        c.On("welcome", func(args []json.RawMessage) (interface{}, error) {
+            welcome <- string(args[0])
+            return nil, nil
+        })
+    })
+    s.waitFor(t, "1 negotiate")
+    s.waitFor(t, "1 handshake tok-1 secret")
+    if c.ConnectionID() != "conn-1" {
+        t.Errorf("ConnectionID() = %q", c.ConnectionID())
+    }
+    select {
+    case n := <-welcome:
+        if n != "1" {
+            t.Errorf("welcome argument = %s", n)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("invocation sent with the handshake response not handled")
+    }
+}
+
+func TestClient_Connect_unauthorized(t *testing.T) {
+    s := newServer(t)
+    c, err := NewClient(&plugin.Ws{}, Config{URL: s.http.URL + "/hub", AccessToken: "wrong"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var ne *NegotiateError
+    if err := c.Connect(context.Background()); !errors.As(err, &ne) || ne.StatusCode != http.StatusUnauthorized {
+        t.Errorf("Connect() error = %v, want a 401 negotiate error", err)
+    }
+    if _, err := NewClient(&plugin.Ws{}, Config{URL: "ws://localhost/hub"}); err == nil {
+        t.Error("NewClient() accepted a websocket url")
+    }
+}
+
+func TestClient_Invoke(t *testing.T) {
+    s := newServer(t)
+    c := newTestClient(t, s, Config{}, nil)
+    r, err := c.Invoke(context.Background(), "Add", 1, 2)
+    if err != nil || string(r) != "3" {
+        t.Errorf("Invoke() = %s, %v", r, err)
+    }
+    var he *HubError
+    if _, err := c.Invoke(context.Background(), "Fail"); !errors.As(err, &he) || he.Target != "Fail" || he.Message != "boom" {
+        t.Errorf("Invoke() error = %v, want the completion error", err)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    if _, err := c.Invoke(ctx, "Slow"); !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("Invoke() error = %v, want %v", err, context.DeadlineExceeded)
+    }
+}
+
+func TestClient_Send(t *testing.T) {
+    s := newServer(t)
+    got := make(chan []json.RawMessage, 1)
+    c := newTestClient(t, s, Config{}, func(c *Client, _ *plugin.Ws) {
+        c.On("Echo", func(args []json.RawMessage) (interface{}, error) {
+            got <- args
+            return nil, nil
+        })
+    })
+    if err := c.Send(context.Background(), "Echo", "hi", 2); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, `1 invoke Echo ["hi",2]`)
+    select {
+    case args := <-got:
+        if len(args) != 2 || string(args[0]) != `"hi"` || string(args[1]) != "2" {
+            t.Errorf("handler arguments = %s", args)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("handler not called")
+    }
+}
+
+func TestClient_On_result(t *testing.T) {
+    s := newServer(t)
+    c := newTestClient(t, s, Config{}, func(c *Client, _ *plugin.Ws) {
+        c.On("Question", func(args []json.RawMessage) (interface{}, error) {
+            var q string
+            if err := json.Unmarshal(args[0], &q); err != nil || q != "answer?" {
+                return nil, errors.New("bad question")
+            }
+            return 42, nil
+        })
+    })
+    if err := c.Send(context.Background(), "Ask", "answer?"); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, "1 completion s1 42 ")
+    if err := c.Send(context.Background(), "Ask", "other"); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, "1 completion s1  bad question")
+}
+
+func TestClient_Stream(t *testing.T) {
+    s := newServer(t)
+    c := newTestClient(t, s, Config{}, nil)
+    st, err := c.Stream(context.Background(), "Counter", 3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 1; i <= 3; i++ {
+        if item := next(t, st); item != fmt.Sprint(i) {
+            t.Errorf("item %d = %s", i, item)
+        }
+    }
+    ended(t, st)
+    if st.Err() != nil {
+        t.Errorf("Err() = %v after the completion", st.Err())
+    }
+}
+
+func TestStream_Cancel(t *testing.T) {
+    s := newServer(t)
+    c := newTestClient(t, s, Config{}, nil)
+    st, err := c.Stream(context.Background(), "Live")
+    if err != nil {
+        t.Fatal(err)
+    }
+    next(t, st)
+    if err := st.Cancel(); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, "1 cancel "+st.ID)
+    ended(t, st)
+}
+
+func TestClient_close(t *testing.T) {
+    s := newServer(t)
+    c := newTestClient(t, s, Config{}, func(_ *Client, w *plugin.Ws) { w.Reconnect(true) })
+    if err := c.Send(context.Background(), "Quit"); err != nil {
+        t.Fatal(err)
+    }
+    var ce *CloseError
+    if err := waitErr(c); !errors.As(err, &ce) || ce.Message != "bye" || ce.AllowReconnect {
+        t.Errorf("Err() = %v, want the close message", err)
+    }
+}
+
+func TestClient_keepAlive(t *testing.T) {
+    s := newServer(t)
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    c := newTestClient(t, s, Config{KeepAlive: 15 * time.Second, ServerTimeout: 30 * time.Second, Clock: clock}, nil)
+    for i := 0; i < 3; i++ {
+        clock.BlockUntil(1)
+        clock.Advance(15 * time.Second)
+        s.waitFor(t, "1 ping")
+        // the answer is read before the next ping
+        if _, err := c.Invoke(context.Background(), "Add", 0, 0); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if c.Err() != nil {
+        t.Errorf("Err() = %v while the server answers", c.Err())
+    }
+}
+
+func TestClient_serverTimeout(t *testing.T) {
+    s := newServer(t)
+    s.noPing = true
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    c := newTestClient(t, s, Config{KeepAlive: 15 * time.Second, ServerTimeout: 30 * time.Second, Clock: clock},
+        func(_ *Client, w *plugin.Ws) { w.Reconnect(true) })
+    st, err := c.Stream(context.Background(), "Live")
+    if err != nil {
+        t.Fatal(err)
+    }
+    next(t, st)
+    clock.BlockUntil(1)
+    clock.Advance(15 * time.Second)
+    s.waitFor(t, "1 ping")
+    clock.BlockUntil(1)
+    clock.Advance(15 * time.Second)
+    ended(t, st)
+    if !errors.Is(st.Err(), ErrServerTimeout) || !errors.Is(c.Err(), ErrServerTimeout) {
+        t.Errorf("Err() = %v, %v, want %v", st.Err(), c.Err(), ErrServerTimeout)
+    }
+}
+
+func TestClient_reconnect(t *testing.T) {
+    s := newServer(t)
+    c := newTestClient(t, s, Config{}, func(_ *Client, w *plugin.Ws) { w.Reconnect(true) })
+    st, err := c.Stream(context.Background(), "Live")
+    if err != nil {
+        t.Fatal(err)
+    }
+    next(t, st)
+    s.ws.CloseConnections()
+    ended(t, st)
+    if !errors.Is(st.Err(), ErrConnectionLost) {
+        t.Errorf("Err() = %v, want %v", st.Err(), ErrConnectionLost)
+    }
+    s.waitFor(t, "2 negotiate")
+    s.waitFor(t, "2 handshake tok-2 secret")
+    if c.ConnectionID() != "conn-2" {
+        t.Errorf("ConnectionID() = %q after the reconnect", c.ConnectionID())
+    }
+    if r, err := c.Invoke(context.Background(), "Add", 2, 3); err != nil || string(r) != "5" {
+        t.Errorf("Invoke() = %s, %v after the reconnect", r, err)
+    }
+}
+
+func TestClient_reconnectNegotiateFails(t *testing.T) {
+    s := newServer(t)
+    c := newTestClient(t, s, Config{}, func(_ *Client, w *plugin.Ws) {
+        w.Reconnect(true)
+        w.SetMaxReconnectAttempts(1)
+    })
+    s.waitFor(t, "1 handshake tok-1 secret")
+    s.lock.Lock()
+    s.refuse = true
+    s.lock.Unlock()
+    s.ws.CloseConnections()
+    var ne *NegotiateError
+    if err := waitErr(c); !errors.As(err, &ne) || ne.StatusCode != http.StatusServiceUnavailable {
+        t.Errorf("Err() = %v, want the attempt to fail with the negotiate error", err)
+    }
+    if n := s.ws.Connections(); n != 1 {
+        t.Errorf("server got %d connections, want the hub to not be dialed after the negotiation failed", n)
+    }
+}
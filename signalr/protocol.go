@@ -0,0 +1,110 @@
+// Package signalr is a client for ASP.NET Core SignalR hubs with the json hub protocol on top of the plugin
+package signalr
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+)
+
+// RecordSeparator ends every message of the json hub protocol
+const RecordSeparator = 0x1E
+
+// message types of the hub protocol
+const (
+    TypeInvocation       = 1
+    TypeStreamItem       = 2
+    TypeCompletion       = 3
+    TypeStreamInvocation = 4
+    TypeCancelInvocation = 5
+    TypePing             = 6
+    TypeClose            = 7
+)
+
+// ErrIncomplete is returned for data that does not end with a record separator
+var ErrIncomplete = errors.New("signalr: message is not terminated by a record separator")
+
+// Message is a message of the hub protocol, the fields that are used depend on the type
+type Message struct {
+    Type         int    `json:"type"`
+    InvocationID string `json:"invocationId,omitempty"`
+    Target       string `json:"target,omitempty"`
+
+    // Arguments is the json array of arguments of an invocation
+    Arguments json.RawMessage `json:"arguments,omitempty"`
+    StreamIDs []string        `json:"streamIds,omitempty"`
+
+    Item   json.RawMessage `json:"item,omitempty"`
+    Result json.RawMessage `json:"result,omitempty"`
+    Error  string          `json:"error,omitempty"`
+
+    AllowReconnect bool `json:"allowReconnect,omitempty"`
+}
+
+// Args return the arguments of an invocation
+func (m *Message) Args() ([]json.RawMessage, error) {
+    var args []json.RawMessage
+    if len(m.Arguments) == 0 {
+        return args, nil
+    }
+    err := json.Unmarshal(m.Arguments, &args)
+    return args, err
+}
+
+// handshakeRequest is the first message sent on a connection
+type handshakeRequest struct {
+    Protocol string `json:"protocol"`
+    Version  int    `json:"version"`
+}
+
+// handshakeResponse is the reply to the handshake, it is empty when the handshake succeeded
+type handshakeResponse struct {
+    Error string `json:"error,omitempty"`
+}
+
+// Encode a value as a record
+func Encode(v interface{}) ([]byte, error) {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return nil, err
+    }
+    return append(data, RecordSeparator), nil
+}
+
+// Split the records of a text message, a message can carry several records
+func Split(data []byte) ([][]byte, error) {
+    var records [][]byte
+    for len(data) > 0 {
+        i := bytes.IndexByte(data, RecordSeparator)
+        if i < 0 {
+            return records, ErrIncomplete
+        }
+        records = append(records, data[:i])
+        data = data[i+1:]
+    }
+    return records, nil
+}
+
+// Parse the messages of a text message
+func Parse(data []byte) ([]Message, error) {
+    records, err := Split(data)
+    if err != nil {
+        return nil, err
+    }
+    msgs := make([]Message, len(records))
+    for i, r := range records {
+        if err := json.Unmarshal(r, &msgs[i]); err != nil {
+            return nil, fmt.Errorf("signalr: bad message %q: %w", r, err)
+        }
+    }
+    return msgs, nil
+}
+
+// encodeArgs build the json array of arguments
+func encodeArgs(args []interface{}) (json.RawMessage, error) {
+    if args == nil {
+        args = []interface{}{}
+    }
+    return json.Marshal(args)
+}
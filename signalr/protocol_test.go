@@ -0,0 +1,44 @@
+package signalr
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestEncode(t *testing.T) {
+    data, err := Encode(Message{Type: TypeInvocation, InvocationID: "1", Target: "Add", Arguments: []byte("[1,2]")})
+    if err != nil || string(data) != `{"type":1,"invocationId":"1","target":"Add","arguments":[1,2]}`+"\x1e" {
+        t.Errorf("Encode() = %q, %v", data, err)
+    }
+    data, err = Encode(handshakeRequest{Protocol: "json", Version: 1})
+    if err != nil || string(data) != `{"protocol":"json","version":1}`+"\x1e" {
+        t.Errorf("Encode() = %q, %v", data, err)
+    }
+}
+
+func TestParse(t *testing.T) {
+    msgs, err := Parse([]byte(`{"type":6}` + "\x1e" + `{"type":3,"invocationId":"2","result":null}` + "\x1e"))
+    if err != nil || len(msgs) != 2 {
+        t.Fatalf("Parse() = %v, %v", msgs, err)
+    }
+    if msgs[0].Type != TypePing || msgs[1].Type != TypeCompletion || msgs[1].InvocationID != "2" || string(msgs[1].Result) != "null" {
+        t.Errorf("Parse() = %+v", msgs)
+    }
+    if _, err := Parse([]byte(`{"type":6}`)); !errors.Is(err, ErrIncomplete) {
+        t.Errorf("Parse() error = %v, want %v", err, ErrIncomplete)
+    }
+    if _, err := Parse([]byte("{\x1e")); err == nil {
+        t.Error("Parse() accepted a record that is not json")
+    }
+}
+
+func TestMessage_Args(t *testing.T) {
+    m := Message{Arguments: []byte(`[1,"two",{"three":3}]`)}
+    args, err := m.Args()
+    if err != nil || len(args) != 3 || string(args[1]) != `"two"` {
+        t.Errorf("Args() = %s, %v", args, err)
+    }
+    if args, err := (&Message{}).Args(); err != nil || len(args) != 0 {
+        t.Errorf("Args() = %s, %v without arguments", args, err)
+    }
+}
@@ -0,0 +1,711 @@
+package socketio
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/url"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+var (
+    // ErrAckTimeout is returned when the server did not ack an event in time
+    ErrAckTimeout = errors.New("socketio: ack timed out")
+
+    // ErrPingTimeout is the error of a client that stopped getting pings from the server
+    ErrPingTimeout = errors.New("socketio: ping timed out")
+
+    // ErrClientClosed is returned after Close
+    ErrClientClosed = errors.New("socketio: client closed")
+
+    // ErrNotConnected is returned by namespaces that are not connected
+    ErrNotConnected = errors.New("socketio: namespace not connected")
+)
+
+// ConnectError is a CONNECT_ERROR sent by the server for a namespace
+type ConnectError struct {
+    Namespace string
+    Message   string
+    Data      json.RawMessage
+}
+
+func (e *ConnectError) Error() string {
+    return fmt.Sprintf("socketio: connect to %s refused: %s", e.Namespace, e.Message)
+}
+
+// Config of a Client
+type Config struct {
+    // Auth is sent when connecting to the main namespace
+    Auth interface{}
+
+    // Query is added to the query of the url, EIO and transport are set by the client
+    Query url.Values
+
+    // AckTimeout is how long EmitWithAck waits, 0 waits 10 seconds
+    AckTimeout time.Duration
+
+    // ConnectTimeout is how long to wait for the main namespace, 0 waits 30 seconds
+    ConnectTimeout time.Duration
+
+    // OnError is called for packets that can not be decoded and refused namespaces, it must not block
+    OnError func(err error)
+
+    // Clock is used for the ping timeout and ack timeouts, the system clock is used when it is nil
+    Clock plugin.Clock
+}
+
+// handshake is the Engine.IO open packet
+type handshake struct {
+    SID          string `json:"sid"`
+    PingInterval int    `json:"pingInterval"`
+    PingTimeout  int    `json:"pingTimeout"`
+    MaxPayload   int    `json:"maxPayload"`
+}
+
+// Client speaks Socket.IO over a Ws, the connected namespaces are connected again whenever the Ws makes a new connection
+type Client struct {
+    w     *plugin.Ws
+    cfg   Config
+    clock plugin.Clock
+
+    // writeLock makes sure there is only one writer and keeps attachments behind their packet
+    writeLock sync.Mutex
+
+    lock     sync.Mutex
+    sockets  map[string]*Socket
+    acks     map[int64]chan *Message
+    nextAck  int64
+    open     handshake
+    lastPing time.Time
+    err      error
+    running  bool
+    closed   bool
+    stop     chan struct{}
+    gen      uint64
+    timedOut bool
+}
+
+// Socket is a namespace of the client
+type Socket struct {
+    Namespace string
+
+    client    *Client
+    auth      interface{}
+    id        string
+    connected bool
+    joined    bool
+    waiting   chan error
+    handlers  map[string][]func(m *Message)
+}
+
+// Message is a received event or the arguments of an ack
+type Message struct {
+    // Event is the name of the event, it is empty for acks
+    Event string
+    Args  []json.RawMessage
+
+    // Binary holds the attachments that placeholders in Args point to
+    Binary [][]byte
+
+    socket *Socket
+    id     int64
+}
+
+// Arg decode argument i into v
+func (m *Message) Arg(i int, v interface{}) error {
+    if i >= len(m.Args) {
+        return fmt.Errorf("socketio: %s has %d arguments", m.Event, len(m.Args))
+    }
+    return json.Unmarshal(m.Args[i], v)
+}
+
+// Bytes return the attachment of argument i
+func (m *Message) Bytes(i int) ([]byte, bool) {
+    if i >= len(m.Args) {
+        return nil, false
+    }
+    return attachment(m.Args[i], m.Binary)
+}
+
+// WantsAck return true when the server waits for an ack
+func (m *Message) WantsAck() bool {
+    return m.socket != nil && m.id >= 0
+}
+
+// Ack answer an event that wants an ack, []byte arguments are sent as attachments
+func (m *Message) Ack(args ...interface{}) error {
+    if !m.WantsAck() {
+        return fmt.Errorf("socketio: %s does not want an ack", m.Event)
+    }
+    return m.socket.client.send(&Packet{Type: PacketAck, Namespace: m.socket.Namespace, ID: m.id}, args)
+}
+
+// NewClient create a client for w, the url of w must point at the socket.io path of the server,
+// connecting the main namespace is the init exchange of w and the OnConnect hook of w is wrapped
+// to connect the other namespaces again
+func NewClient(w *plugin.Ws, cfg Config) *Client {
+    if cfg.AckTimeout <= 0 {
+        cfg.AckTimeout = 10 * time.Second
+    }
+    if cfg.Clock == nil {
+        cfg.Clock = plugin.SystemClock
+    }
+    c := &Client{
+        w:       w,
+        cfg:     cfg,
+        clock:   cfg.Clock,
+        sockets: map[string]*Socket{},
+        acks:    map[int64]chan *Message{},
+        stop:    make(chan struct{}),
+    }
+    c.sockets["/"] = c.newSocket("/", cfg.Auth)
+    c.sockets["/"].joined = true
+    q := url.Values{}
+    for k, v := range cfg.Query {
+        q[k] = v
+    }
+    q.Set("EIO", "4")
+    q.Set("transport", "websocket")
+    w.SetQuery(q)
+    w.SetInitExchange(plugin.InitExchange{
+        Messages: [][]byte{[]byte(string(EngineMessage) + c.connectPacket(c.sockets["/"]).Encode())},
+        Accept:   c.accept,
+        Timeout:  cfg.ConnectTimeout,
+    })
+    hooks := w.Hooks()
+    next := hooks.OnConnect
+    hooks.OnConnect = func(w *plugin.Ws, info plugin.ConnectInfo) error {
+        c.restore()
+        if next != nil {
+            return next(w, info)
+        }
+        return nil
+    }
+    w.SetHooks(hooks)
+    return c
+}
+
+func (c *Client) newSocket(namespace string, auth interface{}) *Socket {
+    return &Socket{Namespace: namespace, client: c, auth: auth, handlers: map[string][]func(m *Message){}}
+}
+
+// Connect make the connection, connect the main namespace and start reading packets
+func (c *Client) Connect(ctx context.Context) error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return ErrClientClosed
+    }
+    c.lock.Unlock()
+    if err := c.w.ConnectContext(ctx); err != nil {
+        return err
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.err = nil
+    if !c.running {
+        c.running = true
+        go c.readLoop()
+    }
+    return nil
+}
+
+// SessionID return the Engine.IO session id of the current connection
+func (c *Client) SessionID() string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.open.SID
+}
+
+// Err return why the client stopped reading, it is nil while it runs
+func (c *Client) Err() error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.err
+}
+
+// Socket return the main namespace
+func (c *Client) Socket() *Socket {
+    return c.Of("/")
+}
+
+// Of return a namespace, it has to be connected with Connect unless it is the main namespace
+func (c *Client) Of(namespace string) *Socket {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    s := c.sockets[namespace]
+    if s == nil {
+        s = c.newSocket(namespace, nil)
+        c.sockets[namespace] = s
+    }
+    return s
+}
+
+// Close the connection, the namespaces are not connected again
+func (c *Client) Close() error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil
+    }
+    c.closed = true
+    close(c.stop)
+    c.lock.Unlock()
+    return c.w.Close()
+}
+
+// ID return the socket id the server gave the namespace
+func (s *Socket) ID() string {
+    s.client.lock.Lock()
+    defer s.client.lock.Unlock()
+    return s.id
+}
+
+// Connected return true while the namespace is connected
+func (s *Socket) Connected() bool {
+    s.client.lock.Lock()
+    defer s.client.lock.Unlock()
+    return s.connected
+}
+
+// Connect the namespace with an auth payload and wait for the server to accept it,
+// it is connected again after a reconnect until Disconnect is called
+func (s *Socket) Connect(ctx context.Context, auth interface{}) error {
+    c := s.client
+    ch := make(chan error, 1)
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return ErrClientClosed
+    }
+    if s.connected {
+        c.lock.Unlock()
+        return nil
+    }
+    if s.Namespace != "/" {
+        s.auth = auth
+    }
+    s.joined = true
+    s.waiting = ch
+    p := c.connectPacket(s)
+    c.lock.Unlock()
+    if err := c.write(p); err != nil {
+        return err
+    }
+    select {
+    case err := <-ch:
+        return err
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// Disconnect leave the namespace
+func (s *Socket) Disconnect() error {
+    c := s.client
+    c.lock.Lock()
+    s.joined = false
+    s.connected = false
+    c.lock.Unlock()
+    return c.write(&Packet{Type: PacketDisconnect, Namespace: s.Namespace, ID: NoID})
+}
+
+// On add a handler for an event, it is called on the goroutine that reads packets so it must not wait for acks,
+// the reserved events connect and disconnect are called when the namespace is connected and when the server left it
+func (s *Socket) On(event string, handler func(m *Message)) {
+    s.client.lock.Lock()
+    defer s.client.lock.Unlock()
+    s.handlers[event] = append(s.handlers[event], handler)
+}
+
+// Emit an event, []byte arguments are sent as binary attachments
+func (s *Socket) Emit(event string, args ...interface{}) error {
+    return s.client.send(&Packet{Type: PacketEvent, Namespace: s.Namespace, ID: NoID}, append([]interface{}{event}, args...))
+}
+
+// EmitWithAck emit an event and wait for the ack of the server, the wait ends after the ack timeout
+func (s *Socket) EmitWithAck(ctx context.Context, event string, args ...interface{}) (*Message, error) {
+    c := s.client
+    ch := make(chan *Message, 1)
+    c.lock.Lock()
+    if !s.connected {
+        c.lock.Unlock()
+        return nil, ErrNotConnected
+    }
+    id := c.nextAck
+    c.nextAck++
+    c.acks[id] = ch
+    c.lock.Unlock()
+    defer func() {
+        c.lock.Lock()
+        delete(c.acks, id)
+        c.lock.Unlock()
+    }()
+    if err := c.send(&Packet{Type: PacketEvent, Namespace: s.Namespace, ID: id}, append([]interface{}{event}, args...)); err != nil {
+        return nil, err
+    }
+    timer := c.clock.NewTimer(c.cfg.AckTimeout)
+    defer timer.Stop()
+    select {
+    case m, ok := <-ch:
+        if !ok {
+            return nil, c.Err()
+        }
+        return m, nil
+    case <-timer.C():
+        return nil, fmt.Errorf("%w: %s %d", ErrAckTimeout, event, id)
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// send an event or ack, the packet becomes a binary one when there are attachments
+func (c *Client) send(p *Packet, args []interface{}) error {
+    data, binary, err := encodeArgs(args)
+    if err != nil {
+        return err
+    }
+    p.Data = data
+    if len(binary) > 0 {
+        p.Type += PacketBinaryEvent - PacketEvent
+        p.Binary = binary
+    }
+    return c.write(p)
+}
+
+// write a packet and its attachments
+func (c *Client) write(p *Packet) error {
+    c.writeLock.Lock()
+    defer c.writeLock.Unlock()
+    if err := c.w.WriteMessage(websocket.TextMessage, []byte(string(EngineMessage)+p.Encode())); err != nil {
+        return err
+    }
+    for _, b := range p.Binary {
+        if err := c.w.WriteMessage(websocket.BinaryMessage, b); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// connectPacket build the CONNECT packet of a namespace, the lock must be held for namespaces other than the main one
+func (c *Client) connectPacket(s *Socket) *Packet {
+    p := &Packet{Type: PacketConnect, Namespace: s.Namespace, ID: NoID}
+    if s.auth != nil {
+        p.Data, _ = json.Marshal(s.auth)
+    }
+    return p
+}
+
+// accept read the Engine.IO handshake and wait for the main namespace during the init exchange
+func (c *Client) accept(messageType int, data []byte) (bool, error) {
+    if messageType != websocket.TextMessage || len(data) == 0 {
+        return false, nil
+    }
+    switch data[0] {
+    case EngineOpen:
+        var h handshake
+        if err := json.Unmarshal(data[1:], &h); err != nil {
+            return false, err
+        }
+        c.lock.Lock()
+        c.open = h
+        c.lock.Unlock()
+        return false, nil
+    case EngineMessage:
+        p, err := Decode(string(data[1:]))
+        if err != nil || p.Namespace != "/" {
+            return false, err
+        }
+        switch p.Type {
+        case PacketConnect:
+            c.connected(p)
+            return true, nil
+        case PacketConnectError:
+            return false, connectError(p)
+        }
+    }
+    return false, nil
+}
+
+// connected mark the namespace of a CONNECT packet as connected
+func (c *Client) connected(p *Packet) *Socket {
+    var sid struct {
+        SID string `json:"sid"`
+    }
+    _ = json.Unmarshal(p.Data, &sid)
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    s := c.sockets[p.Namespace]
+    if s == nil {
+        return nil
+    }
+    s.id = sid.SID
+    s.connected = true
+    if s.waiting != nil {
+        s.waiting <- nil
+        s.waiting = nil
+    }
+    return s
+}
+
+// connectError build the error of a CONNECT_ERROR packet
+func connectError(p *Packet) error {
+    e := &ConnectError{Namespace: p.Namespace, Data: p.Data}
+    var body struct {
+        Message string `json:"message"`
+    }
+    if json.Unmarshal(p.Data, &body) == nil && body.Message != "" {
+        e.Message = body.Message
+    } else {
+        _ = json.Unmarshal(p.Data, &e.Message)
+    }
+    return e
+}
+
+// restore connect the other namespaces again after a new connection and start watching the pings,
+// the packets are sent from another goroutine because a write that reconnected still holds the write lock
+func (c *Client) restore() {
+    c.lock.Lock()
+    c.gen++
+    gen := c.gen
+    c.timedOut = false
+    c.lastPing = c.clock.Now()
+    main := c.sockets["/"]
+    var packets []*Packet
+    names := make([]string, 0, len(c.sockets))
+    for ns := range c.sockets {
+        names = append(names, ns)
+    }
+    sort.Strings(names)
+    for _, ns := range names {
+        s := c.sockets[ns]
+        if ns != "/" {
+            s.connected = false
+            if s.joined {
+                packets = append(packets, c.connectPacket(s))
+            }
+        }
+    }
+    c.lock.Unlock()
+    go func() {
+        c.emitReserved(main, "connect")
+        for _, p := range packets {
+            c.lock.Lock()
+            current := c.gen == gen
+            c.lock.Unlock()
+            if !current || c.write(p) != nil {
+                return
+            }
+        }
+    }()
+    go c.watchPings(gen)
+}
+
+// readLoop read packets until the connection fails and is not made again
+func (c *Client) readLoop() {
+    var pending *Packet
+    for {
+        conn := c.w.ConnID()
+        t, d, err := c.w.Read()
+        if err != nil {
+            c.lock.Lock()
+            stopped := c.closed || c.timedOut
+            c.lock.Unlock()
+            if !stopped && c.w.Reconnected(conn) {
+                // the plugin reconnected while reading, attachments are not carried over
+                pending = nil
+                continue
+            }
+            c.fail(err)
+            return
+        }
+        if t == websocket.BinaryMessage {
+            if pending == nil {
+                c.report(fmt.Errorf("%w: unexpected attachment", ErrBadPacket))
+                continue
+            }
+            pending.Binary = append(pending.Binary, d)
+            if len(pending.Binary) == pending.Attachments {
+                c.dispatch(pending)
+                pending = nil
+            }
+            continue
+        }
+        if len(d) == 0 {
+            continue
+        }
+        switch d[0] {
+        case EnginePing:
+            c.lock.Lock()
+            c.lastPing = c.clock.Now()
+            c.lock.Unlock()
+            c.writeEngine(EnginePong)
+        case EngineMessage:
+            p, err := Decode(string(d[1:]))
+            if err != nil {
+                c.report(err)
+                continue
+            }
+            if p.Attachments > 0 {
+                pending = p
+                continue
+            }
+            c.dispatch(p)
+        }
+    }
+}
+
+// writeEngine write an Engine.IO packet without data
+func (c *Client) writeEngine(t byte) {
+    c.writeLock.Lock()
+    defer c.writeLock.Unlock()
+    _ = c.w.WriteMessage(websocket.TextMessage, []byte{t})
+}
+
+// dispatch a Socket.IO packet received from the server
+func (c *Client) dispatch(p *Packet) {
+    switch p.Type {
+    case PacketConnect:
+        if s := c.connected(p); s != nil {
+            c.emitReserved(s, "connect")
+        }
+    case PacketConnectError:
+        err := connectError(p)
+        c.lock.Lock()
+        s := c.sockets[p.Namespace]
+        var ch chan error
+        if s != nil {
+            ch, s.waiting = s.waiting, nil
+        }
+        c.lock.Unlock()
+        if ch != nil {
+            ch <- err
+        } else {
+            c.report(err)
+        }
+    case PacketDisconnect:
+        c.lock.Lock()
+        s := c.sockets[p.Namespace]
+        if s != nil {
+            s.connected = false
+            s.joined = false
+        }
+        c.lock.Unlock()
+        if s != nil {
+            c.emitReserved(s, "disconnect")
+        }
+    case PacketEvent, PacketBinaryEvent:
+        var args []json.RawMessage
+        var name string
+        if err := json.Unmarshal(p.Data, &args); err != nil || len(args) == 0 || json.Unmarshal(args[0], &name) != nil {
+            c.report(fmt.Errorf("%w: event without a name", ErrBadPacket))
+            return
+        }
+        c.lock.Lock()
+        s := c.sockets[p.Namespace]
+        var handlers []func(m *Message)
+        if s != nil {
+            handlers = append(handlers, s.handlers[name]...)
+        }
+        c.lock.Unlock()
+        m := &Message{Event: name, Args: args[1:], Binary: p.Binary, socket: s, id: p.ID}
+        for _, h := range handlers {
+            h(m)
+        }
+    case PacketAck, PacketBinaryAck:
+        var args []json.RawMessage
+        _ = json.Unmarshal(p.Data, &args)
+        c.lock.Lock()
+        ch := c.acks[p.ID]
+        delete(c.acks, p.ID)
+        c.lock.Unlock()
+        if ch != nil {
+            ch <- &Message{Args: args, Binary: p.Binary, id: NoID}
+        }
+    }
+}
+
+// emitReserved call the handlers of a reserved event
+func (c *Client) emitReserved(s *Socket, event string) {
+    c.lock.Lock()
+    handlers := append([]func(m *Message){}, s.handlers[event]...)
+    c.lock.Unlock()
+    m := &Message{Event: event, id: NoID}
+    for _, h := range handlers {
+        h(m)
+    }
+}
+
+// report an error to OnError
+func (c *Client) report(err error) {
+    if c.cfg.OnError != nil {
+        c.cfg.OnError(err)
+    }
+}
+
+// fail stop reading and end the waits for acks
+func (c *Client) fail(err error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.timedOut {
+        err = ErrPingTimeout
+    } else if c.closed {
+        err = ErrClientClosed
+    }
+    c.err = err
+    c.running = false
+    c.gen++
+    for id, ch := range c.acks {
+        close(ch)
+        delete(c.acks, id)
+    }
+    for _, s := range c.sockets {
+        s.connected = false
+        if s.waiting != nil {
+            s.waiting <- err
+            s.waiting = nil
+        }
+    }
+}
+
+// watchPings drop the connection when the server did not ping within its ping interval and timeout
+func (c *Client) watchPings(gen uint64) {
+    for {
+        c.lock.Lock()
+        if c.gen != gen {
+            c.lock.Unlock()
+            return
+        }
+        limit := time.Duration(c.open.PingInterval+c.open.PingTimeout) * time.Millisecond
+        deadline := c.lastPing.Add(limit)
+        c.lock.Unlock()
+        if limit <= 0 {
+            return
+        }
+        if wait := deadline.Sub(c.clock.Now()); wait > 0 {
+            timer := c.clock.NewTimer(wait)
+            select {
+            case <-timer.C():
+            case <-c.stop:
+                timer.Stop()
+                return
+            }
+            continue
+        }
+        c.lock.Lock()
+        current := c.gen == gen
+        c.timedOut = current
+        c.lock.Unlock()
+        if current {
+            _ = c.w.Close()
+        }
+        return
+    }
+}
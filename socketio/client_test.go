@@ -0,0 +1,363 @@
+package socketio
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/url"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+// server is a small Socket.IO server for the tests, echo is emitted back and acked with its arguments,
+// ask makes the server emit question with ack id 7, ping makes it send an Engine.IO ping, kick makes it
+// leave the namespace and ignore is not acked, /private and the main namespace want the token secret
+type server struct {
+    srv          *wstest.Server
+    pingInterval int
+    pingTimeout  int
+
+    lock sync.Mutex
+    log  []string
+}
+
+func newServer(t *testing.T) *server {
+    s := &server{pingInterval: 25000, pingTimeout: 20000}
+    s.srv = wstest.NewServer(s.serve)
+    t.Cleanup(s.srv.Close)
+    return s
+}
+
+func (s *server) record(c *wstest.Conn, format string, args ...interface{}) {
+    s.lock.Lock()
+    s.log = append(s.log, fmt.Sprintf("%d ", c.Index)+fmt.Sprintf(format, args...))
+    s.lock.Unlock()
+}
+
+// waitFor wait until the server logged an entry
+func (s *server) waitFor(t *testing.T, entry string) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        s.lock.Lock()
+        for _, e := range s.log {
+            if e == entry {
+                s.lock.Unlock()
+                return
+            }
+        }
+        s.lock.Unlock()
+        time.Sleep(time.Millisecond)
+    }
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    t.Fatalf("server got %q, want %q", s.log, entry)
+}
+
+func (s *server) serve(c *wstest.Conn) {
+    write := func(p *Packet) {
+        _ = c.WriteMessage(websocket.TextMessage, []byte(string(EngineMessage)+p.Encode()))
+        for _, b := range p.Binary {
+            _ = c.WriteMessage(websocket.BinaryMessage, b)
+        }
+    }
+    _ = c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`0{"sid":"e-%d","upgrades":[],"pingInterval":%d,"pingTimeout":%d,"maxPayload":1000000}`,
+        c.Index, s.pingInterval, s.pingTimeout)))
+    var pending *Packet
+    for {
+        t, d, err := c.Receive()
+        if err != nil {
+            return
+        }
+        if t == websocket.BinaryMessage {
+            pending.Binary = append(pending.Binary, d)
+            if len(pending.Binary) < pending.Attachments {
+                continue
+            }
+            s.handle(c, pending, write)
+            pending = nil
+            continue
+        }
+        if string(d) == string(EnginePong) {
+            s.record(c, "pong")
+            continue
+        }
+        p, err := Decode(string(d[1:]))
+        if err != nil {
+            return
+        }
+        if p.Attachments > 0 {
+            pending = p
+            continue
+        }
+        s.handle(c, p, write)
+    }
+}
+
+func (s *server) handle(c *wstest.Conn, p *Packet, write func(p *Packet)) {
+    switch p.Type {
+    case PacketConnect:
+        s.record(c, "connect %s %s", p.Namespace, p.Data)
+        var auth struct{ Token string }
+        _ = json.Unmarshal(p.Data, &auth)
+        if (p.Namespace == "/private" || p.Namespace == "/") && auth.Token != "secret" {
+            write(&Packet{Type: PacketConnectError, Namespace: p.Namespace, ID: NoID, Data: json.RawMessage(`{"message":"not authorized"}`)})
+            return
+        }
+        write(&Packet{Type: PacketConnect, Namespace: p.Namespace, ID: NoID, Data: json.RawMessage(fmt.Sprintf(`{"sid":"s%s-%d"}`, p.Namespace, c.Index))})
+    case PacketDisconnect:
+        s.record(c, "disconnect %s", p.Namespace)
+    case PacketAck, PacketBinaryAck:
+        s.record(c, "ack %s %d %s", p.Namespace, p.ID, p.Data)
+    case PacketEvent, PacketBinaryEvent:
+        var args []json.RawMessage
+        var name string
+        _ = json.Unmarshal(p.Data, &args)
+        _ = json.Unmarshal(args[0], &name)
+        s.record(c, "event %s %s %d", p.Namespace, p.Data, len(p.Binary))
+        switch name {
+        case "echo":
+            write(&Packet{Type: p.Type, Namespace: p.Namespace, ID: NoID, Data: p.Data, Binary: p.Binary})
+            if p.ID >= 0 {
+                ack, _ := json.Marshal(args[1:])
+                write(&Packet{Type: p.Type + 1, Namespace: p.Namespace, ID: p.ID, Data: ack, Binary: p.Binary})
+            }
+        case "ask":
+            write(&Packet{Type: PacketEvent, Namespace: p.Namespace, ID: 7, Data: json.RawMessage(`["question","ready?"]`)})
+        case "ping":
+            _ = c.WriteMessage(websocket.TextMessage, []byte{EnginePing})
+        case "kick":
+            write(&Packet{Type: PacketDisconnect, Namespace: p.Namespace, ID: NoID})
+        }
+    }
+}
+
+// newTestClient connect a client to the server
+func newTestClient(t *testing.T, s *server, cfg Config, setup func(c *Client, w *plugin.Ws)) (*Client, *plugin.Ws) {
+    w := &plugin.Ws{}
+    w.SetUrl("ws", s.srv.Host, "/socket.io/")
+    if cfg.Auth == nil {
+        cfg.Auth = map[string]string{"token": "secret"}
+    }
+    c := NewClient(w, cfg)
+    if setup != nil {
+        setup(c, w)
+    }
+    if err := c.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { c.Close() })
+    return c, w
+}
+
+// collect return a handler that sends messages to a channel
+func collect() (func(m *Message), chan *Message) {
+    ch := make(chan *Message, 16)
+    return func(m *Message) { ch <- m }, ch
+}
+
+// next wait for a message
+func next(t *testing.T, ch chan *Message) *Message {
+    t.Helper()
+    select {
+    case m := <-ch:
+        return m
+    case <-time.After(5 * time.Second):
+        t.Fatal("no message received")
+        return nil
+    }
+}
+
+func TestClient_Connect(t *testing.T) {
+    s := newServer(t)
+    handler, ch := collect()
+    c, _ := newTestClient(t, s, Config{Query: url.Values{"room": {"a"}}}, func(c *Client, w *plugin.Ws) {
+        c.Socket().On("connect", handler)
+    })
+    s.waitFor(t, `1 connect / {"token":"secret"}`)
+    if got := s.srv.Handshakes()[0].URL.String(); got != "/socket.io/?EIO=4&room=a&transport=websocket" {
+        t.Errorf("handshake url = %q", got)
+    }
+    if c.SessionID() != "e-1" || c.Socket().ID() != "s/-1" || !c.Socket().Connected() {
+        t.Errorf("SessionID(), ID(), Connected() = %v, %v, %v", c.SessionID(), c.Socket().ID(), c.Socket().Connected())
+    }
+    if m := next(t, ch); m.Event != "connect" {
+        t.Errorf("event = %q, want connect", m.Event)
+    }
+}
+
+func TestClient_Connect_refused(t *testing.T) {
+    s := newServer(t)
+    w := &plugin.Ws{}
+    w.SetUrl("ws", s.srv.Host, "/socket.io/")
+    c := NewClient(w, Config{Auth: map[string]string{"token": "wrong"}})
+    err := c.Connect(context.Background())
+    if !errors.Is(err, plugin.ErrInitRejected) || !strings.Contains(err.Error(), "not authorized") {
+        t.Errorf("Connect() error = %v, want the CONNECT_ERROR to reject the init", err)
+    }
+}
+
+func TestSocket_Emit(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, nil)
+    handler, ch := collect()
+    c.Socket().On("echo", handler)
+    if err := c.Socket().Emit("echo", "hello", map[string]int{"n": 1}); err != nil {
+        t.Fatal(err)
+    }
+    m := next(t, ch)
+    var text string
+    var obj struct{ N int }
+    if m.Event != "echo" || m.Arg(0, &text) != nil || m.Arg(1, &obj) != nil || text != "hello" || obj.N != 1 {
+        t.Errorf("message = %+v", m)
+    }
+    if m.WantsAck() {
+        t.Error("WantsAck() = true for an event without an ack id")
+    }
+}
+
+func TestSocket_EmitWithAck(t *testing.T) {
+    s := newServer(t)
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    c, _ := newTestClient(t, s, Config{Clock: clock, AckTimeout: time.Second}, nil)
+    m, err := c.Socket().EmitWithAck(context.Background(), "echo", "a", 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(m.Args, []json.RawMessage{json.RawMessage(`"a"`), json.RawMessage(`2`)}) {
+        t.Errorf("ack = %s", m.Args)
+    }
+    s.waitFor(t, `1 event / ["echo","a",2] 0`)
+
+    done := make(chan error, 1)
+    go func() {
+        _, err := c.Socket().EmitWithAck(context.Background(), "ignore")
+        done <- err
+    }()
+    // the ping watch and the ack wait
+    clock.BlockUntil(2)
+    clock.Advance(time.Second)
+    if err := <-done; !errors.Is(err, ErrAckTimeout) {
+        t.Errorf("EmitWithAck() error = %v, want %v", err, ErrAckTimeout)
+    }
+}
+
+func TestMessage_Ack(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, nil)
+    c.Socket().On("question", func(m *Message) {
+        if !m.WantsAck() {
+            t.Error("WantsAck() = false")
+        }
+        _ = m.Ack("yes", []byte{9})
+    })
+    if err := c.Socket().Emit("ask"); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, `1 ack / 7 ["yes",{"_placeholder":true,"num":0}]`)
+}
+
+func TestSocket_binary(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, nil)
+    handler, ch := collect()
+    c.Socket().On("echo", handler)
+    m, err := c.Socket().EmitWithAck(context.Background(), "echo", []byte{1, 2, 3}, "name", []byte{4})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if b, ok := m.Bytes(2); !ok || !reflect.DeepEqual(b, []byte{4}) {
+        t.Errorf("ack attachment = %v, %v", b, ok)
+    }
+    s.waitFor(t, `1 event / ["echo",{"_placeholder":true,"num":0},"name",{"_placeholder":true,"num":1}] 2`)
+    e := next(t, ch)
+    if b, ok := e.Bytes(0); !ok || !reflect.DeepEqual(b, []byte{1, 2, 3}) {
+        t.Errorf("event attachment = %v, %v", b, ok)
+    }
+    if _, ok := e.Bytes(1); ok {
+        t.Error("Bytes() found an attachment for a plain argument")
+    }
+}
+
+func TestSocket_namespaces(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, nil)
+    private := c.Of("/private")
+    var ce *ConnectError
+    if err := private.Connect(context.Background(), map[string]string{"token": "wrong"}); !errors.As(err, &ce) || ce.Message != "not authorized" {
+        t.Errorf("Connect() error = %v, want a ConnectError", err)
+    }
+    if err := private.Connect(context.Background(), map[string]string{"token": "secret"}); err != nil {
+        t.Fatal(err)
+    }
+    if private.ID() != "s/private-1" {
+        t.Errorf("ID() = %q", private.ID())
+    }
+    handler, ch := collect()
+    private.On("disconnect", handler)
+    if err := private.Emit("kick"); err != nil {
+        t.Fatal(err)
+    }
+    if m := next(t, ch); m.Event != "disconnect" || private.Connected() {
+        t.Errorf("event = %q, Connected() = %v", m.Event, private.Connected())
+    }
+    if _, err := private.EmitWithAck(context.Background(), "echo"); !errors.Is(err, ErrNotConnected) {
+        t.Errorf("EmitWithAck() error = %v, want %v", err, ErrNotConnected)
+    }
+    if err := c.Of("/other").Disconnect(); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, "1 disconnect /other")
+}
+
+func TestClient_pong(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, nil)
+    if err := c.Socket().Emit("ping"); err != nil {
+        t.Fatal(err)
+    }
+    s.waitFor(t, "1 pong")
+}
+
+func TestClient_pingTimeout(t *testing.T) {
+    s := newServer(t)
+    s.pingInterval, s.pingTimeout = 1000, 500
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    c, _ := newTestClient(t, s, Config{Clock: clock}, nil)
+    clock.BlockUntil(1)
+    clock.Advance(1500 * time.Millisecond)
+    deadline := time.Now().Add(5 * time.Second)
+    for c.Err() == nil && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if !errors.Is(c.Err(), ErrPingTimeout) {
+        t.Errorf("Err() = %v, want %v", c.Err(), ErrPingTimeout)
+    }
+}
+
+func TestClient_reconnect(t *testing.T) {
+    s := newServer(t)
+    c, _ := newTestClient(t, s, Config{}, func(c *Client, w *plugin.Ws) { w.Reconnect(true) })
+    private := c.Of("/private")
+    if err := private.Connect(context.Background(), map[string]string{"token": "secret"}); err != nil {
+        t.Fatal(err)
+    }
+    s.srv.CloseConnections()
+    s.waitFor(t, `2 connect / {"token":"secret"}`)
+    s.waitFor(t, `2 connect /private {"token":"secret"}`)
+    deadline := time.Now().Add(5 * time.Second)
+    for private.ID() != "s/private-2" && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if !private.Connected() || private.ID() != "s/private-2" || c.SessionID() != "e-2" {
+        t.Errorf("Connected(), ID(), SessionID() = %v, %v, %v", private.Connected(), private.ID(), c.SessionID())
+    }
+}
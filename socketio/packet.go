@@ -0,0 +1,152 @@
+// Package socketio is a Socket.IO v4 client on top of the plugin, it speaks Engine.IO v4 over the websocket transport
+package socketio
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Engine.IO packet types, they are the first character of a text message
+const (
+    EngineOpen    byte = '0'
+    EngineClose   byte = '1'
+    EnginePing    byte = '2'
+    EnginePong    byte = '3'
+    EngineMessage byte = '4'
+    EngineUpgrade byte = '5'
+    EngineNoop    byte = '6'
+)
+
+// Socket.IO packet types
+const (
+    PacketConnect      = 0
+    PacketDisconnect   = 1
+    PacketEvent        = 2
+    PacketAck          = 3
+    PacketConnectError = 4
+    PacketBinaryEvent  = 5
+    PacketBinaryAck    = 6
+)
+
+// NoID is the ID of a packet that does not ask for an ack
+const NoID = -1
+
+// ErrBadPacket is returned when a packet can not be decoded
+var ErrBadPacket = errors.New("socketio: bad packet")
+
+// Packet is a Socket.IO packet, binary packets carry their attachments in Binary
+type Packet struct {
+    Type      int
+    Namespace string
+    ID        int64
+    Data      json.RawMessage
+
+    // Attachments is the number of binary attachments announced by a binary packet
+    Attachments int
+    Binary      [][]byte
+}
+
+// Encode the packet without the Engine.IO message type, the attachments are sent as separate binary messages
+func (p *Packet) Encode() string {
+    var b strings.Builder
+    b.WriteString(strconv.Itoa(p.Type))
+    if p.Type == PacketBinaryEvent || p.Type == PacketBinaryAck {
+        b.WriteString(strconv.Itoa(len(p.Binary)))
+        b.WriteByte('-')
+    }
+    if p.Namespace != "" && p.Namespace != "/" {
+        b.WriteString(p.Namespace)
+        b.WriteByte(',')
+    }
+    if p.ID >= 0 {
+        b.WriteString(strconv.FormatInt(p.ID, 10))
+    }
+    b.Write(p.Data)
+    return b.String()
+}
+
+// Decode a packet from the text after the Engine.IO message type, the namespace is / when it is not given
+func Decode(s string) (*Packet, error) {
+    if s == "" || s[0] < '0' || s[0] > '6' {
+        return nil, fmt.Errorf("%w: %q", ErrBadPacket, s)
+    }
+    p := &Packet{Type: int(s[0] - '0'), Namespace: "/", ID: NoID}
+    s = s[1:]
+    if p.Type == PacketBinaryEvent || p.Type == PacketBinaryAck {
+        i := strings.IndexByte(s, '-')
+        if i < 0 {
+            return nil, fmt.Errorf("%w: missing attachment count", ErrBadPacket)
+        }
+        n, err := strconv.Atoi(s[:i])
+        if err != nil || n < 0 {
+            return nil, fmt.Errorf("%w: bad attachment count", ErrBadPacket)
+        }
+        p.Attachments = n
+        s = s[i+1:]
+    }
+    if strings.HasPrefix(s, "/") {
+        i := strings.IndexByte(s, ',')
+        if i < 0 {
+            p.Namespace, s = s, ""
+        } else {
+            p.Namespace, s = s[:i], s[i+1:]
+        }
+    }
+    i := 0
+    for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+        i++
+    }
+    if i > 0 {
+        id, err := strconv.ParseInt(s[:i], 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("%w: bad ack id", ErrBadPacket)
+        }
+        p.ID = id
+        s = s[i:]
+    }
+    if s != "" {
+        if !json.Valid([]byte(s)) {
+            return nil, fmt.Errorf("%w: data is not json", ErrBadPacket)
+        }
+        p.Data = json.RawMessage(s)
+    }
+    return p, nil
+}
+
+// placeholder marks the position of a binary attachment in the data of a packet
+type placeholder struct {
+    Placeholder bool `json:"_placeholder"`
+    Num         int  `json:"num"`
+}
+
+// encodeArgs build the json array of an event or ack, []byte arguments become attachments
+func encodeArgs(args []interface{}) (json.RawMessage, [][]byte, error) {
+    var binary [][]byte
+    values := make([]interface{}, len(args))
+    for i, a := range args {
+        if b, ok := a.([]byte); ok {
+            values[i] = placeholder{Placeholder: true, Num: len(binary)}
+            binary = append(binary, b)
+            continue
+        }
+        values[i] = a
+    }
+    data, err := json.Marshal(values)
+    return data, binary, err
+}
+
+// attachment return the attachment an argument is a placeholder for
+func attachment(arg json.RawMessage, binary [][]byte) ([]byte, bool) {
+    if !bytes.Contains(arg, []byte(`"_placeholder"`)) {
+        return nil, false
+    }
+    var ph placeholder
+    if err := json.Unmarshal(arg, &ph); err != nil || !ph.Placeholder || ph.Num < 0 || ph.Num >= len(binary) {
+        return nil, false
+    }
+    return binary[ph.Num], true
+}
@@ -0,0 +1,88 @@
+package socketio
+
+import (
+    "encoding/json"
+    "errors"
+    "reflect"
+    "testing"
+)
+
+func TestPacket_Encode(t *testing.T) {
+    tests := []struct {
+        name   string
+        packet Packet
+        want   string
+    }{
+        {name: "connect", packet: Packet{Type: PacketConnect, ID: NoID}, want: "0"},
+        {name: "connect with auth", packet: Packet{Type: PacketConnect, Namespace: "/admin", ID: NoID, Data: json.RawMessage(`{"token":"x"}`)}, want: `0/admin,{"token":"x"}`},
+        {name: "event", packet: Packet{Type: PacketEvent, Namespace: "/", ID: NoID, Data: json.RawMessage(`["hello",1]`)}, want: `2["hello",1]`},
+        {name: "event with ack id", packet: Packet{Type: PacketEvent, ID: 12, Data: json.RawMessage(`["hello"]`)}, want: `212["hello"]`},
+        {name: "ack in namespace", packet: Packet{Type: PacketAck, Namespace: "/admin", ID: 0, Data: json.RawMessage(`[]`)}, want: `3/admin,0[]`},
+        {name: "binary event", packet: Packet{Type: PacketBinaryEvent, ID: NoID, Data: json.RawMessage(`["up",{"_placeholder":true,"num":0}]`), Binary: [][]byte{{1}}},
+            want: `51-["up",{"_placeholder":true,"num":0}]`},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := tt.packet.Encode(); got != tt.want {
+                t.Errorf("Encode() = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestDecode(t *testing.T) {
+    tests := []struct {
+        name    string
+        data    string
+        want    *Packet
+        wantErr bool
+    }{
+        {name: "connect", data: `0{"sid":"a"}`, want: &Packet{Type: PacketConnect, Namespace: "/", ID: NoID, Data: json.RawMessage(`{"sid":"a"}`)}},
+        {name: "disconnect namespace", data: "1/admin,", want: &Packet{Type: PacketDisconnect, Namespace: "/admin", ID: NoID}},
+        {name: "namespace without comma", data: "1/admin", want: &Packet{Type: PacketDisconnect, Namespace: "/admin", ID: NoID}},
+        {name: "event with ack id", data: `2/admin,7["a"]`, want: &Packet{Type: PacketEvent, Namespace: "/admin", ID: 7, Data: json.RawMessage(`["a"]`)}},
+        {name: "ack id 0", data: `30["ok"]`, want: &Packet{Type: PacketAck, Namespace: "/", ID: 0, Data: json.RawMessage(`["ok"]`)}},
+        {name: "binary ack", data: `62-/x,3[{"_placeholder":true,"num":0},{"_placeholder":true,"num":1}]`,
+            want: &Packet{Type: PacketBinaryAck, Namespace: "/x", ID: 3, Attachments: 2, Data: json.RawMessage(`[{"_placeholder":true,"num":0},{"_placeholder":true,"num":1}]`)}},
+        {name: "empty", data: "", wantErr: true},
+        {name: "unknown type", data: "9", wantErr: true},
+        {name: "missing attachment count", data: `5["a"]`, wantErr: true},
+        {name: "bad json", data: `2["a"`, wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := Decode(tt.data)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+            }
+            if tt.wantErr {
+                if !errors.Is(err, ErrBadPacket) {
+                    t.Errorf("Decode() error = %v, want %v", err, ErrBadPacket)
+                }
+                return
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("Decode() = %+v, want %+v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestEncodeArgs(t *testing.T) {
+    data, binary, err := encodeArgs([]interface{}{"file", []byte{1, 2}, map[string]int{"n": 1}, []byte{3}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := `["file",{"_placeholder":true,"num":0},{"n":1},{"_placeholder":true,"num":1}]`
+    if string(data) != want || !reflect.DeepEqual(binary, [][]byte{{1, 2}, {3}}) {
+        t.Errorf("encodeArgs() = %s, %v", data, binary)
+    }
+    var args []json.RawMessage
+    _ = json.Unmarshal(data, &args)
+    if b, ok := attachment(args[3], binary); !ok || !reflect.DeepEqual(b, []byte{3}) {
+        t.Errorf("attachment() = %v, %v", b, ok)
+    }
+    if _, ok := attachment(args[2], binary); ok {
+        t.Error("attachment() found an attachment for a plain argument")
+    }
+}
@@ -0,0 +1,644 @@
+package stomp
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+var (
+    // ErrReceiptTimeout is returned when the server did not confirm a frame in time
+    ErrReceiptTimeout = errors.New("stomp: receipt timed out")
+
+    // ErrHeartbeatTimeout is the error of a client that stopped hearing from the server
+    ErrHeartbeatTimeout = errors.New("stomp: heart-beat timed out")
+
+    // ErrClientClosed is returned after Disconnect
+    ErrClientClosed = errors.New("stomp: client closed")
+)
+
+// AckMode of a subscription
+type AckMode string
+
+const (
+    AckAuto             AckMode = "auto"
+    AckClient           AckMode = "client"
+    AckClientIndividual AckMode = "client-individual"
+)
+
+// ServerError is an ERROR frame sent by the server
+type ServerError struct {
+    Message string
+    Frame   Frame
+}
+
+func (e *ServerError) Error() string {
+    if len(e.Frame.Body) > 0 {
+        return fmt.Sprintf("stomp: server error: %s: %s", e.Message, e.Frame.Body)
+    }
+    return "stomp: server error: " + e.Message
+}
+
+// Config of a Client
+type Config struct {
+    // Host is the virtual host sent in the CONNECT frame, "/" is used when it is empty
+    Host string
+
+    // Login and Passcode are sent when Login is not empty
+    Login    string
+    Passcode string
+
+    // Header is added to the CONNECT frame
+    Header map[string]string
+
+    // HeartBeatSend is how often the client can send heart-beats and HeartBeatReceive how often it wants them,
+    // the intervals used are negotiated with the server, 0 disables that direction
+    HeartBeatSend    time.Duration
+    HeartBeatReceive time.Duration
+
+    // Receipts asks the server to confirm every frame and makes the methods wait for the confirmation
+    Receipts bool
+
+    // ReceiptTimeout is how long to wait for a receipt, 0 waits 10 seconds
+    ReceiptTimeout time.Duration
+
+    // ConnectTimeout is how long to wait for CONNECTED, 0 waits 30 seconds
+    ConnectTimeout time.Duration
+
+    // OnError is called for ERROR frames that do not answer a receipt, it must not block
+    OnError func(err *ServerError)
+
+    // Clock is used for heart-beats and receipt timeouts, the system clock is used when it is nil
+    Clock plugin.Clock
+}
+
+// Client speaks STOMP over a Ws, it restores its subscriptions whenever the Ws makes a new connection
+type Client struct {
+    w     *plugin.Ws
+    cfg   Config
+    clock plugin.Clock
+
+    // writeLock makes sure there is only one writer
+    writeLock sync.Mutex
+
+    lock     sync.Mutex
+    subs     map[string]*Subscription
+    receipts map[string]chan error
+    nextID   uint64
+    version  string
+    session  string
+    server   string
+    err      error
+    running  bool
+    closed   bool
+    stop     chan struct{}
+
+    // negotiated heart-beat intervals, the time frames were last seen and the connection they belong to
+    sendEvery   time.Duration
+    expectEvery time.Duration
+    lastRead    time.Time
+    lastWrite   time.Time
+    gen         uint64
+    timedOut    bool
+}
+
+// Subscription to a destination
+type Subscription struct {
+    ID          string
+    Destination string
+    Ack         AckMode
+
+    client  *Client
+    header  map[string]string
+    handler func(m *Message)
+}
+
+// Message is a MESSAGE frame received for a subscription
+type Message struct {
+    Frame
+    Subscription *Subscription
+}
+
+// Destination of the message
+func (m *Message) Destination() string {
+    return m.Get("destination")
+}
+
+// Ack acknowledge the message, it is not needed for subscriptions in auto mode
+func (m *Message) Ack() error {
+    return m.Subscription.client.ack(CmdAck, m, "")
+}
+
+// Nack tell the server the message was not consumed
+func (m *Message) Nack() error {
+    return m.Subscription.client.ack(CmdNack, m, "")
+}
+
+// NewClient create a client for w, the CONNECT frame is sent as the init exchange of w
+// and the OnConnect hook of w is wrapped to restore subscriptions
+func NewClient(w *plugin.Ws, cfg Config) *Client {
+    if cfg.Host == "" {
+        cfg.Host = "/"
+    }
+    if cfg.ReceiptTimeout <= 0 {
+        cfg.ReceiptTimeout = 10 * time.Second
+    }
+    if cfg.Clock == nil {
+        cfg.Clock = plugin.SystemClock
+    }
+    c := &Client{
+        w:        w,
+        cfg:      cfg,
+        clock:    cfg.Clock,
+        subs:     map[string]*Subscription{},
+        receipts: map[string]chan error{},
+        stop:     make(chan struct{}),
+    }
+    w.SetInitExchange(plugin.InitExchange{
+        Messages: [][]byte{c.connectFrame().Encode()},
+        Accept:   c.accept,
+        Timeout:  cfg.ConnectTimeout,
+    })
+    hooks := w.Hooks()
+    next := hooks.OnConnect
+    hooks.OnConnect = func(w *plugin.Ws, info plugin.ConnectInfo) error {
+        c.restore()
+        if next != nil {
+            return next(w, info)
+        }
+        return nil
+    }
+    w.SetHooks(hooks)
+    return c
+}
+
+// Connect make the connection and start reading frames
+func (c *Client) Connect(ctx context.Context) error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return ErrClientClosed
+    }
+    c.lock.Unlock()
+    if err := c.w.ConnectContext(ctx); err != nil {
+        return err
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.err = nil
+    if !c.running {
+        c.running = true
+        go c.readLoop()
+    }
+    return nil
+}
+
+// Version return the protocol version the server agreed on
+func (c *Client) Version() string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.version
+}
+
+// Session return the session id of the current connection
+func (c *Client) Session() string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.session
+}
+
+// Server return the server header of the current connection
+func (c *Client) Server() string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.server
+}
+
+// Err return why the client stopped reading, it is nil while it runs
+func (c *Client) Err() error {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.err
+}
+
+// Subscribe to a destination, handler is called for every message on the goroutine that reads frames,
+// so it must not wait for receipts, header is added to the SUBSCRIBE frame
+func (c *Client) Subscribe(destination string, ack AckMode, header map[string]string, handler func(m *Message)) (*Subscription, error) {
+    if ack == "" {
+        ack = AckAuto
+    }
+    s := &Subscription{Destination: destination, Ack: ack, client: c, header: header, handler: handler}
+    c.lock.Lock()
+    s.ID = c.id("sub")
+    c.subs[s.ID] = s
+    c.lock.Unlock()
+    if err := c.request(s.frame()); err != nil {
+        c.lock.Lock()
+        delete(c.subs, s.ID)
+        c.lock.Unlock()
+        return nil, err
+    }
+    return s, nil
+}
+
+// Unsubscribe stop the subscription, it is not restored after a reconnect
+func (s *Subscription) Unsubscribe() error {
+    c := s.client
+    c.lock.Lock()
+    delete(c.subs, s.ID)
+    c.lock.Unlock()
+    return c.request(NewFrame(CmdUnsubscribe, "id", s.ID))
+}
+
+// frame return the SUBSCRIBE frame of the subscription
+func (s *Subscription) frame() Frame {
+    f := NewFrame(CmdSubscribe)
+    for k, v := range s.header {
+        f.Header[k] = v
+    }
+    f.Header["id"] = s.ID
+    f.Header["destination"] = s.Destination
+    f.Header["ack"] = string(s.Ack)
+    return f
+}
+
+// Send a message to a destination, header is added to the SEND frame
+func (c *Client) Send(destination string, body []byte, header map[string]string) error {
+    return c.send(destination, body, header, "")
+}
+
+func (c *Client) send(destination string, body []byte, header map[string]string, tx string) error {
+    f := NewFrame(CmdSend)
+    for k, v := range header {
+        f.Header[k] = v
+    }
+    f.Header["destination"] = destination
+    if tx != "" {
+        f.Header["transaction"] = tx
+    }
+    f.Body = body
+    return c.request(f)
+}
+
+// ack send an ACK or NACK for a message
+func (c *Client) ack(command string, m *Message, tx string) error {
+    f := NewFrame(command, "id", m.Get("ack"))
+    if tx != "" {
+        f.Header["transaction"] = tx
+    }
+    return c.request(f)
+}
+
+// Tx is a transaction, frames sent through it are applied when it is committed
+type Tx struct {
+    ID     string
+    client *Client
+}
+
+// Begin a transaction
+func (c *Client) Begin() (*Tx, error) {
+    c.lock.Lock()
+    tx := &Tx{ID: c.id("tx"), client: c}
+    c.lock.Unlock()
+    if err := c.request(NewFrame(CmdBegin, "transaction", tx.ID)); err != nil {
+        return nil, err
+    }
+    return tx, nil
+}
+
+// Send a message as part of the transaction
+func (tx *Tx) Send(destination string, body []byte, header map[string]string) error {
+    return tx.client.send(destination, body, header, tx.ID)
+}
+
+// Ack a message as part of the transaction
+func (tx *Tx) Ack(m *Message) error {
+    return tx.client.ack(CmdAck, m, tx.ID)
+}
+
+// Nack a message as part of the transaction
+func (tx *Tx) Nack(m *Message) error {
+    return tx.client.ack(CmdNack, m, tx.ID)
+}
+
+// Commit the transaction
+func (tx *Tx) Commit() error {
+    return tx.client.request(NewFrame(CmdCommit, "transaction", tx.ID))
+}
+
+// Abort the transaction
+func (tx *Tx) Abort() error {
+    return tx.client.request(NewFrame(CmdAbort, "transaction", tx.ID))
+}
+
+// Disconnect send DISCONNECT, wait for its receipt and close the connection
+func (c *Client) Disconnect() error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil
+    }
+    c.closed = true
+    close(c.stop)
+    c.lock.Unlock()
+    err := c.withReceipt(NewFrame(CmdDisconnect))
+    if cerr := c.w.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// request send a frame and wait for its receipt when receipts are enabled
+func (c *Client) request(f Frame) error {
+    if c.cfg.Receipts {
+        return c.withReceipt(f)
+    }
+    return c.write(f.Encode())
+}
+
+// withReceipt send a frame with a receipt header and wait for the RECEIPT or ERROR that answers it
+func (c *Client) withReceipt(f Frame) error {
+    ch := make(chan error, 1)
+    c.lock.Lock()
+    id := c.id("receipt")
+    c.receipts[id] = ch
+    c.lock.Unlock()
+    defer func() {
+        c.lock.Lock()
+        delete(c.receipts, id)
+        c.lock.Unlock()
+    }()
+    f.Header["receipt"] = id
+    if err := c.write(f.Encode()); err != nil {
+        return err
+    }
+    timer := c.clock.NewTimer(c.cfg.ReceiptTimeout)
+    defer timer.Stop()
+    select {
+    case err := <-ch:
+        return err
+    case <-timer.C():
+        return fmt.Errorf("%w: %s %s", ErrReceiptTimeout, f.Command, id)
+    }
+}
+
+// write a message, heart-beats are a single newline
+func (c *Client) write(data []byte) error {
+    c.writeLock.Lock()
+    defer c.writeLock.Unlock()
+    if err := c.w.WriteMessage(websocket.TextMessage, data); err != nil {
+        return err
+    }
+    c.lock.Lock()
+    c.lastWrite = c.clock.Now()
+    c.lock.Unlock()
+    return nil
+}
+
+// id return a new id with a prefix, the lock must be held
+func (c *Client) id(prefix string) string {
+    c.nextID++
+    return prefix + "-" + strconv.FormatUint(c.nextID, 10)
+}
+
+// connectFrame build the CONNECT frame from the config
+func (c *Client) connectFrame() Frame {
+    f := NewFrame(CmdConnect)
+    for k, v := range c.cfg.Header {
+        f.Header[k] = v
+    }
+    f.Header["accept-version"] = "1.2"
+    f.Header["host"] = c.cfg.Host
+    if c.cfg.Login != "" {
+        f.Header["login"] = c.cfg.Login
+        f.Header["passcode"] = c.cfg.Passcode
+    }
+    f.Header["heart-beat"] = fmt.Sprintf("%d,%d", c.cfg.HeartBeatSend.Milliseconds(), c.cfg.HeartBeatReceive.Milliseconds())
+    return f
+}
+
+// accept wait for the CONNECTED frame during the init exchange
+func (c *Client) accept(messageType int, data []byte) (bool, error) {
+    frames, err := Decode(data)
+    if err != nil {
+        return false, err
+    }
+    for _, f := range frames {
+        switch f.Command {
+        case CmdConnected:
+            c.connected(f)
+            return true, nil
+        case CmdError:
+            return false, &ServerError{Message: f.Get("message"), Frame: f}
+        }
+    }
+    return false, nil
+}
+
+// connected store the session and negotiate the heart-beat intervals
+func (c *Client) connected(f Frame) {
+    sx, sy := parseHeartBeat(f.Get("heart-beat"))
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.version = f.Get("version")
+    c.session = f.Get("session")
+    c.server = f.Get("server")
+    c.sendEvery = negotiate(c.cfg.HeartBeatSend, sy)
+    c.expectEvery = negotiate(c.cfg.HeartBeatReceive, sx)
+}
+
+// restore resubscribe after a new connection and start its heart-beats, the frames are sent from another
+// goroutine because a write that reconnected still holds the write lock
+func (c *Client) restore() {
+    c.lock.Lock()
+    c.gen++
+    gen := c.gen
+    c.timedOut = false
+    c.lastRead = c.clock.Now()
+    c.lastWrite = c.lastRead
+    subs := make([]*Subscription, 0, len(c.subs))
+    for _, s := range c.subs {
+        subs = append(subs, s)
+    }
+    c.lock.Unlock()
+    sort.Slice(subs, func(i, j int) bool { return idNumber(subs[i].ID) < idNumber(subs[j].ID) })
+    if len(subs) > 0 {
+        go func() {
+            for _, s := range subs {
+                c.lock.Lock()
+                current := c.gen == gen && c.subs[s.ID] == s
+                c.lock.Unlock()
+                if !current {
+                    continue
+                }
+                if c.write(s.frame().Encode()) != nil {
+                    return
+                }
+            }
+        }()
+    }
+    go c.heartbeat(gen)
+}
+
+// readLoop read frames until the connection fails and is not made again
+func (c *Client) readLoop() {
+    for {
+        conn := c.w.ConnID()
+        _, d, err := c.w.Read()
+        if err != nil {
+            c.lock.Lock()
+            stopped := c.closed || c.timedOut
+            c.lock.Unlock()
+            if !stopped && c.w.Reconnected(conn) {
+                // the plugin reconnected while reading
+                continue
+            }
+            c.fail(err)
+            return
+        }
+        c.lock.Lock()
+        c.lastRead = c.clock.Now()
+        c.lock.Unlock()
+        frames, err := Decode(d)
+        for _, f := range frames {
+            c.dispatch(f)
+        }
+        if err != nil && c.cfg.OnError != nil {
+            c.cfg.OnError(&ServerError{Message: err.Error()})
+        }
+    }
+}
+
+// dispatch a frame received from the server
+func (c *Client) dispatch(f Frame) {
+    switch f.Command {
+    case CmdMessage:
+        c.lock.Lock()
+        s := c.subs[f.Get("subscription")]
+        c.lock.Unlock()
+        if s != nil && s.handler != nil {
+            s.handler(&Message{Frame: f, Subscription: s})
+        }
+    case CmdReceipt:
+        c.answer(f.Get("receipt-id"), nil)
+    case CmdError:
+        err := &ServerError{Message: f.Get("message"), Frame: f}
+        if !c.answer(f.Get("receipt-id"), err) && c.cfg.OnError != nil {
+            c.cfg.OnError(err)
+        }
+    }
+}
+
+// answer pass the result for a receipt to the waiting request
+func (c *Client) answer(id string, err error) bool {
+    if id == "" {
+        return false
+    }
+    c.lock.Lock()
+    ch, ok := c.receipts[id]
+    c.lock.Unlock()
+    if ok {
+        ch <- err
+    }
+    return ok
+}
+
+// fail stop reading and fail the requests that wait for a receipt
+func (c *Client) fail(err error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.timedOut {
+        err = ErrHeartbeatTimeout
+    } else if c.closed {
+        err = ErrClientClosed
+    }
+    c.err = err
+    c.running = false
+    c.gen++
+    for id, ch := range c.receipts {
+        select {
+        case ch <- err:
+        default:
+        }
+        delete(c.receipts, id)
+    }
+}
+
+// heartbeat send heart-beats and drop the connection when the server stays silent for twice its interval
+func (c *Client) heartbeat(gen uint64) {
+    for {
+        c.lock.Lock()
+        send, expect, current := c.sendEvery, c.expectEvery, c.gen
+        c.lock.Unlock()
+        if current != gen || (send == 0 && expect == 0) {
+            return
+        }
+        tick := send
+        if tick == 0 || (expect > 0 && expect < tick) {
+            tick = expect
+        }
+        timer := c.clock.NewTimer(tick)
+        select {
+        case <-timer.C():
+        case <-c.stop:
+            timer.Stop()
+            return
+        }
+        now := c.clock.Now()
+        c.lock.Lock()
+        if c.gen != gen {
+            c.lock.Unlock()
+            return
+        }
+        silent := expect > 0 && now.Sub(c.lastRead) > 2*expect
+        idle := send > 0 && now.Sub(c.lastWrite) >= send
+        if silent {
+            c.timedOut = true
+        }
+        c.lock.Unlock()
+        if silent {
+            // a dropped connection is reconnected when the plugin reconnects
+            _ = c.w.Drop()
+            return
+        }
+        if idle {
+            _ = c.write([]byte("\n"))
+        }
+    }
+}
+
+// parseHeartBeat parse a heart-beat header, invalid values are 0
+func parseHeartBeat(h string) (time.Duration, time.Duration) {
+    parts := strings.SplitN(h, ",", 2)
+    if len(parts) != 2 {
+        return 0, 0
+    }
+    x, _ := strconv.Atoi(strings.TrimSpace(parts[0]))
+    y, _ := strconv.Atoi(strings.TrimSpace(parts[1]))
+    return time.Duration(x) * time.Millisecond, time.Duration(y) * time.Millisecond
+}
+
+// negotiate the interval of one direction, it is 0 when either side does not want it
+func negotiate(ours, theirs time.Duration) time.Duration {
+    if ours <= 0 || theirs <= 0 {
+        return 0
+    }
+    if theirs > ours {
+        return theirs
+    }
+    return ours
+}
+
+// idNumber return the number at the end of an id
+func idNumber(id string) uint64 {
+    n, _ := strconv.ParseUint(id[strings.LastIndexByte(id, '-')+1:], 10, 64)
+    return n
+}
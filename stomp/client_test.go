@@ -0,0 +1,543 @@
+package stomp
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+// broker is a small STOMP server for the tests, SEND is delivered to the subscriptions of the same
+// connection, /error answers with an ERROR, /ignore is not answered and /drop ends the connection
+type broker struct {
+    heartBeat string
+
+    lock   sync.Mutex
+    frames []string
+}
+
+// log a received frame as "conn command key=value"
+func (b *broker) log(c *wstest.Conn, f Frame, keys ...string) {
+    s := fmt.Sprintf("%d %s", c.Index, f.Command)
+    for _, k := range keys {
+        s += fmt.Sprintf(" %s=%s", k, f.Get(k))
+    }
+    b.lock.Lock()
+    b.frames = append(b.frames, s)
+    b.lock.Unlock()
+}
+
+// wait until the broker logged n frames and return them
+func (b *broker) wait(t *testing.T, n int) []string {
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        b.lock.Lock()
+        if len(b.frames) >= n {
+            frames := append([]string{}, b.frames...)
+            b.lock.Unlock()
+            return frames
+        }
+        b.lock.Unlock()
+        time.Sleep(time.Millisecond)
+    }
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    t.Fatalf("broker got %v, want %d frames", b.frames, n)
+    return nil
+}
+
+// waitFor wait until the broker logged an entry
+func (b *broker) waitFor(t *testing.T, entry string) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        b.lock.Lock()
+        for _, f := range b.frames {
+            if f == entry {
+                b.lock.Unlock()
+                return
+            }
+        }
+        b.lock.Unlock()
+        time.Sleep(time.Millisecond)
+    }
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    t.Fatalf("broker got %v, want %q", b.frames, entry)
+}
+
+func (b *broker) serve(c *wstest.Conn) {
+    subs := map[string]string{}
+    txs := map[string][]Frame{}
+    write := func(f Frame) { _ = c.WriteMessage(websocket.TextMessage, f.Encode()) }
+    deliver := func(f Frame) {
+        for id, dest := range subs {
+            if dest == f.Get("destination") {
+                m := NewFrame(CmdMessage, "subscription", id, "destination", dest, "message-id", "m-"+string(f.Body), "ack", "a-"+string(f.Body))
+                m.Body = f.Body
+                write(m)
+            }
+        }
+    }
+    for {
+        _, d, err := c.Receive()
+        if err != nil {
+            return
+        }
+        frames, err := Decode(d)
+        if err != nil {
+            return
+        }
+        if len(frames) == 0 {
+            b.log(c, Frame{Command: "HEARTBEAT"})
+        }
+        for _, f := range frames {
+            switch f.Command {
+            case CmdConnect:
+                b.log(c, f, "accept-version", "host", "login", "heart-beat")
+                write(NewFrame(CmdConnected, "version", "1.2", "session", fmt.Sprintf("s-%d", c.Index), "server", "broker/1", "heart-beat", b.heartBeat))
+                continue
+            case CmdSubscribe:
+                b.log(c, f, "id", "destination", "ack")
+                subs[f.Get("id")] = f.Get("destination")
+            case CmdUnsubscribe:
+                b.log(c, f, "id")
+                delete(subs, f.Get("id"))
+            case CmdSend:
+                b.log(c, f, "destination", "transaction")
+                switch {
+                case f.Get("destination") == "/error":
+                    write(NewFrame(CmdError, "message", "no such queue", "receipt-id", f.Get("receipt")))
+                    continue
+                case f.Get("destination") == "/ignore":
+                    continue
+                case f.Get("destination") == "/drop":
+                    _ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+                    return
+                case f.Get("transaction") != "":
+                    txs[f.Get("transaction")] = append(txs[f.Get("transaction")], f)
+                default:
+                    deliver(f)
+                }
+            case CmdBegin:
+                b.log(c, f, "transaction")
+            case CmdCommit:
+                b.log(c, f, "transaction")
+                for _, f := range txs[f.Get("transaction")] {
+                    deliver(f)
+                }
+                delete(txs, f.Get("transaction"))
+            case CmdAbort:
+                b.log(c, f, "transaction")
+                delete(txs, f.Get("transaction"))
+            case CmdAck, CmdNack:
+                b.log(c, f, "id", "transaction")
+            case CmdDisconnect:
+                b.log(c, f)
+            }
+            if r := f.Get("receipt"); r != "" {
+                write(NewFrame(CmdReceipt, "receipt-id", r))
+            }
+        }
+    }
+}
+
+// newTestClient start a broker and connect a client to it
+func newTestClient(t *testing.T, b *broker, cfg Config, setup func(w *plugin.Ws)) (*Client, *plugin.Ws) {
+    srv := wstest.NewServer(b.serve)
+    t.Cleanup(srv.Close)
+    w := &plugin.Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    if setup != nil {
+        setup(w)
+    }
+    c := NewClient(w, cfg)
+    if err := c.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { w.Close() })
+    return c, w
+}
+
+// collect return a handler that sends messages to a channel
+func collect() (func(m *Message), chan *Message) {
+    ch := make(chan *Message, 16)
+    return func(m *Message) { ch <- m }, ch
+}
+
+// next wait for a message
+func next(t *testing.T, ch chan *Message) *Message {
+    select {
+    case m := <-ch:
+        return m
+    case <-time.After(5 * time.Second):
+        t.Fatal("no message received")
+        return nil
+    }
+}
+
+func TestClient_Connect(t *testing.T) {
+    b := &broker{heartBeat: "0,0"}
+    c, _ := newTestClient(t, b, Config{Host: "vhost", Login: "guest", Passcode: "secret", HeartBeatSend: time.Second}, nil)
+    if c.Version() != "1.2" || c.Session() != "s-1" || c.Server() != "broker/1" {
+        t.Errorf("Version(), Session(), Server() = %v, %v, %v", c.Version(), c.Session(), c.Server())
+    }
+    want := []string{"1 CONNECT accept-version=1.2 host=vhost login=guest heart-beat=1000,0"}
+    if got := b.wait(t, 1); !reflect.DeepEqual(got, want) {
+        t.Errorf("broker got %v, want %v", got, want)
+    }
+}
+
+func TestClient_Connect_error(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(
+        wstest.Expect(func(int, []byte) error { return nil }),
+        wstest.SendText(string(NewFrame(CmdError, "message", "bad login").Encode())),
+        wstest.Drain(),
+    ))
+    defer srv.Close()
+    w := &plugin.Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    c := NewClient(w, Config{})
+    if err := c.Connect(context.Background()); !errors.Is(err, plugin.ErrInitRejected) || !strings.Contains(err.Error(), "bad login") {
+        t.Errorf("Connect() error = %v, want the ERROR frame to reject the init", err)
+    }
+}
+
+func TestClient_Subscribe(t *testing.T) {
+    tests := []struct {
+        name    string
+        ack     AckMode
+        respond func(m *Message) error
+        want    string
+    }{
+        {name: "auto", ack: AckAuto},
+        {name: "ack", ack: AckClientIndividual, respond: (*Message).Ack, want: "1 ACK id=a-hello transaction="},
+        {name: "nack", ack: AckClient, respond: (*Message).Nack, want: "1 NACK id=a-hello transaction="},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b := &broker{heartBeat: "0,0"}
+            c, _ := newTestClient(t, b, Config{Receipts: true}, nil)
+            handler, ch := collect()
+            s, err := c.Subscribe("/queue/a", tt.ack, nil, handler)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if err := c.Send("/queue/a", []byte("hello"), map[string]string{"content-type": "text/plain"}); err != nil {
+                t.Fatal(err)
+            }
+            m := next(t, ch)
+            if string(m.Body) != "hello" || m.Destination() != "/queue/a" || m.Subscription != s {
+                t.Errorf("message = %+v", m)
+            }
+            frames := b.wait(t, 3)
+            if frames[1] != "1 SUBSCRIBE id="+s.ID+" destination=/queue/a ack="+string(tt.ack) {
+                t.Errorf("broker got %v", frames[1])
+            }
+            if tt.respond == nil {
+                return
+            }
+            if err := tt.respond(m); err != nil {
+                t.Fatal(err)
+            }
+            if got := b.wait(t, 4)[3]; got != tt.want {
+                t.Errorf("broker got %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestClient_Unsubscribe(t *testing.T) {
+    b := &broker{heartBeat: "0,0"}
+    c, _ := newTestClient(t, b, Config{Receipts: true}, nil)
+    handler, ch := collect()
+    s, err := c.Subscribe("/queue/a", AckAuto, nil, handler)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Unsubscribe(); err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Send("/queue/a", []byte("late"), nil); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case m := <-ch:
+        t.Errorf("received %s after Unsubscribe()", m.Body)
+    default:
+    }
+}
+
+func TestClient_transactions(t *testing.T) {
+    tests := []struct {
+        name   string
+        finish func(tx *Tx) error
+        want   []string
+    }{
+        {name: "commit", finish: (*Tx).Commit, want: []string{"1", "2"}},
+        {name: "abort", finish: (*Tx).Abort},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b := &broker{heartBeat: "0,0"}
+            c, _ := newTestClient(t, b, Config{Receipts: true}, nil)
+            handler, ch := collect()
+            if _, err := c.Subscribe("/queue/a", AckAuto, nil, handler); err != nil {
+                t.Fatal(err)
+            }
+            tx, err := c.Begin()
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, body := range []string{"1", "2"} {
+                if err := tx.Send("/queue/a", []byte(body), nil); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            if err := tt.finish(tx); err != nil {
+                t.Fatal(err)
+            }
+            // the receipt of a marker arrives after every message of the transaction
+            if err := c.Send("/queue/b", nil, nil); err != nil {
+                t.Fatal(err)
+            }
+            var got []string
+            for len(ch) > 0 {
+                got = append(got, string((<-ch).Body))
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("received %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestClient_receipts(t *testing.T) {
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    b := &broker{heartBeat: "0,0"}
+    c, _ := newTestClient(t, b, Config{Receipts: true, ReceiptTimeout: 5 * time.Second, Clock: clock}, nil)
+    var se *ServerError
+    if err := c.Send("/error", []byte("x"), nil); !errors.As(err, &se) || se.Message != "no such queue" {
+        t.Errorf("Send() error = %v, want the ERROR frame", err)
+    }
+    done := make(chan error, 1)
+    go func() { done <- c.Send("/ignore", []byte("x"), nil) }()
+    clock.BlockUntil(1)
+    clock.Advance(5 * time.Second)
+    if err := <-done; !errors.Is(err, ErrReceiptTimeout) {
+        t.Errorf("Send() error = %v, want %v", err, ErrReceiptTimeout)
+    }
+}
+
+func TestClient_restoreSubscriptions(t *testing.T) {
+    b := &broker{heartBeat: "0,0"}
+    c, _ := newTestClient(t, b, Config{}, func(w *plugin.Ws) { w.Reconnect(true) })
+    handler, ch := collect()
+    s, err := c.Subscribe("/queue/a", AckClient, nil, handler)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := c.Send("/drop", nil, nil); err != nil {
+        t.Fatal(err)
+    }
+    frames := b.wait(t, 5)
+    want := []string{
+        "1 CONNECT accept-version=1.2 host=/ login= heart-beat=0,0",
+        "1 SUBSCRIBE id=" + s.ID + " destination=/queue/a ack=client",
+        "1 SEND destination=/drop transaction=",
+        "2 CONNECT accept-version=1.2 host=/ login= heart-beat=0,0",
+        "2 SUBSCRIBE id=" + s.ID + " destination=/queue/a ack=client",
+    }
+    if !reflect.DeepEqual(frames, want) {
+        t.Errorf("broker got %v, want %v", frames, want)
+    }
+    if err := c.Send("/queue/a", []byte("again"), nil); err != nil {
+        t.Fatal(err)
+    }
+    if m := next(t, ch); string(m.Body) != "again" {
+        t.Errorf("received %s after the reconnect, want again", m.Body)
+    }
+    if c.Session() != "s-2" {
+        t.Errorf("Session() = %v after the reconnect, want s-2", c.Session())
+    }
+}
+
+// brokenConn fails every write once broken is closed, reads go on as before
+type brokenConn struct {
+    net.Conn
+    broken chan struct{}
+}
+
+func (c *brokenConn) Write(p []byte) (int, error) {
+    select {
+    case <-c.broken:
+        return 0, errors.New("broken pipe")
+    default:
+    }
+    return c.Conn.Write(p)
+}
+
+func TestClient_restoreFromSend(t *testing.T) {
+    b := &broker{heartBeat: "0,0"}
+    broken := make(chan struct{})
+    dialed := 0
+    c, _ := newTestClient(t, b, Config{}, func(w *plugin.Ws) {
+        w.Reconnect(true)
+        w.SetNetDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+            conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+            if dialed++; err != nil || dialed > 1 {
+                return conn, err
+            }
+            return &brokenConn{Conn: conn, broken: broken}, nil
+        })
+    })
+    handler, _ := collect()
+    s, err := c.Subscribe("/queue/a", AckAuto, nil, handler)
+    if err != nil {
+        t.Fatal(err)
+    }
+    b.waitFor(t, "1 SUBSCRIBE id="+s.ID+" destination=/queue/a ack=auto")
+    // the send fails and reconnects, it must not wait for the subscriptions it restores
+    close(broken)
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        _ = c.Send("/queue/b", nil, nil)
+    }()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Send() blocked while the client reconnected")
+    }
+    b.waitFor(t, "2 SUBSCRIBE id="+s.ID+" destination=/queue/a ack=auto")
+}
+
+func TestClient_reconnectWhileSending(t *testing.T) {
+    b := &broker{heartBeat: "0,0"}
+    c, _ := newTestClient(t, b, Config{}, func(w *plugin.Ws) { w.Reconnect(true) })
+    stop := make(chan struct{})
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+                _ = c.Send("/queue/a", []byte("x"), nil)
+            }
+        }
+    }()
+    for i := 2; i <= 4; i++ {
+        _ = c.Send("/drop", nil, nil)
+        deadline := time.Now().Add(5 * time.Second)
+        for c.Session() != fmt.Sprintf("s-%d", i) {
+            if time.Now().After(deadline) {
+                t.Fatalf("Session() = %v, want s-%d after a reconnect", c.Session(), i)
+            }
+            time.Sleep(time.Millisecond)
+        }
+    }
+    close(stop)
+    <-done
+    if err := c.Err(); err != nil {
+        t.Errorf("Err() = %v after the reconnects", err)
+    }
+}
+
+func TestClient_reconnectRejected(t *testing.T) {
+    any := wstest.Expect(func(int, []byte) error { return nil })
+    srv := wstest.NewServer(wstest.Sequence(
+        wstest.Script(any, wstest.SendText(string(NewFrame(CmdConnected, "version", "1.2", "session", "s-1").Encode())), wstest.Drop()),
+        wstest.Script(any, wstest.SendText(string(NewFrame(CmdError, "message", "bad login").Encode())), wstest.Drain()),
+    ))
+    defer srv.Close()
+    w := &plugin.Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    w.Reconnect(true)
+    w.SetMaxReconnectAttempts(1)
+    c := NewClient(w, Config{})
+    if err := c.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+    // the reconnect makes a connection that fails its init exchange, the client gives up with it
+    deadline := time.Now().Add(5 * time.Second)
+    for c.Err() == nil && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if err := c.Err(); !errors.Is(err, plugin.ErrReconnectExhausted) {
+        t.Errorf("Err() = %v, want the reconnect to give up", err)
+    }
+    if got := srv.Connections(); got != 2 {
+        t.Errorf("server got %d connections, want 2", got)
+    }
+}
+
+func TestClient_heartbeat(t *testing.T) {
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    b := &broker{heartBeat: "1000,1000"}
+    c, _ := newTestClient(t, b, Config{HeartBeatSend: time.Second, HeartBeatReceive: 500 * time.Millisecond, Clock: clock}, nil)
+    // the client sends every second and expects the server every second, it gives up after two silent seconds
+    for i := 0; i < 2; i++ {
+        clock.BlockUntil(1)
+        clock.Advance(time.Second)
+    }
+    if got := b.wait(t, 3); got[1] != "1 HEARTBEAT" || got[2] != "1 HEARTBEAT" {
+        t.Errorf("broker got %v, want two heart-beats", got)
+    }
+    clock.BlockUntil(1)
+    clock.Advance(time.Second)
+    deadline := time.Now().Add(5 * time.Second)
+    for c.Err() == nil && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if err := c.Err(); !errors.Is(err, ErrHeartbeatTimeout) {
+        t.Errorf("Err() = %v, want %v", err, ErrHeartbeatTimeout)
+    }
+}
+
+func TestClient_heartbeatReconnect(t *testing.T) {
+    clock := plugin.NewFakeClock(time.Unix(0, 0))
+    b := &broker{heartBeat: "1000,0"}
+    c, _ := newTestClient(t, b, Config{HeartBeatReceive: time.Second, Clock: clock}, func(w *plugin.Ws) { w.Reconnect(true) })
+    // the server stays silent for more than two seconds, the connection is dropped and made again
+    for i := 0; i < 3; i++ {
+        clock.BlockUntil(1)
+        clock.Advance(time.Second)
+    }
+    frames := b.wait(t, 2)
+    if frames[1] != "2 CONNECT accept-version=1.2 host=/ login= heart-beat=0,1000" {
+        t.Errorf("broker got %v, want a second CONNECT", frames)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for c.Session() != "s-2" && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if c.Session() != "s-2" || c.Err() != nil {
+        t.Errorf("Session(), Err() = %v, %v after the heartbeat timeout, want s-2 and no error", c.Session(), c.Err())
+    }
+}
+
+func TestClient_Disconnect(t *testing.T) {
+    b := &broker{heartBeat: "0,0"}
+    c, _ := newTestClient(t, b, Config{}, nil)
+    if err := c.Disconnect(); err != nil {
+        t.Fatal(err)
+    }
+    if got := b.wait(t, 2)[1]; got != "1 DISCONNECT" {
+        t.Errorf("broker got %v, want DISCONNECT", got)
+    }
+    if err := c.Connect(context.Background()); !errors.Is(err, ErrClientClosed) {
+        t.Errorf("Connect() after Disconnect() error = %v, want %v", err, ErrClientClosed)
+    }
+}
@@ -0,0 +1,200 @@
+// Package stomp is a STOMP 1.2 client on top of the plugin, every frame is sent as one websocket text message
+package stomp
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// client and server commands
+const (
+    CmdConnect     = "CONNECT"
+    CmdStomp       = "STOMP"
+    CmdConnected   = "CONNECTED"
+    CmdSend        = "SEND"
+    CmdSubscribe   = "SUBSCRIBE"
+    CmdUnsubscribe = "UNSUBSCRIBE"
+    CmdAck         = "ACK"
+    CmdNack        = "NACK"
+    CmdBegin       = "BEGIN"
+    CmdCommit      = "COMMIT"
+    CmdAbort       = "ABORT"
+    CmdDisconnect  = "DISCONNECT"
+    CmdMessage     = "MESSAGE"
+    CmdReceipt     = "RECEIPT"
+    CmdError       = "ERROR"
+)
+
+// ErrBadFrame is returned when a frame can not be decoded
+var ErrBadFrame = errors.New("stomp: bad frame")
+
+// Frame is a STOMP frame, when a header is repeated only the first value is kept as the spec requires
+type Frame struct {
+    Command string
+    Header  map[string]string
+    Body    []byte
+}
+
+// NewFrame create a frame from a command and header key value pairs
+func NewFrame(command string, kv ...string) Frame {
+    f := Frame{Command: command, Header: map[string]string{}}
+    for i := 0; i+1 < len(kv); i += 2 {
+        f.Header[kv[i]] = kv[i+1]
+    }
+    return f
+}
+
+// Get return a header value
+func (f Frame) Get(key string) string {
+    return f.Header[key]
+}
+
+// escaped return true for frames whose headers are escaped, CONNECT and CONNECTED are not
+func escaped(command string) bool {
+    return command != CmdConnect && command != CmdConnected && command != CmdStomp
+}
+
+var (
+    escaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+    unescapes = map[byte]byte{'\\': '\\', 'r': '\r', 'n': '\n', 'c': ':'}
+)
+
+// Encode the frame, headers are written in sorted order and a content-length is added when the body is not empty
+func (f Frame) Encode() []byte {
+    var b bytes.Buffer
+    b.WriteString(f.Command)
+    b.WriteByte('\n')
+    keys := make([]string, 0, len(f.Header))
+    for k := range f.Header {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    esc := escaped(f.Command)
+    for _, k := range keys {
+        v := f.Header[k]
+        if esc {
+            k, v = escaper.Replace(k), escaper.Replace(v)
+        }
+        b.WriteString(k)
+        b.WriteByte(':')
+        b.WriteString(v)
+        b.WriteByte('\n')
+    }
+    if _, ok := f.Header["content-length"]; !ok && len(f.Body) > 0 {
+        b.WriteString("content-length:")
+        b.WriteString(strconv.Itoa(len(f.Body)))
+        b.WriteByte('\n')
+    }
+    b.WriteByte('\n')
+    b.Write(f.Body)
+    b.WriteByte(0)
+    return b.Bytes()
+}
+
+// Decode every frame in a websocket message, heart-beats between frames are skipped
+func Decode(data []byte) ([]Frame, error) {
+    var frames []Frame
+    for {
+        data = bytes.TrimLeft(data, "\r\n")
+        if len(data) == 0 {
+            return frames, nil
+        }
+        f, rest, err := decode(data)
+        if err != nil {
+            return frames, err
+        }
+        frames = append(frames, f)
+        data = rest
+    }
+}
+
+// decode the first frame of data and return the bytes after it
+func decode(data []byte) (Frame, []byte, error) {
+    f := Frame{Header: map[string]string{}}
+    line, data, ok := cutLine(data)
+    if !ok || line == "" {
+        return f, nil, fmt.Errorf("%w: missing command", ErrBadFrame)
+    }
+    f.Command = line
+    esc := escaped(f.Command)
+    for {
+        if line, data, ok = cutLine(data); !ok {
+            return f, nil, fmt.Errorf("%w: %s: unterminated headers", ErrBadFrame, f.Command)
+        }
+        if line == "" {
+            break
+        }
+        i := strings.IndexByte(line, ':')
+        if i < 0 {
+            return f, nil, fmt.Errorf("%w: %s: header without colon %q", ErrBadFrame, f.Command, line)
+        }
+        k, v := line[:i], line[i+1:]
+        if esc {
+            var err error
+            if k, err = unescape(k); err != nil {
+                return f, nil, err
+            }
+            if v, err = unescape(v); err != nil {
+                return f, nil, err
+            }
+        }
+        if _, seen := f.Header[k]; !seen {
+            f.Header[k] = v
+        }
+    }
+    if cl, ok := f.Header["content-length"]; ok {
+        n, err := strconv.Atoi(cl)
+        if err != nil || n < 0 || n >= len(data) || data[n] != 0 {
+            return f, nil, fmt.Errorf("%w: %s: content-length %q does not match the body", ErrBadFrame, f.Command, cl)
+        }
+        f.Body = data[:n]
+        return f, data[n+1:], nil
+    }
+    i := bytes.IndexByte(data, 0)
+    if i < 0 {
+        return f, nil, fmt.Errorf("%w: %s: body is not terminated", ErrBadFrame, f.Command)
+    }
+    f.Body = data[:i]
+    return f, data[i+1:], nil
+}
+
+// cutLine return the line at the start of data without its \n or \r\n ending
+func cutLine(data []byte) (string, []byte, bool) {
+    i := bytes.IndexByte(data, '\n')
+    if i < 0 {
+        return "", nil, false
+    }
+    line := data[:i]
+    if len(line) > 0 && line[len(line)-1] == '\r' {
+        line = line[:len(line)-1]
+    }
+    return string(line), data[i+1:], true
+}
+
+// unescape a header key or value, undefined escapes are an error
+func unescape(s string) (string, error) {
+    if strings.IndexByte(s, '\\') < 0 {
+        return s, nil
+    }
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        if s[i] != '\\' {
+            b.WriteByte(s[i])
+            continue
+        }
+        i++
+        if i == len(s) {
+            return "", fmt.Errorf("%w: header ends in an escape", ErrBadFrame)
+        }
+        c, ok := unescapes[s[i]]
+        if !ok {
+            return "", fmt.Errorf("%w: undefined escape \\%c", ErrBadFrame, s[i])
+        }
+        b.WriteByte(c)
+    }
+    return b.String(), nil
+}
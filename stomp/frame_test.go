@@ -0,0 +1,82 @@
+package stomp
+
+import (
+    "errors"
+    "reflect"
+    "testing"
+)
+
+func TestFrame_Encode(t *testing.T) {
+    tests := []struct {
+        name  string
+        frame Frame
+        want  string
+    }{
+        {name: "no body", frame: NewFrame(CmdSubscribe, "id", "sub-1", "destination", "/queue/a"), want: "SUBSCRIBE\ndestination:/queue/a\nid:sub-1\n\n\x00"},
+        {name: "body gets a content-length", frame: Frame{Command: CmdSend, Header: map[string]string{"destination": "/q"}, Body: []byte("hi")}, want: "SEND\ndestination:/q\ncontent-length:2\n\nhi\x00"},
+        {name: "escaped header", frame: NewFrame(CmdSend, "a:b", "line\nbreak\\"), want: "SEND\na\\cb:line\\nbreak\\\\\n\n\x00"},
+        {name: "connect is not escaped", frame: NewFrame(CmdConnect, "passcode", "a:b"), want: "CONNECT\npasscode:a:b\n\n\x00"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := string(tt.frame.Encode()); got != tt.want {
+                t.Errorf("Encode() = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestDecode(t *testing.T) {
+    tests := []struct {
+        name    string
+        data    string
+        want    []Frame
+        wantErr bool
+    }{
+        {name: "heart-beat", data: "\n"},
+        {name: "frame", data: "MESSAGE\nsubscription:sub-1\n\nhello\x00", want: []Frame{{Command: CmdMessage, Header: map[string]string{"subscription": "sub-1"}, Body: []byte("hello")}}},
+        {name: "crlf and heart-beats", data: "\r\n\nRECEIPT\r\nreceipt-id:r-1\r\n\r\n\x00\n", want: []Frame{{Command: CmdReceipt, Header: map[string]string{"receipt-id": "r-1"}, Body: []byte{}}}},
+        {name: "content-length keeps nul bytes", data: "MESSAGE\ncontent-length:3\n\na\x00b\x00", want: []Frame{{Command: CmdMessage, Header: map[string]string{"content-length": "3"}, Body: []byte("a\x00b")}}},
+        {name: "first repeated header wins", data: "MESSAGE\nfoo:1\nfoo:2\n\n\x00", want: []Frame{{Command: CmdMessage, Header: map[string]string{"foo": "1"}, Body: []byte{}}}},
+        {name: "unescaped", data: "MESSAGE\na\\cb:c\\nd\n\n\x00", want: []Frame{{Command: CmdMessage, Header: map[string]string{"a:b": "c\nd"}, Body: []byte{}}}},
+        {name: "connected is not unescaped", data: "CONNECTED\nserver:a\\cb\n\n\x00", want: []Frame{{Command: CmdConnected, Header: map[string]string{"server": "a\\cb"}, Body: []byte{}}}},
+        {name: "two frames", data: "RECEIPT\nreceipt-id:1\n\n\x00RECEIPT\nreceipt-id:2\n\n\x00", want: []Frame{
+            {Command: CmdReceipt, Header: map[string]string{"receipt-id": "1"}, Body: []byte{}},
+            {Command: CmdReceipt, Header: map[string]string{"receipt-id": "2"}, Body: []byte{}},
+        }},
+        {name: "undefined escape", data: "MESSAGE\na:\\t\n\n\x00", wantErr: true},
+        {name: "missing nul", data: "MESSAGE\n\nbody", wantErr: true},
+        {name: "bad content-length", data: "MESSAGE\ncontent-length:9\n\nab\x00", wantErr: true},
+        {name: "header without colon", data: "MESSAGE\nfoo\n\n\x00", wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := Decode([]byte(tt.data))
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+            }
+            if tt.wantErr {
+                if !errors.Is(err, ErrBadFrame) {
+                    t.Errorf("Decode() error = %v, want %v", err, ErrBadFrame)
+                }
+                return
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("Decode() = %+v, want %+v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestFrame_roundTrip(t *testing.T) {
+    f := NewFrame(CmdSend, "destination", "/queue/a", "weird:key", "multi\nline\\value")
+    f.Body = []byte("body with \x00 nul")
+    got, err := Decode(f.Encode())
+    if err != nil {
+        t.Fatal(err)
+    }
+    delete(got[0].Header, "content-length")
+    if !reflect.DeepEqual(got, []Frame{f}) {
+        t.Errorf("Decode(Encode()) = %+v, want %+v", got, f)
+    }
+}
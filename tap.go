@@ -0,0 +1,35 @@
+package websocket
+
+import (
+    "time"
+)
+
+// Frame is a message as it was written to or read from the connection, before any interceptor saw it
+type Frame struct {
+    Time     time.Time
+    Outbound bool
+    Type     int
+    Data     []byte
+
+    // ConnID is the connection the frame belongs to
+    ConnID uint64
+}
+
+// SetTap set a function that receives every frame that is sent or received, it must not block
+func (w *Ws) SetTap(f func(Frame)) {
+    w.tap = f
+}
+
+// ConnID return the id of the current connection, it is increased for every connection that is made
+func (w *Ws) ConnID() uint64 {
+    _, id := w.current()
+    return id
+}
+
+// tapFrame pass a frame to the tap when one is set
+func (w *Ws) tapFrame(outbound bool, messageType int, data []byte) {
+    if w.tap == nil {
+        return
+    }
+    w.tap(Frame{Time: w.now(), Outbound: outbound, Type: messageType, Data: data, ConnID: w.ConnID()})
+}
@@ -0,0 +1,251 @@
+package websocket
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "net/http/httptrace"
+    "sync"
+    "time"
+)
+
+// Tracer creates spans, it is small enough to wrap an OpenTelemetry tracer and propagator
+type Tracer interface {
+    // Start a span as a child of the span in ctx
+    Start(ctx context.Context, name string) (context.Context, Span)
+
+    // Inject write the trace context of ctx into the carrier, for example a traceparent entry
+    Inject(ctx context.Context, carrier map[string]string)
+}
+
+// Span is a single traced operation
+type Span interface {
+    SetAttribute(key string, value interface{})
+    AddEvent(name string)
+    End(err error)
+}
+
+// Tracing contains the tracer and where trace context is injected
+type Tracing struct {
+    Tracer Tracer
+
+    // add the trace context as headers to the handshake request
+    InjectHeaders bool
+
+    // JSONField is the field of outgoing json objects that receives the trace context,
+    // injection into json is disabled when it is empty
+    JSONField string
+}
+
+// SetTracing enable tracing of connects, sent messages and received messages
+func (w *Ws) SetTracing(t Tracing) {
+    w.tracing = &t
+}
+
+// nopSpan is used when there is no tracer
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+func (nopSpan) AddEvent(string)                  {}
+func (nopSpan) End(error)                        {}
+
+// startSpan start a span when a tracer is set
+func (w *Ws) startSpan(ctx context.Context, name string) (context.Context, Span) {
+    if w.tracing == nil || w.tracing.Tracer == nil {
+        return ctx, nopSpan{}
+    }
+    ctx, span := w.tracing.Tracer.Start(ctx, name)
+    span.SetAttribute("url", w.url.String())
+    span.SetAttribute("conn_id", w.ConnID())
+    return ctx, span
+}
+
+// injectHeaders add the trace context to the handshake headers
+func (w *Ws) injectHeaders(ctx context.Context, h http.Header) {
+    if w.tracing == nil || w.tracing.Tracer == nil || !w.tracing.InjectHeaders {
+        return
+    }
+    carrier := map[string]string{}
+    w.tracing.Tracer.Inject(ctx, carrier)
+    for k, v := range carrier {
+        h.Set(k, v)
+    }
+}
+
+// injectJSON add the trace context to a json object, other json values are returned unchanged
+func (w *Ws) injectJSON(ctx context.Context, data []byte) []byte {
+    if w.tracing == nil || w.tracing.Tracer == nil || w.tracing.JSONField == "" {
+        return data
+    }
+    var obj map[string]json.RawMessage
+    if err := json.Unmarshal(data, &obj); err != nil || obj == nil {
+        return data
+    }
+    carrier := map[string]string{}
+    w.tracing.Tracer.Inject(ctx, carrier)
+    if len(carrier) == 0 {
+        return data
+    }
+    raw, err := json.Marshal(carrier)
+    if err != nil {
+        return data
+    }
+    obj[w.tracing.JSONField] = raw
+    out, err := json.Marshal(obj)
+    if err != nil {
+        return data
+    }
+    return out
+}
+
+// traceDial add a client trace to ctx that turns the dns, tcp, tls and upgrade phases into child spans
+func (w *Ws) traceDial(ctx context.Context, secure bool) context.Context {
+    if w.tracing == nil || w.tracing.Tracer == nil {
+        return ctx
+    }
+    var lock sync.Mutex
+    spans := map[string]Span{}
+    start := func(name string) {
+        lock.Lock()
+        defer lock.Unlock()
+        _, spans[name] = w.tracing.Tracer.Start(ctx, name)
+    }
+    end := func(name string, err error) {
+        lock.Lock()
+        defer lock.Unlock()
+        if s, ok := spans[name]; ok {
+            s.End(err)
+            delete(spans, name)
+        }
+    }
+    trace := &httptrace.ClientTrace{
+        DNSStart: func(httptrace.DNSStartInfo) { start("websocket.dns") },
+        DNSDone:  func(i httptrace.DNSDoneInfo) { end("websocket.dns", i.Err) },
+        ConnectStart: func(network, addr string) {
+            start("websocket.tcp")
+        },
+        ConnectDone: func(network, addr string, err error) { end("websocket.tcp", err) },
+        GotConn: func(httptrace.GotConnInfo) {
+            if !secure {
+                start("websocket.upgrade")
+            }
+        },
+        TLSHandshakeStart: func() { start("websocket.tls") },
+        TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+            end("websocket.tls", err)
+            if err == nil {
+                start("websocket.upgrade")
+            }
+        },
+        GotFirstResponseByte: func() { end("websocket.upgrade", nil) },
+    }
+    return httptrace.WithClientTrace(ctx, trace)
+}
+
+// RecordedSpan is a finished span kept by an InMemoryTracer
+type RecordedSpan struct {
+    Name       string
+    TraceID    string
+    SpanID     string
+    ParentID   string
+    Attributes map[string]interface{}
+    Events     []string
+    Err        error
+    Start      time.Time
+    End        time.Time
+}
+
+// InMemoryTracer records finished spans, it is meant for tests and debugging
+type InMemoryTracer struct {
+    lock  sync.Mutex
+    spans []RecordedSpan
+}
+
+// spanKey is the context key of the active in memory span
+type spanKey struct{}
+
+// memorySpan is a span of an InMemoryTracer that has not ended yet
+type memorySpan struct {
+    tracer *InMemoryTracer
+    lock   sync.Mutex
+    span   RecordedSpan
+    ended  bool
+}
+
+// Start a span as a child of the span in ctx
+func (t *InMemoryTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+    s := &memorySpan{tracer: t, span: RecordedSpan{
+        Name:       name,
+        SpanID:     randomHex(8),
+        Attributes: map[string]interface{}{},
+        Start:      time.Now(),
+    }}
+    if parent, ok := ctx.Value(spanKey{}).(*memorySpan); ok {
+        s.span.TraceID = parent.span.TraceID
+        s.span.ParentID = parent.span.SpanID
+    } else {
+        s.span.TraceID = randomHex(16)
+    }
+    return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Inject write a w3c traceparent for the span in ctx
+func (t *InMemoryTracer) Inject(ctx context.Context, carrier map[string]string) {
+    if s, ok := ctx.Value(spanKey{}).(*memorySpan); ok {
+        carrier["traceparent"] = "00-" + s.span.TraceID + "-" + s.span.SpanID + "-01"
+    }
+}
+
+// Spans return the finished spans in the order they ended
+func (t *InMemoryTracer) Spans() []RecordedSpan {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    spans := make([]RecordedSpan, len(t.spans))
+    copy(spans, t.spans)
+    return spans
+}
+
+// Reset forget all recorded spans
+func (t *InMemoryTracer) Reset() {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    t.spans = nil
+}
+
+func (s *memorySpan) SetAttribute(key string, value interface{}) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.span.Attributes[key] = value
+}
+
+func (s *memorySpan) AddEvent(name string) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.span.Events = append(s.span.Events, name)
+}
+
+func (s *memorySpan) End(err error) {
+    s.lock.Lock()
+    if s.ended {
+        s.lock.Unlock()
+        return
+    }
+    s.ended = true
+    s.span.Err = err
+    s.span.End = time.Now()
+    span := s.span
+    s.lock.Unlock()
+    s.tracer.lock.Lock()
+    defer s.tracer.lock.Unlock()
+    s.tracer.spans = append(s.tracer.spans, span)
+}
+
+// randomHex return n random bytes as hex
+func randomHex(n int) string {
+    b := make([]byte, n)
+    _, _ = rand.Read(b)
+    return hex.EncodeToString(b)
+}
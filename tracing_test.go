@@ -0,0 +1,100 @@
+package websocket
+
+import (
+    "context"
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+func TestWs_SetTracing(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer srv.Close()
+
+    tracer := &InMemoryTracer{}
+    w := &Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    w.SetTracing(Tracing{Tracer: tracer, InjectHeaders: true, JSONField: "trace"})
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+
+    ctx, parent := tracer.Start(context.Background(), "parent")
+    if err := w.WriteJSONContext(ctx, map[string]string{"op": "hello"}); err != nil {
+        t.Fatal(err)
+    }
+    parent.End(nil)
+
+    if got := srv.Handshakes()[0].Header.Get("traceparent"); !strings.HasPrefix(got, "00-") {
+        t.Errorf("handshake traceparent = %q, want a w3c trace context", got)
+    }
+    var msg struct {
+        Op    string            `json:"op"`
+        Trace map[string]string `json:"trace"`
+    }
+    if !srv.WaitFor(1, time.Second) {
+        t.Fatal("message was not received")
+    }
+    if err := json.Unmarshal(srv.Received()[0].Data, &msg); err != nil {
+        t.Fatal(err)
+    }
+    if msg.Op != "hello" || msg.Trace["traceparent"] == "" {
+        t.Errorf("message = %+v, want op and injected trace context", msg)
+    }
+
+    spans := map[string]RecordedSpan{}
+    for _, s := range tracer.Spans() {
+        spans[s.Name] = s
+    }
+    tests := []struct {
+        name   string
+        parent string
+    }{
+        {name: "websocket.connect"},
+        {name: "websocket.tcp", parent: "websocket.connect"},
+        {name: "websocket.upgrade", parent: "websocket.connect"},
+        {name: "websocket.send", parent: "parent"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s, ok := spans[tt.name]
+            if !ok {
+                t.Fatalf("span %s was not recorded", tt.name)
+            }
+            if tt.parent != "" && s.ParentID != spans[tt.parent].SpanID {
+                t.Errorf("span %s parent = %v, want %v", tt.name, s.ParentID, tt.parent)
+            }
+        })
+    }
+    if want := "00-" + spans["websocket.send"].TraceID + "-" + spans["websocket.send"].SpanID + "-01"; msg.Trace["traceparent"] != want {
+        t.Errorf("injected traceparent = %v, want %v", msg.Trace["traceparent"], want)
+    }
+}
+
+func TestWs_injectJSON(t *testing.T) {
+    tracer := &InMemoryTracer{}
+    ctx, _ := tracer.Start(context.Background(), "test")
+    tests := []struct {
+        name    string
+        data    string
+        changed bool
+    }{
+        {name: "object", data: `{"a":1}`, changed: true},
+        {name: "array", data: `[1,2]`, changed: false},
+        {name: "string", data: `"text"`, changed: false},
+    }
+    w := &Ws{}
+    w.SetTracing(Tracing{Tracer: tracer, JSONField: "trace"})
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := string(w.injectJSON(ctx, []byte(tt.data)))
+            if (got != tt.data) != tt.changed {
+                t.Errorf("injectJSON() = %v, changed want %v", got, tt.changed)
+            }
+        })
+    }
+}
@@ -0,0 +1,189 @@
+package tunnel
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "time"
+)
+
+// ErrForwarderClosed is returned by Serve after Close
+var ErrForwarderClosed = errors.New("tunnel: forwarder closed")
+
+// DialError is returned when the server could not reach the target
+type DialError struct {
+    Target string
+    Reason string
+}
+
+func (e *DialError) Error() string {
+    return fmt.Sprintf("tunnel: server could not reach %s: %s", e.Target, e.Reason)
+}
+
+// Config of a Forwarder
+type Config struct {
+    // Target is the address the server dials for every connection, like db.internal:5432
+    Target string
+
+    // Open opens the stream to the server, see WsOpener and SessionOpener
+    Open Opener
+
+    // OpenTimeout limits opening the stream and waiting for the server to reach the target, 0 waits 10 seconds
+    OpenTimeout time.Duration
+
+    // OnError is called when a connection could not be forwarded or ended with an error
+    OnError func(err error)
+}
+
+// Forwarder accepts local connections and carries each of them to the target through the server
+type Forwarder struct {
+    cfg Config
+
+    lock      sync.Mutex
+    listeners map[net.Listener]struct{}
+    conns     map[net.Conn]struct{}
+    closed    bool
+}
+
+// NewForwarder create a forwarder
+func NewForwarder(cfg Config) *Forwarder {
+    if cfg.OpenTimeout <= 0 {
+        cfg.OpenTimeout = 10 * time.Second
+    }
+    return &Forwarder{cfg: cfg, listeners: map[net.Listener]struct{}{}, conns: map[net.Conn]struct{}{}}
+}
+
+// ListenAndServe listen on a local tcp address and forward the connections
+func (f *Forwarder) ListenAndServe(addr string) error {
+    l, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    return f.Serve(l)
+}
+
+// Serve forward the connections accepted on l until Close, l is closed when Serve returns
+func (f *Forwarder) Serve(l net.Listener) error {
+    f.lock.Lock()
+    if f.closed {
+        f.lock.Unlock()
+        _ = l.Close()
+        return ErrForwarderClosed
+    }
+    f.listeners[l] = struct{}{}
+    f.lock.Unlock()
+    defer func() {
+        f.lock.Lock()
+        delete(f.listeners, l)
+        f.lock.Unlock()
+        _ = l.Close()
+    }()
+    for {
+        c, err := l.Accept()
+        if err != nil {
+            f.lock.Lock()
+            closed := f.closed
+            f.lock.Unlock()
+            if closed {
+                return ErrForwarderClosed
+            }
+            return err
+        }
+        go func() {
+            if err := f.Forward(context.Background(), c); err != nil {
+                f.report(err)
+            }
+        }()
+    }
+}
+
+// Forward carry a single connection to the target and return when both directions ended,
+// c is closed when it returns
+func (f *Forwarder) Forward(ctx context.Context, c net.Conn) error {
+    f.lock.Lock()
+    if f.closed {
+        f.lock.Unlock()
+        _ = c.Close()
+        return ErrForwarderClosed
+    }
+    f.conns[c] = struct{}{}
+    f.lock.Unlock()
+    defer func() {
+        f.lock.Lock()
+        delete(f.conns, c)
+        f.lock.Unlock()
+        _ = c.Close()
+    }()
+    st, err := f.open(ctx)
+    if err != nil {
+        return err
+    }
+    return pipe(c, st)
+}
+
+// open a stream and wait until the server reached the target
+func (f *Forwarder) open(ctx context.Context) (Stream, error) {
+    ctx, cancel := context.WithTimeout(ctx, f.cfg.OpenTimeout)
+    defer cancel()
+    st, err := f.cfg.Open(ctx)
+    if err != nil {
+        return nil, err
+    }
+    // the stream is closed to stop waiting for a server that does not answer
+    answered := make(chan struct{})
+    expired := make(chan bool, 1)
+    go func() {
+        select {
+        case <-ctx.Done():
+            _ = st.Close()
+            expired <- true
+        case <-answered:
+            expired <- false
+        }
+    }()
+    reason, err := f.handshake(st)
+    close(answered)
+    if <-expired && err == nil {
+        err = ctx.Err()
+    }
+    if err != nil {
+        _ = st.Close()
+        return nil, err
+    }
+    if reason != "" {
+        _ = st.Close()
+        return nil, &DialError{Target: f.cfg.Target, Reason: reason}
+    }
+    return st, nil
+}
+
+// handshake send the target and read the answer of the server
+func (f *Forwarder) handshake(st Stream) (string, error) {
+    if err := writeField(st, f.cfg.Target); err != nil {
+        return "", err
+    }
+    return readField(st)
+}
+
+// Close stop accepting connections and close the forwarded ones
+func (f *Forwarder) Close() error {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.closed = true
+    for l := range f.listeners {
+        _ = l.Close()
+    }
+    for c := range f.conns {
+        _ = c.Close()
+    }
+    return nil
+}
+
+// report an error to OnError
+func (f *Forwarder) report(err error) {
+    if f.cfg.OnError != nil {
+        f.cfg.OnError(err)
+    }
+}
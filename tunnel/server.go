@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "time"
+
+    "github.com/pizzalord22/go-web-plug/mux"
+)
+
+// ErrTargetNotAllowed is returned by Serve for a target that is not in the allowed targets
+var ErrTargetNotAllowed = errors.New("tunnel: target not allowed")
+
+// ServerConfig of a Server
+type ServerConfig struct {
+    // Targets are the addresses forwarders may reach, "*" allows every address
+    Targets []string
+
+    // Dial connects to the target, a net.Dialer is used when it is nil
+    Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+    // DialTimeout limits connecting to the target, 0 waits 10 seconds
+    DialTimeout time.Duration
+
+    // OnError is called when a tunneled connection could not be made or ended with an error
+    OnError func(err error)
+}
+
+// Server is the endpoint of the tunnels, it dials the target of every stream and copies the bytes
+type Server struct {
+    cfg ServerConfig
+}
+
+// NewServer create a server
+func NewServer(cfg ServerConfig) *Server {
+    if cfg.Dial == nil {
+        var d net.Dialer
+        cfg.Dial = d.DialContext
+    }
+    if cfg.DialTimeout <= 0 {
+        cfg.DialTimeout = 10 * time.Second
+    }
+    return &Server{cfg: cfg}
+}
+
+// ServeConn serve a tunnel that uses a whole websocket connection, for example a *server.Peer
+func (sv *Server) ServeConn(c mux.Conn) error {
+    return sv.Serve(NewWsStream(c))
+}
+
+// ServeSession serve a tunnel on every stream the other side of the session opens, it returns when
+// the session ended
+func (sv *Server) ServeSession(s *mux.Session) error {
+    for {
+        st, err := s.Accept()
+        if err != nil {
+            return err
+        }
+        go func() {
+            if err := sv.Serve(st); err != nil {
+                sv.report(err)
+            }
+        }()
+    }
+}
+
+// Serve read the target from st, dial it and copy the bytes both ways until both sides are done,
+// st is closed when it returns
+func (sv *Server) Serve(st Stream) error {
+    target, err := readField(st)
+    if err != nil {
+        _ = st.Close()
+        return err
+    }
+    c, err := sv.dial(target)
+    if err != nil {
+        reason := err.Error()
+        if errors.Is(err, ErrTargetNotAllowed) {
+            reason = "not allowed"
+        }
+        _ = writeField(st, reason)
+        _ = st.Close()
+        return err
+    }
+    if err := writeField(st, ""); err != nil {
+        _ = c.Close()
+        _ = st.Close()
+        return err
+    }
+    return pipe(st, c)
+}
+
+// dial connect to an allowed target
+func (sv *Server) dial(target string) (net.Conn, error) {
+    if !sv.allowed(target) {
+        return nil, fmt.Errorf("%w: %s", ErrTargetNotAllowed, target)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), sv.cfg.DialTimeout)
+    defer cancel()
+    return sv.cfg.Dial(ctx, "tcp", target)
+}
+
+// allowed return true for a target in Targets
+func (sv *Server) allowed(target string) bool {
+    for _, t := range sv.cfg.Targets {
+        if t == "*" || t == target {
+            return true
+        }
+    }
+    return false
+}
+
+// report an error to OnError
+func (sv *Server) report(err error) {
+    if sv.cfg.OnError != nil {
+        sv.cfg.OnError(err)
+    }
+}
@@ -0,0 +1,178 @@
+// Package tunnel forwards tcp connections through websockets, a forwarder listens locally and carries
+// every connection to a server that dials the target, either on a websocket of its own or on a stream
+// of a mux session
+package tunnel
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+
+    "github.com/gorilla/websocket"
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/mux"
+)
+
+// Stream is the connection between the forwarder and the server for one tunneled connection,
+// *mux.Stream implements it
+type Stream interface {
+    io.ReadWriteCloser
+
+    // CloseWrite ends the writing side, the other end reads io.EOF
+    CloseWrite() error
+}
+
+// Opener opens a stream to the server
+type Opener func(ctx context.Context) (Stream, error)
+
+// WsOpener open a websocket made by newWs for every connection, the websocket must not reconnect
+// because the bytes in flight would be lost
+func WsOpener(newWs func() *plugin.Ws) Opener {
+    return func(ctx context.Context) (Stream, error) {
+        w := newWs()
+        if err := w.ConnectContext(ctx); err != nil {
+            return nil, err
+        }
+        return NewWsStream(w), nil
+    }
+}
+
+// SessionOpener open a stream on a mux session for every connection, with resumption enabled
+// the tunneled connections survive a reconnect of the session
+func SessionOpener(s *mux.Session) Opener {
+    return func(ctx context.Context) (Stream, error) {
+        return s.Open()
+    }
+}
+
+// wsStream carries bytes as binary messages, an empty message ends the writing side
+type wsStream struct {
+    c mux.Conn
+
+    writeLock sync.Mutex
+    buf       []byte
+    eof       bool
+}
+
+// NewWsStream use a whole websocket connection as a stream, *websocket.Ws and *server.Peer can be used
+func NewWsStream(c mux.Conn) Stream {
+    return &wsStream{c: c}
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+    for len(s.buf) == 0 {
+        if s.eof {
+            return 0, io.EOF
+        }
+        t, d, err := s.c.Read()
+        if err != nil {
+            return 0, err
+        }
+        if t != websocket.BinaryMessage {
+            continue
+        }
+        if len(d) == 0 {
+            s.eof = true
+        }
+        s.buf = d
+    }
+    n := copy(p, s.buf)
+    s.buf = s.buf[n:]
+    return n, nil
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+    if len(p) == 0 {
+        return 0, nil
+    }
+    s.writeLock.Lock()
+    defer s.writeLock.Unlock()
+    if err := s.c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+func (s *wsStream) CloseWrite() error {
+    s.writeLock.Lock()
+    defer s.writeLock.Unlock()
+    return s.c.WriteMessage(websocket.BinaryMessage, []byte{})
+}
+
+func (s *wsStream) Close() error {
+    return s.c.Close()
+}
+
+// maxField is the largest target address or error text
+const maxField = 1<<16 - 1
+
+// ErrBadHeader is returned for a target or reply that can not be read
+var ErrBadHeader = errors.New("tunnel: bad header")
+
+// writeField write a length prefixed string, the forwarder sends the target this way and the server
+// answers with an error text that is empty when the target was reached
+func writeField(w io.Writer, s string) error {
+    if len(s) > maxField {
+        return fmt.Errorf("%w: %d bytes", ErrBadHeader, len(s))
+    }
+    b := make([]byte, 2+len(s))
+    binary.BigEndian.PutUint16(b, uint16(len(s)))
+    copy(b[2:], s)
+    _, err := w.Write(b)
+    return err
+}
+
+// readField read a length prefixed string
+func readField(r io.Reader) (string, error) {
+    var n [2]byte
+    if _, err := io.ReadFull(r, n[:]); err != nil {
+        return "", fmt.Errorf("%w: %v", ErrBadHeader, err)
+    }
+    b := make([]byte, binary.BigEndian.Uint16(n[:]))
+    if _, err := io.ReadFull(r, b); err != nil {
+        return "", fmt.Errorf("%w: %v", ErrBadHeader, err)
+    }
+    return string(b), nil
+}
+
+// halfCloser is implemented by *net.TCPConn and *net.UnixConn
+type halfCloser interface {
+    CloseWrite() error
+}
+
+// closeWrite end the writing side of c, connections that can not half close are closed
+func closeWrite(c io.Closer) error {
+    if h, ok := c.(halfCloser); ok {
+        return h.CloseWrite()
+    }
+    return c.Close()
+}
+
+// pipe copy bytes both ways until both sides ended their writing side, a failure in one direction
+// closes both, the first failure is returned
+func pipe(a, b io.ReadWriteCloser) error {
+    errs := make(chan error, 2)
+    copyHalf := func(dst, src io.ReadWriteCloser) {
+        _, err := io.Copy(dst, src)
+        if err == nil {
+            err = closeWrite(dst)
+        }
+        if err != nil {
+            _ = a.Close()
+            _ = b.Close()
+        }
+        errs <- err
+    }
+    go copyHalf(a, b)
+    go copyHalf(b, a)
+    err := <-errs
+    if err2 := <-errs; err == nil {
+        err = err2
+    }
+    _ = a.Close()
+    _ = b.Close()
+    return err
+}
@@ -0,0 +1,237 @@
+package tunnel
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/mux"
+    "github.com/pizzalord22/go-web-plug/server"
+)
+
+// startTarget run a tcp server that handles every connection with handle
+func startTarget(t *testing.T, handle func(c *net.TCPConn)) string {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { l.Close() })
+    go func() {
+        for {
+            c, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer c.Close()
+                handle(c.(*net.TCPConn))
+            }()
+        }
+    }()
+    return l.Addr().String()
+}
+
+// echo write back everything and end the writing side after the client did
+func echo(c *net.TCPConn) {
+    _, _ = io.Copy(c, c)
+    _ = c.CloseWrite()
+}
+
+// count read until the client ended its writing side and answer with the number of bytes
+func count(c *net.TCPConn) {
+    n, _ := io.Copy(io.Discard, c)
+    fmt.Fprintf(c, "%d bytes", n)
+}
+
+// transport makes the opener of a forwarder for a tunnel server
+type transport func(t *testing.T, sv *Server) Opener
+
+// overWs carry every connection on a websocket of its own
+func overWs(t *testing.T, sv *Server) Opener {
+    srv := httptest.NewServer(server.NewHandler(server.Config{}, func(p *server.Peer) {
+        _ = sv.ServeConn(p)
+    }))
+    t.Cleanup(srv.Close)
+    host := strings.TrimPrefix(srv.URL, "http://")
+    return WsOpener(func() *plugin.Ws {
+        w := &plugin.Ws{}
+        w.SetUrl("ws", host, "/tunnel")
+        return w
+    })
+}
+
+// overMux carry every connection on a stream of one mux session
+func overMux(t *testing.T, sv *Server) Opener {
+    ms := mux.NewServer(mux.Config{}, func(s *mux.Session) {
+        _ = sv.ServeSession(s)
+    })
+    srv := httptest.NewServer(server.NewHandler(server.Config{}, func(p *server.Peer) {
+        _ = ms.Serve(p)
+    }))
+    t.Cleanup(srv.Close)
+    w := &plugin.Ws{}
+    w.SetUrl("ws", strings.TrimPrefix(srv.URL, "http://"), "/mux")
+    s := mux.NewClient(w, mux.Config{})
+    if err := s.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { s.Close() })
+    return SessionOpener(s)
+}
+
+var transports = map[string]transport{"ws": overWs, "mux": overMux}
+
+// newTestForwarder start a forwarder to target and return its address
+func newTestForwarder(t *testing.T, tr transport, target string, cfg ServerConfig) (*Forwarder, string) {
+    f := NewForwarder(Config{Target: target, Open: tr(t, NewServer(cfg))})
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go f.Serve(l)
+    t.Cleanup(func() { f.Close() })
+    return f, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *net.TCPConn {
+    c, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { c.Close() })
+    return c.(*net.TCPConn)
+}
+
+func TestHalfClose(t *testing.T) {
+    for name, tr := range transports {
+        t.Run(name, func(t *testing.T) {
+            target := startTarget(t, count)
+            _, addr := newTestForwarder(t, tr, target, ServerConfig{Targets: []string{target}})
+            c := dial(t, addr)
+            if _, err := c.Write(make([]byte, 100000)); err != nil {
+                t.Fatal(err)
+            }
+            if err := c.CloseWrite(); err != nil {
+                t.Fatal(err)
+            }
+            got, err := io.ReadAll(c)
+            if err != nil || string(got) != "100000 bytes" {
+                t.Errorf("read %q, %v, want 100000 bytes", got, err)
+            }
+        })
+    }
+}
+
+func TestEcho(t *testing.T) {
+    for name, tr := range transports {
+        t.Run(name, func(t *testing.T) {
+            target := startTarget(t, echo)
+            _, addr := newTestForwarder(t, tr, target, ServerConfig{Targets: []string{"*"}})
+            var wg sync.WaitGroup
+            for i := 0; i < 4; i++ {
+                c := dial(t, addr)
+                data := bytes.Repeat([]byte{byte(i), 1, 2, 3}, 1<<18)
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    go func() {
+                        _, _ = c.Write(data)
+                        _ = c.CloseWrite()
+                    }()
+                    got, err := io.ReadAll(c)
+                    if err != nil || !bytes.Equal(got, data) {
+                        t.Errorf("echoed %d bytes, %v, want %d", len(got), err, len(data))
+                    }
+                }()
+            }
+            wg.Wait()
+        })
+    }
+}
+
+func TestTargetNotAllowed(t *testing.T) {
+    for name, tr := range transports {
+        t.Run(name, func(t *testing.T) {
+            target := startTarget(t, echo)
+            f, _ := newTestForwarder(t, tr, target, ServerConfig{Targets: []string{"127.0.0.1:1"}})
+            local, remote := net.Pipe()
+            defer remote.Close()
+            err := f.Forward(context.Background(), local)
+            var de *DialError
+            if !errors.As(err, &de) || de.Target != target || de.Reason != "not allowed" {
+                t.Errorf("Forward() error = %v, want a DialError for %s", err, target)
+            }
+        })
+    }
+}
+
+func TestDialFailure(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    target := l.Addr().String()
+    l.Close()
+    f, addr := newTestForwarder(t, overMux, target, ServerConfig{Targets: []string{"*"}})
+    local, remote := net.Pipe()
+    defer remote.Close()
+    var de *DialError
+    if err := f.Forward(context.Background(), local); !errors.As(err, &de) || !strings.Contains(de.Reason, "refused") {
+        t.Errorf("Forward() error = %v, want a refused DialError", err)
+    }
+    // connections from the listener are closed without bytes
+    c := dial(t, addr)
+    if got, err := io.ReadAll(c); len(got) != 0 || err != nil {
+        t.Errorf("read %q, %v from a connection to an unreachable target", got, err)
+    }
+}
+
+func TestForwarderClose(t *testing.T) {
+    target := startTarget(t, echo)
+    f := NewForwarder(Config{Target: target, Open: overMux(t, NewServer(ServerConfig{Targets: []string{target}}))})
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    served := make(chan error, 1)
+    go func() { served <- f.Serve(l) }()
+    c := dial(t, l.Addr().String())
+    if _, err := c.Write([]byte("x")); err != nil {
+        t.Fatal(err)
+    }
+    b := make([]byte, 1)
+    if _, err := io.ReadFull(c, b); err != nil {
+        t.Fatal(err)
+    }
+    f.Close()
+    if err := <-served; err != ErrForwarderClosed {
+        t.Errorf("Serve() = %v, want %v", err, ErrForwarderClosed)
+    }
+    if _, err := io.ReadAll(c); err != nil {
+        t.Errorf("read after Close: %v", err)
+    }
+}
+
+func TestField(t *testing.T) {
+    var b bytes.Buffer
+    if err := writeField(&b, "db:5432"); err != nil {
+        t.Fatal(err)
+    }
+    if s, err := readField(&b); err != nil || s != "db:5432" {
+        t.Errorf("readField() = %q, %v", s, err)
+    }
+    if err := writeField(&b, strings.Repeat("x", maxField+1)); !errors.Is(err, ErrBadHeader) {
+        t.Errorf("writeField() error = %v for a long field, want %v", err, ErrBadHeader)
+    }
+    if _, err := readField(bytes.NewReader([]byte{0, 5, 'a'})); !errors.Is(err, ErrBadHeader) {
+        t.Errorf("readField() error = %v for a short field, want %v", err, ErrBadHeader)
+    }
+}
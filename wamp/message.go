@@ -0,0 +1,151 @@
+// Package wamp is a WAMP v2 client with the caller, callee, publisher and subscriber roles
+// and the wamp.2.json subprotocol on top of the plugin
+package wamp
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+)
+
+// Subprotocol is the websocket subprotocol of WAMP with json serialization
+const Subprotocol = "wamp.2.json"
+
+// message types
+const (
+    TypeHello        = 1
+    TypeWelcome      = 2
+    TypeAbort        = 3
+    TypeGoodbye      = 6
+    TypeError        = 8
+    TypePublish      = 16
+    TypePublished    = 17
+    TypeSubscribe    = 32
+    TypeSubscribed   = 33
+    TypeUnsubscribe  = 34
+    TypeUnsubscribed = 35
+    TypeEvent        = 36
+    TypeCall         = 48
+    TypeResult       = 50
+    TypeRegister     = 64
+    TypeRegistered   = 65
+    TypeUnregister   = 66
+    TypeUnregistered = 67
+    TypeInvocation   = 68
+    TypeYield        = 70
+)
+
+// error and close uris used by the client
+const (
+    ErrorRuntime         = "wamp.error.runtime_error"
+    ErrorNoSuchProcedure = "wamp.error.no_such_procedure"
+    CloseRealm           = "wamp.close.close_realm"
+    CloseGoodbyeAndOut   = "wamp.close.goodbye_and_out"
+)
+
+// ErrBadMessage is returned for messages that do not match their type
+var ErrBadMessage = errors.New("wamp: bad message")
+
+// Error is an ERROR message, handlers can return it to send a specific error uri
+type Error struct {
+    URI    string
+    Args   []json.RawMessage
+    Kwargs map[string]json.RawMessage
+}
+
+func (e *Error) Error() string {
+    if len(e.Args) > 0 {
+        return fmt.Sprintf("wamp: %s: %s", e.URI, e.Args[0])
+    }
+    return "wamp: " + e.URI
+}
+
+// AbortError is an ABORT message of the router, it is returned when the session could not be joined
+type AbortError struct {
+    Reason  string
+    Details map[string]json.RawMessage
+}
+
+func (e *AbortError) Error() string {
+    return "wamp: session aborted: " + e.Reason
+}
+
+// Result is the result of a call
+type Result struct {
+    Details map[string]json.RawMessage
+    Args    []json.RawMessage
+    Kwargs  map[string]json.RawMessage
+}
+
+// Invocation is a call of a registered procedure
+type Invocation struct {
+    Procedure string
+    Details   map[string]json.RawMessage
+    Args      []json.RawMessage
+    Kwargs    map[string]json.RawMessage
+}
+
+// Event is an event of a subscribed topic
+type Event struct {
+    Topic       string
+    Publication uint64
+    Details     map[string]json.RawMessage
+    Args        []json.RawMessage
+    Kwargs      map[string]json.RawMessage
+}
+
+// decode split a message into its type and fields, the type is not part of the fields
+func decode(data []byte) (int, []json.RawMessage, error) {
+    var fields []json.RawMessage
+    if err := json.Unmarshal(data, &fields); err != nil {
+        return 0, nil, fmt.Errorf("%w: %v", ErrBadMessage, err)
+    }
+    if len(fields) == 0 {
+        return 0, nil, fmt.Errorf("%w: empty message", ErrBadMessage)
+    }
+    var t int
+    if err := json.Unmarshal(fields[0], &t); err != nil {
+        return 0, nil, fmt.Errorf("%w: bad type %s", ErrBadMessage, fields[0])
+    }
+    return t, fields[1:], nil
+}
+
+// fields decode the fields of a message into values, missing optional fields at the end are left alone
+func fields(f []json.RawMessage, required int, values ...interface{}) error {
+    if len(f) < required {
+        return fmt.Errorf("%w: %d fields, want at least %d", ErrBadMessage, len(f), required)
+    }
+    for i, v := range values {
+        if i >= len(f) {
+            break
+        }
+        if err := json.Unmarshal(f[i], v); err != nil {
+            return fmt.Errorf("%w: field %d: %v", ErrBadMessage, i+1, err)
+        }
+    }
+    return nil
+}
+
+// withPayload append the arguments of a message, empty trailing arguments are left out
+func withPayload(msg []interface{}, args []interface{}, kwargs map[string]interface{}) []interface{} {
+    if len(kwargs) > 0 {
+        if args == nil {
+            args = []interface{}{}
+        }
+        return append(msg, args, kwargs)
+    }
+    if len(args) > 0 {
+        return append(msg, args)
+    }
+    return msg
+}
+
+// errorOf build the error of an ERROR message, its fields start after the request id
+func errorOf(f []json.RawMessage) *Error {
+    e := &Error{}
+    var details map[string]json.RawMessage
+    if err := fields(f, 2, &details, &e.URI, &e.Args, &e.Kwargs); err != nil {
+        e.URI = ErrBadMessage.Error()
+    }
+    return e
+}
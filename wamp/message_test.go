@@ -0,0 +1,53 @@
+package wamp
+
+import (
+    "encoding/json"
+    "errors"
+    "testing"
+)
+
+func TestDecode(t *testing.T) {
+    typ, f, err := decode([]byte(`[50, 7, {}, [1, 2]]`))
+    if err != nil || typ != TypeResult || len(f) != 3 {
+        t.Fatalf("decode() = %d, %s, %v", typ, f, err)
+    }
+    for _, data := range []string{`{}`, `[]`, `["x"]`} {
+        if _, _, err := decode([]byte(data)); !errors.Is(err, ErrBadMessage) {
+            t.Errorf("decode(%s) error = %v, want %v", data, err, ErrBadMessage)
+        }
+    }
+}
+
+func TestFields(t *testing.T) {
+    var id uint64
+    var details map[string]json.RawMessage
+    var args []json.RawMessage
+    f := []json.RawMessage{json.RawMessage(`5`), json.RawMessage(`{"a":1}`)}
+    if err := fields(f, 2, &id, &details, &args); err != nil || id != 5 || string(details["a"]) != "1" || args != nil {
+        t.Errorf("fields() = %d, %s, %s, %v", id, details, args, err)
+    }
+    if err := fields(f, 3, &id); !errors.Is(err, ErrBadMessage) {
+        t.Errorf("fields() error = %v with a missing field", err)
+    }
+    if err := fields([]json.RawMessage{json.RawMessage(`"x"`)}, 1, &id); !errors.Is(err, ErrBadMessage) {
+        t.Errorf("fields() error = %v with a bad field", err)
+    }
+}
+
+func TestWithPayload(t *testing.T) {
+    tests := []struct {
+        args   []interface{}
+        kwargs map[string]interface{}
+        want   string
+    }{
+        {nil, nil, `[48,1,{},"p"]`},
+        {[]interface{}{1}, nil, `[48,1,{},"p",[1]]`},
+        {nil, map[string]interface{}{"a": 1}, `[48,1,{},"p",[],{"a":1}]`},
+    }
+    for _, tt := range tests {
+        data, _ := json.Marshal(withPayload([]interface{}{TypeCall, 1, map[string]interface{}{}, "p"}, tt.args, tt.kwargs))
+        if string(data) != tt.want {
+            t.Errorf("withPayload(%v, %v) = %s, want %s", tt.args, tt.kwargs, data, tt.want)
+        }
+    }
+}
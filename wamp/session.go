@@ -0,0 +1,632 @@
+package wamp
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+)
+
+var (
+    // ErrSessionClosed is returned after Close
+    ErrSessionClosed = errors.New("wamp: session closed")
+
+    // ErrConnectionLost ends requests that were waiting when the connection was made again,
+    // the router does not know them in the new session
+    ErrConnectionLost = errors.New("wamp: connection lost")
+)
+
+// Config of a Session
+type Config struct {
+    // Realm to join
+    Realm string
+
+    // Details are added to the details of the HELLO message, the roles are set by the session
+    Details map[string]interface{}
+
+    // ConnectTimeout is the time to wait for the WELCOME message, 0 uses the default of the init exchange
+    ConnectTimeout time.Duration
+
+    // OnError is called for messages that can not be decoded and registrations or subscriptions
+    // that could not be made again after a reconnect, it must not block
+    OnError func(err error)
+}
+
+// Handler handles an invocation of a registered procedure, the returned arguments are sent back with YIELD,
+// an *Error is sent with its uri and other errors are sent as wamp.error.runtime_error
+type Handler func(ctx context.Context, inv *Invocation) (args []interface{}, kwargs map[string]interface{}, err error)
+
+// Session is a WAMP session over a Ws, registrations and subscriptions are made again whenever the Ws
+// makes a new connection and joins the realm again
+type Session struct {
+    w   *plugin.Ws
+    cfg Config
+
+    // writeLock makes sure there is only one writer
+    writeLock sync.Mutex
+
+    lock          sync.Mutex
+    id            uint64
+    nextID        uint64
+    requests      map[uint64]chan reply
+    registrations map[uint64]*Registration
+    regs          []*Registration
+    subscriptions map[uint64][]*Subscription
+    subs          []*Subscription
+    invocations   map[uint64]context.CancelFunc
+    connected     bool
+    err           error
+    running       bool
+    closed        bool
+    gen           uint64
+}
+
+// reply is the reply to a request, its fields start after the request id
+type reply struct {
+    t int
+    f []json.RawMessage
+}
+
+// Registration is a procedure registered by the session
+type Registration struct {
+    Procedure string
+
+    session *Session
+    handler Handler
+    id      uint64
+}
+
+// Subscription is a subscription to a topic
+type Subscription struct {
+    Topic string
+
+    session *Session
+    handler func(ev *Event)
+    id      uint64
+}
+
+// NewSession create a session for w, the OnConnect hook of w is wrapped to register and subscribe again
+func NewSession(w *plugin.Ws, cfg Config) (*Session, error) {
+    s := &Session{
+        w:             w,
+        cfg:           cfg,
+        requests:      map[uint64]chan reply{},
+        registrations: map[uint64]*Registration{},
+        subscriptions: map[uint64][]*Subscription{},
+        invocations:   map[uint64]context.CancelFunc{},
+    }
+    details := map[string]interface{}{}
+    for k, v := range cfg.Details {
+        details[k] = v
+    }
+    details["roles"] = map[string]interface{}{
+        "caller":     map[string]interface{}{},
+        "callee":     map[string]interface{}{},
+        "publisher":  map[string]interface{}{},
+        "subscriber": map[string]interface{}{},
+    }
+    hello, err := json.Marshal([]interface{}{TypeHello, cfg.Realm, details})
+    if err != nil {
+        return nil, err
+    }
+    w.SetSubprotocols(Subprotocol)
+    w.SetInitExchange(plugin.InitExchange{Messages: [][]byte{hello}, Accept: s.accept, Timeout: cfg.ConnectTimeout})
+    hooks := w.Hooks()
+    next := hooks.OnConnect
+    hooks.OnConnect = func(w *plugin.Ws, info plugin.ConnectInfo) error {
+        s.restore()
+        if next != nil {
+            return next(w, info)
+        }
+        return nil
+    }
+    w.SetHooks(hooks)
+    return s, nil
+}
+
+// accept wait for the WELCOME message, an ABORT message rejects the connection
+func (s *Session) accept(_ int, data []byte) (bool, error) {
+    t, f, err := decode(data)
+    if err != nil {
+        return false, err
+    }
+    switch t {
+    case TypeWelcome:
+        var id uint64
+        if err := fields(f, 2, &id); err != nil {
+            return false, err
+        }
+        s.lock.Lock()
+        s.id = id
+        s.lock.Unlock()
+        return true, nil
+    case TypeAbort:
+        e := &AbortError{}
+        if err := fields(f, 2, &e.Details, &e.Reason); err != nil {
+            return false, err
+        }
+        return false, e
+    }
+    return false, nil
+}
+
+// Connect make the connection, join the realm and start reading messages
+func (s *Session) Connect(ctx context.Context) error {
+    s.lock.Lock()
+    if s.closed {
+        s.lock.Unlock()
+        return ErrSessionClosed
+    }
+    s.lock.Unlock()
+    if err := s.w.ConnectContext(ctx); err != nil {
+        return err
+    }
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.err = nil
+    if !s.running {
+        s.running = true
+        go s.readLoop()
+    }
+    return nil
+}
+
+// ID return the id of the current session
+func (s *Session) ID() uint64 {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return s.id
+}
+
+// Err return why the session stopped reading, it is nil while it runs
+func (s *Session) Err() error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return s.err
+}
+
+// Close leave the realm with GOODBYE and close the connection
+func (s *Session) Close() error {
+    s.lock.Lock()
+    if s.closed {
+        s.lock.Unlock()
+        return nil
+    }
+    s.closed = true
+    s.lock.Unlock()
+    _ = s.write([]interface{}{TypeGoodbye, map[string]interface{}{}, CloseRealm})
+    return s.w.Close()
+}
+
+// Call a procedure and wait for its result
+func (s *Session) Call(ctx context.Context, procedure string, args []interface{}, kwargs map[string]interface{}) (*Result, error) {
+    f, err := s.request(ctx, TypeResult, func(id uint64) []interface{} {
+        return withPayload([]interface{}{TypeCall, id, map[string]interface{}{}, procedure}, args, kwargs)
+    })
+    if err != nil {
+        return nil, err
+    }
+    r := &Result{}
+    if err := fields(f, 1, &r.Details, &r.Args, &r.Kwargs); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+// Publish an event to a topic, with acknowledge it waits until the router confirmed the publication
+func (s *Session) Publish(ctx context.Context, topic string, args []interface{}, kwargs map[string]interface{}, acknowledge bool) error {
+    build := func(id uint64) []interface{} {
+        options := map[string]interface{}{}
+        if acknowledge {
+            options["acknowledge"] = true
+        }
+        return withPayload([]interface{}{TypePublish, id, options, topic}, args, kwargs)
+    }
+    if acknowledge {
+        _, err := s.request(ctx, TypePublished, build)
+        return err
+    }
+    s.lock.Lock()
+    id := s.newID()
+    s.lock.Unlock()
+    return s.write(build(id))
+}
+
+// Register a procedure, handler runs on its own goroutine for every invocation
+func (s *Session) Register(ctx context.Context, procedure string, handler Handler) (*Registration, error) {
+    r := &Registration{Procedure: procedure, session: s, handler: handler}
+    if err := s.register(ctx, r); err != nil {
+        return nil, err
+    }
+    s.lock.Lock()
+    s.regs = append(s.regs, r)
+    s.lock.Unlock()
+    return r, nil
+}
+
+// register send REGISTER and keep the registration id
+func (s *Session) register(ctx context.Context, r *Registration) error {
+    f, err := s.request(ctx, TypeRegistered, func(id uint64) []interface{} {
+        return []interface{}{TypeRegister, id, map[string]interface{}{}, r.Procedure}
+    })
+    if err != nil {
+        return err
+    }
+    var id uint64
+    if err := fields(f, 1, &id); err != nil {
+        return err
+    }
+    s.lock.Lock()
+    r.id = id
+    s.registrations[id] = r
+    s.lock.Unlock()
+    return nil
+}
+
+// Unregister the procedure
+func (r *Registration) Unregister(ctx context.Context) error {
+    s := r.session
+    s.lock.Lock()
+    for i, reg := range s.regs {
+        if reg == r {
+            s.regs = append(s.regs[:i], s.regs[i+1:]...)
+            break
+        }
+    }
+    id := r.id
+    delete(s.registrations, id)
+    r.id = 0
+    s.lock.Unlock()
+    if id == 0 {
+        return nil
+    }
+    _, err := s.request(ctx, TypeUnregistered, func(req uint64) []interface{} {
+        return []interface{}{TypeUnregister, req, id}
+    })
+    return err
+}
+
+// Subscribe to a topic, handler is called on the goroutine that reads messages so it must not wait for calls
+func (s *Session) Subscribe(ctx context.Context, topic string, handler func(ev *Event)) (*Subscription, error) {
+    sub := &Subscription{Topic: topic, session: s, handler: handler}
+    if err := s.subscribe(ctx, sub); err != nil {
+        return nil, err
+    }
+    s.lock.Lock()
+    s.subs = append(s.subs, sub)
+    s.lock.Unlock()
+    return sub, nil
+}
+
+// subscribe send SUBSCRIBE and keep the subscription id, the router uses one id for every subscription
+// to the same topic
+func (s *Session) subscribe(ctx context.Context, sub *Subscription) error {
+    f, err := s.request(ctx, TypeSubscribed, func(id uint64) []interface{} {
+        return []interface{}{TypeSubscribe, id, map[string]interface{}{}, sub.Topic}
+    })
+    if err != nil {
+        return err
+    }
+    var id uint64
+    if err := fields(f, 1, &id); err != nil {
+        return err
+    }
+    s.lock.Lock()
+    sub.id = id
+    s.subscriptions[id] = append(s.subscriptions[id], sub)
+    s.lock.Unlock()
+    return nil
+}
+
+// Unsubscribe from the topic, UNSUBSCRIBE is sent when no other subscription of the session uses the topic
+func (sub *Subscription) Unsubscribe(ctx context.Context) error {
+    s := sub.session
+    s.lock.Lock()
+    for i, other := range s.subs {
+        if other == sub {
+            s.subs = append(s.subs[:i], s.subs[i+1:]...)
+            break
+        }
+    }
+    id := sub.id
+    sub.id = 0
+    subs := s.subscriptions[id]
+    for i, other := range subs {
+        if other == sub {
+            subs = append(subs[:i:i], subs[i+1:]...)
+            break
+        }
+    }
+    if len(subs) > 0 {
+        s.subscriptions[id] = subs
+    } else {
+        delete(s.subscriptions, id)
+    }
+    s.lock.Unlock()
+    if id == 0 || len(subs) > 0 {
+        return nil
+    }
+    _, err := s.request(ctx, TypeUnsubscribed, func(req uint64) []interface{} {
+        return []interface{}{TypeUnsubscribe, req, id}
+    })
+    return err
+}
+
+// newID return a new request id, the lock must be held
+func (s *Session) newID() uint64 {
+    s.nextID++
+    return s.nextID
+}
+
+// request send a message built with a new request id and wait for the reply of type want, an ERROR reply
+// is returned as *Error, the fields of the reply start after the request id
+func (s *Session) request(ctx context.Context, want int, build func(id uint64) []interface{}) ([]json.RawMessage, error) {
+    replies := make(chan reply, 1)
+    s.lock.Lock()
+    if s.closed {
+        s.lock.Unlock()
+        return nil, ErrSessionClosed
+    }
+    id := s.newID()
+    s.requests[id] = replies
+    s.lock.Unlock()
+    defer func() {
+        s.lock.Lock()
+        delete(s.requests, id)
+        s.lock.Unlock()
+    }()
+    if err := s.write(build(id)); err != nil {
+        return nil, err
+    }
+    select {
+    case r, ok := <-replies:
+        if !ok {
+            return nil, s.lost()
+        }
+        if r.t == TypeError {
+            return nil, errorOf(r.f)
+        }
+        if r.t != want {
+            return nil, fmt.Errorf("%w: got type %d, want %d", ErrBadMessage, r.t, want)
+        }
+        return r.f, nil
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+// lost return the error of a request that ended without a reply
+func (s *Session) lost() error {
+    if err := s.Err(); err != nil {
+        return err
+    }
+    return ErrConnectionLost
+}
+
+// write a message
+func (s *Session) write(msg []interface{}) error {
+    s.writeLock.Lock()
+    defer s.writeLock.Unlock()
+    return s.w.WriteJSON(msg)
+}
+
+// restore end the requests of the previous session and register and subscribe again,
+// on another goroutine because a write that reconnected still holds the write lock
+func (s *Session) restore() {
+    s.lock.Lock()
+    s.gen++
+    gen := s.gen
+    resumed := s.connected
+    s.connected = true
+    var lost []chan reply
+    if resumed {
+        for id, replies := range s.requests {
+            lost = append(lost, replies)
+            delete(s.requests, id)
+        }
+    }
+    for _, cancel := range s.invocations {
+        cancel()
+    }
+    s.invocations = map[uint64]context.CancelFunc{}
+    s.registrations = map[uint64]*Registration{}
+    s.subscriptions = map[uint64][]*Subscription{}
+    regs := append([]*Registration(nil), s.regs...)
+    subs := append([]*Subscription(nil), s.subs...)
+    for _, r := range regs {
+        r.id = 0
+    }
+    for _, sub := range subs {
+        sub.id = 0
+    }
+    s.lock.Unlock()
+    for _, replies := range lost {
+        close(replies)
+    }
+    if len(regs) == 0 && len(subs) == 0 {
+        return
+    }
+    go func() {
+        for _, r := range regs {
+            if !s.current(gen) {
+                return
+            }
+            if err := s.register(context.Background(), r); err != nil {
+                s.report(fmt.Errorf("wamp: register %s again: %w", r.Procedure, err))
+            }
+        }
+        for _, sub := range subs {
+            if !s.current(gen) {
+                return
+            }
+            if err := s.subscribe(context.Background(), sub); err != nil {
+                s.report(fmt.Errorf("wamp: subscribe to %s again: %w", sub.Topic, err))
+            }
+        }
+    }()
+}
+
+// current return true while the connection of gen is in use
+func (s *Session) current(gen uint64) bool {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return s.gen == gen
+}
+
+// readLoop read messages until the connection fails and is not made again
+func (s *Session) readLoop() {
+    for {
+        conn := s.w.ConnID()
+        _, d, err := s.w.Read()
+        if err != nil {
+            s.lock.Lock()
+            stopped := s.closed
+            s.lock.Unlock()
+            if !stopped && s.w.Reconnected(conn) {
+                // the plugin reconnected while reading
+                continue
+            }
+            s.fail(err)
+            return
+        }
+        t, f, err := decode(d)
+        if err != nil {
+            s.report(err)
+            continue
+        }
+        if err := s.dispatch(t, f, d); err != nil {
+            s.report(err)
+        }
+    }
+}
+
+// dispatch a message received from the router
+func (s *Session) dispatch(t int, f []json.RawMessage, data []byte) error {
+    switch t {
+    case TypeResult, TypePublished, TypeRegistered, TypeUnregistered, TypeSubscribed, TypeUnsubscribed, TypeError:
+        // ERROR carries the type of the request before its id
+        i := 0
+        if t == TypeError {
+            i = 1
+        }
+        var id uint64
+        if len(f) <= i || json.Unmarshal(f[i], &id) != nil {
+            return fmt.Errorf("%w: %s", ErrBadMessage, data)
+        }
+        s.lock.Lock()
+        replies := s.requests[id]
+        delete(s.requests, id)
+        s.lock.Unlock()
+        if replies != nil {
+            replies <- reply{t: t, f: f[i+1:]}
+        }
+    case TypeEvent:
+        var id, publication uint64
+        ev := &Event{}
+        if err := fields(f, 3, &id, &publication, &ev.Details, &ev.Args, &ev.Kwargs); err != nil {
+            return err
+        }
+        ev.Publication = publication
+        s.lock.Lock()
+        subs := append([]*Subscription(nil), s.subscriptions[id]...)
+        s.lock.Unlock()
+        for _, sub := range subs {
+            e := *ev
+            e.Topic = sub.Topic
+            sub.handler(&e)
+        }
+    case TypeInvocation:
+        var req, id uint64
+        inv := &Invocation{}
+        if err := fields(f, 3, &req, &id, &inv.Details, &inv.Args, &inv.Kwargs); err != nil {
+            return err
+        }
+        s.invoke(req, id, inv)
+    case TypeGoodbye:
+        // the router ends the session, it closes the connection after the reply
+        return s.write([]interface{}{TypeGoodbye, map[string]interface{}{}, CloseGoodbyeAndOut})
+    }
+    return nil
+}
+
+// invoke run the handler of a registration and send YIELD or ERROR
+func (s *Session) invoke(req, id uint64, inv *Invocation) {
+    s.lock.Lock()
+    r := s.registrations[id]
+    gen := s.gen
+    ctx, cancel := context.WithCancel(context.Background())
+    if r != nil {
+        s.invocations[req] = cancel
+    }
+    s.lock.Unlock()
+    if r == nil {
+        cancel()
+        _ = s.write([]interface{}{TypeError, TypeInvocation, req, map[string]interface{}{}, ErrorNoSuchProcedure})
+        return
+    }
+    inv.Procedure = r.Procedure
+    go func() {
+        defer cancel()
+        args, kwargs, err := r.handler(ctx, inv)
+        s.lock.Lock()
+        current := s.gen == gen
+        delete(s.invocations, req)
+        s.lock.Unlock()
+        if !current {
+            // the invocation belongs to a session that ended
+            return
+        }
+        if err == nil {
+            _ = s.write(withPayload([]interface{}{TypeYield, req, map[string]interface{}{}}, args, kwargs))
+            return
+        }
+        var we *Error
+        if !errors.As(err, &we) {
+            _ = s.write([]interface{}{TypeError, TypeInvocation, req, map[string]interface{}{}, ErrorRuntime, []interface{}{err.Error()}})
+            return
+        }
+        msg := []interface{}{TypeError, TypeInvocation, req, map[string]interface{}{}, we.URI}
+        if len(we.Kwargs) > 0 {
+            args := we.Args
+            if args == nil {
+                args = []json.RawMessage{}
+            }
+            msg = append(msg, args, we.Kwargs)
+        } else if len(we.Args) > 0 {
+            msg = append(msg, we.Args)
+        }
+        _ = s.write(msg)
+    }()
+}
+
+// report an error to OnError
+func (s *Session) report(err error) {
+    if s.cfg.OnError != nil {
+        s.cfg.OnError(err)
+    }
+}
+
+// fail stop reading and end the requests
+func (s *Session) fail(err error) {
+    s.lock.Lock()
+    if s.closed {
+        err = ErrSessionClosed
+    }
+    s.err = err
+    s.running = false
+    s.gen++
+    requests := s.requests
+    s.requests = map[uint64]chan reply{}
+    for _, cancel := range s.invocations {
+        cancel()
+    }
+    s.invocations = map[uint64]context.CancelFunc{}
+    s.lock.Unlock()
+    for _, replies := range requests {
+        close(replies)
+    }
+}
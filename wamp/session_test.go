@@ -0,0 +1,486 @@
+package wamp
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    plugin "github.com/pizzalord22/go-web-plug"
+    "github.com/pizzalord22/go-web-plug/wstest"
+)
+
+// router is a minimal dealer and broker for the realm realm1, it routes calls to the session that registered
+// the procedure and events to every other subscriber of the topic
+type router struct {
+    srv *wstest.Server
+
+    lock        sync.Mutex
+    nextID      uint64
+    procs       map[string]uint64
+    regs        map[uint64]*peer
+    topics      map[string]uint64
+    subscribers map[uint64]map[*peer]bool
+    calls       map[uint64]call
+    log         []string
+}
+
+// peer is a session connected to the router
+type peer struct {
+    c         *wstest.Conn
+    writeLock sync.Mutex
+}
+
+// call is a call waiting for the callee
+type call struct {
+    caller *peer
+    req    json.RawMessage
+}
+
+func newRouter(t *testing.T) *router {
+    r := &router{
+        procs:       map[string]uint64{},
+        regs:        map[uint64]*peer{},
+        topics:      map[string]uint64{},
+        subscribers: map[uint64]map[*peer]bool{},
+        calls:       map[uint64]call{},
+    }
+    r.srv = wstest.NewServer(r.serve)
+    r.srv.Upgrader.Subprotocols = []string{Subprotocol}
+    t.Cleanup(r.srv.Close)
+    return r
+}
+
+func (r *router) record(p *peer, format string, args ...interface{}) {
+    r.log = append(r.log, fmt.Sprintf("%d ", p.c.Index)+fmt.Sprintf(format, args...))
+}
+
+// waitFor wait until the router logged an entry
+func (r *router) waitFor(t *testing.T, entry string) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        r.lock.Lock()
+        for _, e := range r.log {
+            if e == entry {
+                r.lock.Unlock()
+                return
+            }
+        }
+        r.lock.Unlock()
+        time.Sleep(time.Millisecond)
+    }
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    t.Fatalf("router got %q, want %q", r.log, entry)
+}
+
+func (p *peer) send(msg ...interface{}) {
+    p.writeLock.Lock()
+    defer p.writeLock.Unlock()
+    _ = p.c.WriteJSON(msg)
+}
+
+func (r *router) id() uint64 {
+    r.nextID++
+    return r.nextID
+}
+
+func (r *router) serve(c *wstest.Conn) {
+    p := &peer{c: c}
+    _, d, err := c.Receive()
+    if err != nil {
+        return
+    }
+    t, f, err := decode(d)
+    if err != nil || t != TypeHello {
+        return
+    }
+    var realm string
+    var details struct{ Roles map[string]interface{} }
+    _ = fields(f, 2, &realm, &details)
+    if realm != "realm1" {
+        p.send(TypeAbort, map[string]string{"message": "no such realm"}, "wamp.error.no_such_realm")
+        return
+    }
+    roles := make([]string, 0, len(details.Roles))
+    for role := range details.Roles {
+        roles = append(roles, role)
+    }
+    r.lock.Lock()
+    r.record(p, "hello %s %d roles", realm, len(roles))
+    r.lock.Unlock()
+    p.send(TypeWelcome, c.Index, map[string]interface{}{"roles": map[string]interface{}{"dealer": struct{}{}, "broker": struct{}{}}})
+    defer r.leave(p)
+    for {
+        _, d, err := c.Receive()
+        if err != nil {
+            return
+        }
+        t, f, err := decode(d)
+        if err != nil {
+            return
+        }
+        if t == TypeGoodbye {
+            var reason string
+            _ = fields(f, 2, new(map[string]interface{}), &reason)
+            r.lock.Lock()
+            r.record(p, "goodbye %s", reason)
+            r.lock.Unlock()
+            p.send(TypeGoodbye, struct{}{}, CloseGoodbyeAndOut)
+            return
+        }
+        r.handle(p, t, f)
+    }
+}
+
+// handle a message of a joined session
+func (r *router) handle(p *peer, t int, f []json.RawMessage) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    payload := func(from int) []interface{} {
+        var rest []interface{}
+        for _, raw := range f[from:] {
+            rest = append(rest, raw)
+        }
+        return rest
+    }
+    switch t {
+    case TypeCall:
+        var proc string
+        _ = json.Unmarshal(f[2], &proc)
+        r.record(p, "call %s", proc)
+        reg, ok := r.procs[proc]
+        if !ok {
+            go p.send(TypeError, TypeCall, f[0], struct{}{}, ErrorNoSuchProcedure)
+            return
+        }
+        inv := r.id()
+        r.calls[inv] = call{caller: p, req: f[0]}
+        callee := r.regs[reg]
+        go callee.send(append([]interface{}{TypeInvocation, inv, reg, struct{}{}}, payload(3)...)...)
+    case TypeYield, TypeError:
+        i := 0
+        if t == TypeError {
+            i = 1
+        }
+        var inv uint64
+        _ = json.Unmarshal(f[i], &inv)
+        cl, ok := r.calls[inv]
+        if !ok {
+            return
+        }
+        delete(r.calls, inv)
+        if t == TypeYield {
+            r.record(p, "yield")
+            go cl.caller.send(append([]interface{}{TypeResult, cl.req, struct{}{}}, payload(2)...)...)
+            return
+        }
+        r.record(p, "error")
+        go cl.caller.send(append([]interface{}{TypeError, TypeCall, cl.req}, payload(2)...)...)
+    case TypeRegister:
+        var proc string
+        _ = json.Unmarshal(f[2], &proc)
+        r.record(p, "register %s", proc)
+        if _, ok := r.procs[proc]; ok {
+            go p.send(TypeError, TypeRegister, f[0], struct{}{}, "wamp.error.procedure_already_exists")
+            return
+        }
+        reg := r.id()
+        r.procs[proc] = reg
+        r.regs[reg] = p
+        go p.send(TypeRegistered, f[0], reg)
+    case TypeUnregister:
+        var reg uint64
+        _ = json.Unmarshal(f[1], &reg)
+        for proc, id := range r.procs {
+            if id == reg && r.regs[reg] == p {
+                r.record(p, "unregister %s", proc)
+                delete(r.procs, proc)
+                delete(r.regs, reg)
+            }
+        }
+        go p.send(TypeUnregistered, f[0])
+    case TypeSubscribe:
+        var topic string
+        _ = json.Unmarshal(f[2], &topic)
+        r.record(p, "subscribe %s", topic)
+        sub, ok := r.topics[topic]
+        if !ok {
+            sub = r.id()
+            r.topics[topic] = sub
+            r.subscribers[sub] = map[*peer]bool{}
+        }
+        r.subscribers[sub][p] = true
+        go p.send(TypeSubscribed, f[0], sub)
+    case TypeUnsubscribe:
+        var sub uint64
+        _ = json.Unmarshal(f[1], &sub)
+        for topic, id := range r.topics {
+            if id == sub {
+                r.record(p, "unsubscribe %s", topic)
+            }
+        }
+        delete(r.subscribers[sub], p)
+        go p.send(TypeUnsubscribed, f[0])
+    case TypePublish:
+        var options struct{ Acknowledge bool }
+        var topic string
+        _ = fields(f, 3, new(uint64), &options, &topic)
+        r.record(p, "publish %s", topic)
+        pub := r.id()
+        sub := r.topics[topic]
+        for other := range r.subscribers[sub] {
+            if other != p {
+                go other.send(append([]interface{}{TypeEvent, sub, pub, struct{}{}}, payload(3)...)...)
+            }
+        }
+        if options.Acknowledge {
+            go p.send(TypePublished, f[0], pub)
+        }
+    }
+}
+
+// leave remove the registrations and subscriptions of a session that ended
+func (r *router) leave(p *peer) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+    for proc, reg := range r.procs {
+        if r.regs[reg] == p {
+            delete(r.procs, proc)
+            delete(r.regs, reg)
+        }
+    }
+    for _, subs := range r.subscribers {
+        delete(subs, p)
+    }
+}
+
+// newTestSession join realm1 on the router
+func newTestSession(t *testing.T, r *router, setup func(w *plugin.Ws)) *Session {
+    w := &plugin.Ws{}
+    w.SetUrl("ws", r.srv.Host, "/ws")
+    if setup != nil {
+        setup(w)
+    }
+    s, err := NewSession(w, Config{Realm: "realm1"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { s.Close() })
+    return s
+}
+
+// add is a procedure that returns the sum of its arguments
+func add(_ context.Context, inv *Invocation) ([]interface{}, map[string]interface{}, error) {
+    sum := 0
+    for _, a := range inv.Args {
+        var n int
+        if err := json.Unmarshal(a, &n); err != nil {
+            return nil, nil, &Error{URI: "wamp.error.invalid_argument", Args: []json.RawMessage{json.RawMessage(`"not a number"`)}}
+        }
+        sum += n
+    }
+    return []interface{}{sum}, nil, nil
+}
+
+// events collect the events of a subscription
+func events() (func(ev *Event), <-chan *Event) {
+    ch := make(chan *Event, 16)
+    return func(ev *Event) { ch <- ev }, ch
+}
+
+func receive(t *testing.T, ch <-chan *Event) *Event {
+    t.Helper()
+    select {
+    case ev := <-ch:
+        return ev
+    case <-time.After(5 * time.Second):
+        t.Fatal("no event received")
+        return nil
+    }
+}
+
+func TestSession_Connect(t *testing.T) {
+    r := newRouter(t)
+    w := &plugin.Ws{}
+    w.SetUrl("ws", r.srv.Host, "/ws")
+    s, err := NewSession(w, Config{Realm: "realm1", Details: map[string]interface{}{"agent": "test"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    r.waitFor(t, "1 hello realm1 4 roles")
+    if s.ID() != 1 || w.Subprotocol() != Subprotocol {
+        t.Errorf("ID(), Subprotocol() = %d, %q", s.ID(), w.Subprotocol())
+    }
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+    r.waitFor(t, "1 goodbye "+CloseRealm)
+}
+
+func TestSession_Connect_noSuchRealm(t *testing.T) {
+    r := newRouter(t)
+    w := &plugin.Ws{}
+    w.SetUrl("ws", r.srv.Host, "/ws")
+    s, err := NewSession(w, Config{Realm: "other"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = s.Connect(context.Background())
+    if !errors.Is(err, plugin.ErrInitRejected) || !strings.Contains(err.Error(), "wamp.error.no_such_realm") {
+        t.Errorf("Connect() error = %v, want the abort reason", err)
+    }
+}
+
+func TestSession_Call(t *testing.T) {
+    r := newRouter(t)
+    callee := newTestSession(t, r, nil)
+    caller := newTestSession(t, r, nil)
+    if _, err := callee.Register(context.Background(), "com.add", add); err != nil {
+        t.Fatal(err)
+    }
+    res, err := caller.Call(context.Background(), "com.add", []interface{}{1, 2, 3}, nil)
+    if err != nil || len(res.Args) != 1 || string(res.Args[0]) != "6" {
+        t.Fatalf("Call() = %+v, %v", res, err)
+    }
+    var we *Error
+    _, err = caller.Call(context.Background(), "com.add", []interface{}{"x"}, nil)
+    if !errors.As(err, &we) || we.URI != "wamp.error.invalid_argument" || len(we.Args) != 1 {
+        t.Errorf("Call() error = %v, want the error of the handler", err)
+    }
+    _, err = caller.Call(context.Background(), "com.missing", nil, map[string]interface{}{"a": 1})
+    if !errors.As(err, &we) || we.URI != ErrorNoSuchProcedure {
+        t.Errorf("Call() error = %v, want %s", err, ErrorNoSuchProcedure)
+    }
+}
+
+func TestSession_Call_runtimeError(t *testing.T) {
+    r := newRouter(t)
+    callee := newTestSession(t, r, nil)
+    caller := newTestSession(t, r, nil)
+    _, err := callee.Register(context.Background(), "com.fail", func(ctx context.Context, inv *Invocation) ([]interface{}, map[string]interface{}, error) {
+        return nil, nil, errors.New("broken")
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    var we *Error
+    if _, err := caller.Call(context.Background(), "com.fail", nil, nil); !errors.As(err, &we) || we.URI != ErrorRuntime || string(we.Args[0]) != `"broken"` {
+        t.Errorf("Call() error = %v, want %s", err, ErrorRuntime)
+    }
+}
+
+func TestSession_Register(t *testing.T) {
+    r := newRouter(t)
+    s := newTestSession(t, r, nil)
+    other := newTestSession(t, r, nil)
+    reg, err := s.Register(context.Background(), "com.add", add)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var we *Error
+    if _, err := other.Register(context.Background(), "com.add", add); !errors.As(err, &we) || we.URI != "wamp.error.procedure_already_exists" {
+        t.Errorf("Register() error = %v, want the procedure to exist", err)
+    }
+    if err := reg.Unregister(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    r.waitFor(t, "1 unregister com.add")
+    if _, err := other.Register(context.Background(), "com.add", add); err != nil {
+        t.Errorf("Register() error = %v after Unregister()", err)
+    }
+}
+
+func TestSession_Subscribe(t *testing.T) {
+    r := newRouter(t)
+    sub := newTestSession(t, r, nil)
+    pub := newTestSession(t, r, nil)
+    handler, ch := events()
+    subscription, err := sub.Subscribe(context.Background(), "com.news", handler)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := pub.Publish(context.Background(), "com.news", []interface{}{"hello"}, map[string]interface{}{"n": 1}, false); err != nil {
+        t.Fatal(err)
+    }
+    ev := receive(t, ch)
+    if ev.Topic != "com.news" || len(ev.Args) != 1 || string(ev.Args[0]) != `"hello"` || string(ev.Kwargs["n"]) != "1" {
+        t.Errorf("event = %+v", ev)
+    }
+    if err := pub.Publish(context.Background(), "com.news", nil, nil, true); err != nil {
+        t.Errorf("Publish() with acknowledge = %v", err)
+    }
+    receive(t, ch)
+    if err := subscription.Unsubscribe(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    r.waitFor(t, "1 unsubscribe com.news")
+}
+
+func TestSession_Subscribe_twice(t *testing.T) {
+    r := newRouter(t)
+    s := newTestSession(t, r, nil)
+    pub := newTestSession(t, r, nil)
+    h1, ch1 := events()
+    h2, ch2 := events()
+    first, err := s.Subscribe(context.Background(), "com.news", h1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := s.Subscribe(context.Background(), "com.news", h2); err != nil {
+        t.Fatal(err)
+    }
+    if err := first.Unsubscribe(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if err := pub.Publish(context.Background(), "com.news", []interface{}{1}, nil, true); err != nil {
+        t.Fatal(err)
+    }
+    receive(t, ch2)
+    select {
+    case ev := <-ch1:
+        t.Errorf("unsubscribed handler got %+v", ev)
+    default:
+    }
+}
+
+func TestSession_reconnect(t *testing.T) {
+    r := newRouter(t)
+    reconnect := func(w *plugin.Ws) { w.Reconnect(true) }
+    callee := newTestSession(t, r, reconnect)
+    if _, err := callee.Register(context.Background(), "com.add", add); err != nil {
+        t.Fatal(err)
+    }
+    handler, ch := events()
+    if _, err := callee.Subscribe(context.Background(), "com.news", handler); err != nil {
+        t.Fatal(err)
+    }
+    r.srv.CloseConnections()
+    r.waitFor(t, "2 register com.add")
+    r.waitFor(t, "2 subscribe com.news")
+    if callee.ID() != 2 {
+        t.Errorf("ID() = %d after the reconnect", callee.ID())
+    }
+    caller := newTestSession(t, r, nil)
+    res, err := caller.Call(context.Background(), "com.add", []interface{}{2, 2}, nil)
+    if err != nil || string(res.Args[0]) != "4" {
+        t.Errorf("Call() = %v, %v after the reconnect", res, err)
+    }
+    if err := caller.Publish(context.Background(), "com.news", []interface{}{"again"}, nil, true); err != nil {
+        t.Fatal(err)
+    }
+    if ev := receive(t, ch); string(ev.Args[0]) != `"again"` {
+        t.Errorf("event = %s after the reconnect", ev.Args)
+    }
+}
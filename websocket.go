@@ -1,12 +1,14 @@
 package websocket
 
 import (
+    "context"
     "crypto/tls"
     "crypto/x509"
+    "encoding/json"
     "errors"
-    `fmt`
-    "log"
     "math/rand"
+    "net"
+    "net/http"
     "net/url"
     "sync"
     "time"
@@ -17,14 +19,19 @@ import (
 // semver 2.0
 const version = "1.2.3"
 
-// global lock for synchronization
-var syncLock = new(sync.Mutex)
-
 // var reconnectLock = new(sync.Mutex)
 
 type Ws struct {
-    // websocket connection
-    conn *websocket.Conn
+    // websocket connection, connLock guards it and connID because a reconnect on one
+    // goroutine replaces them while others read or write
+    conn     *websocket.Conn
+    connLock sync.RWMutex
+    
+    // writeLock allows one writer on the connection at a time
+    writeLock sync.Mutex
+    
+    // connectLock lets one Connect of this Ws run at a time, other Ws connect in parallel
+    connectLock sync.Mutex
     
     // certificate pool used for secure connections
     caPool *x509.CertPool
@@ -41,18 +48,79 @@ type Ws struct {
     // message that is to be sent when a connection is made
     initMsg []byte
     
+    // messages and awaited reply of the init exchange
+    initExchange *InitExchange
+    
     // set to true to automatically try to reconnect
     reconnect    bool
     reconnecting bool
+    maxAttempts  int
+    
+    // connecting is true while Connect runs, attempt is the reconnect attempt it belongs to and
+    // pending is the id of the connection it is setting up
+    connecting bool
+    attempt    int
+    pending    uint64
+    
+    // ended is the id of the last connection whose end was handled
+    ended uint64
+    
+    // settled is signalled when a connect or reconnect ended, it uses stateLock
+    settled *sync.Cond
     
-    // close handler is called when a connection ends
+    // lifecycle hooks
+    hooks Hooks
+    
+    // subprotocols offered to the server in the upgrade request
+    subprotocols []string
+    
+    // netDial makes the network connection, net.Dialer is used when it is nil
+    netDial func(ctx context.Context, network, addr string) (net.Conn, error)
+    
+    // tap receives every frame on the wire
+    tap func(Frame)
+    
+    // clock is used for every sleep, timer and timeout, the system clock is used when it is nil
+    clock Clock
+    
+    // close handler is called when a close frame is received
     closeHandler func(int, string) error
+    
+    // close event handler decides what happens after a connection ended
+    closeEventHandler func(CloseEvent) CloseDecision
+    
+    // closing is set by Close, connectedAt is the time the current connection was made
+    closing     bool
+    connectedAt time.Time
+    stateLock   sync.Mutex
+    
+    // session resumption settings and the last received sequence number
+    resume  *Resume
+    lastSeq int64
+    seqSeen bool
+    seqLock sync.Mutex
+    
+    // logger receives connection events, nothing is logged when it is nil
+    logger Logger
+    
+    // connID is increased for every connection that is made
+    connID uint64
+    
+    // counters that are kept over reconnects
+    metrics metrics
+    
+    // tracer and trace context injection settings
+    tracing *Tracing
+    
+    // interceptors for sent and received messages
+    outbound      []Interceptor
+    inbound       []Interceptor
+    interceptLock sync.Mutex
 }
 
 // create a new caPool, this is needed since we can not add new certs to an empty cert pool
 func init() {
     Websocket.caPool = x509.NewCertPool() // this is not needed with a server that is configured properly
-    fmt.Println("load websocket plugin version: " + version)
 }
 
 // Version return the current version number
@@ -62,53 +130,105 @@ func (w *Ws) Version() string {
 
 // Read a websocket message
 func (w *Ws) Read() (int, []byte, error) {
-    if w.conn == nil {
+    c, id := w.current()
+    if c == nil {
         err := w.Connect()
         if err != nil {
-            return 0, []byte{}, errors.New("can not read when there is no connection, and could not create a connection")
+            return 0, []byte{}, &NotConnectedError{Op: "read", Err: err}
+        }
+        c, id = w.current()
+    }
+    for {
+        t, d, err := c.ReadMessage()
+        w.metrics.messageIn(t, len(d), err)
+        if err != nil {
+            return t, d, w.errCheck(id, err)
+        }
+        w.tapFrame(false, t, d)
+        ctx, span := w.startSpan(context.Background(), "websocket.receive")
+        span.SetAttribute("message_type", t)
+        span.SetAttribute("size", len(d))
+        m, ok, err := w.receive(ctx, Message{Type: t, Data: d})
+        span.End(err)
+        if err != nil {
+            return 0, []byte{}, err
+        }
+        if !ok {
+            // dropped by an interceptor, wait for the next message
+            continue
         }
+        w.trackSeq(m.Data)
+        return m.Type, m.Data, nil
     }
-    t, d, err := w.conn.ReadMessage()
-    w.errCheck(err)
-    return t, d, err
 }
 
 // ReadJSON read a websocket message in json format
 func (w *Ws) ReadJSON(v interface{}) error {
-    if w.conn == nil {
+    if c, _ := w.current(); c == nil {
         err := w.Connect()
         if err != nil {
-            return errors.New("can not read when there is no connection, and could not create a connection")
+            return &NotConnectedError{Op: "read", Err: err}
         }
     }
-    err := w.conn.ReadJSON(v)
-    w.errCheck(err)
-    return err
+    _, d, err := w.Read()
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(d, v)
 }
 
 // WriteMessage write a message
 func (w *Ws) WriteMessage(messageType int, data []byte) error {
-    if w.conn == nil {
-        err := w.Connect()
-        if err != nil {
-            return errors.New("can not read when there is no connection, and could not create a connection")
-        }
-    }
-    err := w.conn.WriteMessage(messageType, data)
-    w.errCheck(err)
-    return err
+    return w.WriteMessageContext(context.Background(), messageType, data)
+}
+
+// WriteMessageContext write a message, the send span is a child of the span in ctx
+func (w *Ws) WriteMessageContext(ctx context.Context, messageType int, data []byte) error {
+    return w.write(ctx, messageType, data, false)
 }
 
 // WriteJSON write a message in json format
 func (w *Ws) WriteJSON(v interface{}) error {
-    if w.conn == nil {
+    return w.WriteJSONContext(context.Background(), v)
+}
+
+// WriteJSONContext write a message in json format, the trace context of ctx can be injected into it
+func (w *Ws) WriteJSONContext(ctx context.Context, v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    return w.write(ctx, websocket.TextMessage, data, true)
+}
+
+// write a message, trace context is injected into json messages
+func (w *Ws) write(ctx context.Context, messageType int, data []byte, isJSON bool) error {
+    c, id := w.current()
+    if c == nil {
         err := w.Connect()
         if err != nil {
-            return errors.New("can not read when there is no connection, and could not create a connection")
+            return &NotConnectedError{Op: "write", Err: err}
         }
+        c, id = w.current()
+    }
+    ctx, span := w.startSpan(ctx, "websocket.send")
+    if isJSON {
+        data = w.injectJSON(ctx, data)
     }
-    err := w.conn.WriteJSON(v)
-    w.errCheck(err)
+    span.SetAttribute("message_type", messageType)
+    span.SetAttribute("size", len(data))
+    send := w.sendChain(func(ctx context.Context, m *Message) error {
+        w.writeLock.Lock()
+        err := c.WriteMessage(m.Type, m.Data)
+        w.writeLock.Unlock()
+        if err == nil {
+            w.tapFrame(true, m.Type, m.Data)
+        }
+        w.metrics.messageOut(m.Type, len(m.Data), err)
+        return w.errCheck(id, err)
+    })
+    err := send(ctx, &Message{Type: messageType, Data: data})
+    span.End(err)
     return err
 }
 
@@ -122,45 +242,125 @@ func (w *Ws) SetUrl(scheme, host, path string) {
     w.url = url.URL{Scheme: scheme, Host: host, Path: path}
 }
 
+// SetQuery set the query of the url to connect to, SetUrl clears it
+func (w *Ws) SetQuery(q url.Values) {
+    w.url.RawQuery = q.Encode()
+}
+
 // Connect to the websocket server
 func (w *Ws) Connect() error {
-    syncLock.Lock()
-    defer syncLock.Unlock()
-    log.Println("locked connect mutex")
+    return w.ConnectContext(context.Background())
+}
+
+// ConnectContext connect to the websocket server, ctx can cancel the handshake and carries the parent span
+func (w *Ws) ConnectContext(ctx context.Context) (err error) {
+    w.connectLock.Lock()
+    defer w.connectLock.Unlock()
+    w.stateLock.Lock()
+    w.connecting = true
+    attempt := w.attempt
+    w.stateLock.Unlock()
+    defer func() {
+        w.stateLock.Lock()
+        w.connecting = false
+        w.pending = 0
+        w.settledCond().Broadcast()
+        w.stateLock.Unlock()
+    }()
+    ctx, span := w.startSpan(ctx, "websocket.connect")
+    defer func() { span.End(err) }()
+    w.log().Debug("locked connect mutex", w.logArgs()...)
     var d websocket.Dialer
+    d.NetDialContext = w.netDial
+    d.Subprotocols = w.subprotocols
+    dialCtx := ctx
+    var timer *expiry
     if w.secure {
         config := tls.Config{RootCAs: w.caPool}
-        d = websocket.Dialer{TLSClientConfig: &config, HandshakeTimeout: 30 * time.Second}
+        d.TLSClientConfig = &config
+        dialCtx, d.NetDialContext, timer = startHandshakeTimer(ctx, w.getClock(), 30*time.Second, w.netDial)
     }
-    log.Println("attempting to make connection")
-    c, _, err := d.Dial(w.url.String(), nil)
+    w.log().Debug("attempting to make connection", w.logArgs()...)
+    u := w.url
+    h := http.Header{}
+    resumeMsg := w.resumeHandshake(&u, h)
+    w.injectHeaders(ctx, h)
+    start := w.now()
+    c, resp, err := d.DialContext(w.traceDial(dialCtx, u.Scheme == "wss"), u.String(), h)
+    if timer != nil {
+        timer.stop(err == nil)
+    }
+    w.metrics.dial(w.now().Sub(start), w.now(), err)
     if err != nil {
-        return err
+        return dialError(u.String(), resp, err)
     }
-    if w.conn != nil {
-        log.Println("closing existing connection")
-        err = w.Close()
-        if err != nil {
-            log.Println(err)
+    if old, _ := w.current(); old != nil {
+        // the replaced connection is not counted as a disconnect, the new one is already up
+        w.log().Debug("closing existing connection", w.logArgs()...)
+        if cerr := old.Close(); cerr != nil {
+            w.log().Warn("could not close existing connection", w.logArgs("err", cerr)...)
         }
     }
-    log.Println("made a connection")
+    c.SetCloseHandler(w.handleClose(c))
+    w.connLock.Lock()
     w.conn = c
-    w.conn.SetCloseHandler(w.closeHandler)
-    if w.sendInitMsg {
-        log.Println("send innit message exiting connect")
-        return w.WriteMessage(1, w.initMsg)
+    w.connID++
+    id := w.connID
+    w.connLock.Unlock()
+    w.stateLock.Lock()
+    w.pending = id
+    w.closing = false
+    w.connectedAt = w.now()
+    w.stateLock.Unlock()
+    w.log().Info("made a connection", w.logArgs()...)
+    if w.initExchange != nil {
+        w.log().Debug("run init exchange", w.logArgs()...)
+        if err = w.runInitExchange(ctx, resumeMsg); err != nil {
+            w.log().Warn("init exchange failed", w.logArgs("err", err)...)
+            w.abortConnect()
+            return err
+        }
+    } else if resumeMsg != nil {
+        w.log().Debug("send resume message", w.logArgs()...)
+        err = w.WriteMessageContext(ctx, 1, resumeMsg)
+    } else if w.sendInitMsg {
+        w.log().Debug("send init message", w.logArgs()...)
+        err = w.WriteMessageContext(ctx, 1, w.initMsg)
+    }
+    if err != nil {
+        w.log().Warn("could not send the first message", w.logArgs("err", err)...)
+        w.abortConnect()
+        return err
     }
-    return nil
+    return w.onConnect(ConnectInfo{ConnID: id, Response: resp, Attempt: attempt})
 }
 
-// SetInitMsg set a message to be sent when a connection is established
+// SetInitMsg set a message to be sent when a connection is established, it replaces the init exchange
 func (w *Ws) SetInitMsg(msg []byte) {
     w.sendInitMsg = true
     w.initMsg = msg
+    w.initExchange = nil
 }
 
-// SetCloseHandler set a close handler to call when a connection ends
+// abortConnect close a connection that was made but could not be set up
+func (w *Ws) abortConnect() {
+    if err := w.Close(); err != nil {
+        w.log().Warn("could not close connection", w.logArgs("err", err)...)
+    }
+    w.connLock.Lock()
+    w.conn = nil
+    w.connLock.Unlock()
+}
+
+// current return the connection in use and its id, the connection is nil before Connect
+func (w *Ws) current() (*websocket.Conn, uint64) {
+    w.connLock.RLock()
+    defer w.connLock.RUnlock()
+    return w.conn, w.connID
+}
+
+// SetCloseHandler set a close handler to call when a close frame is received,
+// the close frame is echoed to the server after the handler returns without an error
 func (w *Ws) SetCloseHandler(f func(int, string) error) {
     w.closeHandler = f
 }
@@ -172,30 +372,156 @@ func (w *Ws) Reconnect(b bool) {
 
 // Close the websocket connection
 func (w *Ws) Close() error {
-    if w.conn == nil {
+    c, _ := w.current()
+    if c == nil {
         return nil
     }
     // w.WriteMessage(websocket.CloseMessage, []byte{})
-    return w.conn.Close()
+    w.stateLock.Lock()
+    w.closing = true
+    w.stateLock.Unlock()
+    w.metrics.disconnect(w.now(), nil)
+    return c.Close()
 }
 
-// check for network problems
-func (w *Ws) errCheck(err error) {
-    if err != nil {
-        log.Println(err)
+// Drop close the current connection like a network failure would, unlike Close the end of the
+// connection is not local so the close policy decides about reconnecting, for example after a
+// heartbeat timeout
+func (w *Ws) Drop() error {
+    c, _ := w.current()
+    if c == nil {
+        return nil
+    }
+    return c.Close()
+}
+
+// Reconnected return true when a newer connection than conn is in use, a read or write that failed on
+// conn returns after the plugin reconnected or gave up so a protocol client can call it to know if it
+// can go on, a connection that failed its init exchange or connect hook is not counted
+func (w *Ws) Reconnected(conn uint64) bool {
+    w.stateLock.Lock()
+    defer w.stateLock.Unlock()
+    c, id := w.current()
+    return c != nil && id != conn && id != w.pending
+}
+
+// check for network problems on connection id, the returned error is the one the caller should report
+func (w *Ws) errCheck(id uint64, err error) error {
+    if err == nil {
+        return nil
     }
-    if w.reconnecting {
-        return
+    err = connError(err)
+    var ce *ClosedError
+    if errors.As(err, &ce) {
+        w.log().Info("connection closed", w.logArgs("close_code", ce.Code, "reason", ce.Reason)...)
+    } else {
+        w.log().Error("connection error", w.logArgs("err", err)...)
     }
-    if w.reconnect && err != nil {
-        w.reconnecting = true
-        for err != nil {
-            err = w.Connect()
-            time.Sleep(time.Duration(rand.Intn(3000)) * time.Second)
-        }
+    // only one goroutine handles the end of a connection, the others wait until it is
+    // replaced and return the error, errors of a connection that is being set up fail the connect
+    // and errors of a connection that already ended are only returned
+    w.stateLock.Lock()
+    if id != 0 && id == w.pending {
+        w.stateLock.Unlock()
+        return err
+    }
+    for w.reconnecting || w.connecting {
+        w.settledCond().Wait()
+    }
+    if id != w.ConnID() || (id != 0 && id == w.ended) {
+        w.stateLock.Unlock()
+        return err
+    }
+    w.ended = id
+    w.reconnecting = true
+    w.stateLock.Unlock()
+    defer func() {
+        w.stateLock.Lock()
         w.reconnecting = false
-        return
+        w.settledCond().Broadcast()
+        w.stateLock.Unlock()
+    }()
+    w.metrics.disconnect(w.now(), err)
+    event := w.closeEvent(err)
+    w.onDisconnect(event)
+    decision := w.closeDecision(event)
+    if !w.reconnect {
+        return err
     }
+    if decision.Action == ActionStop {
+        w.log().Info("not reconnecting", w.logArgs("close_code", event.Code)...)
+        w.onGiveUp(0, err)
+        return err
+    }
+    if decision.Action == ActionReconnectAfter {
+        w.log().Info("waiting before reconnecting", w.logArgs("delay", decision.Delay)...)
+        w.getClock().Sleep(decision.Delay)
+    }
+    defer w.setAttempt(0)
+    var dialErr error
+    for attempt := 1; ; attempt++ {
+        w.log().Info("reconnecting", w.logArgs("attempt", attempt)...)
+        w.metrics.reconnect(attempt)
+        w.onReconnectAttempt(attempt, dialErr)
+        w.setAttempt(attempt)
+        dialErr = w.Connect()
+        if dialErr == nil {
+            return err
+        }
+        w.log().Warn("reconnect failed", w.logArgs("attempt", attempt, "err", dialErr)...)
+        if w.maxAttempts > 0 && attempt >= w.maxAttempts {
+            w.log().Error("giving up reconnecting", w.logArgs("attempt", attempt, "err", dialErr)...)
+            rerr := &ReconnectError{Attempts: attempt, Err: dialErr}
+            w.onGiveUp(attempt, rerr)
+            return rerr
+        }
+        w.getClock().Sleep(time.Duration(rand.Intn(3000)) * time.Second)
+    }
+}
+
+// settledCond return the condition that is signalled when a connect or reconnect ended,
+// stateLock must be held
+func (w *Ws) settledCond() *sync.Cond {
+    if w.settled == nil {
+        w.settled = sync.NewCond(&w.stateLock)
+    }
+    return w.settled
+}
+
+// setAttempt set the reconnect attempt the next Connect belongs to
+func (w *Ws) setAttempt(attempt int) {
+    w.stateLock.Lock()
+    w.attempt = attempt
+    w.stateLock.Unlock()
+}
+
+// SetMaxReconnectAttempts limit the number of reconnect attempts after a failure, 0 keeps trying forever
+func (w *Ws) SetMaxReconnectAttempts(n int) {
+    w.maxAttempts = n
+}
+
+// SetSubprotocols set the subprotocols offered to the server, in order of preference
+func (w *Ws) SetSubprotocols(protocols ...string) {
+    w.subprotocols = protocols
+}
+
+// Subprotocol return the subprotocol the server chose for the current connection
+func (w *Ws) Subprotocol() string {
+    c, _ := w.current()
+    if c == nil {
+        return ""
+    }
+    return c.Subprotocol()
+}
+
+// SetNetDial set the function that makes the network connection, for example a proxy or a fault injecting dialer
+func (w *Ws) SetNetDial(f func(ctx context.Context, network, addr string) (net.Conn, error)) {
+    w.netDial = f
+}
+
+// NetDial return the function that makes the network connection, it is nil when net.Dialer is used
+func (w *Ws) NetDial() func(ctx context.Context, network, addr string) (net.Conn, error) {
+    return w.netDial
 }
 
 // SetSecure set the secure bit
@@ -208,8 +534,8 @@ func (w *Ws) SetSecure(b bool) {
 func (w *Ws) WriteQueue(c chan []byte, e chan error) {
     go func() {
         for bytes := range c {
+            w.metrics.queueDepth(len(c))
             err := w.WriteMessage(1, bytes)
-            w.errCheck(err)
             if err != nil {
                 e <- err
                 // when the buffer is full we remove an old element and insert a new one,
@@ -219,7 +545,7 @@ func (w *Ws) WriteQueue(c chan []byte, e chan error) {
                     <-c
                 }
                 c <- bytes
-                time.Sleep(time.Second)
+                w.getClock().Sleep(time.Second)
             }
         }
     }()
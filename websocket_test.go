@@ -4,9 +4,12 @@ import (
     "crypto/x509"
     "net/url"
     "reflect"
+    "sync"
     "testing"
+    "time"
 
     "github.com/gorilla/websocket"
+    "github.com/pizzalord22/go-web-plug/wstest"
 )
 
 func TestWs_AppendCertsFromPem(t *testing.T) {
@@ -89,6 +92,10 @@ func TestWs_Close(t *testing.T) {
 }
 
 func TestWs_Connect(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Echo()))
+    defer srv.Close()
+    tlsSrv := wstest.NewTLSServer(wstest.Script(wstest.Echo()))
+    defer tlsSrv.Close()
     type fields struct {
         conn         *websocket.Conn
         caPool       *x509.CertPool
@@ -104,7 +111,11 @@ func TestWs_Connect(t *testing.T) {
         fields  fields
         wantErr bool
     }{
-        // TODO: Add test cases.
+        {name: "connect", fields: fields{url: url.URL{Scheme: "ws", Host: srv.Host}}, wantErr: false},
+        {name: "connect with init message", fields: fields{url: url.URL{Scheme: "ws", Host: srv.Host}, sendInitMsg: true, initMsg: []byte("hi")}, wantErr: false},
+        {name: "connect secure", fields: fields{url: url.URL{Scheme: "wss", Host: tlsSrv.Host}, secure: true, caPool: tlsSrv.CertPool}, wantErr: false},
+        {name: "secure with unknown ca", fields: fields{url: url.URL{Scheme: "wss", Host: tlsSrv.Host}, secure: true, caPool: x509.NewCertPool()}, wantErr: true},
+        {name: "no server", fields: fields{url: url.URL{Scheme: "ws", Host: "127.0.0.1:1"}}, wantErr: true},
     }
     for _, tt := range tests {
         t.Run(tt.name, func(t *testing.T) {
@@ -121,11 +132,14 @@ func TestWs_Connect(t *testing.T) {
             if err := w.Connect(); (err != nil) != tt.wantErr {
                 t.Errorf("Connect() error = %v, wantErr %v", err, tt.wantErr)
             }
+            w.Close()
         })
     }
 }
 
 func TestWs_Read(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.SendText("hello"), wstest.Drain()))
+    defer srv.Close()
     type fields struct {
         conn         *websocket.Conn
         caPool       *x509.CertPool
@@ -143,7 +157,8 @@ func TestWs_Read(t *testing.T) {
         want1   []byte
         wantErr bool
     }{
-        // TODO: Add test cases.
+        {name: "connect and read", fields: fields{url: url.URL{Scheme: "ws", Host: srv.Host}}, want: websocket.TextMessage, want1: []byte("hello"), wantErr: false},
+        {name: "no server", fields: fields{url: url.URL{Scheme: "ws", Host: "127.0.0.1:1"}}, want: 0, want1: []byte{}, wantErr: true},
     }
     for _, tt := range tests {
         t.Run(tt.name, func(t *testing.T) {
@@ -157,6 +172,7 @@ func TestWs_Read(t *testing.T) {
                 reconnect:    tt.fields.reconnect,
                 closeHandler: tt.fields.closeHandler,
             }
+            defer w.Close()
             got, got1, err := w.Read()
             if (err != nil) != tt.wantErr {
                 t.Errorf("Read() error = %v, wantErr %v", err, tt.wantErr)
@@ -348,7 +364,7 @@ func TestWs_Version(t *testing.T) {
         fields fields
         want   string
     }{
-        // TODO: Add test cases.
+        {name: "version", fields: fields{}, want: version},
     }
     for _, tt := range tests {
         t.Run(tt.name, func(t *testing.T) {
@@ -411,6 +427,8 @@ func TestWs_WriteJSON(t *testing.T) {
 }
 
 func TestWs_WriteMessage(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer srv.Close()
     type fields struct {
         conn         *websocket.Conn
         caPool       *x509.CertPool
@@ -431,7 +449,9 @@ func TestWs_WriteMessage(t *testing.T) {
         args    args
         wantErr bool
     }{
-        // TODO: Add test cases.
+        {name: "text", fields: fields{url: url.URL{Scheme: "ws", Host: srv.Host}}, args: args{messageType: websocket.TextMessage, data: []byte("a")}, wantErr: false},
+        {name: "binary", fields: fields{url: url.URL{Scheme: "ws", Host: srv.Host}}, args: args{messageType: websocket.BinaryMessage, data: []byte{1}}, wantErr: false},
+        {name: "no server", fields: fields{url: url.URL{Scheme: "ws", Host: "127.0.0.1:1"}}, args: args{messageType: websocket.TextMessage, data: []byte("a")}, wantErr: true},
     }
     for _, tt := range tests {
         t.Run(tt.name, func(t *testing.T) {
@@ -445,6 +465,7 @@ func TestWs_WriteMessage(t *testing.T) {
                 reconnect:    tt.fields.reconnect,
                 closeHandler: tt.fields.closeHandler,
             }
+            defer w.Close()
             if err := w.WriteMessage(tt.args.messageType, tt.args.data); (err != nil) != tt.wantErr {
                 t.Errorf("WriteMessage() error = %v, wantErr %v", err, tt.wantErr)
             }
@@ -453,6 +474,8 @@ func TestWs_WriteMessage(t *testing.T) {
 }
 
 func TestWs_WriteQueue(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer srv.Close()
     type fields struct {
         conn         *websocket.Conn
         caPool       *x509.CertPool
@@ -468,11 +491,14 @@ func TestWs_WriteQueue(t *testing.T) {
         e chan error
     }
     tests := []struct {
-        name   string
-        fields fields
-        args   args
+        name     string
+        fields   fields
+        args     args
+        messages []string
+        wantErr  bool
     }{
-        // TODO: Add test cases.
+        {name: "send in order", fields: fields{url: url.URL{Scheme: "ws", Host: srv.Host}}, args: args{c: make(chan []byte, 5), e: make(chan error, 5)}, messages: []string{"1", "2", "3"}},
+        {name: "requeue on error", fields: fields{url: url.URL{Scheme: "ws", Host: "127.0.0.1:1"}}, args: args{c: make(chan []byte, 5), e: make(chan error, 5)}, messages: []string{"1"}, wantErr: true},
     }
     for _, tt := range tests {
         t.Run(tt.name, func(t *testing.T) {
@@ -486,12 +512,38 @@ func TestWs_WriteQueue(t *testing.T) {
                 reconnect:    tt.fields.reconnect,
                 closeHandler: tt.fields.closeHandler,
             }
-            _ = w
+            defer w.Close()
+            for _, m := range tt.messages {
+                tt.args.c <- []byte(m)
+            }
+            w.WriteQueue(tt.args.c, tt.args.e)
+            if tt.wantErr {
+                select {
+                case <-tt.args.e:
+                case <-time.After(time.Second):
+                    t.Fatal("WriteQueue() did not report an error")
+                }
+                time.Sleep(10 * time.Millisecond)
+                if got := len(tt.args.c); got != len(tt.messages) {
+                    t.Errorf("WriteQueue() queue length = %v, want the message to be requeued", got)
+                }
+                return
+            }
+            if !srv.WaitFor(len(tt.messages), time.Second) {
+                t.Fatalf("WriteQueue() sent %v, want %v", srv.Received(), tt.messages)
+            }
+            for i, m := range tt.messages {
+                if got := string(srv.Received()[i].Data); got != m {
+                    t.Errorf("WriteQueue() message %d = %v, want %v", i, got, m)
+                }
+            }
         })
     }
 }
 
 func TestWs_errCheck(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer srv.Close()
     type fields struct {
         conn         *websocket.Conn
         caPool       *x509.CertPool
@@ -503,14 +555,20 @@ func TestWs_errCheck(t *testing.T) {
         closeHandler func(int, string) error
     }
     type args struct {
+        id  uint64
         err error
     }
     tests := []struct {
-        name   string
-        fields fields
-        args   args
+        name      string
+        fields    fields
+        args      args
+        wantErr   bool
+        wantConns int
     }{
-        // TODO: Add test cases.
+        {name: "no error", fields: fields{url: url.URL{Scheme: "ws", Host: srv.Host}, reconnect: true}, args: args{err: nil}, wantConns: 0},
+        {name: "error without reconnect", fields: fields{url: url.URL{Scheme: "ws", Host: srv.Host}}, args: args{err: errTest}, wantErr: true, wantConns: 0},
+        {name: "error with reconnect", fields: fields{url: url.URL{Scheme: "ws", Host: srv.Host}, reconnect: true}, args: args{err: errTest}, wantErr: true, wantConns: 1},
+        {name: "error of a replaced connection", fields: fields{url: url.URL{Scheme: "ws", Host: srv.Host}, reconnect: true}, args: args{id: 1, err: errTest}, wantErr: true, wantConns: 0},
     }
     for _, tt := range tests {
         t.Run(tt.name, func(t *testing.T) {
@@ -524,7 +582,160 @@ func TestWs_errCheck(t *testing.T) {
                 reconnect:    tt.fields.reconnect,
                 closeHandler: tt.fields.closeHandler,
             }
-            _ = w
+            defer w.Close()
+            before := srv.Connections()
+            if err := w.errCheck(tt.args.id, tt.args.err); (err != nil) != tt.wantErr {
+                t.Errorf("errCheck() error = %v, wantErr %v", err, tt.wantErr)
+            }
+            if got := srv.Connections() - before; got != tt.wantConns {
+                t.Errorf("errCheck() made %v connections, want %v", got, tt.wantConns)
+            }
         })
     }
 }
+
+// newTestWs start a server that runs handler for every connection and return a Ws that is connected to it
+func newTestWs(t *testing.T, handler wstest.Handler) (*Ws, *wstest.Server) {
+    srv := wstest.NewServer(handler)
+    t.Cleanup(srv.Close)
+    w := &Ws{}
+    w.SetUrl("ws", srv.Host, "/")
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { w.Close() })
+    return w, srv
+}
+
+// echo every message back until the connection fails
+func echo(c *wstest.Conn) {
+    wstest.Echo()(c)
+}
+
+func TestWs_ReconnectWhileSending(t *testing.T) {
+    w, srv := newTestWs(t, wstest.Script(wstest.Echo()))
+    w.Reconnect(true)
+    w.SetMaxReconnectAttempts(1)
+    stop := make(chan struct{})
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+                _ = w.WriteMessage(websocket.TextMessage, []byte("ping"))
+            }
+        }
+    }()
+    go func() {
+        defer wg.Done()
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+                _, _, _ = w.Read()
+            }
+        }
+    }()
+    for id := uint64(1); id <= 4; id++ {
+        deadline := time.Now().Add(2 * time.Second)
+        for w.ConnID() < id {
+            if time.Now().After(deadline) {
+                t.Fatalf("ConnID() = %v, want a reconnect to connection %v", w.ConnID(), id)
+            }
+            time.Sleep(time.Millisecond)
+        }
+        if id < 4 {
+            srv.CloseConnections()
+        }
+    }
+    close(stop)
+    // a write unblocks the reader with an echo
+    _ = w.WriteMessage(websocket.TextMessage, []byte("last"))
+    w.Close()
+    wg.Wait()
+}
+
+func TestWs_Drop(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Script(wstest.Echo()))
+    w.Reconnect(true)
+    events := make(chan CloseEvent, 1)
+    w.SetCloseEventHandler(func(e CloseEvent) CloseDecision {
+        events <- e
+        return DefaultClosePolicy(e)
+    })
+    if err := w.Drop(); err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := w.Read(); err == nil {
+        t.Fatal("Read() error = nil on a dropped connection")
+    }
+    if e := <-events; e.Local {
+        t.Errorf("close event = %+v, want a dropped connection to not be local", e)
+    }
+    if got := w.ConnID(); got != 2 {
+        t.Errorf("ConnID() = %v, want a reconnect after Drop()", got)
+    }
+}
+
+func TestWs_Reconnected(t *testing.T) {
+    w, _ := newTestWs(t, wstest.Script(wstest.Echo()))
+    if w.Reconnected(1) || !w.Reconnected(0) {
+        t.Errorf("Reconnected(1), Reconnected(0) = %v, %v, want only an older connection to be replaced", w.Reconnected(1), w.Reconnected(0))
+    }
+    w.SetHooks(Hooks{OnConnect: func(*Ws, ConnectInfo) error { return errTest }})
+    if err := w.Connect(); err == nil {
+        t.Fatal("Connect() error = nil, want the hook error")
+    }
+    if w.ConnID() != 2 || w.Reconnected(1) {
+        t.Errorf("Reconnected(1) = true after connection %d failed its connect hook", w.ConnID())
+    }
+}
+
+func TestWs_SetSubprotocols(t *testing.T) {
+    tests := []struct {
+        name    string
+        offered []string
+        want    string
+    }{
+        {name: "none offered", want: ""},
+        {name: "supported", offered: []string{"mqttv3.1", "mqtt"}, want: "mqtt"},
+        {name: "unsupported", offered: []string{"stomp"}, want: ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+            srv.Upgrader.Subprotocols = []string{"mqtt"}
+            defer srv.Close()
+            w := &Ws{}
+            w.SetUrl("ws", srv.Host, "/")
+            w.SetSubprotocols(tt.offered...)
+            if err := w.Connect(); err != nil {
+                t.Fatal(err)
+            }
+            defer w.Close()
+            if got := w.Subprotocol(); got != tt.want {
+                t.Errorf("Subprotocol() = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestWs_SetQuery(t *testing.T) {
+    srv := wstest.NewServer(wstest.Script(wstest.Drain()))
+    defer srv.Close()
+    w := &Ws{}
+    w.SetUrl("ws", srv.Host, "/socket.io/")
+    w.SetQuery(url.Values{"EIO": {"4"}, "transport": {"websocket"}})
+    if err := w.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+    if got := srv.Handshakes()[0].URL.String(); got != "/socket.io/?EIO=4&transport=websocket" {
+        t.Errorf("handshake url = %q", got)
+    }
+}
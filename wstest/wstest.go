@@ -0,0 +1,445 @@
+// Package wstest provides an in-process websocket server for tests,
+// connections are handled by scripts of steps like sending, expecting and closing
+package wstest
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "math/big"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// Frame is a message received by the server
+type Frame struct {
+    // Conn is the number of the connection that received the frame, starting at 1
+    Conn int
+    Type int
+    Data []byte
+}
+
+// Handshake is an upgrade request received by the server
+type Handshake struct {
+    Conn   int
+    URL    *url.URL
+    Header http.Header
+}
+
+// Handler runs for every connection, the connection is closed when it returns
+type Handler func(c *Conn)
+
+// Server is a websocket server running on a local port
+type Server struct {
+    // URL is the websocket url of the server, ws:// or wss://
+    URL string
+
+    // Host is the host and port of the server
+    Host string
+
+    // CAPEM is the pem encoded certificate authority of a TLS server, it is nil without TLS
+    CAPEM []byte
+
+    // CertPool contains the certificate authority of a TLS server
+    CertPool *x509.CertPool
+
+    // Upgrader is used for every connection, it can be changed before the first connection
+    Upgrader websocket.Upgrader
+
+    srv     *httptest.Server
+    handler Handler
+
+    lock       sync.Mutex
+    conns      int
+    open       map[*Conn]struct{}
+    received   []Frame
+    handshakes []Handshake
+    errs       []error
+}
+
+// NewServer start a server that runs handler for every connection
+func NewServer(handler Handler) *Server {
+    s := newServer(handler)
+    s.srv = httptest.NewServer(s)
+    s.setURL("ws")
+    return s
+}
+
+// NewTLSServer start a server with a certificate signed by a freshly generated certificate authority
+func NewTLSServer(handler Handler) *Server {
+    s := newServer(handler)
+    cert, caPEM, err := generateCert()
+    if err != nil {
+        panic("wstest: " + err.Error())
+    }
+    s.CAPEM = caPEM
+    s.CertPool = x509.NewCertPool()
+    s.CertPool.AppendCertsFromPEM(caPEM)
+    s.srv = httptest.NewUnstartedServer(s)
+    s.srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+    s.srv.StartTLS()
+    s.setURL("wss")
+    return s
+}
+
+func newServer(handler Handler) *Server {
+    return &Server{
+        handler:  handler,
+        open:     map[*Conn]struct{}{},
+        Upgrader: websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }},
+    }
+}
+
+func (s *Server) setURL(scheme string) {
+    u, _ := url.Parse(s.srv.URL)
+    s.Host = u.Host
+    s.URL = scheme + "://" + u.Host
+}
+
+// ServeHTTP upgrade the request and run the handler
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+    s.lock.Lock()
+    s.conns++
+    n := s.conns
+    s.handshakes = append(s.handshakes, Handshake{Conn: n, URL: r.URL, Header: r.Header.Clone()})
+    s.lock.Unlock()
+    ws, err := s.Upgrader.Upgrade(rw, r, nil)
+    if err != nil {
+        s.fail(err)
+        return
+    }
+    c := &Conn{Conn: ws, Index: n, Request: r, server: s}
+    s.lock.Lock()
+    s.open[c] = struct{}{}
+    s.lock.Unlock()
+    defer func() {
+        s.lock.Lock()
+        delete(s.open, c)
+        s.lock.Unlock()
+        ws.Close()
+    }()
+    s.handler(c)
+}
+
+// Close shut the server down and close every open connection
+func (s *Server) Close() {
+    s.CloseConnections()
+    s.srv.Close()
+}
+
+// CloseConnections drop every open connection without a close frame, the server keeps accepting new ones
+func (s *Server) CloseConnections() {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    for c := range s.open {
+        c.Conn.UnderlyingConn().Close()
+    }
+}
+
+// Connections return the number of connections that were made
+func (s *Server) Connections() int {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    return s.conns
+}
+
+// Received return every frame received by a script step
+func (s *Server) Received() []Frame {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    frames := make([]Frame, len(s.received))
+    copy(frames, s.received)
+    return frames
+}
+
+// Handshakes return every upgrade request
+func (s *Server) Handshakes() []Handshake {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    h := make([]Handshake, len(s.handshakes))
+    copy(h, s.handshakes)
+    return h
+}
+
+// Err return the errors of failed steps and expectations joined together, nil when there were none
+func (s *Server) Err() error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if len(s.errs) == 0 {
+        return nil
+    }
+    msgs := make([]string, len(s.errs))
+    for i, err := range s.errs {
+        msgs[i] = err.Error()
+    }
+    return fmt.Errorf("wstest: %s", strings.Join(msgs, "; "))
+}
+
+// WaitFor wait until the server received n frames, false when the timeout passed first
+func (s *Server) WaitFor(n int, timeout time.Duration) bool {
+    deadline := time.Now().Add(timeout)
+    for time.Now().Before(deadline) {
+        if len(s.Received()) >= n {
+            return true
+        }
+        time.Sleep(time.Millisecond)
+    }
+    return false
+}
+
+func (s *Server) fail(err error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.errs = append(s.errs, err)
+}
+
+func (s *Server) record(f Frame) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.received = append(s.received, f)
+}
+
+// Conn is a connection on the server side
+type Conn struct {
+    *websocket.Conn
+
+    // Index is the number of the connection, starting at 1
+    Index int
+
+    // Request is the upgrade request
+    Request *http.Request
+
+    server *Server
+}
+
+// Receive read a frame and record it on the server
+func (c *Conn) Receive() (int, []byte, error) {
+    t, d, err := c.ReadMessage()
+    if err == nil {
+        c.server.record(Frame{Conn: c.Index, Type: t, Data: d})
+    }
+    return t, d, err
+}
+
+// Step is a single action of a script, a step that returns an error ends the script
+type Step func(c *Conn) error
+
+// Script return a handler that runs the steps in order, failures are reported by Server.Err
+func Script(steps ...Step) Handler {
+    return func(c *Conn) {
+        for i, step := range steps {
+            if err := step(c); err != nil {
+                if err != errStop {
+                    c.server.fail(fmt.Errorf("conn %d step %d: %v", c.Index, i+1, err))
+                }
+                return
+            }
+        }
+    }
+}
+
+// Sequence return a handler that runs the n-th handler for the n-th connection,
+// the last handler is used for every connection after that
+func Sequence(handlers ...Handler) Handler {
+    return func(c *Conn) {
+        i := c.Index - 1
+        if i >= len(handlers) {
+            i = len(handlers) - 1
+        }
+        handlers[i](c)
+    }
+}
+
+// errStop ends a script without reporting an error
+var errStop = fmt.Errorf("stop")
+
+// Echo send every received frame back until the connection ends
+func Echo() Step {
+    return func(c *Conn) error {
+        for {
+            t, d, err := c.Receive()
+            if err != nil {
+                return errStop
+            }
+            if err := c.WriteMessage(t, d); err != nil {
+                return errStop
+            }
+        }
+    }
+}
+
+// Drain read and record frames until the connection ends
+func Drain() Step {
+    return func(c *Conn) error {
+        for {
+            if _, _, err := c.Receive(); err != nil {
+                return errStop
+            }
+        }
+    }
+}
+
+// Send write a frame
+func Send(messageType int, data []byte) Step {
+    return func(c *Conn) error {
+        return c.WriteMessage(messageType, data)
+    }
+}
+
+// SendText write a text frame
+func SendText(s string) Step {
+    return Send(websocket.TextMessage, []byte(s))
+}
+
+// SendJSON write v as a json text frame
+func SendJSON(v interface{}) Step {
+    return func(c *Conn) error {
+        return c.WriteJSON(v)
+    }
+}
+
+// Expect read a frame and check it with f
+func Expect(f func(messageType int, data []byte) error) Step {
+    return func(c *Conn) error {
+        t, d, err := c.Receive()
+        if err != nil {
+            return err
+        }
+        return f(t, d)
+    }
+}
+
+// ExpectText read a frame and check that it is the text s
+func ExpectText(s string) Step {
+    return Expect(func(t int, d []byte) error {
+        if t != websocket.TextMessage || string(d) != s {
+            return fmt.Errorf("expected text %q, got type %d %q", s, t, d)
+        }
+        return nil
+    })
+}
+
+// ExpectBinary read a frame and check that it is the binary data b
+func ExpectBinary(b []byte) Step {
+    return Expect(func(t int, d []byte) error {
+        if t != websocket.BinaryMessage || !bytes.Equal(d, b) {
+            return fmt.Errorf("expected binary %x, got type %d %x", b, t, d)
+        }
+        return nil
+    })
+}
+
+// ExpectJSON read a frame and check that it holds the same json as v
+func ExpectJSON(v interface{}) Step {
+    return Expect(func(t int, d []byte) error {
+        want, err := json.Marshal(v)
+        if err != nil {
+            return err
+        }
+        var a, b interface{}
+        if err := json.Unmarshal(want, &a); err != nil {
+            return err
+        }
+        if err := json.Unmarshal(d, &b); err != nil {
+            return fmt.Errorf("expected json %s, got %q: %v", want, d, err)
+        }
+        if !jsonEqual(a, b) {
+            return fmt.Errorf("expected json %s, got %s", want, d)
+        }
+        return nil
+    })
+}
+
+// CloseWith send a close frame with code and reason and wait shortly for the echo
+func CloseWith(code int, reason string) Step {
+    return func(c *Conn) error {
+        msg := websocket.FormatCloseMessage(code, reason)
+        if err := c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+            return err
+        }
+        _ = c.SetReadDeadline(time.Now().Add(time.Second))
+        for {
+            if _, _, err := c.ReadMessage(); err != nil {
+                return errStop
+            }
+        }
+    }
+}
+
+// Drop close the connection without a close frame
+func Drop() Step {
+    return func(c *Conn) error {
+        c.UnderlyingConn().Close()
+        return errStop
+    }
+}
+
+// Sleep wait before the next step
+func Sleep(d time.Duration) Step {
+    return func(c *Conn) error {
+        time.Sleep(d)
+        return nil
+    }
+}
+
+// jsonEqual compare two decoded json values
+func jsonEqual(a, b interface{}) bool {
+    x, _ := json.Marshal(a)
+    y, _ := json.Marshal(b)
+    return bytes.Equal(x, y)
+}
+
+// generateCert create a certificate authority and a certificate for localhost signed by it
+func generateCert() (tls.Certificate, []byte, error) {
+    caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return tls.Certificate{}, nil, err
+    }
+    ca := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "wstest ca"},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(24 * time.Hour),
+        IsCA:                  true,
+        KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+        BasicConstraintsValid: true,
+    }
+    caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+    if err != nil {
+        return tls.Certificate{}, nil, err
+    }
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return tls.Certificate{}, nil, err
+    }
+    leaf := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject:      pkix.Name{CommonName: "localhost"},
+        DNSNames:     []string{"localhost"},
+        IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(24 * time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+    if err != nil {
+        return tls.Certificate{}, nil, err
+    }
+    cert := tls.Certificate{Certificate: [][]byte{leafDER, caDER}, PrivateKey: key}
+    return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), nil
+}
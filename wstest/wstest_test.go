@@ -0,0 +1,147 @@
+package wstest
+
+import (
+    "crypto/tls"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// dial connect a gorilla client to the server
+func dial(t *testing.T, s *Server) *websocket.Conn {
+    d := websocket.Dialer{HandshakeTimeout: time.Second}
+    if s.CertPool != nil {
+        d.TLSClientConfig = &tls.Config{RootCAs: s.CertPool}
+    }
+    c, _, err := d.Dial(s.URL+"/path?x=1", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { c.Close() })
+    return c
+}
+
+func TestScript(t *testing.T) {
+    tests := []struct {
+        name    string
+        server  func(Handler) *Server
+        steps   []Step
+        client  func(c *websocket.Conn) error
+        wantErr bool
+    }{
+        {
+            name:   "echo",
+            server: NewServer,
+            steps:  []Step{Echo()},
+            client: func(c *websocket.Conn) error {
+                if err := c.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+                    return err
+                }
+                _, d, err := c.ReadMessage()
+                if err == nil && string(d) != "hi" {
+                    err = errors.New("echo mismatch")
+                }
+                return err
+            },
+        },
+        {
+            name:   "echo over tls",
+            server: NewTLSServer,
+            steps:  []Step{Echo()},
+            client: func(c *websocket.Conn) error {
+                if err := c.WriteMessage(websocket.BinaryMessage, []byte{1}); err != nil {
+                    return err
+                }
+                _, _, err := c.ReadMessage()
+                return err
+            },
+        },
+        {
+            name:   "scripted sends and expectations",
+            server: NewServer,
+            steps:  []Step{SendText("hello"), ExpectJSON(map[string]int{"a": 1}), SendJSON(map[string]bool{"ok": true})},
+            client: func(c *websocket.Conn) error {
+                if _, _, err := c.ReadMessage(); err != nil {
+                    return err
+                }
+                if err := c.WriteMessage(websocket.TextMessage, []byte(`{ "a" : 1 }`)); err != nil {
+                    return err
+                }
+                _, _, err := c.ReadMessage()
+                return err
+            },
+        },
+        {
+            name:   "failed expectation",
+            server: NewServer,
+            steps:  []Step{ExpectText("login")},
+            client: func(c *websocket.Conn) error {
+                return c.WriteMessage(websocket.TextMessage, []byte("logout"))
+            },
+            wantErr: true,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := tt.server(Script(tt.steps...))
+            defer s.Close()
+            c := dial(t, s)
+            if err := tt.client(c); err != nil {
+                t.Fatal(err)
+            }
+            c.Close()
+            time.Sleep(10 * time.Millisecond)
+            if err := s.Err(); (err != nil) != tt.wantErr {
+                t.Errorf("Err() = %v, wantErr %v", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestCloseWith(t *testing.T) {
+    s := NewServer(Script(CloseWith(websocket.CloseTryAgainLater, "busy")))
+    defer s.Close()
+    c := dial(t, s)
+    _, _, err := c.ReadMessage()
+    var ce *websocket.CloseError
+    if !errors.As(err, &ce) || ce.Code != websocket.CloseTryAgainLater || ce.Text != "busy" {
+        t.Errorf("ReadMessage() error = %v, want close 1013 busy", err)
+    }
+}
+
+func TestSequence(t *testing.T) {
+    s := NewServer(Sequence(Script(SendText("first")), Script(SendText("again"))))
+    defer s.Close()
+    for _, want := range []string{"first", "again", "again"} {
+        c := dial(t, s)
+        if _, d, err := c.ReadMessage(); err != nil || string(d) != want {
+            t.Errorf("ReadMessage() = %s, %v, want %s", d, err, want)
+        }
+    }
+    if got := s.Connections(); got != 3 {
+        t.Errorf("Connections() = %v, want 3", got)
+    }
+    h := s.Handshakes()
+    if len(h) != 3 || h[0].URL.Path != "/path" || h[0].URL.Query().Get("x") != "1" {
+        t.Errorf("Handshakes() = %+v, want three requests for /path?x=1", h)
+    }
+}
+
+func TestServer_WaitFor(t *testing.T) {
+    s := NewServer(Script(Drain()))
+    defer s.Close()
+    c := dial(t, s)
+    for _, m := range []string{"a", "b"} {
+        if err := c.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if !s.WaitFor(2, time.Second) {
+        t.Fatalf("WaitFor() timed out, received %v", s.Received())
+    }
+    if f := s.Received()[1]; f.Conn != 1 || string(f.Data) != "b" {
+        t.Errorf("Received()[1] = %+v, want b on connection 1", f)
+    }
+}